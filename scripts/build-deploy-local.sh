@@ -7,13 +7,17 @@ NAMESPACE="${NAMESPACE:-demo-apps}"
 MINIKUBE_PROFILE="${MINIKUBE_PROFILE:-knative-dev}"
 IMAGE_TAG="${IMAGE_TAG:-${DEPLOYMENT_ID:-$(date +%Y%m%d%H%M%S)}}"
 IMAGE="${IMAGE:-dev.local/${SERVICE_NAME}:${IMAGE_TAG}}"
+# SKIP_DEPLOY=true only builds the image; upload-api applies the Knative Service itself.
+SKIP_DEPLOY="${SKIP_DEPLOY:-false}"
+# CREATE_NAMESPACE=false fails instead of creating a missing NAMESPACE.
+CREATE_NAMESPACE="${CREATE_NAMESPACE:-true}"
 
 if ! command -v minikube >/dev/null 2>&1; then
   echo "[build-deploy-local] minikube is required"
   exit 1
 fi
 
-if ! command -v kubectl >/dev/null 2>&1; then
+if [[ "${SKIP_DEPLOY}" != "true" ]] && ! command -v kubectl >/dev/null 2>&1; then
   echo "[build-deploy-local] kubectl is required"
   exit 1
 fi
@@ -23,7 +27,11 @@ if [[ ! -f "${APP_DIR}/Dockerfile" ]]; then
   exit 1
 fi
 
-if ! kubectl get namespace "${NAMESPACE}" >/dev/null 2>&1; then
+if [[ "${SKIP_DEPLOY}" != "true" ]] && ! kubectl get namespace "${NAMESPACE}" >/dev/null 2>&1; then
+  if [[ "${CREATE_NAMESPACE}" != "true" ]]; then
+    echo "[build-deploy-local] namespace ${NAMESPACE} does not exist and CREATE_NAMESPACE=${CREATE_NAMESPACE}"
+    exit 1
+  fi
   echo "[build-deploy-local] Creating namespace ${NAMESPACE}"
   kubectl create namespace "${NAMESPACE}" >/dev/null
 fi
@@ -48,6 +56,11 @@ else
   fi
 fi
 
+if [[ "${SKIP_DEPLOY}" == "true" ]]; then
+  echo "[build-deploy-local] SKIP_DEPLOY=true; image built: ${IMAGE}"
+  exit 0
+fi
+
 CURRENT_SKIP="$(kubectl get configmap config-deployment -n knative-serving -o jsonpath='{.data.registriesSkippingTagResolving}' 2>/dev/null || true)"
 if [[ "${CURRENT_SKIP}" == *"dev.local"* ]]; then
   echo "[build-deploy-local] Knative already configured to skip tag resolution for dev.local"
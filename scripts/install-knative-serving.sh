@@ -23,6 +23,16 @@ kubectl patch configmap/config-network \
   --type merge \
   --patch '{"data":{"ingress-class":"kourier.ingress.networking.knative.dev"}}'
 
+echo "[install-knative] Skipping tag resolution for dev.local images"
+CURRENT_SKIP="$(kubectl get configmap config-deployment -n knative-serving -o jsonpath='{.data.registriesSkippingTagResolving}' 2>/dev/null || true)"
+if [[ ",${CURRENT_SKIP}," != *",dev.local,"* ]]; then
+  NEW_SKIP="${CURRENT_SKIP:+${CURRENT_SKIP},}dev.local"
+  kubectl patch configmap/config-deployment \
+    --namespace knative-serving \
+    --type merge \
+    --patch "{\"data\":{\"registriesSkippingTagResolving\":\"${NEW_SKIP}\"}}"
+fi
+
 echo "[install-knative] Waiting for Serving and Kourier rollouts"
 kubectl rollout status deployment/activator -n knative-serving --timeout=180s
 kubectl rollout status deployment/autoscaler -n knative-serving --timeout=180s
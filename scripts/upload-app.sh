@@ -2,13 +2,22 @@
 set -euo pipefail
 
 API_URL="${API_URL:-http://localhost:8080}"
+# Remember whether service/namespace were chosen explicitly: an app manifest
+# in the bundle supplies them otherwise.
+SERVICE_NAME_SET="${SERVICE_NAME:+true}"
+NAMESPACE_SET="${NAMESPACE:+true}"
 SERVICE_NAME="${SERVICE_NAME:-sample-webapp}"
 NAMESPACE="${NAMESPACE:-demo-apps}"
 APP_DIR="${APP_DIR:-samples/webapp}"
+BUNDLE="${BUNDLE:-}"
 POLL_SECONDS="${POLL_SECONDS:-2}"
 MAX_POLLS="${MAX_POLLS:-180}"
 SKIP_HEALTHCHECK="${SKIP_HEALTHCHECK:-false}"
 WAIT_FOR_RESULT="${WAIT_FOR_RESULT:-true}"
+FOLLOW_LOGS="${FOLLOW_LOGS:-true}"
+UPLOAD_API_TOKEN="${UPLOAD_API_TOKEN:-}"
+EXTRA_FIELDS=()
+AUTH_HEADER=()
 
 usage() {
   cat <<EOF
@@ -16,17 +25,39 @@ Usage: scripts/upload-app.sh [options]
 
 Options:
   --api-url URL          Upload API base URL (default: ${API_URL})
-  --service NAME         Knative service name (default: ${SERVICE_NAME})
-  --namespace NAME       Target namespace (default: ${NAMESPACE})
+  --service NAME         Knative service name (default: ${SERVICE_NAME}, or the app manifest's)
+  --namespace NAME       Target namespace (default: ${NAMESPACE}, or the app manifest's)
+  --port N               Container port (default: the app manifest's, else 8080)
   --app-dir PATH         App directory to bundle (default: ${APP_DIR})
+  --bundle PATH          Upload this archive (zip, tar, tar.gz/zst/xz/bz2) or
+                         Dockerfile as is instead of bundling --app-dir
   --poll-seconds N       Poll interval seconds (default: ${POLL_SECONDS})
   --max-polls N          Max poll attempts (default: ${MAX_POLLS})
   --skip-healthcheck     Skip API /healthz probe
   --no-wait              Return after upload acceptance without polling
+  --no-logs              Do not stream build/deploy logs while waiting
+  --token TOKEN          Bearer token for upload-api (prefer UPLOAD_API_TOKEN)
+  --env KEY=VALUE        Set a runtime env var (repeatable)
+  --secret-env KEY=VALUE Set a runtime env var stored in a Secret (repeatable)
+  --env-configmap REF    Env from a ConfigMap: NAME, or KEY=NAME/KEY (repeatable)
+  --env-secret REF       Env from a Secret: NAME, or KEY=NAME/KEY (repeatable)
+  --min-scale N          Minimum replicas (default 0: scale to zero)
+  --max-scale N          Maximum replicas (default 0: unbounded)
+  --initial-scale N      Replicas started for a new revision (default 1)
+  --metric NAME          Autoscaling metric: concurrency or rps
+  --target N             Target concurrency or requests/s per replica
+  --container-concurrency N
+                         Hard limit of concurrent requests per replica (0: unlimited)
+  --scale-down-delay D   Delay before scaling down, e.g. 5m (max 1h)
+  --cpu-request Q        CPU request, e.g. 250m
+  --memory-request Q     Memory request, e.g. 256Mi
+  --cpu-limit Q          CPU limit, e.g. 1
+  --memory-limit Q       Memory limit, e.g. 1Gi
   -h, --help             Show this help
 
 Env vars:
-  API_URL, SERVICE_NAME, NAMESPACE, APP_DIR, POLL_SECONDS, MAX_POLLS
+  API_URL, SERVICE_NAME, NAMESPACE, APP_DIR, BUNDLE, POLL_SECONDS, MAX_POLLS, FOLLOW_LOGS,
+  UPLOAD_API_TOKEN
 EOF
 }
 
@@ -39,16 +70,26 @@ parse_args() {
         ;;
       --service)
         SERVICE_NAME="${2:?missing value for --service}"
+        SERVICE_NAME_SET="true"
         shift 2
         ;;
       --namespace)
         NAMESPACE="${2:?missing value for --namespace}"
+        NAMESPACE_SET="true"
+        shift 2
+        ;;
+      --port)
+        EXTRA_FIELDS+=(-F "port=${2:?missing value for --port}")
         shift 2
         ;;
       --app-dir)
         APP_DIR="${2:?missing value for --app-dir}"
         shift 2
         ;;
+      --bundle)
+        BUNDLE="${2:?missing value for --bundle}"
+        shift 2
+        ;;
       --poll-seconds)
         POLL_SECONDS="${2:?missing value for --poll-seconds}"
         shift 2
@@ -65,6 +106,74 @@ parse_args() {
         WAIT_FOR_RESULT="false"
         shift
         ;;
+      --no-logs)
+        FOLLOW_LOGS="false"
+        shift
+        ;;
+      --token)
+        UPLOAD_API_TOKEN="${2:?missing value for --token}"
+        shift 2
+        ;;
+      --env)
+        EXTRA_FIELDS+=(-F "env=${2:?missing value for --env}")
+        shift 2
+        ;;
+      --secret-env)
+        EXTRA_FIELDS+=(-F "secretEnv=${2:?missing value for --secret-env}")
+        shift 2
+        ;;
+      --env-configmap)
+        EXTRA_FIELDS+=(-F "envConfigMap=${2:?missing value for --env-configmap}")
+        shift 2
+        ;;
+      --env-secret)
+        EXTRA_FIELDS+=(-F "envSecret=${2:?missing value for --env-secret}")
+        shift 2
+        ;;
+      --min-scale)
+        EXTRA_FIELDS+=(-F "minScale=${2:?missing value for --min-scale}")
+        shift 2
+        ;;
+      --max-scale)
+        EXTRA_FIELDS+=(-F "maxScale=${2:?missing value for --max-scale}")
+        shift 2
+        ;;
+      --initial-scale)
+        EXTRA_FIELDS+=(-F "initialScale=${2:?missing value for --initial-scale}")
+        shift 2
+        ;;
+      --metric)
+        EXTRA_FIELDS+=(-F "metric=${2:?missing value for --metric}")
+        shift 2
+        ;;
+      --target)
+        EXTRA_FIELDS+=(-F "target=${2:?missing value for --target}")
+        shift 2
+        ;;
+      --container-concurrency)
+        EXTRA_FIELDS+=(-F "containerConcurrency=${2:?missing value for --container-concurrency}")
+        shift 2
+        ;;
+      --scale-down-delay)
+        EXTRA_FIELDS+=(-F "scaleDownDelay=${2:?missing value for --scale-down-delay}")
+        shift 2
+        ;;
+      --cpu-request)
+        EXTRA_FIELDS+=(-F "cpuRequest=${2:?missing value for --cpu-request}")
+        shift 2
+        ;;
+      --memory-request)
+        EXTRA_FIELDS+=(-F "memoryRequest=${2:?missing value for --memory-request}")
+        shift 2
+        ;;
+      --cpu-limit)
+        EXTRA_FIELDS+=(-F "cpuLimit=${2:?missing value for --cpu-limit}")
+        shift 2
+        ;;
+      --memory-limit)
+        EXTRA_FIELDS+=(-F "memoryLimit=${2:?missing value for --memory-limit}")
+        shift 2
+        ;;
       -h|--help)
         usage
         exit 0
@@ -82,13 +191,9 @@ json_get() {
   local json="$1"
   local key="$2"
 
-  if command -v jq >/dev/null 2>&1; then
-    echo "${json}" | jq -r --arg k "${key}" '.[$k] // empty'
-    return 0
-  fi
-
-  # Fallback parser for simple flat JSON keys.
-  echo "${json}" | sed -n "s/.*\"${key}\":\"\\([^\"]*\\)\".*/\\1/p"
+  # Records nest phases that reuse key names such as "status", so only a
+  # real JSON parser reliably picks the top-level field.
+  echo "${json}" | jq -r --arg k "${key}" '.[$k] // empty'
 }
 
 require_tools() {
@@ -100,6 +205,28 @@ require_tools() {
     echo "[upload-app] tar is required"
     exit 1
   fi
+  if ! command -v jq >/dev/null 2>&1; then
+    echo "[upload-app] jq is required"
+    exit 1
+  fi
+}
+
+# follow_logs prints the deployment's live build/deploy log from the SSE
+# endpoint; it returns when the server sends the final "done" event.
+follow_logs() {
+  local deploy_id="$1"
+  local line event=""
+  curl -sN ${AUTH_HEADER[@]+"${AUTH_HEADER[@]}"} "${API_URL}/deployments/${deploy_id}/logs?follow=true" | while IFS= read -r line; do
+    case "${line}" in
+      "event: done") break ;;
+      "event: "*) event="${line#event: }" ;;
+      "data: "*)
+        if [[ "${event}" == "log" ]]; then
+          echo "[build] ${line#data: }"
+        fi
+        ;;
+    esac
+  done || true
 }
 
 healthcheck() {
@@ -117,30 +244,59 @@ healthcheck() {
 main() {
   parse_args "$@"
   require_tools
+  if [[ -n "${UPLOAD_API_TOKEN}" ]]; then
+    AUTH_HEADER=(-H "Authorization: Bearer ${UPLOAD_API_TOKEN}")
+  fi
 
-  if [[ ! -d "${APP_DIR}" ]]; then
+  if [[ -n "${BUNDLE}" ]]; then
+    if [[ ! -f "${BUNDLE}" ]]; then
+      echo "[upload-app] bundle not found: ${BUNDLE}"
+      exit 1
+    fi
+  elif [[ ! -d "${APP_DIR}" ]]; then
     echo "[upload-app] app directory not found: ${APP_DIR}"
     exit 1
-  fi
-
-  if [[ ! -f "${APP_DIR}/Dockerfile" ]]; then
-    echo "[upload-app] warning: Dockerfile not found in ${APP_DIR}; build may fail"
+  elif [[ ! -f "${APP_DIR}/Dockerfile" ]]; then
+    echo "[upload-app] note: no Dockerfile in ${APP_DIR}; upload-api will generate one from the detected language"
   fi
 
   healthcheck
 
-  local tmp_dir bundle_path response deploy_id
-  tmp_dir="$(mktemp -d)"
-  bundle_path="${tmp_dir}/${SERVICE_NAME}.tar.gz"
-  trap 'rm -rf "${tmp_dir}"' EXIT
+  local tmp_dir bundle_path response deploy_id source
+  local form_fields=()
+  if [[ -n "${BUNDLE}" ]]; then
+    # upload-api detects the format from the content; a manifest inside
+    # the bundle may supply service and namespace.
+    bundle_path="${BUNDLE}"
+    source="${BUNDLE}"
+    [[ "${SERVICE_NAME_SET}" == "true" ]] && form_fields+=(-F "service=${SERVICE_NAME}")
+    [[ "${NAMESPACE_SET}" == "true" ]] && form_fields+=(-F "namespace=${NAMESPACE}")
+  else
+    tmp_dir="$(mktemp -d)"
+    bundle_path="${tmp_dir}/${SERVICE_NAME}.tar.gz"
+    source="${APP_DIR}"
+    trap 'rm -rf "${tmp_dir}"' EXIT
 
-  tar -czf "${bundle_path}" -C "${APP_DIR}" .
+    tar -czf "${bundle_path}" -C "${APP_DIR}" .
 
-  echo "[upload-app] Uploading ${APP_DIR} to ${API_URL}/deploy"
-  response="$(curl -sf -X POST "${API_URL}/deploy" \
+    if [[ -f "${APP_DIR}/app.yaml" || -f "${APP_DIR}/knative-app.json" ]]; then
+      echo "[upload-app] using app manifest in ${APP_DIR}; flags override its values"
+      [[ "${SERVICE_NAME_SET}" == "true" ]] && form_fields+=(-F "service=${SERVICE_NAME}")
+      [[ "${NAMESPACE_SET}" == "true" ]] && form_fields+=(-F "namespace=${NAMESPACE}")
+    else
+      form_fields+=(-F "service=${SERVICE_NAME}" -F "namespace=${NAMESPACE}")
+    fi
+  fi
+  form_fields+=(${EXTRA_FIELDS[@]+"${EXTRA_FIELDS[@]}"})
+
+  echo "[upload-app] Uploading ${source} to ${API_URL}/deploy"
+  if ! response="$(curl -sS -X POST "${API_URL}/deploy" \
+    ${AUTH_HEADER[@]+"${AUTH_HEADER[@]}"} \
     -F "bundle=@${bundle_path}" \
-    -F "service=${SERVICE_NAME}" \
-    -F "namespace=${NAMESPACE}")"
+    ${form_fields[@]+"${form_fields[@]}"})"; then
+    echo "[upload-app] upload request failed"
+    exit 1
+  fi
 
   deploy_id="$(json_get "${response}" "id")"
   if [[ -z "${deploy_id}" ]]; then
@@ -157,9 +313,13 @@ main() {
     exit 0
   fi
 
+  if [[ "${FOLLOW_LOGS}" == "true" ]]; then
+    follow_logs "${deploy_id}"
+  fi
+
   local status_json status revision logs_hint service_name namespace
   for _ in $(seq 1 "${MAX_POLLS}"); do
-    if ! status_json="$(curl -s "${API_URL}/status/${deploy_id}")"; then
+    if ! status_json="$(curl -s ${AUTH_HEADER[@]+"${AUTH_HEADER[@]}"} "${API_URL}/status/${deploy_id}")"; then
       echo "[upload-app] status endpoint not reachable yet; retrying"
       sleep "${POLL_SECONDS}"
       continue
@@ -173,7 +333,7 @@ main() {
     fi
 
     echo "[upload-app] status=${status}"
-    if [[ "${status}" == "READY" || "${status}" == "FAILED" ]]; then
+    if [[ "${status}" =~ ^(READY|FAILED|CANCELLED|TIMED_OUT)$ ]]; then
       service_name="$(json_get "${status_json}" "serviceName")"
       namespace="$(json_get "${status_json}" "namespace")"
       revision="$(json_get "${status_json}" "revision")"
@@ -188,7 +348,7 @@ main() {
         echo "[upload-app] url_hint=http://${service_name}.${namespace}.localhost:8081"
       fi
 
-      if [[ "${status}" == "FAILED" ]]; then
+      if [[ "${status}" != "READY" ]]; then
         exit 1
       fi
       exit 0
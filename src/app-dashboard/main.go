@@ -25,6 +25,19 @@ type appRow struct {
 	CreatedAt     string `json:"createdAt"`
 	Reason        string `json:"reason"`
 	Source        string `json:"source"`
+	// Autoscaling is read from the service template; settings left to the
+	// cluster defaults are omitted.
+	Autoscaling autoscaling `json:"autoscaling"`
+}
+
+type autoscaling struct {
+	MinScale             string `json:"minScale,omitempty"`
+	MaxScale             string `json:"maxScale,omitempty"`
+	InitialScale         string `json:"initialScale,omitempty"`
+	Metric               string `json:"metric,omitempty"`
+	Target               string `json:"target,omitempty"`
+	ContainerConcurrency *int64 `json:"containerConcurrency,omitempty"`
+	ScaleDownDelay       string `json:"scaleDownDelay,omitempty"`
 }
 
 type ksvcList struct {
@@ -34,6 +47,16 @@ type ksvcList struct {
 			Namespace         string `json:"namespace"`
 			CreationTimestamp string `json:"creationTimestamp"`
 		} `json:"metadata"`
+		Spec struct {
+			Template struct {
+				Metadata struct {
+					Annotations map[string]string `json:"annotations"`
+				} `json:"metadata"`
+				Spec struct {
+					ContainerConcurrency *int64 `json:"containerConcurrency"`
+				} `json:"spec"`
+			} `json:"template"`
+		} `json:"spec"`
 		Status struct {
 			URL                       string `json:"url"`
 			LatestCreatedRevisionName string `json:"latestCreatedRevisionName"`
@@ -165,11 +188,34 @@ func toRows(list ksvcList, source string) []appRow {
 			CreatedAt:     item.Metadata.CreationTimestamp,
 			Reason:        reason,
 			Source:        source,
+			Autoscaling:   readAutoscaling(item.Spec.Template.Metadata.Annotations, item.Spec.Template.Spec.ContainerConcurrency),
 		})
 	}
 	return rows
 }
 
+// readAutoscaling picks the autoscaling settings out of revision template
+// annotations, accepting both the current and the older camelCase keys.
+func readAutoscaling(annotations map[string]string, containerConcurrency *int64) autoscaling {
+	get := func(keys ...string) string {
+		for _, k := range keys {
+			if v := annotations["autoscaling.knative.dev/"+k]; v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	return autoscaling{
+		MinScale:             get("min-scale", "minScale"),
+		MaxScale:             get("max-scale", "maxScale"),
+		InitialScale:         get("initial-scale", "initialScale"),
+		Metric:               get("metric"),
+		Target:               get("target"),
+		ContainerConcurrency: containerConcurrency,
+		ScaleDownDelay:       get("scale-down-delay", "scaleDownDelay"),
+	}
+}
+
 func conditionReady(conditions []struct {
 	Type   string `json:"type"`
 	Status string `json:"status"`
@@ -259,6 +305,7 @@ const indexHTML = `<!doctype html>
         padding: 9px 14px;
         cursor: pointer;
       }
+      .scaling { color: #334155; white-space: nowrap; }
       code { font-family: ui-monospace, SFMono-Regular, Menlo, monospace; }
     </style>
   </head>
@@ -279,11 +326,12 @@ const indexHTML = `<!doctype html>
               <th>Latest Created</th>
               <th>Latest Ready</th>
               <th>URL</th>
+              <th>Autoscaling</th>
               <th>Reason</th>
             </tr>
           </thead>
           <tbody id="rows">
-            <tr><td colspan="7">Loading...</td></tr>
+            <tr><td colspan="8">Loading...</td></tr>
           </tbody>
         </table>
       </div>
@@ -292,13 +340,13 @@ const indexHTML = `<!doctype html>
     <script>
       async function loadApps() {
         const rows = document.getElementById('rows');
-        rows.innerHTML = '<tr><td colspan="7">Loading...</td></tr>';
+        rows.innerHTML = '<tr><td colspan="8">Loading...</td></tr>';
         try {
           const res = await fetch('/api/apps');
           if (!res.ok) throw new Error('status ' + res.status);
           const data = await res.json();
           if (!Array.isArray(data) || data.length === 0) {
-            rows.innerHTML = '<tr><td colspan="7">No applications found</td></tr>';
+            rows.innerHTML = '<tr><td colspan="8">No applications found</td></tr>';
             return;
           }
           document.getElementById('source').textContent = data[0].source || '-';
@@ -315,13 +363,26 @@ const indexHTML = `<!doctype html>
               '<td>' + escapeHtml(app.latestCreatedRevision || '') + '</td>' +
               '<td>' + escapeHtml(app.latestReadyRevision || '') + '</td>' +
               '<td>' + link + '</td>' +
+              '<td class="scaling">' + escapeHtml(describeScaling(app.autoscaling || {})) + '</td>' +
               '<td>' + escapeHtml(app.reason || '') + '</td>' +
               '</tr>';
           }).join('');
         } catch (err) {
-          rows.innerHTML = '<tr><td colspan="7">Failed to load: ' + escapeHtml(String(err)) + '</td></tr>';
+          rows.innerHTML = '<tr><td colspan="8">Failed to load: ' + escapeHtml(String(err)) + '</td></tr>';
         }
       }
+      // describeScaling summarises autoscaling settings, e.g.
+      // "0-3 replicas, concurrency 100, limit 10, delay 5m".
+      function describeScaling(a) {
+        var parts = [];
+        var max = a.maxScale && a.maxScale !== '0' ? a.maxScale : '∞';
+        parts.push((a.minScale || '0') + '-' + max + ' replicas');
+        if (a.initialScale) parts.push('initial ' + a.initialScale);
+        if (a.metric || a.target) parts.push((a.metric || 'concurrency') + ' ' + (a.target || 'default'));
+        if (a.containerConcurrency) parts.push('limit ' + a.containerConcurrency);
+        if (a.scaleDownDelay && a.scaleDownDelay !== '0s') parts.push('delay ' + a.scaleDownDelay);
+        return parts.join(', ');
+      }
       function escapeHtml(v) {
         return String(v)
           .replaceAll('&', '&amp;')
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// appManifestFiles are looked up at the bundle root. A bundle may carry at
+// most one of them.
+var appManifestFiles = []string{"app.yaml", "knative-app.json"}
+
+// knativeReservedPorts are used by the queue-proxy sidecar and rejected by
+// Knative as container ports.
+var knativeReservedPorts = map[int32]bool{8012: true, 8013: true, 8022: true, 9090: true, 9091: true}
+
+// AppManifest is the declarative settings file of a bundle. See
+// app.schema.json for the published schema; validate enforces the same rules.
+type AppManifest struct {
+	Name        string          `json:"name,omitempty"`
+	Namespace   string          `json:"namespace,omitempty"`
+	Port        int32           `json:"port,omitempty"`
+	Env         []EnvVar        `json:"env,omitempty"`
+	EnvFrom     []EnvFromSource `json:"envFrom,omitempty"`
+	Resources   *Resources      `json:"resources,omitempty"`
+	Autoscaling *Autoscaling    `json:"autoscaling,omitempty"`
+	Probes      *Probes         `json:"probes,omitempty"`
+	Build       *BuildSettings  `json:"build,omitempty"`
+}
+
+// Probes are the container health checks. Both are HTTP GET probes against
+// the container port.
+type Probes struct {
+	Readiness *Probe `json:"readiness,omitempty"`
+	Liveness  *Probe `json:"liveness,omitempty"`
+}
+
+type Probe struct {
+	Path                string `json:"path"`
+	InitialDelaySeconds int32  `json:"initialDelaySeconds,omitempty"`
+	PeriodSeconds       int32  `json:"periodSeconds,omitempty"`
+	TimeoutSeconds      int32  `json:"timeoutSeconds,omitempty"`
+	FailureThreshold    int32  `json:"failureThreshold,omitempty"`
+}
+
+type BuildSettings struct {
+	Builder string `json:"builder,omitempty"`
+	// Dockerfile is a path relative to the bundle root, used instead of
+	// ./Dockerfile.
+	Dockerfile string `json:"dockerfile,omitempty"`
+}
+
+// loadAppManifest reads the app manifest at the root of dir. It returns a
+// nil manifest when the bundle has none.
+func loadAppManifest(dir string) (*AppManifest, string, error) {
+	var found []string
+	for _, name := range appManifestFiles {
+		if fileExists(filepath.Join(dir, name)) {
+			found = append(found, name)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, "", nil
+	case 1:
+	default:
+		return nil, "", fmt.Errorf("bundle has both %s; keep one", strings.Join(found, " and "))
+	}
+
+	name := found[0]
+	raw, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return nil, name, fmt.Errorf("%s: %w", name, err)
+	}
+	var m AppManifest
+	// Strict decoding rejects unknown and misspelled keys.
+	if err := yaml.UnmarshalStrict(raw, &m); err != nil {
+		msg := strings.TrimPrefix(err.Error(), "error unmarshaling JSON: while decoding JSON: ")
+		return nil, name, fmt.Errorf("%s: %s", name, strings.TrimPrefix(msg, "json: "))
+	}
+	if err := m.validate(); err != nil {
+		return nil, name, fmt.Errorf("%s: %v", name, err)
+	}
+	return &m, name, nil
+}
+
+func (m *AppManifest) validate() error {
+	if m.Name != "" && !isDNSLabel(m.Name) {
+		return fmt.Errorf("name %q must be a lowercase DNS label", m.Name)
+	}
+	if m.Namespace != "" && !isDNSLabel(m.Namespace) {
+		return fmt.Errorf("namespace %q must be a lowercase DNS label", m.Namespace)
+	}
+	if m.Port != 0 {
+		if err := checkPort(m.Port); err != nil {
+			return err
+		}
+	}
+	seen := map[string]bool{}
+	for i, v := range m.Env {
+		if err := v.validate(); err != nil {
+			return fmt.Errorf("env[%d]: %v", i, err)
+		}
+		if seen[v.Name] {
+			return fmt.Errorf("env[%d]: environment variable %s is set more than once", i, v.Name)
+		}
+		seen[v.Name] = true
+	}
+	for i, e := range m.EnvFrom {
+		if err := e.validate(); err != nil {
+			return fmt.Errorf("envFrom[%d]: %v", i, err)
+		}
+	}
+	if err := m.Resources.validate(); err != nil {
+		return err
+	}
+	if err := m.Autoscaling.validate(); err != nil {
+		return err
+	}
+	if m.Probes != nil {
+		if err := m.Probes.Readiness.validate("probes.readiness"); err != nil {
+			return err
+		}
+		if err := m.Probes.Liveness.validate("probes.liveness"); err != nil {
+			return err
+		}
+	}
+	if m.Build != nil && m.Build.Dockerfile != "" {
+		if _, err := safeJoin(".", m.Build.Dockerfile); err != nil || filepath.IsAbs(m.Build.Dockerfile) {
+			return fmt.Errorf("build.dockerfile %q must be a path inside the bundle", m.Build.Dockerfile)
+		}
+	}
+	return nil
+}
+
+func (p *Probe) validate(field string) error {
+	if p == nil {
+		return nil
+	}
+	if !strings.HasPrefix(p.Path, "/") {
+		return fmt.Errorf("%s.path must start with /", field)
+	}
+	for name, v := range map[string]int32{
+		"initialDelaySeconds": p.InitialDelaySeconds,
+		"periodSeconds":       p.PeriodSeconds,
+		"timeoutSeconds":      p.TimeoutSeconds,
+		"failureThreshold":    p.FailureThreshold,
+	} {
+		if v < 0 {
+			return fmt.Errorf("%s.%s must not be negative", field, name)
+		}
+	}
+	return nil
+}
+
+// container renders p as a container probe.
+func (p *Probe) container() map[string]any {
+	out := map[string]any{"httpGet": map[string]any{"path": p.Path}}
+	for name, v := range map[string]int32{
+		"initialDelaySeconds": p.InitialDelaySeconds,
+		"periodSeconds":       p.PeriodSeconds,
+		"timeoutSeconds":      p.TimeoutSeconds,
+		"failureThreshold":    p.FailureThreshold,
+	} {
+		if v > 0 {
+			out[name] = v
+		}
+	}
+	return out
+}
+
+// applyTo fills d from the manifest wherever the upload form left the
+// setting unset; form fields always win. Env merges by name, with form
+// variables replacing manifest ones; resources and autoscaling merge field
+// by field.
+func (m *AppManifest) applyTo(d *Deployment, form url.Values) {
+	if strings.TrimSpace(form.Get("service")) == "" && m.Name != "" {
+		d.ServiceName = m.Name
+	}
+	if strings.TrimSpace(form.Get("namespace")) == "" && m.Namespace != "" {
+		d.Namespace = m.Namespace
+	}
+	if strings.TrimSpace(form.Get("builder")) == "" && m.Build != nil && m.Build.Builder != "" {
+		d.Builder = m.Build.Builder
+	}
+	if d.Port == 0 {
+		d.Port = m.Port
+	}
+	d.Env = mergeEnv(m.Env, d.Env)
+	d.EnvFrom = mergeEnvFrom(m.EnvFrom, d.EnvFrom)
+	d.Resources = m.Resources.overlay(d.Resources)
+	d.Autoscaling = m.Autoscaling.overlay(d.Autoscaling)
+	d.Probes = m.Probes
+}
+
+// parsePort reads the port form field; empty means the Knative default.
+func parsePort(raw string) (int32, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(raw, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("port must be a number between 1 and 65535")
+	}
+	return int32(n), checkPort(int32(n))
+}
+
+func checkPort(port int32) error {
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("port must be a number between 1 and 65535")
+	}
+	if knativeReservedPorts[port] {
+		return fmt.Errorf("port %d is reserved by Knative", port)
+	}
+	return nil
+}
+
+// useManifestDockerfile copies the Dockerfile named by the manifest to the
+// root of the build context, where every builder looks for it.
+func useManifestDockerfile(dir, path string) error {
+	src, err := safeJoin(dir, path)
+	if err != nil {
+		return err
+	}
+	if filepath.Clean(path) == "Dockerfile" {
+		return nil
+	}
+	raw, err := os.ReadFile(src)
+	if err != nil {
+		return fmt.Errorf("build.dockerfile %s not found in bundle", path)
+	}
+	return os.WriteFile(filepath.Join(dir, "Dockerfile"), raw, 0o644)
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testAppYAML = `
+name: hello
+namespace: demo-apps
+port: 3000
+env:
+  - name: GREETING
+    value: hello
+  - name: DB_PASSWORD
+    valueFrom:
+      secretKeyRef: {name: db, key: password}
+envFrom:
+  - configMapRef: {name: shared-config}
+resources:
+  limits: {memory: 256Mi}
+autoscaling:
+  minScale: 1
+probes:
+  readiness: {path: /healthz, periodSeconds: 5}
+  liveness: {path: /livez, initialDelaySeconds: 10, failureThreshold: 3}
+`
+
+func writeBundle(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadAppManifest(t *testing.T) {
+	wantApp := &AppManifest{
+		Name:      "hello",
+		Namespace: "demo-apps",
+		Port:      3000,
+		Env: []EnvVar{
+			{Name: "GREETING", Value: "hello"},
+			{Name: "DB_PASSWORD", ValueFrom: secretKey("db", "password")},
+		},
+		EnvFrom:     []EnvFromSource{{ConfigMapRef: &NameRef{Name: "shared-config"}}},
+		Resources:   &Resources{Limits: ResourceList{Memory: "256Mi"}},
+		Autoscaling: &Autoscaling{MinScale: intPtr(1)},
+		Probes: &Probes{
+			Readiness: &Probe{Path: "/healthz", PeriodSeconds: 5},
+			Liveness:  &Probe{Path: "/livez", InitialDelaySeconds: 10, FailureThreshold: 3},
+		},
+	}
+
+	for _, tc := range []struct {
+		name     string
+		files    map[string]string
+		want     *AppManifest
+		wantFile string
+		wantErr  string
+	}{
+		{name: "no manifest", files: map[string]string{"Dockerfile": testDockerfile}},
+		{name: "app.yaml", files: map[string]string{"app.yaml": testAppYAML}, want: wantApp, wantFile: "app.yaml"},
+		{
+			name:     "knative-app.json",
+			files:    map[string]string{"knative-app.json": `{"port": 8081, "build": {"builder": "docker", "dockerfile": "deploy/Dockerfile.prod"}}`},
+			want:     &AppManifest{Port: 8081, Build: &BuildSettings{Builder: "docker", Dockerfile: "deploy/Dockerfile.prod"}},
+			wantFile: "knative-app.json",
+		},
+		{name: "manifest in a subdirectory is ignored", files: map[string]string{"app/app.yaml": "port: 1"}},
+
+		{name: "both files", files: map[string]string{"app.yaml": "port: 3000", "knative-app.json": "{}"}, wantErr: "bundle has both app.yaml and knative-app.json; keep one"},
+		{name: "unknown key", files: map[string]string{"app.yaml": "replicas: 3"}, wantErr: `app.yaml: unknown field "replicas"`},
+		{name: "misspelled nested key", files: map[string]string{"app.yaml": "probes:\n  readyness: {path: /}"}, wantErr: `unknown field "readyness"`},
+		{name: "wrong type", files: map[string]string{"knative-app.json": `{"port": "http"}`}, wantErr: "knative-app.json: "},
+		{name: "invalid name", files: map[string]string{"app.yaml": "name: Hello"}, wantErr: `app.yaml: name "Hello" must be a lowercase DNS label`},
+		{name: "invalid namespace", files: map[string]string{"app.yaml": "namespace: demo_apps"}, wantErr: `namespace "demo_apps" must be a lowercase DNS label`},
+		{name: "port out of range", files: map[string]string{"app.yaml": "port: 70000"}, wantErr: "port must be a number between 1 and 65535"},
+		{name: "reserved port", files: map[string]string{"app.yaml": "port: 9090"}, wantErr: "port 9090 is reserved by Knative"},
+		{name: "reserved env", files: map[string]string{"app.yaml": "env: [{name: K_SERVICE, value: x}]"}, wantErr: "env[0]: environment variable K_SERVICE is set by Knative"},
+		{name: "duplicate env", files: map[string]string{"app.yaml": "env: [{name: A, value: x}, {name: A, value: y}]"}, wantErr: "env[1]: environment variable A is set more than once"},
+		{
+			name:    "value and valueFrom",
+			files:   map[string]string{"app.yaml": "env: [{name: A, value: x, valueFrom: {secretKeyRef: {name: db, key: a}}}]"},
+			wantErr: "env[0]: A: set value or valueFrom, not both",
+		},
+		{
+			name:    "both key refs",
+			files:   map[string]string{"app.yaml": "env: [{name: A, valueFrom: {secretKeyRef: {name: db, key: a}, configMapKeyRef: {name: cfg, key: a}}}]"},
+			wantErr: "valueFrom needs exactly one of configMapKeyRef or secretKeyRef",
+		},
+		{name: "secret ref without key", files: map[string]string{"app.yaml": "env: [{name: A, valueFrom: {secretKeyRef: {name: db}}}]"}, wantErr: "A: valueFrom needs a valid name and key"},
+		{name: "empty envFrom", files: map[string]string{"app.yaml": "envFrom: [{}]"}, wantErr: "envFrom[0]: envFrom entries need exactly one of configMapRef or secretRef"},
+		{name: "invalid envFrom name", files: map[string]string{"app.yaml": "envFrom: [{secretRef: {name: Db}}]"}, wantErr: `envFrom[0]: envFrom: invalid name "Db"`},
+		{name: "invalid quantity", files: map[string]string{"app.yaml": "resources: {limits: {memory: lots}}"}, wantErr: `resources.limits.memory: invalid quantity "lots"`},
+		{name: "request above limit", files: map[string]string{"app.yaml": "resources: {requests: {cpu: '2'}, limits: {cpu: 500m}}"}, wantErr: "resources.requests.cpu"},
+		{name: "scale bounds", files: map[string]string{"app.yaml": "autoscaling: {minScale: 3, maxScale: 2}"}, wantErr: "autoscaling.minScale (3) exceeds autoscaling.maxScale (2)"},
+		{name: "relative probe path", files: map[string]string{"app.yaml": "probes: {readiness: {path: healthz}}"}, wantErr: "probes.readiness.path must start with /"},
+		{name: "negative probe setting", files: map[string]string{"app.yaml": "probes: {liveness: {path: /, periodSeconds: -1}}"}, wantErr: "probes.liveness.periodSeconds must not be negative"},
+		{name: "dockerfile outside the bundle", files: map[string]string{"app.yaml": "build: {dockerfile: ../Dockerfile}"}, wantErr: `build.dockerfile "../Dockerfile" must be a path inside the bundle`},
+		{name: "absolute dockerfile", files: map[string]string{"app.yaml": "build: {dockerfile: /etc/Dockerfile}"}, wantErr: "must be a path inside the bundle"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, file, err := loadAppManifest(writeBundle(t, tc.files))
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if file != tc.wantFile || !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("loadAppManifest = %s %+v, want %s %+v", file, got, tc.wantFile, tc.want)
+			}
+		})
+	}
+}
+
+func TestAppManifestApplyTo(t *testing.T) {
+	manifest := &AppManifest{
+		Name:        "from-manifest",
+		Namespace:   "team-a",
+		Port:        3000,
+		Env:         []EnvVar{{Name: "A", Value: "manifest"}, {Name: "B", Value: "manifest"}},
+		EnvFrom:     []EnvFromSource{{ConfigMapRef: &NameRef{Name: "shared"}}},
+		Resources:   &Resources{Requests: ResourceList{CPU: "250m"}, Limits: ResourceList{Memory: "256Mi"}},
+		Autoscaling: &Autoscaling{MinScale: intPtr(1), MaxScale: intPtr(5)},
+		Probes:      &Probes{Readiness: &Probe{Path: "/healthz"}},
+		Build:       &BuildSettings{Builder: "docker"},
+	}
+	base := func() *Deployment {
+		return &Deployment{ServiceName: "hello-world", Namespace: "default", Builder: "minikube"}
+	}
+
+	// Without form settings the manifest decides.
+	d := base()
+	manifest.applyTo(d, url.Values{})
+	want := &Deployment{
+		ServiceName: "from-manifest",
+		Namespace:   "team-a",
+		Builder:     "docker",
+		Port:        3000,
+		Env:         manifest.Env,
+		EnvFrom:     manifest.EnvFrom,
+		Resources:   manifest.Resources,
+		Autoscaling: manifest.Autoscaling,
+		Probes:      manifest.Probes,
+	}
+	if !reflect.DeepEqual(d, want) {
+		t.Fatalf("applyTo without form = %+v, want %+v", d, want)
+	}
+
+	// Form fields win; env, resources and autoscaling merge.
+	d = base()
+	d.ServiceName, d.Namespace, d.Builder, d.Port = "hello", "demo-apps", "buildkit", 8081
+	d.Env = []EnvVar{{Name: "B", Value: "form"}, {Name: "C", Value: "form"}}
+	d.EnvFrom = []EnvFromSource{{ConfigMapRef: &NameRef{Name: "shared"}}, {SecretRef: &NameRef{Name: "db"}}}
+	d.Resources = &Resources{Limits: ResourceList{Memory: "1Gi"}}
+	d.Autoscaling = &Autoscaling{MaxScale: intPtr(10)}
+	manifest.applyTo(d, url.Values{"service": {"hello"}, "namespace": {"demo-apps"}, "builder": {"buildkit"}})
+	want = &Deployment{
+		ServiceName: "hello",
+		Namespace:   "demo-apps",
+		Builder:     "buildkit",
+		Port:        8081,
+		Env:         []EnvVar{{Name: "A", Value: "manifest"}, {Name: "B", Value: "form"}, {Name: "C", Value: "form"}},
+		EnvFrom:     []EnvFromSource{{ConfigMapRef: &NameRef{Name: "shared"}}, {SecretRef: &NameRef{Name: "db"}}},
+		Resources:   &Resources{Requests: ResourceList{CPU: "250m"}, Limits: ResourceList{Memory: "1Gi"}},
+		Autoscaling: &Autoscaling{MinScale: intPtr(1), MaxScale: intPtr(10)},
+		Probes:      manifest.Probes,
+	}
+	if !reflect.DeepEqual(d, want) {
+		t.Fatalf("applyTo with form = %+v, want %+v", d, want)
+	}
+}
+
+func TestDeployWithAppManifest(t *testing.T) {
+	s := newTestServer(t)
+	fields := map[string]string{"memoryLimit": "384Mi"}
+	code, out := deploy(t, s, deployRequest(t, fields, "app.tar.gz", tarGz(t, map[string]string{"Dockerfile": testDockerfile, "app.yaml": testAppYAML})))
+	if code != http.StatusAccepted {
+		t.Fatalf("status = %d (%v), want 202", code, out)
+	}
+	d, _ := s.store.Get(out["id"].(string))
+	if d.AppManifest != "app.yaml" || d.ServiceName != "hello" || d.Namespace != "demo-apps" || d.Image != "dev.local/hello:"+d.ID {
+		t.Fatalf("record = %s %s/%s image %s, want app.yaml settings", d.AppManifest, d.Namespace, d.ServiceName, d.Image)
+	}
+
+	raw, err := json.Marshal(revisionTemplate(revisionSpecFor(d), false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var template struct {
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+		Spec struct {
+			Containers []map[string]any `json:"containers"`
+		} `json:"spec"`
+	}
+	if err := json.Unmarshal(raw, &template); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{annotationMinScale: "1"}; !reflect.DeepEqual(template.Metadata.Annotations, want) {
+		t.Errorf("annotations = %v, want %v", template.Metadata.Annotations, want)
+	}
+	container := template.Spec.Containers[0]
+	for key, want := range map[string]string{
+		"ports": `[{"containerPort": 3000}]`,
+		"env": `[{"name": "GREETING", "value": "hello"},
+			{"name": "DB_PASSWORD", "valueFrom": {"secretKeyRef": {"name": "db", "key": "password"}}}]`,
+		"envFrom": `[{"configMapRef": {"name": "shared-config"}}]`,
+		// The form limit wins; the rest comes from the defaults.
+		"resources":      `{"requests": {"cpu": "100m", "memory": "128Mi"}, "limits": {"cpu": "1", "memory": "384Mi"}}`,
+		"readinessProbe": `{"httpGet": {"path": "/healthz"}, "periodSeconds": 5}`,
+		"livenessProbe":  `{"httpGet": {"path": "/livez"}, "initialDelaySeconds": 10, "failureThreshold": 3}`,
+	} {
+		var wantValue any
+		if err := json.Unmarshal([]byte(want), &wantValue); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(container[key], wantValue) {
+			got, _ := json.Marshal(container[key])
+			t.Errorf("container %s = %s, want %s", key, got, want)
+		}
+	}
+}
+
+func TestDeployUsesManifestDockerfile(t *testing.T) {
+	s := newTestServer(t)
+	files := map[string]string{
+		"knative-app.json":       `{"build": {"dockerfile": "deploy/Dockerfile.prod"}}`,
+		"deploy/Dockerfile.prod": "FROM busybox:1.36\nCMD [\"echo\", \"prod\"]\n",
+		"go.mod":                 "module hello\n",
+	}
+	code, out := deploy(t, s, deployRequest(t, nil, "app.tar.gz", tarGz(t, files)))
+	if code != http.StatusAccepted {
+		t.Fatalf("status = %d (%v), want 202", code, out)
+	}
+	d, _ := s.store.Get(out["id"].(string))
+	raw, err := os.ReadFile(filepath.Join(d.ExtractedPath, "Dockerfile"))
+	if err != nil || string(raw) != files["deploy/Dockerfile.prod"] || d.Dockerfile != dockerfileBundled {
+		t.Fatalf("Dockerfile = %q (%v), recorded as %q; want the manifest's bundled Dockerfile", raw, err, d.Dockerfile)
+	}
+}
+
+func TestDeployRejectsInvalidAppManifest(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		files   map[string]string
+		wantErr string
+	}{
+		{name: "both manifests", files: map[string]string{"app.yaml": "port: 3000", "knative-app.json": "{}"}, wantErr: "bundle has both app.yaml and knative-app.json"},
+		{name: "unknown key", files: map[string]string{"app.yaml": "ports: [3000]"}, wantErr: `app.yaml: unknown field "ports"`},
+		{name: "reserved port", files: map[string]string{"app.yaml": "port: 8012"}, wantErr: "app.yaml: port 8012 is reserved by Knative"},
+		{name: "unknown builder", files: map[string]string{"app.yaml": "build: {builder: bazel}"}, wantErr: "app.yaml: build.builder must be one of: "},
+		{name: "missing dockerfile", files: map[string]string{"app.yaml": "build: {dockerfile: deploy/Dockerfile}"}, wantErr: "app.yaml: build.dockerfile deploy/Dockerfile not found in bundle"},
+		{name: "resources above the ceiling", files: map[string]string{"app.yaml": "resources: {limits: {memory: 64Gi}}"}, wantErr: "resources.limits.memory"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t)
+			tc.files["Dockerfile"] = testDockerfile
+			code, out := deploy(t, s, deployRequest(t, nil, "app.tar.gz", tarGz(t, tc.files)))
+			if code != http.StatusBadRequest || !strings.Contains(out["error"].(string), tc.wantErr) {
+				t.Fatalf("deploy = %d %v, want 400 %q", code, out, tc.wantErr)
+			}
+			if list := s.store.List(); len(list) != 0 {
+				t.Fatalf("rejected upload recorded %d deployments", len(list))
+			}
+		})
+	}
+}
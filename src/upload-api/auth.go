@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Identity is the authenticated caller of a request.
+type Identity struct {
+	Username string   `json:"username"`
+	Groups   []string `json:"groups,omitempty"`
+	Provider string   `json:"provider"` // token, oidc or tokenreview
+}
+
+// authenticator checks a bearer token. It returns a nil identity and nil
+// error when the token is not one it handles, so the next provider can try.
+type authenticator interface {
+	name() string
+	authenticate(ctx context.Context, token string) (*Identity, error)
+}
+
+type identityKey struct{}
+
+// identityFrom returns the caller attached by requireAuth, or nil when
+// authentication is disabled or the request carried no credentials.
+func identityFrom(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityKey{}).(*Identity)
+	return id
+}
+
+// createdBy is the name recorded on deployments a request creates.
+func createdBy(r *http.Request) string {
+	if id := identityFrom(r.Context()); id != nil {
+		return id.Username
+	}
+	return ""
+}
+
+// configuredAuthenticators builds the providers enabled by the AUTH_*
+// settings, in the order they are tried: static tokens, OIDC, TokenReview.
+// kube is only needed for TokenReview.
+func configuredAuthenticators(kube func() (*kubeClient, error)) []authenticator {
+	var out []authenticator
+	if path := envOr("AUTH_TOKENS_FILE", ""); path != "" {
+		a, err := loadStaticTokens(path)
+		if err != nil {
+			log.Fatalf("failed to load AUTH_TOKENS_FILE: %v", err)
+		}
+		out = append(out, a)
+	}
+	if path := envOr("AUTH_OIDC_JWKS_FILE", ""); path != "" {
+		a, err := newOIDCAuthenticator(path)
+		if err != nil {
+			log.Fatalf("failed to configure OIDC authentication: %v", err)
+		}
+		out = append(out, a)
+	}
+	if envTrue("AUTH_TOKENREVIEW") {
+		client, err := kube()
+		if err != nil {
+			log.Fatalf("AUTH_TOKENREVIEW needs kubernetes access: %v", err)
+		}
+		out = append(out, newTokenReviewAuthenticator(client))
+	}
+	return out
+}
+
+// requireAuth authenticates bearer tokens and attaches the caller to the
+// request context. Requests other than GET and HEAD must be authenticated;
+// reads may be anonymous, but a token that is sent must be valid. With no
+// providers configured every request passes through unauthenticated. The
+// build context endpoint checks its own one-time token instead.
+func (s *Server) requireAuth(next http.Handler) http.Handler {
+	if len(s.authenticators) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || isBuildContextPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token, hasToken := bearerToken(r)
+		if !hasToken {
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+			unauthorized(w, "authentication required: send Authorization: Bearer <token>")
+			return
+		}
+		id, err := s.authenticate(r.Context(), token)
+		if err != nil {
+			unauthorized(w, err.Error())
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+	})
+}
+
+// authenticate tries each provider in turn. The first one that accepts the
+// token wins; otherwise the first rejection reason is reported.
+func (s *Server) authenticate(ctx context.Context, token string) (*Identity, error) {
+	var firstErr error
+	for _, a := range s.authenticators {
+		id, err := a.authenticate(ctx, token)
+		if err != nil {
+			log.Printf("%s authentication failed: %v", a.name(), err)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %v", a.name(), err)
+			}
+			continue
+		}
+		if id != nil {
+			id.Provider = a.name()
+			return id, nil
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return nil, errors.New("invalid bearer token")
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	h := strings.TrimSpace(r.Header.Get("Authorization"))
+	if h == "" {
+		return "", false
+	}
+	scheme, token, _ := strings.Cut(h, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return "", true
+	}
+	return strings.TrimSpace(token), true
+}
+
+func unauthorized(w http.ResponseWriter, msg string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="upload-api"`)
+	writeJSON(w, http.StatusUnauthorized, map[string]string{"error": msg})
+}
+
+// staticTokens authenticates the API tokens of AUTH_TOKENS_FILE. Tokens are
+// kept as SHA-256 digests only.
+type staticTokens struct {
+	users map[[32]byte]Identity
+}
+
+func (*staticTokens) name() string { return "token" }
+
+func (a *staticTokens) authenticate(_ context.Context, token string) (*Identity, error) {
+	if token == "" {
+		return nil, nil
+	}
+	id, ok := a.users[sha256.Sum256([]byte(token))]
+	if !ok {
+		return nil, nil
+	}
+	return &Identity{Username: id.Username, Groups: append([]string(nil), id.Groups...)}, nil
+}
+
+// loadStaticTokens reads a token file in the Kubernetes static token format:
+//
+//	token,username[,uid[,"group1,group2"]]
+//
+// Blank lines and lines starting with # are ignored; the uid is unused.
+func loadStaticTokens(path string) (*staticTokens, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	r.Comment = '#'
+	r.TrimLeadingSpace = true
+	a := &staticTokens{users: map[[32]byte]Identity{}}
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := r.FieldPos(0)
+		if len(rec) < 2 || rec[0] == "" || strings.TrimSpace(rec[1]) == "" {
+			return nil, fmt.Errorf("%s:%d: expected token,username[,uid[,groups]]", path, line)
+		}
+		id := Identity{Username: strings.TrimSpace(rec[1])}
+		if len(rec) > 3 {
+			id.Groups = splitList(rec[3])
+		}
+		sum := sha256.Sum256([]byte(rec[0]))
+		if _, dup := a.users[sum]; dup {
+			return nil, fmt.Errorf("%s:%d: duplicate token", path, line)
+		}
+		a.users[sum] = id
+	}
+	if len(a.users) == 0 {
+		return nil, fmt.Errorf("%s has no tokens", path)
+	}
+	return a, nil
+}
+
+// splitList splits a comma-separated setting, dropping empty entries.
+func splitList(raw string) []string {
+	var out []string
+	for _, v := range strings.Split(raw, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Actions checked by the authorization policy.
+const (
+	actionDeploy   = "deploy"   // upload, cancel, traffic changes
+	actionRollback = "rollback" // roll a service back
+	actionDelete   = "delete"   // delete a service
+	actionLogs     = "logs"     // read build/deploy logs, service history, webhook deliveries
+)
+
+// policyActions maps each action to the phrase used in denials.
+var policyActions = map[string]string{
+	actionDeploy:   "deploy",
+	actionRollback: "roll back",
+	actionDelete:   "delete services",
+	actionLogs:     "read logs",
+}
+
+// defaultProtectedNamespaces are never deployed to, whatever the policy says.
+const defaultProtectedNamespaces = "knative-serving,kube-system,platform-system"
+
+// authzPolicy grants actions in namespaces. A request is allowed when any
+// rule matches the caller, the namespace and the action.
+type authzPolicy struct {
+	Rules []policyRule `json:"rules"`
+}
+
+// policyRule matches callers by username, by group, or by the username a
+// static API token is issued to in AUTH_TOKENS_FILE. "*" in users matches
+// every authenticated caller. Namespaces are glob patterns such as team-* or *.
+type policyRule struct {
+	Users      []string `json:"users,omitempty"`
+	Groups     []string `json:"groups,omitempty"`
+	TokenUsers []string `json:"tokenUsers,omitempty"`
+	Namespaces []string `json:"namespaces"`
+	Actions    []string `json:"actions"`
+}
+
+func (p *authzPolicy) validate() error {
+	for i, r := range p.Rules {
+		if len(r.Users)+len(r.Groups)+len(r.TokenUsers) == 0 {
+			return fmt.Errorf("rules[%d]: needs users, groups or tokenUsers", i)
+		}
+		if len(r.Namespaces) == 0 {
+			return fmt.Errorf("rules[%d]: needs namespaces", i)
+		}
+		for _, ns := range r.Namespaces {
+			if _, err := path.Match(ns, ""); err != nil {
+				return fmt.Errorf("rules[%d]: invalid namespace pattern %q", i, ns)
+			}
+		}
+		if len(r.Actions) == 0 {
+			return fmt.Errorf("rules[%d]: needs actions", i)
+		}
+		for _, a := range r.Actions {
+			if _, ok := policyActions[a]; a != "*" && !ok {
+				return fmt.Errorf("rules[%d]: unknown action %q (use deploy, rollback, delete, logs or *)", i, a)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *authzPolicy) allows(id *Identity, action, namespace string) bool {
+	for _, r := range p.Rules {
+		if r.matchesCaller(id) && r.matchesNamespace(namespace) && contains(r.Actions, action, "*") {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsAnywhere reports whether any rule grants id action in some namespace.
+func (p *authzPolicy) allowsAnywhere(id *Identity, action string) bool {
+	for _, r := range p.Rules {
+		if r.matchesCaller(id) && contains(r.Actions, action, "*") {
+			return true
+		}
+	}
+	return false
+}
+
+func (r policyRule) matchesCaller(id *Identity) bool {
+	if contains(r.Users, id.Username, "*") {
+		return true
+	}
+	if id.Provider == "token" && contains(r.TokenUsers, id.Username, "") {
+		return true
+	}
+	for _, g := range id.Groups {
+		if contains(r.Groups, g, "") {
+			return true
+		}
+	}
+	return false
+}
+
+func (r policyRule) matchesNamespace(namespace string) bool {
+	for _, pattern := range r.Namespaces {
+		if ok, _ := path.Match(pattern, namespace); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// contains reports whether list holds v or the wildcard (if not empty).
+func contains(list []string, v, wildcard string) bool {
+	for _, item := range list {
+		if item == v || (wildcard != "" && item == wildcard) {
+			return true
+		}
+	}
+	return false
+}
+
+// policyFile is the policy loaded from AUTH_POLICY_FILE. Edits to the file
+// take effect on the next request; an edit that does not parse is logged
+// and the last good policy stays in force.
+type policyFile struct {
+	path string
+
+	mu      sync.Mutex
+	policy  *authzPolicy
+	modTime time.Time
+}
+
+func loadPolicyFile(path string) (*policyFile, error) {
+	f := &policyFile{path: path}
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	p, err := readPolicy(path)
+	if err != nil {
+		return nil, err
+	}
+	f.policy, f.modTime = p, st.ModTime()
+	return f, nil
+}
+
+func readPolicy(path string) (*authzPolicy, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p authzPolicy
+	if err := yaml.UnmarshalStrict(raw, &p); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := p.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &p, nil
+}
+
+// current returns the policy, re-reading the file if it changed.
+func (f *policyFile) current() *authzPolicy {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	st, err := os.Stat(f.path)
+	if err != nil || st.ModTime().Equal(f.modTime) {
+		return f.policy
+	}
+	f.modTime = st.ModTime()
+	p, err := readPolicy(f.path)
+	if err != nil {
+		log.Printf("keeping previous authorization policy: %v", err)
+		return f.policy
+	}
+	log.Printf("reloaded authorization policy from %s (%d rules)", f.path, len(p.Rules))
+	f.policy = p
+	return p
+}
+
+// authorize checks that the caller may perform action in namespace and
+// writes the 401/403 response if not. Protected namespaces are refused to
+// everyone. Without a policy file every caller may act everywhere else.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, action, namespace string) bool {
+	if s.protectedNamespaces[namespace] {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": fmt.Sprintf("namespace %s is protected", namespace)})
+		return false
+	}
+	if s.policy == nil {
+		return true
+	}
+	id := identityFrom(r.Context())
+	if id == nil {
+		unauthorized(w, "authentication required: send Authorization: Bearer <token>")
+		return false
+	}
+	if !s.policy.current().allows(id, action, namespace) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": fmt.Sprintf("%s may not %s in namespace %s", id.Username, policyActions[action], namespace)})
+		return false
+	}
+	return true
+}
+
+// authorizeAnywhere checks that the caller may perform action in at least
+// one namespace, for requests whose namespace is not known yet, and writes
+// the 401/403 response if not.
+func (s *Server) authorizeAnywhere(w http.ResponseWriter, r *http.Request, action string) bool {
+	if s.policy == nil {
+		return true
+	}
+	id := identityFrom(r.Context())
+	if id == nil {
+		unauthorized(w, "authentication required: send Authorization: Bearer <token>")
+		return false
+	}
+	if !s.policy.current().allowsAnywhere(id, action) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": fmt.Sprintf("%s may not %s in any namespace", id.Username, policyActions[action])})
+		return false
+	}
+	return true
+}
+
+// permits reports whether the caller may perform action in namespace, like
+// authorize but without writing a response.
+func (s *Server) permits(r *http.Request, action, namespace string) bool {
+	if s.protectedNamespaces[namespace] {
+		return false
+	}
+	if s.policy == nil {
+		return true
+	}
+	id := identityFrom(r.Context())
+	return id != nil && s.policy.current().allows(id, action, namespace)
+}
+
+// redactLogs withholds d's build output and phase log excerpts, and sets
+// logsRedacted, unless the caller may read logs in its namespace. d must be
+// a copy from the store.
+func (s *Server) redactLogs(r *http.Request, d *Deployment) *Deployment {
+	if s.permits(r, actionLogs, d.Namespace) {
+		return d
+	}
+	d.Output, d.OutputOffset = "", 0
+	for i := range d.Phases {
+		d.Phases[i].LogExcerpt = ""
+	}
+	d.LogsRedacted = true
+	return d
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPolicy = `
+rules:
+  - users: [alice]
+    namespaces: ["team-*"]
+    actions: ["*"]
+  - groups: [devs]
+    namespaces: [demo-apps]
+    actions: [deploy]
+  - tokenUsers: [ci-bot]
+    namespaces: [staging]
+    actions: [deploy, logs]
+`
+
+func writePolicy(t *testing.T, dir, policy string) string {
+	t.Helper()
+	path := filepath.Join(dir, "policy.yaml")
+	if err := os.WriteFile(path, []byte(policy), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func withPolicy(t *testing.T, s *Server, policy string) {
+	t.Helper()
+	p, err := loadPolicyFile(writePolicy(t, t.TempDir(), policy))
+	if err != nil {
+		t.Fatalf("loadPolicyFile: %v", err)
+	}
+	s.policy = p
+}
+
+// asCaller returns r as sent by id; nil means anonymous.
+func asCaller(r *http.Request, id *Identity) *http.Request {
+	if id == nil {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, id))
+}
+
+func get(t *testing.T, handler http.HandlerFunc, target string, id *Identity) (int, []byte) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler(rec, asCaller(httptest.NewRequest(http.MethodGet, target, nil), id))
+	return rec.Code, rec.Body.Bytes()
+}
+
+func storeWithLogs(t *testing.T, s *Server, id, namespace string) {
+	t.Helper()
+	now := time.Now().UTC()
+	err := s.store.Put(&Deployment{
+		ID: id, Kind: kindUpload, ServiceName: "hello", Namespace: namespace, Status: statusFailed,
+		Output:    "npm ERR! token=hunter2\n",
+		Phases:    []PhaseRecord{{Name: phaseBuild, Status: "FAILED", LogExcerpt: "npm ERR! token=hunter2"}},
+		CreatedAt: now, UpdatedAt: now,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPolicyAllows(t *testing.T) {
+	p, err := loadPolicyFile(writePolicy(t, t.TempDir(), testPolicy))
+	if err != nil {
+		t.Fatalf("loadPolicyFile: %v", err)
+	}
+	policy := p.current()
+	alice := &Identity{Username: "alice", Provider: "oidc"}
+	dev := &Identity{Username: "bob", Groups: []string{"qa", "devs"}, Provider: "oidc"}
+	bot := &Identity{Username: "ci-bot", Provider: "token"}
+	for _, tc := range []struct {
+		id                *Identity
+		action, namespace string
+		want              bool
+	}{
+		{alice, actionDeploy, "team-a", true},
+		{alice, actionDelete, "team-payments", true},
+		{alice, actionDeploy, "team", false},
+		{alice, actionDeploy, "demo-apps", false},
+		{dev, actionDeploy, "demo-apps", true},
+		{dev, actionLogs, "demo-apps", false},
+		{dev, actionDeploy, "team-a", false},
+		{&Identity{Username: "bob", Provider: "oidc"}, actionDeploy, "demo-apps", false},
+		{bot, actionLogs, "staging", true},
+		{bot, actionRollback, "staging", false},
+		{&Identity{Username: "ci-bot", Provider: "oidc"}, actionDeploy, "staging", false},
+		{&Identity{Username: "ci-bot", Provider: "token", Groups: []string{"devs"}}, actionDeploy, "demo-apps", true},
+	} {
+		if got := policy.allows(tc.id, tc.action, tc.namespace); got != tc.want {
+			t.Errorf("allows(%s via %s, %s, %s) = %v, want %v", tc.id.Username, tc.id.Provider, tc.action, tc.namespace, got, tc.want)
+		}
+	}
+
+	everyone := &authzPolicy{Rules: []policyRule{{Users: []string{"*"}, Namespaces: []string{"*"}, Actions: []string{actionLogs}}}}
+	if !everyone.allows(&Identity{Username: "anyone", Provider: "token"}, actionLogs, "default") {
+		t.Errorf("users: [*] does not match an authenticated caller")
+	}
+	if everyone.allows(&Identity{Username: "anyone"}, actionDeploy, "default") {
+		t.Errorf("users: [*] granted an action it does not list")
+	}
+}
+
+func TestPolicyValidation(t *testing.T) {
+	for name, tc := range map[string]struct {
+		policy, want string
+	}{
+		"no callers":      {"rules:\n  - namespaces: [a]\n    actions: [deploy]\n", "rules[0]: needs users, groups or tokenUsers"},
+		"no namespaces":   {"rules:\n  - users: [a]\n    actions: [deploy]\n", "rules[0]: needs namespaces"},
+		"bad pattern":     {"rules:\n  - users: [a]\n    namespaces: [\"team-[\"]\n    actions: [deploy]\n", `invalid namespace pattern "team-["`},
+		"no actions":      {"rules:\n  - users: [a]\n    namespaces: [a]\n", "rules[0]: needs actions"},
+		"unknown action":  {"rules:\n  - users: [a]\n    namespaces: [a]\n    actions: [admin]\n", `unknown action "admin"`},
+		"old tokens key":  {"rules:\n  - tokens: [ci-bot]\n    namespaces: [a]\n    actions: [deploy]\n", `unknown field "tokens"`},
+		"second rule bad": {testPolicy + "  - users: [b]\n    namespaces: [b]\n    actions: []\n", "rules[3]: needs actions"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := loadPolicyFile(writePolicy(t, t.TempDir(), tc.policy))
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("loadPolicyFile = %v, want error containing %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestPolicyReloadsOnChange(t *testing.T) {
+	path := writePolicy(t, t.TempDir(), testPolicy)
+	p, err := loadPolicyFile(path)
+	if err != nil {
+		t.Fatalf("loadPolicyFile: %v", err)
+	}
+	dev := &Identity{Username: "bob", Groups: []string{"devs"}, Provider: "oidc"}
+	touch := func(offset time.Duration) {
+		t.Helper()
+		later := time.Now().Add(offset)
+		if err := os.Chtimes(path, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writePolicy(t, filepath.Dir(path), "rules:\n  - groups: [devs]\n    namespaces: [staging]\n    actions: [deploy]\n")
+	touch(time.Minute)
+	if policy := p.current(); !policy.allows(dev, actionDeploy, "staging") || policy.allows(dev, actionDeploy, "demo-apps") {
+		t.Fatalf("edited policy not in force: %+v", policy.Rules)
+	}
+
+	// A broken edit keeps the last good policy.
+	writePolicy(t, filepath.Dir(path), "rules:\n  - groups: [devs]\n    namespaces: [staging]\n    actions: [sudo]\n")
+	touch(2 * time.Minute)
+	if policy := p.current(); !policy.allows(dev, actionDeploy, "staging") {
+		t.Fatalf("broken edit replaced the policy: %+v", policy.Rules)
+	}
+	writePolicy(t, filepath.Dir(path), "rules: [")
+	touch(3 * time.Minute)
+	if policy := p.current(); !policy.allows(dev, actionDeploy, "staging") {
+		t.Fatalf("unparsable edit replaced the policy: %+v", policy.Rules)
+	}
+
+	// A removed file keeps it too.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if policy := p.current(); !policy.allows(dev, actionDeploy, "staging") {
+		t.Fatalf("removing the file dropped the policy")
+	}
+}
+
+func TestStatusRedactsLogsWithoutLogsAction(t *testing.T) {
+	s := newTestServer(t)
+	withPolicy(t, s, testPolicy)
+	storeWithLogs(t, s, "dep-000001", "demo-apps")
+
+	alice := &Identity{Username: "alice", Provider: "oidc"}
+	dev := &Identity{Username: "bob", Groups: []string{"devs"}, Provider: "oidc"}
+	for _, target := range []string{"/status/dep-000001", "/status/latest"} {
+		handler := s.handleStatusByID
+		if target == "/status/latest" {
+			handler = s.handleLatestStatus
+		}
+		for name, id := range map[string]*Identity{"anonymous": nil, "deploy only": dev, "other namespaces": alice} {
+			code, body := get(t, handler, target, id)
+			var d Deployment
+			if err := json.Unmarshal(body, &d); err != nil || code != http.StatusOK {
+				t.Fatalf("%s as %s = %d %s", target, name, code, body)
+			}
+			if d.Output != "" || d.Phases[0].LogExcerpt != "" || !d.LogsRedacted {
+				t.Errorf("%s as %s leaked logs: output %q, excerpt %q, logsRedacted %v", target, name, d.Output, d.Phases[0].LogExcerpt, d.LogsRedacted)
+			}
+		}
+	}
+
+	// The stored record keeps its logs.
+	if d, _ := s.store.Get("dep-000001"); d.Output == "" || d.Phases[0].LogExcerpt == "" {
+		t.Fatalf("redaction changed the stored record")
+	}
+}
+
+func TestListShowsOnlyReadableNamespaces(t *testing.T) {
+	s := newTestServer(t)
+	withPolicy(t, s, testPolicy)
+	storeWithLogs(t, s, "dep-000001", "team-a")
+	storeWithLogs(t, s, "dep-000002", "demo-apps")
+	storeWithLogs(t, s, "dep-000003", "team-b")
+	storeWithLogs(t, s, "dep-000004", "staging")
+
+	for name, tc := range map[string]struct {
+		id   *Identity
+		want []string
+	}{
+		"anonymous":   {nil, nil},
+		"alice":       {&Identity{Username: "alice", Provider: "oidc"}, []string{"dep-000003", "dep-000001"}},
+		"deploy only": {&Identity{Username: "bob", Groups: []string{"devs"}, Provider: "oidc"}, nil},
+		"ci-bot":      {&Identity{Username: "ci-bot", Provider: "token"}, []string{"dep-000004"}},
+	} {
+		code, body := get(t, s.handleListDeployments, "/deployments", tc.id)
+		var list DeploymentList
+		if err := json.Unmarshal(body, &list); err != nil || code != http.StatusOK {
+			t.Fatalf("GET /deployments as %s = %d %s", name, code, body)
+		}
+		if got := listIDs(list); strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("%s sees %v, want %v", name, got, tc.want)
+		}
+		for _, d := range list.Items {
+			if d.Output == "" || d.LogsRedacted {
+				t.Errorf("%s: listed deployment %s has its logs redacted", name, d.ID)
+			}
+		}
+	}
+
+	// Pages are cut after filtering: a page of one for alice skips the
+	// records she cannot see, and the cursor leads to her next one.
+	alice := &Identity{Username: "alice", Provider: "oidc"}
+	_, body := get(t, s.handleListDeployments, "/deployments?limit=1", alice)
+	var page DeploymentList
+	json.Unmarshal(body, &page)
+	if got := listIDs(page); len(got) != 1 || got[0] != "dep-000003" || page.NextCursor == "" {
+		t.Fatalf("first page = %v (cursor %q), want dep-000003 and a cursor", got, page.NextCursor)
+	}
+	_, body = get(t, s.handleListDeployments, "/deployments?limit=1&cursor="+page.NextCursor, alice)
+	page = DeploymentList{}
+	json.Unmarshal(body, &page)
+	if got := listIDs(page); len(got) != 1 || got[0] != "dep-000001" || page.NextCursor != "" {
+		t.Fatalf("second page = %v (cursor %q), want dep-000001 and no cursor", got, page.NextCursor)
+	}
+}
+
+func TestStatusKeepsLogsWithoutPolicy(t *testing.T) {
+	s := newTestServer(t)
+	storeWithLogs(t, s, "dep-000001", "demo-apps")
+	_, body := get(t, s.handleStatusByID, "/status/dep-000001", nil)
+	var d Deployment
+	if err := json.Unmarshal(body, &d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Output == "" || d.LogsRedacted {
+		t.Fatalf("logs redacted although no policy is configured")
+	}
+}
+
+func TestServiceHistoryRequiresLogsAction(t *testing.T) {
+	s := newTestServer(t)
+	withPolicy(t, s, testPolicy)
+	storeWithLogs(t, s, "dep-000001", "staging")
+
+	for name, tc := range map[string]struct {
+		id   *Identity
+		want int
+	}{
+		"anonymous":   {nil, http.StatusUnauthorized},
+		"no rule":     {&Identity{Username: "alice", Provider: "oidc"}, http.StatusForbidden},
+		"logs action": {&Identity{Username: "ci-bot", Provider: "token"}, http.StatusOK},
+		// tokenUsers match static API tokens only, not other providers
+		// that report the same username.
+		"oidc ci-bot": {&Identity{Username: "ci-bot", Provider: "oidc"}, http.StatusForbidden},
+	} {
+		if code, body := get(t, s.handleServices, "/services/staging/hello/history", tc.id); code != tc.want {
+			t.Errorf("history as %s = %d %s, want %d", name, code, body, tc.want)
+		}
+	}
+}
+
+func TestWebhookDeliveriesFilteredByLogsAction(t *testing.T) {
+	s := newTestServer(t)
+	withPolicy(t, s, testPolicy)
+	storeWithLogs(t, s, "dep-000001", "team-a")
+	storeWithLogs(t, s, "dep-000002", "demo-apps")
+	s.webhooks = &webhookNotifier{deliveries: []*WebhookDelivery{
+		{ID: "whd-1", DeploymentID: "dep-000001", Status: deliveryDelivered},
+		{ID: "whd-2", DeploymentID: "dep-000002", Status: deliveryFailed},
+		{ID: "whd-3", DeploymentID: "dep-000001", Status: deliveryDelivered},
+	}}
+
+	var out struct {
+		Items []WebhookDelivery `json:"items"`
+	}
+	_, body := get(t, s.handleWebhookDeliveries, "/webhooks/deliveries", &Identity{Username: "alice", Provider: "oidc"})
+	if err := json.Unmarshal(body, &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Items) != 2 || out.Items[0].ID != "whd-3" || out.Items[1].ID != "whd-1" {
+		t.Fatalf("alice sees %+v, want whd-3 and whd-1", out.Items)
+	}
+
+	_, body = get(t, s.handleWebhookDeliveries, "/webhooks/deliveries", nil)
+	if err := json.Unmarshal(body, &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Items) != 0 {
+		t.Fatalf("anonymous caller sees %+v", out.Items)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	annotationMinScale       = "autoscaling.knative.dev/min-scale"
+	annotationMaxScale       = "autoscaling.knative.dev/max-scale"
+	annotationInitialScale   = "autoscaling.knative.dev/initial-scale"
+	annotationMetric         = "autoscaling.knative.dev/metric"
+	annotationTarget         = "autoscaling.knative.dev/target"
+	annotationScaleDownDelay = "autoscaling.knative.dev/scale-down-delay"
+)
+
+// autoscalingAnnotations are the revision annotations upload-api owns. Any
+// not set for a deployment are removed from the service template. The
+// camelCase keys are the older spellings; Knative rejects a template that
+// has both spellings of one setting.
+var autoscalingAnnotations = []string{
+	annotationMinScale, annotationMaxScale, annotationInitialScale,
+	annotationMetric, annotationTarget, annotationScaleDownDelay,
+	"autoscaling.knative.dev/minScale", "autoscaling.knative.dev/maxScale",
+	"autoscaling.knative.dev/initialScale", "autoscaling.knative.dev/scaleDownDelay",
+}
+
+const (
+	metricConcurrency = "concurrency"
+	metricRPS         = "rps"
+
+	// maxContainerConcurrency is Knative's container-concurrency-max-limit.
+	maxContainerConcurrency = 1000
+	maxScaleDownDelay       = time.Hour
+)
+
+// Autoscaling holds the Knative autoscaler settings of a deployment. Unset
+// fields are left to the cluster's autoscaler defaults.
+type Autoscaling struct {
+	MinScale     *int   `json:"minScale,omitempty"`
+	MaxScale     *int   `json:"maxScale,omitempty"` // 0 means unbounded
+	InitialScale *int   `json:"initialScale,omitempty"`
+	Metric       string `json:"metric,omitempty"` // concurrency or rps
+	Target       *int   `json:"target,omitempty"` // concurrent requests or requests per second per replica
+	// ContainerConcurrency is the hard limit of concurrent requests per
+	// replica; 0 means unlimited.
+	ContainerConcurrency *int   `json:"containerConcurrency,omitempty"`
+	ScaleDownDelay       string `json:"scaleDownDelay,omitempty"`
+}
+
+// parseAutoscalingForm reads the autoscaling form fields of POST /deploy.
+// It returns nil when none is set.
+func parseAutoscalingForm(form url.Values) (*Autoscaling, error) {
+	var a Autoscaling
+	set := false
+	ints := []struct {
+		field string
+		dst   **int
+	}{
+		{"minScale", &a.MinScale},
+		{"maxScale", &a.MaxScale},
+		{"initialScale", &a.InitialScale},
+		{"target", &a.Target},
+		{"containerConcurrency", &a.ContainerConcurrency},
+	}
+	for _, f := range ints {
+		raw := strings.TrimSpace(form.Get(f.field))
+		if raw == "" {
+			continue
+		}
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be an integer", f.field)
+		}
+		*f.dst = &n
+		set = true
+	}
+	if raw := strings.TrimSpace(form.Get("metric")); raw != "" {
+		a.Metric = raw
+		set = true
+	}
+	if raw := strings.TrimSpace(form.Get("scaleDownDelay")); raw != "" {
+		a.ScaleDownDelay = raw
+		set = true
+	}
+	if !set {
+		return nil, nil
+	}
+	return &a, nil
+}
+
+// overlay returns a with the fields set in o replacing its own.
+func (a *Autoscaling) overlay(o *Autoscaling) *Autoscaling {
+	if a == nil {
+		return o
+	}
+	out := *a
+	if o == nil {
+		return &out
+	}
+	if o.MinScale != nil {
+		out.MinScale = o.MinScale
+	}
+	if o.MaxScale != nil {
+		out.MaxScale = o.MaxScale
+	}
+	if o.InitialScale != nil {
+		out.InitialScale = o.InitialScale
+	}
+	if o.Metric != "" {
+		out.Metric = o.Metric
+	}
+	if o.Target != nil {
+		out.Target = o.Target
+	}
+	if o.ContainerConcurrency != nil {
+		out.ContainerConcurrency = o.ContainerConcurrency
+	}
+	if o.ScaleDownDelay != "" {
+		out.ScaleDownDelay = o.ScaleDownDelay
+	}
+	return &out
+}
+
+func (a *Autoscaling) validate() error {
+	if a == nil {
+		return nil
+	}
+	if a.MinScale != nil && *a.MinScale < 0 {
+		return fmt.Errorf("autoscaling.minScale must not be negative")
+	}
+	if a.MaxScale != nil && *a.MaxScale < 0 {
+		return fmt.Errorf("autoscaling.maxScale must not be negative (0 means unbounded)")
+	}
+	bounded := a.MaxScale != nil && *a.MaxScale > 0
+	if bounded && a.MinScale != nil && *a.MinScale > *a.MaxScale {
+		return fmt.Errorf("autoscaling.minScale (%d) exceeds autoscaling.maxScale (%d)", *a.MinScale, *a.MaxScale)
+	}
+	if a.InitialScale != nil {
+		// Knative only accepts 0 when the cluster sets allow-zero-initial-scale.
+		if *a.InitialScale < 1 {
+			return fmt.Errorf("autoscaling.initialScale must be at least 1")
+		}
+		if bounded && *a.InitialScale > *a.MaxScale {
+			return fmt.Errorf("autoscaling.initialScale (%d) exceeds autoscaling.maxScale (%d)", *a.InitialScale, *a.MaxScale)
+		}
+	}
+	if a.Metric != "" && a.Metric != metricConcurrency && a.Metric != metricRPS {
+		return fmt.Errorf("autoscaling.metric must be %s or %s", metricConcurrency, metricRPS)
+	}
+	if a.Target != nil && *a.Target < 1 {
+		return fmt.Errorf("autoscaling.target must be at least 1")
+	}
+	if cc := a.ContainerConcurrency; cc != nil {
+		if *cc < 0 || *cc > maxContainerConcurrency {
+			return fmt.Errorf("autoscaling.containerConcurrency must be between 0 and %d (0 means unlimited)", maxContainerConcurrency)
+		}
+		if *cc > 0 && a.Target != nil && a.Metric != metricRPS && *a.Target > *cc {
+			return fmt.Errorf("autoscaling.target (%d) exceeds autoscaling.containerConcurrency (%d)", *a.Target, *cc)
+		}
+	}
+	if a.ScaleDownDelay != "" {
+		d, err := time.ParseDuration(a.ScaleDownDelay)
+		if err != nil || d < 0 || d > maxScaleDownDelay {
+			return fmt.Errorf("autoscaling.scaleDownDelay must be a duration between 0s and 1h")
+		}
+	}
+	return nil
+}
+
+// annotations renders the settings that are set as revision annotations.
+// containerConcurrency is a template spec field, not an annotation.
+func (a *Autoscaling) annotations() map[string]string {
+	out := map[string]string{}
+	if a == nil {
+		return out
+	}
+	ints := []struct {
+		key string
+		val *int
+	}{
+		{annotationMinScale, a.MinScale},
+		{annotationMaxScale, a.MaxScale},
+		{annotationInitialScale, a.InitialScale},
+		{annotationTarget, a.Target},
+	}
+	for _, f := range ints {
+		if f.val != nil {
+			out[f.key] = strconv.Itoa(*f.val)
+		}
+	}
+	if a.Metric != "" {
+		out[annotationMetric] = a.Metric
+	}
+	if a.ScaleDownDelay != "" {
+		out[annotationScaleDownDelay] = a.ScaleDownDelay
+	}
+	return out
+}
+
+// containerConcurrency returns the requested hard concurrency limit, or nil
+// to leave it to the cluster default.
+func (a *Autoscaling) containerConcurrency() *int {
+	if a == nil {
+		return nil
+	}
+	return a.ContainerConcurrency
+}
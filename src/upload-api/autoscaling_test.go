@@ -0,0 +1,242 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseAutoscalingForm(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		form    url.Values
+		want    *Autoscaling
+		wantErr string
+	}{
+		{name: "none set", form: url.Values{"service": {"hello"}}},
+		{
+			name: "only set fields",
+			form: url.Values{"minScale": {"1"}, "metric": {"rps"}},
+			want: &Autoscaling{MinScale: intPtr(1), Metric: metricRPS},
+		},
+		{
+			name: "explicit zero",
+			form: url.Values{"maxScale": {"0"}, "containerConcurrency": {" 0 "}},
+			want: &Autoscaling{MaxScale: intPtr(0), ContainerConcurrency: intPtr(0)},
+		},
+		{
+			name: "every field",
+			form: url.Values{
+				"minScale": {"1"}, "maxScale": {"5"}, "initialScale": {"2"}, "metric": {"concurrency"},
+				"target": {"8"}, "containerConcurrency": {"10"}, "scaleDownDelay": {"5m"},
+			},
+			want: &Autoscaling{
+				MinScale: intPtr(1), MaxScale: intPtr(5), InitialScale: intPtr(2), Metric: metricConcurrency,
+				Target: intPtr(8), ContainerConcurrency: intPtr(10), ScaleDownDelay: "5m",
+			},
+		},
+		{name: "not an integer", form: url.Values{"target": {"ten"}}, wantErr: "target must be an integer"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseAutoscalingForm(tc.form)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("parseAutoscalingForm = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAutoscalingValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		a       *Autoscaling
+		wantErr string
+	}{
+		{name: "unset", a: nil},
+		{name: "empty", a: &Autoscaling{}},
+		{name: "min equals max", a: &Autoscaling{MinScale: intPtr(3), MaxScale: intPtr(3)}},
+		{name: "min above unbounded max", a: &Autoscaling{MinScale: intPtr(3), MaxScale: intPtr(0)}},
+		{name: "rps target above containerConcurrency", a: &Autoscaling{Metric: metricRPS, Target: intPtr(50), ContainerConcurrency: intPtr(10)}},
+		{name: "target with unlimited containerConcurrency", a: &Autoscaling{Target: intPtr(500), ContainerConcurrency: intPtr(0)}},
+		{name: "longest scaleDownDelay", a: &Autoscaling{ScaleDownDelay: "1h"}},
+
+		{name: "negative minScale", a: &Autoscaling{MinScale: intPtr(-1)}, wantErr: "minScale must not be negative"},
+		{name: "negative maxScale", a: &Autoscaling{MaxScale: intPtr(-1)}, wantErr: "maxScale must not be negative"},
+		{name: "min above max", a: &Autoscaling{MinScale: intPtr(5), MaxScale: intPtr(1)}, wantErr: "minScale (5) exceeds autoscaling.maxScale (1)"},
+		{name: "zero initialScale", a: &Autoscaling{InitialScale: intPtr(0)}, wantErr: "initialScale must be at least 1"},
+		{name: "initial above max", a: &Autoscaling{InitialScale: intPtr(4), MaxScale: intPtr(2)}, wantErr: "initialScale (4) exceeds autoscaling.maxScale (2)"},
+		{name: "unknown metric", a: &Autoscaling{Metric: "cpu"}, wantErr: "metric must be concurrency or rps"},
+		{name: "zero target", a: &Autoscaling{Target: intPtr(0)}, wantErr: "target must be at least 1"},
+		{name: "containerConcurrency above limit", a: &Autoscaling{ContainerConcurrency: intPtr(1001)}, wantErr: "containerConcurrency must be between 0 and 1000"},
+		{name: "negative containerConcurrency", a: &Autoscaling{ContainerConcurrency: intPtr(-1)}, wantErr: "containerConcurrency must be between 0 and 1000"},
+		{name: "concurrency target above containerConcurrency", a: &Autoscaling{Target: intPtr(20), ContainerConcurrency: intPtr(10)}, wantErr: "target (20) exceeds autoscaling.containerConcurrency (10)"},
+		{name: "unparsable scaleDownDelay", a: &Autoscaling{ScaleDownDelay: "soon"}, wantErr: "scaleDownDelay must be a duration"},
+		{name: "scaleDownDelay above 1h", a: &Autoscaling{ScaleDownDelay: "61m"}, wantErr: "scaleDownDelay must be a duration"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.a.validate()
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("validate() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("validate() = %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestAutoscalingAnnotations(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		a    *Autoscaling
+		want map[string]string
+	}{
+		{name: "unset", a: nil, want: map[string]string{}},
+		{name: "empty", a: &Autoscaling{}, want: map[string]string{}},
+		{
+			name: "minScale only",
+			a:    &Autoscaling{MinScale: intPtr(1)},
+			want: map[string]string{annotationMinScale: "1"},
+		},
+		{
+			name: "rps target without defaults filled in",
+			a:    &Autoscaling{Metric: metricRPS, Target: intPtr(50)},
+			want: map[string]string{annotationMetric: "rps", annotationTarget: "50"},
+		},
+		{
+			name: "explicit unbounded maxScale",
+			a:    &Autoscaling{MaxScale: intPtr(0)},
+			want: map[string]string{annotationMaxScale: "0"},
+		},
+		{
+			name: "containerConcurrency is not an annotation",
+			a:    &Autoscaling{ContainerConcurrency: intPtr(10)},
+			want: map[string]string{},
+		},
+		{
+			name: "every field",
+			a: &Autoscaling{
+				MinScale: intPtr(1), MaxScale: intPtr(5), InitialScale: intPtr(2), Metric: metricConcurrency,
+				Target: intPtr(8), ContainerConcurrency: intPtr(10), ScaleDownDelay: "5m",
+			},
+			want: map[string]string{
+				annotationMinScale: "1", annotationMaxScale: "5", annotationInitialScale: "2",
+				annotationMetric: "concurrency", annotationTarget: "8", annotationScaleDownDelay: "5m",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.a.annotations(); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("annotations() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRevisionTemplateAutoscaling(t *testing.T) {
+	spec := RevisionSpec{Image: "dev.local/hello:1", Annotations: (&Autoscaling{MinScale: intPtr(1)}).annotations()}
+
+	created := revisionTemplate(spec, false)
+	annotations := created["metadata"].(map[string]any)["annotations"].(map[string]any)
+	if !reflect.DeepEqual(annotations, map[string]any{annotationMinScale: "1"}) {
+		t.Fatalf("new service annotations = %v, want only min-scale", annotations)
+	}
+	if v, ok := created["spec"].(map[string]any)["containerConcurrency"]; ok {
+		t.Fatalf("new service containerConcurrency = %v, want it left to the cluster default", v)
+	}
+
+	// An update clears the owned settings it does not set, so a later deploy
+	// does not inherit them from the previous revision.
+	patched := revisionTemplate(spec, true)
+	annotations = patched["metadata"].(map[string]any)["annotations"].(map[string]any)
+	for _, key := range autoscalingAnnotations {
+		want := any(nil)
+		if key == annotationMinScale {
+			want = "1"
+		}
+		if v, ok := annotations[key]; !ok || v != want {
+			t.Errorf("patch annotation %s = %v (present %v), want %v", key, v, ok, want)
+		}
+	}
+	if v, ok := patched["spec"].(map[string]any)["containerConcurrency"]; !ok || v != nil {
+		t.Fatalf("patch containerConcurrency = %v (present %v), want explicit null", v, ok)
+	}
+
+	spec.ContainerConcurrency = intPtr(0)
+	if v := revisionTemplate(spec, true)["spec"].(map[string]any)["containerConcurrency"]; v != 0 {
+		t.Fatalf("containerConcurrency = %v, want 0", v)
+	}
+}
+
+func TestDeployRecordsOnlySetAutoscaling(t *testing.T) {
+	s := newTestServer(t)
+	files := map[string]string{
+		"Dockerfile": testDockerfile,
+		"app.yaml":   "autoscaling:\n  target: 10\n  maxScale: 3\n",
+	}
+	code, out := deploy(t, s, deployRequest(t, map[string]string{"minScale": "1", "maxScale": "5"}, "app.tar.gz", tarGz(t, files)))
+	if code != http.StatusAccepted {
+		t.Fatalf("status = %d (%v), want 202", code, out)
+	}
+	d, _ := s.store.Get(out["id"].(string))
+	want := &Autoscaling{MinScale: intPtr(1), MaxScale: intPtr(5), Target: intPtr(10)}
+	if !reflect.DeepEqual(d.Autoscaling, want) {
+		t.Fatalf("recorded autoscaling = %+v, want %+v", d.Autoscaling, want)
+	}
+	spec := revisionSpecFor(d)
+	wantAnnotations := map[string]string{annotationMinScale: "1", annotationMaxScale: "5", annotationTarget: "10"}
+	if !reflect.DeepEqual(spec.Annotations, wantAnnotations) {
+		t.Fatalf("revision annotations = %v, want %v", spec.Annotations, wantAnnotations)
+	}
+	if spec.ContainerConcurrency != nil {
+		t.Fatalf("containerConcurrency = %d, want unset", *spec.ContainerConcurrency)
+	}
+}
+
+func TestDeployRejectsInvalidAutoscaling(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		fields   map[string]string
+		manifest string
+		wantErr  string
+	}{
+		{name: "form not an integer", fields: map[string]string{"minScale": "one"}, wantErr: "minScale must be an integer"},
+		{name: "form min above max", fields: map[string]string{"minScale": "5", "maxScale": "1"}, wantErr: "exceeds autoscaling.maxScale"},
+		{name: "manifest unknown metric", manifest: "autoscaling:\n  metric: cpu\n", wantErr: "metric must be"},
+		{
+			name:     "form target above manifest containerConcurrency",
+			fields:   map[string]string{"target": "50"},
+			manifest: "autoscaling:\n  containerConcurrency: 10\n",
+			wantErr:  "exceeds autoscaling.containerConcurrency",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t)
+			files := map[string]string{"Dockerfile": testDockerfile}
+			if tc.manifest != "" {
+				files["app.yaml"] = tc.manifest
+			}
+			code, out := deploy(t, s, deployRequest(t, tc.fields, "app.tar.gz", tarGz(t, files)))
+			if code != http.StatusBadRequest {
+				t.Fatalf("status = %d (%v), want 400", code, out)
+			}
+			if msg, _ := out["error"].(string); !strings.Contains(msg, tc.wantErr) {
+				t.Fatalf("error = %q, want %q", msg, tc.wantErr)
+			}
+		})
+	}
+}
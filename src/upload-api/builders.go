@@ -0,0 +1,371 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BuildRequest describes one image build.
+type BuildRequest struct {
+	DeploymentID string
+	ServiceName  string
+	Namespace    string
+	ContextDir   string
+	Image        string
+}
+
+// Builder turns an extracted source directory into an image the cluster can
+// pull. Progress is written to logs as it happens.
+type Builder interface {
+	Name() string
+	Build(ctx context.Context, req BuildRequest, logs io.Writer) error
+}
+
+// imagePusher is implemented by builders that push the built image as a
+// separate step, so the push runs under its own deadline.
+type imagePusher interface {
+	// Pushes reports whether Push has anything to do.
+	Pushes() bool
+	Push(ctx context.Context, req BuildRequest, logs io.Writer) error
+}
+
+// configuredBuilders returns every builder backend keyed by name. kube may be
+// nil in mock mode, where builds never run. tokens is shared with the
+// context endpoint that serves builders running outside this process.
+func configuredBuilders(scriptPath string, kube *kubeClient, tokens *contextTokens) map[string]Builder {
+	all := []Builder{
+		minikubeBuilder{profile: envOr("MINIKUBE_PROFILE", "knative-dev")},
+		scriptBuilder{path: scriptPath},
+		dockerBuilder{
+			host: envOr("DOCKER_HOST", "unix:///var/run/docker.sock"),
+			push: envTrue("DOCKER_PUSH"),
+		},
+		buildkitBuilder{
+			addr: envOr("BUILDKIT_HOST", "unix:///run/buildkit/buildkitd.sock"),
+			push: envTrue("BUILDKIT_PUSH"),
+		},
+		buildpacksBuilder{
+			builder: envOr("PACK_BUILDER", "paketobuildpacks/builder-jammy-base"),
+			publish: envTrue("PACK_PUBLISH"),
+		},
+		kanikoBuilder{
+			kube:         kube,
+			namespace:    envOr("KANIKO_NAMESPACE", "default"),
+			image:        envOr("KANIKO_IMAGE", "gcr.io/kaniko-project/executor:latest"),
+			fetchImage:   envOr("KANIKO_FETCH_IMAGE", "busybox:1.36"),
+			uploadAPIURL: envOr("UPLOAD_API_URL", ""),
+			insecure:     envTrue("KANIKO_INSECURE"),
+			tokens:       tokens,
+		},
+	}
+	builders := make(map[string]Builder, len(all))
+	for _, b := range all {
+		builders[b.Name()] = b
+	}
+	return builders
+}
+
+func builderNames(builders map[string]Builder) []string {
+	names := make([]string, 0, len(builders))
+	for name := range builders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// minikubeBuilder builds straight into the minikube image cache, falling
+// back to docker build + minikube image load like build-deploy-local.sh.
+type minikubeBuilder struct {
+	profile string
+}
+
+func (minikubeBuilder) Name() string { return "minikube" }
+
+func (b minikubeBuilder) Build(ctx context.Context, req BuildRequest, logs io.Writer) error {
+	fmt.Fprintf(logs, "[minikube] building %s in profile %s\n", req.Image, b.profile)
+	if err := runLogged(ctx, logs, "minikube", "image", "build", "-p", b.profile, "-t", req.Image, req.ContextDir); err != nil {
+		return err
+	}
+	if b.hasImage(ctx, req.Image) {
+		fmt.Fprintf(logs, "[minikube] image available in minikube cache: %s\n", req.Image)
+		return nil
+	}
+
+	fmt.Fprintln(logs, "[minikube] image not found after minikube build; falling back to docker build + minikube image load")
+	if err := runLogged(ctx, logs, "docker", "build", "-t", req.Image, req.ContextDir); err != nil {
+		return err
+	}
+	if err := runLogged(ctx, logs, "minikube", "image", "load", "-p", b.profile, req.Image); err != nil {
+		return err
+	}
+	if !b.hasImage(ctx, req.Image) {
+		return fmt.Errorf("image still not present in minikube after fallback load: %s", req.Image)
+	}
+	return nil
+}
+
+func (b minikubeBuilder) hasImage(ctx context.Context, image string) bool {
+	out, err := commandContext(ctx, "minikube", "image", "ls", "-p", b.profile).Output()
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.TrimSpace(line) == image {
+			return true
+		}
+	}
+	return false
+}
+
+// scriptBuilder runs BUILD_DEPLOY_SCRIPT in build-only mode.
+type scriptBuilder struct {
+	path string
+}
+
+func (scriptBuilder) Name() string { return "script" }
+
+func (b scriptBuilder) Build(ctx context.Context, req BuildRequest, logs io.Writer) error {
+	cmd := commandContext(ctx, b.path)
+	cmd.Env = append(os.Environ(),
+		"APP_DIR="+req.ContextDir,
+		"SERVICE_NAME="+req.ServiceName,
+		"NAMESPACE="+req.Namespace,
+		"DEPLOYMENT_ID="+req.DeploymentID,
+		"IMAGE_TAG="+req.DeploymentID,
+		"IMAGE="+req.Image,
+		"SKIP_DEPLOY=true",
+	)
+	cmd.Stdout = logs
+	cmd.Stderr = logs
+	return cmd.Run()
+}
+
+// dockerBuilder talks to the Docker Engine API. Without push the image only
+// exists in that daemon, so point DOCKER_HOST at the cluster's daemon
+// (e.g. `minikube docker-env`).
+type dockerBuilder struct {
+	host string
+	push bool
+}
+
+func (dockerBuilder) Name() string { return "docker" }
+
+func (b dockerBuilder) client() (*http.Client, string, error) {
+	u, err := url.Parse(b.host)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid DOCKER_HOST %q: %w", b.host, err)
+	}
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+		return &http.Client{Transport: transport}, "http://docker", nil
+	case "tcp", "http":
+		return &http.Client{}, "http://" + u.Host, nil
+	default:
+		return nil, "", fmt.Errorf("unsupported DOCKER_HOST scheme %q", u.Scheme)
+	}
+}
+
+func (b dockerBuilder) Build(ctx context.Context, req BuildRequest, logs io.Writer) error {
+	client, base, err := b.client()
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeContextTar(pw, req.ContextDir))
+	}()
+
+	q := url.Values{"t": {req.Image}, "rm": {"1"}}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, base+"/build?"+q.Encode(), pr)
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/x-tar")
+	fmt.Fprintf(logs, "[docker] building %s via %s\n", req.Image, b.host)
+	return streamDockerJSON(client, httpReq, logs)
+}
+
+func (b dockerBuilder) Pushes() bool { return b.push }
+
+func (b dockerBuilder) Push(ctx context.Context, req BuildRequest, logs io.Writer) error {
+	client, base, err := b.client()
+	if err != nil {
+		return err
+	}
+	name, tag := splitImageTag(req.Image)
+	pushReq, err := http.NewRequestWithContext(ctx, http.MethodPost, base+"/images/"+name+"/push?tag="+url.QueryEscape(tag), nil)
+	if err != nil {
+		return err
+	}
+	// The engine requires the header even for registries without auth.
+	pushReq.Header.Set("X-Registry-Auth", base64.URLEncoding.EncodeToString([]byte("{}")))
+	fmt.Fprintf(logs, "[docker] pushing %s\n", req.Image)
+	return streamDockerJSON(client, pushReq, logs)
+}
+
+// streamDockerJSON copies the engine's JSON message stream to logs and
+// surfaces an in-stream error.
+func streamDockerJSON(client *http.Client, req *http.Request, logs io.Writer) error {
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 2000))
+		return fmt.Errorf("docker api status %d: %s", res.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	dec := json.NewDecoder(res.Body)
+	for {
+		var msg struct {
+			Stream string `json:"stream"`
+			Status string `json:"status"`
+			Error  string `json:"error"`
+		}
+		if err := dec.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		switch {
+		case msg.Error != "":
+			return errors.New(strings.TrimSpace(msg.Error))
+		case msg.Stream != "":
+			io.WriteString(logs, msg.Stream)
+		case msg.Status != "":
+			fmt.Fprintln(logs, msg.Status)
+		}
+	}
+}
+
+// buildkitBuilder drives a buildkitd socket through buildctl.
+type buildkitBuilder struct {
+	addr string
+	push bool
+}
+
+func (buildkitBuilder) Name() string { return "buildkit" }
+
+func (b buildkitBuilder) Build(ctx context.Context, req BuildRequest, logs io.Writer) error {
+	output := fmt.Sprintf("type=image,name=%s,push=%t", req.Image, b.push)
+	fmt.Fprintf(logs, "[buildkit] building %s via %s\n", req.Image, b.addr)
+	return runLogged(ctx, logs, "buildctl", "--addr", b.addr, "build",
+		"--frontend", "dockerfile.v0",
+		"--local", "context="+req.ContextDir,
+		"--local", "dockerfile="+req.ContextDir,
+		"--progress", "plain",
+		"--output", output,
+	)
+}
+
+// commandContext is exec.CommandContext with the process group killed on
+// cancellation.
+func commandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	setProcessGroup(cmd)
+	cmd.WaitDelay = 5 * time.Second
+	return cmd
+}
+
+func runLogged(ctx context.Context, logs io.Writer, name string, args ...string) error {
+	cmd := commandContext(ctx, name, args...)
+	cmd.Stdout = logs
+	cmd.Stderr = logs
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s: %w", name, args[0], err)
+	}
+	return nil
+}
+
+func splitImageTag(image string) (string, string) {
+	slash := strings.LastIndex(image, "/")
+	if colon := strings.LastIndex(image, ":"); colon > slash {
+		return image[:colon], image[colon+1:]
+	}
+	return image, "latest"
+}
+
+// writeContextTar streams dir as an uncompressed tar archive, keeping file
+// modes and symbolic links.
+func writeContextTar(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		link := ""
+		switch {
+		case info.Mode()&fs.ModeSymlink != 0:
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		case !info.Mode().IsRegular() && !info.IsDir():
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// writeContextTarGz streams dir as a gzip-compressed tar archive.
+func writeContextTarGz(w io.Writer, dir string) error {
+	gw := gzip.NewWriter(w)
+	if err := writeContextTar(gw, dir); err != nil {
+		return err
+	}
+	return gw.Close()
+}
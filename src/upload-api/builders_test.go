@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// fakeMinikube puts a minikube script running body first on PATH.
+func fakeMinikube(t *testing.T, body string) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "minikube"), []byte("#!/bin/sh\n"+body+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestMinikubeHasImage(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a POSIX shell")
+	}
+	fakeMinikube(t, `printf 'docker.io/library/busybox:latest\n  dev.local/hello:dep-000001  \n'`)
+	b := minikubeBuilder{profile: "test"}
+	for image, want := range map[string]bool{
+		"dev.local/hello:dep-000001": true,
+		"dev.local/hello:dep-000002": false,
+		"dev.local/hello":            false,
+	} {
+		if got := b.hasImage(testContext(t), image); got != want {
+			t.Errorf("hasImage(%s) = %v, want %v", image, got, want)
+		}
+	}
+}
+
+func TestMinikubeHasImageStopsOnCancel(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a POSIX shell")
+	}
+	// The child sleep keeps stdout open after minikube itself is killed, so
+	// only killing the process group ends the call early.
+	fakeMinikube(t, "sleep 30 &\nwait")
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if (minikubeBuilder{profile: "test"}).hasImage(ctx, "dev.local/hello:1") {
+		t.Fatal("hasImage = true for a cancelled listing")
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("hasImage returned after %v, want it to stop with its context", elapsed)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const cleanupTimeout = 30 * time.Second
+
+var errCancelRequested = errors.New("cancelled by request")
+
+// beginRun registers a cancellable context for the deployment's background
+// job. It returns false if the deployment was cancelled (or otherwise
+// finished) before the job started.
+func (s *Server) beginRun(id string) (context.Context, func(), bool) {
+	s.runsMu.Lock()
+	defer s.runsMu.Unlock()
+	if d, ok := s.store.Get(id); !ok || isTerminalStatus(d.Status) {
+		return nil, nil, false
+	}
+	ctx, cancel := context.WithCancelCause(context.Background())
+	s.runs[id] = cancel
+	end := func() {
+		s.runsMu.Lock()
+		delete(s.runs, id)
+		s.runsMu.Unlock()
+		cancel(nil)
+	}
+	return ctx, end, true
+}
+
+func cancelRequested(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errCancelRequested)
+}
+
+// handleCancel serves POST /deployments/{id}/cancel. A running job is
+// cancelled and records CANCELLED itself once it has stopped and cleaned
+// up; a job that has not started yet is marked CANCELLED immediately.
+func (s *Server) handleCancel(w http.ResponseWriter, id string) {
+	s.runsMu.Lock()
+	defer s.runsMu.Unlock()
+
+	d, ok := s.store.Get(id)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "deployment not found"})
+		return
+	}
+	if isTerminalStatus(d.Status) {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": fmt.Sprintf("deployment already finished with status %s", d.Status)})
+		return
+	}
+
+	if cancel, running := s.runs[id]; running {
+		cancel(errCancelRequested)
+		writeJSON(w, http.StatusAccepted, DeployResponse{ID: id, Status: d.Status, Message: "cancellation requested"})
+		return
+	}
+	s.queue.remove(id)
+	s.updateDeployment(id, func(d *Deployment) {
+		d.Status = statusCancelled
+		d.Error = "cancelled before the job started"
+	})
+	writeJSON(w, http.StatusOK, DeployResponse{ID: id, Status: statusCancelled, Message: "deployment cancelled"})
+}
+
+func (s *Server) markCancelled(id, output, phase string) {
+	s.updateStatus(id, statusCancelled, output, "cancelled during "+phase)
+}
+
+// revertApply undoes a cancelled Apply where possible: a service created by
+// this deployment is deleted, otherwise traffic is pinned back to the
+// revisions that were serving before.
+func (s *Server) revertApply(d *Deployment, before *ServiceState, beforeErr error, logs io.Writer) {
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+
+	switch {
+	case serviceNotFound(beforeErr):
+		if err := s.services.Delete(ctx, d.Namespace, d.ServiceName); err != nil && !serviceNotFound(err) {
+			fmt.Fprintf(logs, "cleanup: failed to delete ksvc %s/%s: %v\n", d.Namespace, d.ServiceName, err)
+			return
+		}
+		fmt.Fprintf(logs, "cleanup: deleted ksvc %s/%s created by this deployment\n", d.Namespace, d.ServiceName)
+	case before != nil && len(before.Traffic) > 0:
+		pinned := make([]TrafficTarget, 0, len(before.Traffic))
+		for _, t := range before.Traffic {
+			pinned = append(pinned, TrafficTarget{RevisionName: t.RevisionName, Percent: t.Percent, Tag: t.Tag})
+		}
+		if _, err := s.services.SetTraffic(ctx, d.Namespace, d.ServiceName, pinned); err != nil {
+			fmt.Fprintf(logs, "cleanup: failed to restore traffic: %v\n", err)
+			return
+		}
+		fmt.Fprintf(logs, "cleanup: restored traffic to %s\n", describeTraffic(pinned))
+	default:
+		fmt.Fprintln(logs, "cleanup: previous service state unknown; left as is")
+	}
+}
+
+// sleepContext waits for d or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
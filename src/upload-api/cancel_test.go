@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blockingBuilder reports each build on started and then blocks until the
+// build's context ends.
+type blockingBuilder struct{ started chan string }
+
+func (blockingBuilder) Name() string { return "minikube" }
+
+func (b blockingBuilder) Build(ctx context.Context, req BuildRequest, _ io.Writer) error {
+	b.started <- req.DeploymentID
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// stuckServices applies revisions like mockServices but never sees them
+// become ready. Each wait is reported on waiting.
+type stuckServices struct {
+	*mockServices
+	waiting chan string
+}
+
+func (s stuckServices) WaitReady(ctx context.Context, _, name string, _ int64) (*ServiceState, error) {
+	s.waiting <- name
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func receive(t *testing.T, ch <-chan string) string {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the pipeline")
+		return ""
+	}
+}
+
+func cancelDeployment(t *testing.T, s *Server, method, id string) (int, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.handleDeploymentRoutes(rec, httptest.NewRequest(method, "/deployments/"+id+"/cancel", nil))
+	return rec.Code, rec.Body.String()
+}
+
+func TestCancelRequests(t *testing.T) {
+	s := newTestServer(t)
+	var ids []string
+	for _, service := range []string{"api", "web"} {
+		code, out := deploy(t, s, deployRequest(t, map[string]string{"service": service}, "app.tar.gz", tarGz(t, map[string]string{"Dockerfile": testDockerfile})))
+		if code != http.StatusAccepted {
+			t.Fatalf("status = %d (%v), want 202", code, out)
+		}
+		ids = append(ids, out["id"].(string))
+	}
+	s.store.Put(&Deployment{ID: "dep-000050", Status: statusReady})
+	queued := ids[1]
+
+	for _, tc := range []struct {
+		name, method, id string
+		want             int
+	}{
+		{"unknown deployment", http.MethodPost, "dep-000099", http.StatusNotFound},
+		{"wrong method", http.MethodGet, queued, http.StatusMethodNotAllowed},
+		{"already finished", http.MethodPost, "dep-000050", http.StatusConflict},
+		{"queued", http.MethodPost, queued, http.StatusOK},
+		{"cancelled twice", http.MethodPost, queued, http.StatusConflict},
+	} {
+		if code, body := cancelDeployment(t, s, tc.method, tc.id); code != tc.want {
+			t.Errorf("%s: %s cancel = %d %s, want %d", tc.name, tc.method, code, body, tc.want)
+		}
+	}
+
+	d, _ := s.store.Get(queued)
+	if d.Status != statusCancelled || d.Error != "cancelled before the job started" {
+		t.Fatalf("queued deployment = %s (%s), want CANCELLED before start", d.Status, d.Error)
+	}
+	if pos := s.queue.position(queued); pos != 0 {
+		t.Fatalf("cancelled deployment still queued at %d", pos)
+	}
+}
+
+func TestCancelStopsRunningBuild(t *testing.T) {
+	s := newPipelineServer(t)
+	started := make(chan string, 1)
+	s.builders["minikube"] = blockingBuilder{started: started}
+	code, out := deploy(t, s, deployRequest(t, map[string]string{"service": "hello", "namespace": "demo-apps"}, "app.tar.gz", tarGz(t, map[string]string{"Dockerfile": testDockerfile})))
+	if code != http.StatusAccepted {
+		t.Fatalf("status = %d (%v), want 202", code, out)
+	}
+	id := receive(t, started)
+
+	if code, body := cancelDeployment(t, s, http.MethodPost, id); code != http.StatusAccepted {
+		t.Fatalf("cancel = %d %s, want 202", code, body)
+	}
+	d := waitFinished(t, s, id)
+	if d.Status != statusCancelled || d.Error != "cancelled during build" {
+		t.Fatalf("deployment = %s (%s), want CANCELLED during build", d.Status, d.Error)
+	}
+	last := d.Phases[len(d.Phases)-1]
+	if last.Name != phaseBuild || last.Status != statusCancelled {
+		t.Fatalf("last phase = %s %s, want build CANCELLED", last.Name, last.Status)
+	}
+	if _, err := s.services.GetService(testContext(t), "demo-apps", "hello"); !serviceNotFound(err) {
+		t.Fatalf("cancelled build created a service: %v", err)
+	}
+}
+
+func TestCancelRevertsApply(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		existing bool
+	}{
+		{"new service is deleted", false},
+		{"existing service gets its traffic back", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newPipelineServer(t)
+			fields := map[string]string{"service": "hello", "namespace": "demo-apps"}
+			files := map[string]string{"Dockerfile": testDockerfile}
+			if tc.existing {
+				deployAndWait(t, s, fields, files)
+			}
+			waiting := make(chan string, 1)
+			mock := s.services.(*mockServices)
+			s.services = stuckServices{mockServices: mock, waiting: waiting}
+
+			code, out := deploy(t, s, deployRequest(t, fields, "app.tar.gz", tarGz(t, files)))
+			if code != http.StatusAccepted {
+				t.Fatalf("status = %d (%v), want 202", code, out)
+			}
+			receive(t, waiting)
+			id := out["id"].(string)
+			if code, body := cancelDeployment(t, s, http.MethodPost, id); code != http.StatusAccepted {
+				t.Fatalf("cancel = %d %s, want 202", code, body)
+			}
+			d := waitFinished(t, s, id)
+			if d.Status != statusCancelled || d.Error != "cancelled during ready" {
+				t.Fatalf("deployment = %s (%s), want CANCELLED during ready", d.Status, d.Error)
+			}
+
+			st, err := mock.GetService(testContext(t), "demo-apps", "hello")
+			if !tc.existing {
+				if !serviceNotFound(err) {
+					t.Fatalf("service created by the cancelled deployment still exists: %+v", st)
+				}
+				if !strings.Contains(d.Output, "cleanup: deleted ksvc demo-apps/hello") {
+					t.Fatalf("output lacks the cleanup note:\n%s", d.Output)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(st.Traffic) != 1 || st.Traffic[0].RevisionName != "hello-00001" || st.Traffic[0].Percent != 100 {
+				t.Fatalf("traffic after cancel = %+v, want 100%% pinned to hello-00001", st.Traffic)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// cloudEventTypePrefix turns a lifecycle event such as deployment.ready
+	// into the CloudEvent type dev.knative-appdev.deployment.ready.
+	cloudEventTypePrefix = "dev.knative-appdev."
+	cloudEventQueueSize  = 256
+)
+
+// cloudEventSink publishes lifecycle events as binary-mode CloudEvents to a
+// sink such as a Knative Eventing Broker. The deployment record is the event
+// data; the CloudEvent attributes are HTTP headers.
+type cloudEventSink struct {
+	url         string
+	source      string
+	maxAttempts int
+	client      *http.Client
+	queue       chan DeploymentEvent
+}
+
+// newCloudEventSink reads CLOUDEVENTS_SINK, falling back to K_SINK as set by
+// a Knative SinkBinding. It returns nil when neither is set.
+func newCloudEventSink() *cloudEventSink {
+	url := envOr("CLOUDEVENTS_SINK", envOr("K_SINK", ""))
+	if url == "" {
+		return nil
+	}
+	c := &cloudEventSink{
+		url:         url,
+		source:      envOr("CLOUDEVENTS_SOURCE", "/knative-appdev/upload-api"),
+		maxAttempts: max(envInt("CLOUDEVENTS_MAX_ATTEMPTS", 3), 1),
+		client:      &http.Client{Timeout: webhookRequestTimeout},
+		queue:       make(chan DeploymentEvent, cloudEventQueueSize),
+	}
+	go c.work()
+	return c
+}
+
+func (c *cloudEventSink) publish(e DeploymentEvent) {
+	select {
+	case c.queue <- e:
+	default:
+		log.Printf("cloudevents queue is full; dropping %s for %s", e.Type, e.Deployment.ID)
+	}
+}
+
+func (c *cloudEventSink) work() {
+	for e := range c.queue {
+		c.send(e)
+	}
+}
+
+func (c *cloudEventSink) send(e DeploymentEvent) {
+	data, err := json.Marshal(e.Deployment)
+	if err != nil {
+		log.Printf("failed to encode cloudevent %s for %s: %v", e.Type, e.Deployment.ID, err)
+		return
+	}
+	newRequest := func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		h := req.Header
+		h.Set("Content-Type", "application/json")
+		h.Set("Ce-Specversion", "1.0")
+		h.Set("Ce-Id", e.ID)
+		h.Set("Ce-Type", cloudEventTypePrefix+e.Type)
+		h.Set("Ce-Source", c.source)
+		h.Set("Ce-Subject", e.Deployment.ID)
+		h.Set("Ce-Time", e.OccurredAt.Format(time.RFC3339Nano))
+		// Extension attributes, usable in Trigger filters.
+		h.Set("Ce-Namespace", e.Deployment.Namespace)
+		h.Set("Ce-Service", e.Deployment.ServiceName)
+		h.Set("Ce-Status", e.Deployment.Status)
+		if e.PreviousStatus != "" {
+			h.Set("Ce-Previousstatus", e.PreviousStatus)
+		}
+		return req, nil
+	}
+	var lastErr string
+	ok := sendWithRetry(c.client, c.maxAttempts, newRequest, func(a WebhookAttempt, _ bool) {
+		lastErr = a.Error
+	})
+	if !ok {
+		log.Printf("cloudevent %s for %s to %s failed: %s", e.Type, e.Deployment.ID, c.url, lastErr)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type receivedEvent struct {
+	header http.Header
+	body   []byte
+}
+
+// cloudEventReceiver starts a sink that fails the first failures requests
+// with 503 and records every request it accepts.
+func cloudEventReceiver(t *testing.T, failures int32) (string, <-chan receivedEvent) {
+	t.Helper()
+	received := make(chan receivedEvent, 8)
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		received <- receivedEvent{header: r.Header.Clone(), body: body}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, received
+}
+
+func waitEvent(t *testing.T, received <-chan receivedEvent) receivedEvent {
+	t.Helper()
+	select {
+	case ev := <-received:
+		return ev
+	case <-time.After(10 * time.Second):
+		t.Fatal("no cloudevent received")
+		return receivedEvent{}
+	}
+}
+
+func TestCloudEventBinaryModeHeaders(t *testing.T) {
+	url, received := cloudEventReceiver(t, 0)
+	t.Setenv("CLOUDEVENTS_SINK", url)
+	t.Setenv("CLOUDEVENTS_SOURCE", "/test/upload-api")
+	sink := newCloudEventSink()
+
+	occurred := time.Date(2026, 10, 17, 9, 30, 0, 123, time.UTC)
+	sink.publish(DeploymentEvent{
+		ID:             "evt-0123456789abcdef",
+		Type:           eventReady,
+		OccurredAt:     occurred,
+		PreviousStatus: statusDeploy,
+		Deployment:     &Deployment{ID: "dep-000007", ServiceName: "hello", Namespace: "demo-apps", Status: statusReady},
+	})
+
+	ev := waitEvent(t, received)
+	for name, want := range map[string]string{
+		"Content-Type":      "application/json",
+		"Ce-Specversion":    "1.0",
+		"Ce-Id":             "evt-0123456789abcdef",
+		"Ce-Type":           "dev.knative-appdev.deployment.ready",
+		"Ce-Source":         "/test/upload-api",
+		"Ce-Subject":        "dep-000007",
+		"Ce-Time":           "2026-10-17T09:30:00.000000123Z",
+		"Ce-Namespace":      "demo-apps",
+		"Ce-Service":        "hello",
+		"Ce-Status":         statusReady,
+		"Ce-Previousstatus": statusDeploy,
+	} {
+		if got := ev.header.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	var data Deployment
+	if err := json.Unmarshal(ev.body, &data); err != nil {
+		t.Fatalf("event data is not a deployment record: %v", err)
+	}
+	if data.ID != "dep-000007" || data.Status != statusReady {
+		t.Errorf("event data = %+v, want the deployment record", data)
+	}
+}
+
+func TestCloudEventRetriesAndOmitsEmptyPreviousStatus(t *testing.T) {
+	url, received := cloudEventReceiver(t, 1)
+	t.Setenv("CLOUDEVENTS_SINK", url)
+	t.Setenv("CLOUDEVENTS_MAX_ATTEMPTS", "2")
+	sink := newCloudEventSink()
+
+	sink.publish(DeploymentEvent{
+		ID:         "evt-1",
+		Type:       eventAccepted,
+		OccurredAt: time.Now().UTC(),
+		Deployment: &Deployment{ID: "dep-000008", ServiceName: "hello", Namespace: "demo-apps", Status: statusQueued},
+	})
+
+	ev := waitEvent(t, received)
+	if got := ev.header.Get("Ce-Type"); got != "dev.knative-appdev.deployment.accepted" {
+		t.Errorf("Ce-Type = %q, want dev.knative-appdev.deployment.accepted", got)
+	}
+	if _, ok := ev.header["Ce-Previousstatus"]; ok {
+		t.Errorf("Ce-Previousstatus sent for a new record")
+	}
+	if got := ev.header.Get("Ce-Source"); got != "/knative-appdev/upload-api" {
+		t.Errorf("Ce-Source = %q, want the default source", got)
+	}
+}
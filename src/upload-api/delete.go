@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// handleDeleteService deletes a Knative Service. The deletion is recorded as
+// a deployment of kind delete, so it shows in the service history and the
+// service stops counting against its namespace quota.
+func (s *Server) handleDeleteService(w http.ResponseWriter, r *http.Request, namespace, name string) {
+	for _, d := range s.store.List() {
+		if d.Namespace == namespace && d.ServiceName == name && !isTerminalStatus(d.Status) {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": fmt.Sprintf("deployment %s for %s/%s has not finished; cancel it first", d.ID, namespace, name)})
+			return
+		}
+	}
+	if err := s.services.Delete(r.Context(), namespace, name); err != nil {
+		if serviceNotFound(err) {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "service not found"})
+			return
+		}
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("failed to delete service: %v", err)})
+		return
+	}
+
+	id, err := s.store.NextID()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("failed to allocate deployment id: %v", err)})
+		return
+	}
+	now := time.Now().UTC()
+	d := &Deployment{
+		ID:          id,
+		Kind:        kindDelete,
+		ServiceName: name,
+		Namespace:   namespace,
+		Status:      statusReady,
+		LogsHint:    logsHint(name, namespace),
+		CreatedBy:   createdBy(r),
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		ReadyAt:     &now,
+	}
+	if err := s.store.Put(d); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("failed to record deletion: %v", err)})
+		return
+	}
+	s.announce("", d)
+	writeJSON(w, http.StatusOK, DeployResponse{ID: id, Status: d.Status, Message: fmt.Sprintf("service %s/%s deleted", namespace, name)})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+// isBuildContextPath reports whether path is /deployments/{id}/context, which
+// authenticates with a build's context token instead of a caller token.
+func isBuildContextPath(path string) bool {
+	rest, ok := strings.CutPrefix(path, "/deployments/")
+	if !ok {
+		return false
+	}
+	id, ok := strings.CutSuffix(rest, "/context")
+	return ok && id != "" && !strings.Contains(id, "/")
+}
+
+// handleDeploymentRoutes routes /deployments/{id}/{action}.
+func (s *Server) handleDeploymentRoutes(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/deployments/"), "/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "expected /deployments/{id}/{action}"})
+		return
+	}
+	id, action := parts[0], parts[1]
+
+	d, ok := s.store.Get(id)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "deployment not found"})
+		return
+	}
+
+	switch action {
+	case "context":
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		s.handleBuildContext(w, r, d)
+	case "cancel":
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		if !s.authorize(w, r, actionDeploy, d.Namespace) {
+			return
+		}
+		s.handleCancel(w, d.ID)
+	case "logs":
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		if !s.authorize(w, r, actionLogs, d.Namespace) {
+			return
+		}
+		s.handleLogs(w, r, d)
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown deployment action: " + action})
+	}
+}
+
+// handleBuildContext serves the extracted source as a tar.gz. Builders that
+// run outside this process (the kaniko Job) download their context here
+// with the one-time token issued for the build; every other caller,
+// including authenticated users, is rejected.
+func (s *Server) handleBuildContext(w http.ResponseWriter, r *http.Request, d *Deployment) {
+	token, _ := bearerToken(r)
+	if !s.contextTokens.redeem(d.ID, token) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "build context is only served to the deployment's build job"})
+		return
+	}
+	if d.ExtractedPath == "" {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "deployment has no build context"})
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+d.ID+`-context.tar.gz"`)
+	if err := writeContextTarGz(w, d.ExtractedPath); err != nil {
+		log.Printf("failed to stream build context for %s: %v", d.ID, err)
+	}
+}
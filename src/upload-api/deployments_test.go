@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuildContextRequiresOneTimeToken(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "Dockerfile"), []byte("FROM scratch\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{store: newMemoryStore(), contextTokens: newContextTokens()}
+	if err := s.store.Put(&Deployment{ID: "dep-000001", Namespace: "demo-apps", ExtractedPath: dir}); err != nil {
+		t.Fatal(err)
+	}
+	fetch := func(token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/deployments/dep-000001/context", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		s.handleDeploymentRoutes(rec, req)
+		return rec.Code
+	}
+
+	if code := fetch(""); code != http.StatusForbidden {
+		t.Fatalf("anonymous fetch = %d, want 403", code)
+	}
+	token := s.contextTokens.issue("dep-000001")
+	if code := fetch("not-the-token"); code != http.StatusForbidden {
+		t.Fatalf("fetch with wrong token = %d, want 403", code)
+	}
+	if code := fetch(token); code != http.StatusOK {
+		t.Fatalf("fetch with build token = %d, want 200", code)
+	}
+	if code := fetch(token); code != http.StatusForbidden {
+		t.Fatalf("second fetch with build token = %d, want 403", code)
+	}
+
+	token = s.contextTokens.issue("dep-000001")
+	s.contextTokens.revoke("dep-000001")
+	if code := fetch(token); code != http.StatusForbidden {
+		t.Fatalf("fetch with revoked token = %d, want 403", code)
+	}
+}
+
+func TestIsBuildContextPath(t *testing.T) {
+	for path, want := range map[string]bool{
+		"/deployments/dep-000001/context":   true,
+		"/deployments/dep-000001/logs":      false,
+		"/deployments//context":             false,
+		"/deployments/a/b/context":          false,
+		"/status/dep-000001/context":        false,
+		"/deployments/dep-000001/context/x": false,
+	} {
+		if got := isBuildContextPath(path); got != want {
+			t.Errorf("isBuildContextPath(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// EnvVar mirrors the Kubernetes container env entry. Values from Secrets
+// are only ever referenced, so Deployment JSON never carries them.
+type EnvVar struct {
+	Name      string        `json:"name"`
+	Value     string        `json:"value,omitempty"`
+	ValueFrom *EnvVarSource `json:"valueFrom,omitempty"`
+}
+
+type EnvVarSource struct {
+	ConfigMapKeyRef *KeySelector `json:"configMapKeyRef,omitempty"`
+	SecretKeyRef    *KeySelector `json:"secretKeyRef,omitempty"`
+}
+
+type KeySelector struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+// EnvFromSource mirrors the Kubernetes envFrom entry: every key of a
+// ConfigMap or Secret becomes a variable.
+type EnvFromSource struct {
+	ConfigMapRef *NameRef `json:"configMapRef,omitempty"`
+	SecretRef    *NameRef `json:"secretRef,omitempty"`
+}
+
+type NameRef struct {
+	Name string `json:"name"`
+}
+
+// RuntimeEnv is the environment requested for an upload. SecretValues holds
+// inline secret values on their way into a generated Secret; it is never
+// stored or logged.
+type RuntimeEnv struct {
+	Env          []EnvVar
+	EnvFrom      []EnvFromSource
+	SecretValues map[string]string
+}
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+// reservedEnv are set by Knative itself and rejected in a revision.
+var reservedEnv = map[string]bool{"PORT": true, "K_SERVICE": true, "K_CONFIGURATION": true, "K_REVISION": true}
+
+// parseEnvForm reads the env form fields of POST /deploy:
+//
+//	env=KEY=value                   plain value
+//	secretEnv=KEY=value             value stored in a generated Secret
+//	envConfigMap=KEY=configmap/key  one ConfigMap key
+//	envConfigMap=configmap          every key of a ConfigMap
+//	envSecret=KEY=secret/key        one Secret key
+//	envSecret=secret                every key of a Secret
+//
+// Inline secret values are returned in SecretValues; the caller stores
+// them and points the matching variables at the Secret it created.
+func parseEnvForm(form url.Values) (RuntimeEnv, error) {
+	var out RuntimeEnv
+	seen := map[string]bool{}
+	add := func(v EnvVar) error {
+		if err := checkEnvName(v.Name); err != nil {
+			return err
+		}
+		if seen[v.Name] {
+			return fmt.Errorf("environment variable %s is set more than once", v.Name)
+		}
+		seen[v.Name] = true
+		out.Env = append(out.Env, v)
+		return nil
+	}
+
+	for _, raw := range form["env"] {
+		name, value, ok := strings.Cut(raw, "=")
+		if !ok {
+			return out, fmt.Errorf("env must be KEY=value, got %q", raw)
+		}
+		if err := add(EnvVar{Name: strings.TrimSpace(name), Value: value}); err != nil {
+			return out, err
+		}
+	}
+	for _, raw := range form["secretEnv"] {
+		name, value, ok := strings.Cut(raw, "=")
+		if !ok {
+			// Do not echo raw: it may be a secret value.
+			return out, fmt.Errorf("secretEnv must be KEY=value")
+		}
+		name = strings.TrimSpace(name)
+		if err := add(EnvVar{Name: name}); err != nil {
+			return out, err
+		}
+		if out.SecretValues == nil {
+			out.SecretValues = map[string]string{}
+		}
+		out.SecretValues[name] = value
+	}
+	for _, field := range []string{"envConfigMap", "envSecret"} {
+		for _, raw := range form[field] {
+			raw = strings.TrimSpace(raw)
+			name, ref, isKey := strings.Cut(raw, "=")
+			if !isKey {
+				if !isDNSLabel(raw) {
+					return out, fmt.Errorf("%s must be a resource name or KEY=name/key, got %q", field, raw)
+				}
+				if field == "envConfigMap" {
+					out.EnvFrom = append(out.EnvFrom, EnvFromSource{ConfigMapRef: &NameRef{Name: raw}})
+				} else {
+					out.EnvFrom = append(out.EnvFrom, EnvFromSource{SecretRef: &NameRef{Name: raw}})
+				}
+				continue
+			}
+			resource, key, ok := strings.Cut(ref, "/")
+			if !ok || !isDNSLabel(resource) || key == "" {
+				return out, fmt.Errorf("%s must be KEY=name/key, got %q", field, raw)
+			}
+			selector := &KeySelector{Name: resource, Key: key}
+			source := &EnvVarSource{ConfigMapKeyRef: selector}
+			if field == "envSecret" {
+				source = &EnvVarSource{SecretKeyRef: selector}
+			}
+			if err := add(EnvVar{Name: strings.TrimSpace(name), ValueFrom: source}); err != nil {
+				return out, err
+			}
+		}
+	}
+	return out, nil
+}
+
+// bindSecretValues points the variables in env holding inline secret
+// values at keys of the generated Secret secretName.
+func bindSecretValues(env []EnvVar, values map[string]string, secretName string) {
+	for i, v := range env {
+		if _, ok := values[v.Name]; ok {
+			env[i].ValueFrom = &EnvVarSource{SecretKeyRef: &KeySelector{Name: secretName, Key: v.Name}}
+		}
+	}
+}
+
+// mergeEnv returns base with the variables of override replacing those of
+// the same name; new names are appended in override order.
+func mergeEnv(base, override []EnvVar) []EnvVar {
+	if len(base) == 0 {
+		return override
+	}
+	out := append([]EnvVar(nil), base...)
+	index := map[string]int{}
+	for i, v := range out {
+		index[v.Name] = i
+	}
+	for _, v := range override {
+		if i, ok := index[v.Name]; ok {
+			out[i] = v
+		} else {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// mergeEnvFrom returns base followed by the sources of extra it lacks.
+func mergeEnvFrom(base, extra []EnvFromSource) []EnvFromSource {
+	out := append([]EnvFromSource(nil), base...)
+	for _, e := range extra {
+		dup := false
+		for _, b := range base {
+			if b.key() == e.key() {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+func (e EnvFromSource) key() string {
+	if e.ConfigMapRef != nil {
+		return "configmap/" + e.ConfigMapRef.Name
+	}
+	if e.SecretRef != nil {
+		return "secret/" + e.SecretRef.Name
+	}
+	return ""
+}
+
+// checkEnvName reports why name cannot be used as a variable name.
+func checkEnvName(name string) error {
+	if !envNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid environment variable name %q", name)
+	}
+	if reservedEnv[name] {
+		return fmt.Errorf("environment variable %s is set by Knative and cannot be overridden", name)
+	}
+	return nil
+}
+
+// validate checks a variable declared outside the form fields, such as in
+// an app manifest.
+func (v EnvVar) validate() error {
+	if err := checkEnvName(v.Name); err != nil {
+		return err
+	}
+	if v.ValueFrom == nil {
+		return nil
+	}
+	if v.Value != "" {
+		return fmt.Errorf("%s: set value or valueFrom, not both", v.Name)
+	}
+	sel := v.ValueFrom.ConfigMapKeyRef
+	if (sel == nil) == (v.ValueFrom.SecretKeyRef == nil) {
+		return fmt.Errorf("%s: valueFrom needs exactly one of configMapKeyRef or secretKeyRef", v.Name)
+	}
+	if sel == nil {
+		sel = v.ValueFrom.SecretKeyRef
+	}
+	if !isDNSLabel(sel.Name) || sel.Key == "" {
+		return fmt.Errorf("%s: valueFrom needs a valid name and key", v.Name)
+	}
+	return nil
+}
+
+func (e EnvFromSource) validate() error {
+	if (e.ConfigMapRef == nil) == (e.SecretRef == nil) {
+		return fmt.Errorf("envFrom entries need exactly one of configMapRef or secretRef")
+	}
+	ref := e.ConfigMapRef
+	if ref == nil {
+		ref = e.SecretRef
+	}
+	if !isDNSLabel(ref.Name) {
+		return fmt.Errorf("envFrom: invalid name %q", ref.Name)
+	}
+	return nil
+}
+
+// envSecretName names the Secret holding a deployment's inline secret
+// values. Each deployment gets its own, so rollbacks keep their values.
+func envSecretName(service, deploymentID string) string {
+	return service + "-" + deploymentID + "-env"
+}
+
+func isDNSLabel(v string) bool {
+	return v != "" && len(v) <= 63 && sanitizeK8sName(v) == v
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// secretRecorder keeps the Secrets written through it, or fails with err.
+type secretRecorder struct {
+	*mockServices
+	err error
+
+	mu      sync.Mutex
+	secrets map[string]map[string]string
+}
+
+func (s *secretRecorder) ApplySecret(_ context.Context, namespace, name string, data map[string]string) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.secrets == nil {
+		s.secrets = map[string]map[string]string{}
+	}
+	s.secrets[namespace+"/"+name] = data
+	return nil
+}
+
+func configMapKey(name, key string) *EnvVarSource {
+	return &EnvVarSource{ConfigMapKeyRef: &KeySelector{Name: name, Key: key}}
+}
+
+func secretKey(name, key string) *EnvVarSource {
+	return &EnvVarSource{SecretKeyRef: &KeySelector{Name: name, Key: key}}
+}
+
+func TestParseEnvForm(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		form    url.Values
+		want    RuntimeEnv
+		wantErr string
+	}{
+		{name: "empty", form: url.Values{}},
+		{
+			name: "plain values",
+			form: url.Values{"env": {"GREETING=hello=world", " LOG_LEVEL =debug", "EMPTY="}},
+			want: RuntimeEnv{Env: []EnvVar{{Name: "GREETING", Value: "hello=world"}, {Name: "LOG_LEVEL", Value: "debug"}, {Name: "EMPTY"}}},
+		},
+		{
+			name: "inline secret",
+			form: url.Values{"secretEnv": {"API_KEY=s3cret"}},
+			want: RuntimeEnv{Env: []EnvVar{{Name: "API_KEY"}}, SecretValues: map[string]string{"API_KEY": "s3cret"}},
+		},
+		{
+			name: "references",
+			form: url.Values{
+				"envConfigMap": {"LEVEL=app-config/log.level", "shared-config"},
+				"envSecret":    {"DB_PASSWORD=db/password", " db-creds "},
+			},
+			want: RuntimeEnv{
+				Env: []EnvVar{
+					{Name: "LEVEL", ValueFrom: configMapKey("app-config", "log.level")},
+					{Name: "DB_PASSWORD", ValueFrom: secretKey("db", "password")},
+				},
+				EnvFrom: []EnvFromSource{
+					{ConfigMapRef: &NameRef{Name: "shared-config"}},
+					{SecretRef: &NameRef{Name: "db-creds"}},
+				},
+			},
+		},
+
+		{name: "no separator", form: url.Values{"env": {"GREETING"}}, wantErr: `env must be KEY=value, got "GREETING"`},
+		{name: "reserved name", form: url.Values{"env": {"PORT=9090"}}, wantErr: "PORT is set by Knative and cannot be overridden"},
+		{name: "reserved secret name", form: url.Values{"secretEnv": {"K_SERVICE=x"}}, wantErr: "K_SERVICE is set by Knative"},
+		{name: "invalid name", form: url.Values{"env": {"1ST=x"}}, wantErr: `invalid environment variable name "1ST"`},
+		{name: "empty name", form: url.Values{"env": {"=x"}}, wantErr: `invalid environment variable name ""`},
+		{name: "set twice", form: url.Values{"env": {"TOKEN=a"}, "secretEnv": {"TOKEN=b"}}, wantErr: "TOKEN is set more than once"},
+		{name: "reference set twice", form: url.Values{"env": {"LEVEL=info"}, "envConfigMap": {"LEVEL=app-config/level"}}, wantErr: "LEVEL is set more than once"},
+		{name: "invalid resource name", form: url.Values{"envConfigMap": {"App_Config"}}, wantErr: "envConfigMap must be a resource name or KEY=name/key"},
+		{name: "reference without key", form: url.Values{"envSecret": {"DB_PASSWORD=db"}}, wantErr: "envSecret must be KEY=name/key"},
+		{name: "reference with empty key", form: url.Values{"envSecret": {"DB_PASSWORD=db/"}}, wantErr: "envSecret must be KEY=name/key"},
+		{name: "invalid referenced name", form: url.Values{"envConfigMap": {"LEVEL=App/level"}}, wantErr: "envConfigMap must be KEY=name/key"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseEnvForm(tc.form)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("parseEnvForm = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseEnvFormDoesNotEchoSecretValues(t *testing.T) {
+	_, err := parseEnvForm(url.Values{"secretEnv": {"hunter2"}})
+	if err == nil || strings.Contains(err.Error(), "hunter2") {
+		t.Fatalf("error = %v, want one without the value", err)
+	}
+}
+
+func TestDeployEnv(t *testing.T) {
+	s := newTestServer(t)
+	secrets := &secretRecorder{mockServices: s.services.(*mockServices)}
+	s.services = secrets
+	form := url.Values{
+		"service":      {"hello"},
+		"namespace":    {"demo-apps"},
+		"env":          {"GREETING=hello"},
+		"secretEnv":    {"API_KEY=s3cret"},
+		"envConfigMap": {"LEVEL=app-config/level", "shared-config"},
+		"envSecret":    {"DB_PASSWORD=db/password"},
+	}
+	code, out := deploy(t, s, deployFormRequest(t, form, "app.tar.gz", tarGz(t, map[string]string{"Dockerfile": testDockerfile})))
+	if code != http.StatusAccepted {
+		t.Fatalf("status = %d (%v), want 202", code, out)
+	}
+	id := out["id"].(string)
+	secretName := "hello-" + id + "-env"
+
+	if want := map[string]map[string]string{"demo-apps/" + secretName: {"API_KEY": "s3cret"}}; !reflect.DeepEqual(secrets.secrets, want) {
+		t.Fatalf("secrets = %v, want %v", secrets.secrets, want)
+	}
+	d, _ := s.store.Get(id)
+	wantEnv := []EnvVar{
+		{Name: "GREETING", Value: "hello"},
+		{Name: "API_KEY", ValueFrom: secretKey(secretName, "API_KEY")},
+		{Name: "LEVEL", ValueFrom: configMapKey("app-config", "level")},
+		{Name: "DB_PASSWORD", ValueFrom: secretKey("db", "password")},
+	}
+	if !reflect.DeepEqual(d.Env, wantEnv) || !reflect.DeepEqual(d.EnvFrom, []EnvFromSource{{ConfigMapRef: &NameRef{Name: "shared-config"}}}) {
+		t.Fatalf("env = %+v envFrom = %+v", d.Env, d.EnvFrom)
+	}
+	if _, body := get(t, s.handleStatusByID, "/status/"+id, nil); strings.Contains(string(body), "s3cret") {
+		t.Fatalf("status echoes the secret value: %s", body)
+	}
+
+	// The revision references the values; it never carries the secret.
+	raw, err := json.Marshal(revisionTemplate(revisionSpecFor(d), false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var template struct {
+		Spec struct {
+			Containers []struct {
+				Env     []EnvVar        `json:"env"`
+				EnvFrom []EnvFromSource `json:"envFrom"`
+			} `json:"containers"`
+		} `json:"spec"`
+	}
+	if err := json.Unmarshal(raw, &template); err != nil {
+		t.Fatal(err)
+	}
+	container := template.Spec.Containers[0]
+	if !reflect.DeepEqual(container.Env, wantEnv) || !reflect.DeepEqual(container.EnvFrom, d.EnvFrom) {
+		t.Fatalf("ksvc container env = %s", raw)
+	}
+	if strings.Contains(string(raw), "s3cret") {
+		t.Fatalf("ksvc carries the secret value: %s", raw)
+	}
+}
+
+func TestDeployRejectsInvalidEnv(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		form    url.Values
+		wantErr string
+	}{
+		{name: "reserved name", form: url.Values{"env": {"K_REVISION=x"}}, wantErr: "K_REVISION is set by Knative"},
+		{name: "invalid name", form: url.Values{"secretEnv": {"API KEY=s3cret"}}, wantErr: `invalid environment variable name "API KEY"`},
+		{name: "bad reference", form: url.Values{"envSecret": {"DB_PASSWORD=db"}}, wantErr: "envSecret must be KEY=name/key"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t)
+			secrets := &secretRecorder{mockServices: s.services.(*mockServices)}
+			s.services = secrets
+			code, out := deploy(t, s, deployFormRequest(t, tc.form, "app.tar.gz", tarGz(t, map[string]string{"Dockerfile": testDockerfile})))
+			if code != http.StatusBadRequest || !strings.Contains(out["error"].(string), tc.wantErr) {
+				t.Fatalf("deploy = %d %v, want 400 %q", code, out, tc.wantErr)
+			}
+			if len(secrets.secrets) != 0 || len(s.store.List()) != 0 {
+				t.Fatalf("rejected upload stored secrets %v or records", secrets.secrets)
+			}
+		})
+	}
+}
+
+func TestDeployEnvIgnoresQueryString(t *testing.T) {
+	s := newTestServer(t)
+	r := deployRequest(t, nil, "app.tar.gz", tarGz(t, map[string]string{"Dockerfile": testDockerfile}))
+	r.URL.RawQuery = url.Values{"secretEnv": {"API_KEY=s3cret"}, "env": {"GREETING=hi"}}.Encode()
+	code, out := deploy(t, s, r)
+	if code != http.StatusAccepted {
+		t.Fatalf("status = %d (%v), want 202", code, out)
+	}
+	if d, _ := s.store.Get(out["id"].(string)); len(d.Env) != 0 {
+		t.Fatalf("env from the query string = %+v", d.Env)
+	}
+}
+
+func TestDeploySecretEnvFailure(t *testing.T) {
+	s := newTestServer(t)
+	s.services = &secretRecorder{mockServices: s.services.(*mockServices), err: errors.New("forbidden")}
+	form := url.Values{"secretEnv": {"API_KEY=s3cret"}}
+	code, out := deploy(t, s, deployFormRequest(t, form, "app.tar.gz", tarGz(t, map[string]string{"Dockerfile": testDockerfile})))
+	if code != http.StatusInternalServerError || out["error"] != "failed to store secret env: forbidden" {
+		t.Fatalf("deploy = %d %v, want 500", code, out)
+	}
+	if list := s.store.List(); len(list) != 0 {
+		t.Fatalf("failed upload recorded %d deployments", len(list))
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// Lifecycle event types, derived from deployment status transitions.
+const (
+	eventAccepted      = "deployment.accepted"
+	eventBuildStarted  = "deployment.build_started"
+	eventBuildFailed   = "deployment.build_failed"
+	eventDeployStarted = "deployment.deploy_started"
+	eventDeployFailed  = "deployment.deploy_failed"
+	eventReady         = "deployment.ready"
+	eventRolledBack    = "deployment.rolled_back"
+	eventDeleted       = "deployment.deleted"
+	eventCancelled     = "deployment.cancelled"
+	eventTimedOut      = "deployment.timed_out"
+)
+
+// DeploymentEvent announces one lifecycle change of a deployment.
+type DeploymentEvent struct {
+	ID             string      `json:"id"`
+	Type           string      `json:"type"`
+	OccurredAt     time.Time   `json:"occurredAt"`
+	PreviousStatus string      `json:"previousStatus,omitempty"`
+	Deployment     *Deployment `json:"deployment"`
+}
+
+// eventSink receives lifecycle events. publish must not block on delivery.
+type eventSink interface {
+	publish(e DeploymentEvent)
+}
+
+// lifecycleEvent returns the event announced by a move from status from to
+// d.Status, or "" if the move is not announced. from is empty for a new
+// record.
+func lifecycleEvent(from string, d *Deployment) string {
+	if from == d.Status {
+		return ""
+	}
+	switch d.Status {
+	case statusQueued:
+		return eventAccepted
+	case statusBuild:
+		return eventBuildStarted
+	case statusDeploy:
+		if from == "" {
+			return eventAccepted
+		}
+		return eventDeployStarted
+	case statusReady:
+		switch d.Kind {
+		case kindRollback:
+			return eventRolledBack
+		case kindDelete:
+			return eventDeleted
+		}
+		return eventReady
+	case statusFailed:
+		if from == statusQueued || from == statusBuild {
+			return eventBuildFailed
+		}
+		return eventDeployFailed
+	case statusCancelled:
+		return eventCancelled
+	case statusTimedOut:
+		return eventTimedOut
+	}
+	return ""
+}
+
+// announce publishes the event for d's move from status from to every sink.
+func (s *Server) announce(from string, d *Deployment) {
+	eventType := lifecycleEvent(from, d)
+	if eventType == "" || len(s.sinks) == 0 {
+		return
+	}
+	snapshot := d.clone()
+	// Output can be megabytes; consumers fetch it from /deployments/{id}/logs.
+	snapshot.Output = ""
+	e := DeploymentEvent{
+		ID:             newEventID(),
+		Type:           eventType,
+		OccurredAt:     time.Now().UTC(),
+		PreviousStatus: from,
+		Deployment:     snapshot,
+	}
+	for _, sink := range s.sinks {
+		sink.publish(e)
+	}
+}
+
+func newEventID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return "evt-" + hex.EncodeToString(b[:])
+}
@@ -0,0 +1,667 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Bundle formats, detected from the content rather than the file name.
+const (
+	formatZip        = "zip"
+	formatTar        = "tar"
+	formatTarGzip    = "tar+gzip"
+	formatTarZstd    = "tar+zstd"
+	formatTarXz      = "tar+xz"
+	formatTarBzip2   = "tar+bzip2"
+	formatDockerfile = "dockerfile"
+)
+
+// sniffLen is how much of a bundle detectBundleFormat reads: a tar header,
+// and room for the comments and ARGs above a Dockerfile's FROM.
+const sniffLen = 8 << 10
+
+// zstdMaxWindow bounds the memory a zstd stream may make the decoder use;
+// it allows archives made with zstd --long.
+const zstdMaxWindow = 128 << 20
+
+var errUnsupportedBundle = errors.New("bundle must be a zip or tar archive (plain, gzip, zstd, xz or bzip2 compressed) or a Dockerfile")
+
+var compressionMagic = []struct {
+	magic  []byte
+	format string
+}{
+	{[]byte{0x1f, 0x8b}, formatTarGzip},
+	{[]byte{0x28, 0xb5, 0x2f, 0xfd}, formatTarZstd},
+	{[]byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, formatTarXz},
+	{[]byte("BZh"), formatTarBzip2},
+}
+
+// detectBundleFormat identifies a bundle by its magic bytes. Compressed
+// bundles are assumed to hold a tar archive; that is checked when they are
+// unpacked.
+func detectBundleFormat(r io.ReaderAt) (string, error) {
+	head := make([]byte, sniffLen)
+	n, err := r.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	head = head[:n]
+	if bytes.HasPrefix(head, []byte("PK\x03\x04")) || bytes.HasPrefix(head, []byte("PK\x05\x06")) {
+		return formatZip, nil
+	}
+	for _, c := range compressionMagic {
+		if bytes.HasPrefix(head, c.magic) {
+			return c.format, nil
+		}
+	}
+	if isTarHeader(head) {
+		return formatTar, nil
+	}
+	if isDockerfile(head) {
+		return formatDockerfile, nil
+	}
+	return "", errUnsupportedBundle
+}
+
+// isTarHeader reports whether b starts with a tar header: one carrying the
+// ustar magic or, for old v7 archives, a valid header checksum.
+func isTarHeader(b []byte) bool {
+	if len(b) < 512 || b[0] == 0 {
+		return false
+	}
+	if bytes.Equal(b[257:262], []byte("ustar")) {
+		return true
+	}
+	stored, err := strconv.ParseUint(strings.Trim(string(b[148:156]), " \x00"), 8, 64)
+	if err != nil {
+		return false
+	}
+	var sum uint64
+	for i, c := range b[:512] {
+		if i >= 148 && i < 156 {
+			c = ' '
+		}
+		sum += uint64(c)
+	}
+	return sum == stored
+}
+
+// isDockerfile reports whether head is text whose first instruction is
+// FROM, allowing comments, parser directives and ARGs before it.
+func isDockerfile(head []byte) bool {
+	if bytes.IndexByte(head, 0) >= 0 {
+		return false
+	}
+	for _, line := range strings.Split(string(head), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "FROM":
+			return true
+		case "ARG":
+			continue
+		}
+		return false
+	}
+	return false
+}
+
+// Codes reported when a bundle breaks an extraction limit.
+const (
+	limitBundleSize = "bundle_too_large"  // EXTRACT_MAX_BYTES
+	limitFileSize   = "file_too_large"    // EXTRACT_MAX_FILE_BYTES
+	limitEntries    = "too_many_entries"  // EXTRACT_MAX_ENTRIES
+	limitDepth      = "path_too_deep"     // EXTRACT_MAX_DEPTH
+	limitRatio      = "compression_ratio" // EXTRACT_MAX_RATIO
+)
+
+// ratioFloor is how much a bundle may unpack to before the compression
+// ratio is checked, so small, highly compressible bundles are never refused.
+const ratioFloor = 1 << 20
+
+// extractLimits bound what unpacking one bundle may write, so a small
+// archive cannot fill the disk. Zero disables a limit.
+type extractLimits struct {
+	maxBytes     int64 // bytes written, summed over all files
+	maxFileBytes int64 // bytes of any one file
+	maxEntries   int   // archive entries, directories included
+	maxDepth     int   // path components of any entry
+	maxRatio     int64 // bytes written per byte of archive
+}
+
+func extractLimitsFromEnv() extractLimits {
+	return extractLimits{
+		maxBytes:     envBytes("EXTRACT_MAX_BYTES", "512Mi"),
+		maxFileBytes: envBytes("EXTRACT_MAX_FILE_BYTES", "100Mi"),
+		maxEntries:   envInt("EXTRACT_MAX_ENTRIES", 10000),
+		maxDepth:     envInt("EXTRACT_MAX_DEPTH", 32),
+		maxRatio:     int64(envInt("EXTRACT_MAX_RATIO", 100)),
+	}
+}
+
+// envBytes reads a size such as 512Mi; "0" disables the limit.
+func envBytes(key, fallback string) int64 {
+	raw := envOr(key, fallback)
+	if raw == "0" {
+		return 0
+	}
+	n, err := memoryBytes(raw)
+	if err != nil {
+		log.Fatalf("%s must be a size such as %s, or 0, got %q", key, fallback, raw)
+	}
+	return n
+}
+
+// extractLimitError stops extraction of a bundle that breaks a limit. code
+// names the limit.
+type extractLimitError struct {
+	code string
+	msg  string
+}
+
+func (e *extractLimitError) Error() string { return e.msg }
+
+// maxSkipped caps how many skipped entries a deployment reports.
+const maxSkipped = 100
+
+// SkippedEntry is an archive entry that was not unpacked.
+type SkippedEntry struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"` // symlink, hardlink, fifo, char-device, block-device, ...
+	Reason string `json:"reason"`
+}
+
+// errLeavesBundle reports a link that resolves outside the extraction root.
+var errLeavesBundle = errors.New("resolves outside the bundle")
+
+// extractBundle unpacks the bundle into outDir within limits, giving up once
+// ctx is done. It returns the entries it skipped: special files, and links
+// that would point outside outDir.
+func extractBundle(ctx context.Context, bundlePath, outDir string, limits extractLimits) ([]SkippedEntry, error) {
+	st, err := os.Stat(bundlePath)
+	if err != nil {
+		return nil, err
+	}
+	x := &extractor{ctx: ctx, outDir: outDir, limits: limits, archiveSize: st.Size()}
+	f, err := os.Open(bundlePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := x.unpack(f); err != nil {
+		return nil, err
+	}
+	if err := x.createSymlinks(); err != nil {
+		return nil, err
+	}
+	return x.skipped, nil
+}
+
+// extractor unpacks one bundle and keeps count of what it wrote.
+type extractor struct {
+	ctx         context.Context
+	outDir      string
+	limits      extractLimits
+	archiveSize int64
+
+	entries int
+	written int64
+	// symlinks are created once everything else is unpacked, so no file
+	// is ever written through one.
+	symlinks []pendingSymlink
+	skipped  []SkippedEntry
+}
+
+type pendingSymlink struct {
+	name   string // entry name
+	target string // link target, relative to the link's directory
+}
+
+func (x *extractor) unpack(f *os.File) error {
+	format, err := detectBundleFormat(f)
+	if err != nil {
+		return err
+	}
+	var r io.Reader
+	switch format {
+	case formatZip:
+		return x.extractZip(f)
+	case formatDockerfile:
+		return x.extractDockerfile(f)
+	case formatTar:
+		return x.extractTar(f)
+	case formatTarGzip:
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		r = gr
+	case formatTarZstd:
+		zr, err := zstd.NewReader(f, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(zstdMaxWindow))
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	case formatTarXz:
+		xr, err := xz.NewReader(f)
+		if err != nil {
+			return err
+		}
+		r = xr
+	case formatTarBzip2:
+		r = bzip2.NewReader(f)
+	}
+	br := bufio.NewReader(r)
+	if head, _ := br.Peek(512); !isTarHeader(head) {
+		return fmt.Errorf("%s stream does not contain a tar archive", strings.TrimPrefix(format, "tar+"))
+	}
+	return x.extractTar(br)
+}
+
+func (x *extractor) extractZip(r io.ReaderAt) error {
+	zr, err := zip.NewReader(r, x.archiveSize)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range zr.File {
+		target, err := x.entry(f.Name)
+		if err != nil {
+			return err
+		}
+		mode := f.Mode()
+		switch {
+		case mode.IsDir():
+			if err := os.MkdirAll(target, 0o755); err != nil {
+				return err
+			}
+		case mode&os.ModeSymlink != 0:
+			// The entry's content is the link target.
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			link, err := io.ReadAll(io.LimitReader(contextReader{x.ctx, rc}, 4096))
+			rc.Close()
+			if err != nil {
+				return err
+			}
+			x.symlink(f.Name, string(link))
+		case mode.IsRegular():
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			err = x.writeFile(f.Name, target, rc, int64(f.UncompressedSize64), mode)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		default:
+			x.skip(f.Name, modeType(mode), "unsupported entry type")
+		}
+	}
+	return nil
+}
+
+func (x *extractor) extractTar(r io.Reader) error {
+	tr := tar.NewReader(contextReader{x.ctx, r})
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+
+		target, err := x.entry(hdr.Name)
+		if err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0o755); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeGNUSparse:
+			if err := x.writeFile(hdr.Name, target, tr, hdr.Size, hdr.FileInfo().Mode()); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			x.symlink(hdr.Name, hdr.Linkname)
+		case tar.TypeLink:
+			if err := x.hardlink(hdr.Name, target, hdr.Linkname); err != nil {
+				return err
+			}
+		default:
+			x.skip(hdr.Name, modeType(hdr.FileInfo().Mode()), "unsupported entry type")
+		}
+	}
+	return nil
+}
+
+// extractDockerfile unpacks a bundle that is a bare Dockerfile, which then
+// builds with an otherwise empty context.
+func (x *extractor) extractDockerfile(f *os.File) error {
+	target, err := x.entry("Dockerfile")
+	if err != nil {
+		return err
+	}
+	return x.writeFile("Dockerfile", target, f, x.archiveSize, 0o644)
+}
+
+func (x *extractor) skip(name, typ, reason string) {
+	if len(x.skipped) < maxSkipped {
+		x.skipped = append(x.skipped, SkippedEntry{Name: name, Type: typ, Reason: reason})
+	}
+}
+
+// modeType names the kind of a file that is not unpacked.
+func modeType(mode os.FileMode) string {
+	switch {
+	case mode&os.ModeSymlink != 0:
+		return "symlink"
+	case mode&os.ModeNamedPipe != 0:
+		return "fifo"
+	case mode&os.ModeCharDevice != 0:
+		return "char-device"
+	case mode&os.ModeDevice != 0:
+		return "block-device"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	}
+	return "other"
+}
+
+// fileMode is the mode a regular file is unpacked with: 0755 if the archive
+// marks it executable for anyone, 0644 otherwise. Other bits are dropped.
+func fileMode(mode os.FileMode) os.FileMode {
+	if mode&0o111 != 0 {
+		return 0o755
+	}
+	return 0o644
+}
+
+// entry counts one archive entry, checks its depth and returns the path it
+// unpacks to.
+func (x *extractor) entry(name string) (string, error) {
+	if err := x.ctx.Err(); err != nil {
+		return "", err
+	}
+	x.entries++
+	if max := x.limits.maxEntries; max > 0 && x.entries > max {
+		return "", &extractLimitError{limitEntries, fmt.Sprintf("bundle has more than %d entries", max)}
+	}
+	if max := x.limits.maxDepth; max > 0 {
+		if depth := pathDepth(name); depth > max {
+			return "", &extractLimitError{limitDepth, fmt.Sprintf("%s is nested %d levels deep; the limit is %d", name, depth, max)}
+		}
+	}
+	return safeJoin(x.outDir, name)
+}
+
+// writeFile copies one file out of the archive. size is the size the
+// archive declares, used to refuse an oversized file before writing it; the
+// bytes actually written are counted too, since headers can lie.
+func (x *extractor) writeFile(name, target string, r io.Reader, size int64, mode os.FileMode) error {
+	if err := x.checkFile(name, size); err != nil {
+		return err
+	}
+	if err := x.prepare(target); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fileMode(mode))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(&limitedFile{x: x, name: name, w: out}, contextReader{x.ctx, r})
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// prepare creates the parent of target and removes a file an earlier entry
+// left there, so a later entry replaces it instead of writing through a
+// hardlink.
+func (x *extractor) prepare(target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	if st, err := os.Lstat(target); err == nil && !st.IsDir() {
+		return os.Remove(target)
+	}
+	return nil
+}
+
+// hardlink links target to linkname, a file unpacked earlier. Tar names
+// hardlink targets relative to the archive root.
+func (x *extractor) hardlink(name, target, linkname string) error {
+	if filepath.IsAbs(linkname) {
+		x.skip(name, "hardlink", fmt.Sprintf("target %s %v", linkname, errLeavesBundle))
+		return nil
+	}
+	src, err := safeJoin(x.outDir, linkname)
+	if err != nil {
+		x.skip(name, "hardlink", fmt.Sprintf("target %s %v", linkname, errLeavesBundle))
+		return nil
+	}
+	if st, err := os.Lstat(src); err != nil || !st.Mode().IsRegular() {
+		x.skip(name, "hardlink", fmt.Sprintf("target %s is not a file unpacked before it", linkname))
+		return nil
+	}
+	if src == target {
+		return nil
+	}
+	if err := x.prepare(target); err != nil {
+		return err
+	}
+	return os.Link(src, target)
+}
+
+// symlink queues a symbolic link for createSymlinks. Absolute targets and
+// targets that plainly climb out of the bundle are skipped right away.
+func (x *extractor) symlink(name, target string) {
+	if target == "" || filepath.IsAbs(target) || strings.HasPrefix(filepath.ToSlash(target), "/") {
+		x.skip(name, "symlink", fmt.Sprintf("target %q is not a relative path", target))
+		return
+	}
+	if _, err := safeJoin(x.outDir, filepath.Join(filepath.Dir(filepath.Clean(name)), target)); err != nil {
+		x.skip(name, "symlink", fmt.Sprintf("target %s %v", target, errLeavesBundle))
+		return
+	}
+	x.symlinks = append(x.symlinks, pendingSymlink{name: name, target: target})
+}
+
+// createSymlinks creates the queued links whose targets resolve inside the
+// bundle, following the links created before them. A link created later can
+// redirect an earlier one, so once all exist each is checked again and
+// removed if it now leads outside.
+func (x *extractor) createSymlinks() error {
+	var created []pendingSymlink
+	for _, l := range x.symlinks {
+		if err := x.ctx.Err(); err != nil {
+			return err
+		}
+		clean := filepath.Clean(l.name)
+		parent, err := resolveIn(x.outDir, filepath.Dir(clean))
+		if err != nil {
+			x.skip(l.name, "symlink", fmt.Sprintf("parent directory %v", err))
+			continue
+		}
+		path := filepath.Join(parent, filepath.Base(clean))
+		if _, err := os.Lstat(path); err == nil {
+			x.skip(l.name, "symlink", "another entry already exists at this path")
+			continue
+		}
+		rel, err := filepath.Rel(x.outDir, parent)
+		if err != nil {
+			return err
+		}
+		if _, err := resolveIn(x.outDir, rel+"/"+l.target); err != nil {
+			x.skip(l.name, "symlink", fmt.Sprintf("target %s %v", l.target, err))
+			continue
+		}
+		if err := os.MkdirAll(parent, 0o755); err != nil {
+			return err
+		}
+		if err := os.Symlink(l.target, path); err != nil {
+			return err
+		}
+		l.name, _ = filepath.Rel(x.outDir, path)
+		created = append(created, l)
+	}
+
+	for removed := true; removed; {
+		removed = false
+		kept := created[:0]
+		for _, l := range created {
+			if _, err := resolveIn(x.outDir, l.name); err != nil {
+				if err := os.Remove(filepath.Join(x.outDir, l.name)); err != nil {
+					return err
+				}
+				x.skip(l.name, "symlink", fmt.Sprintf("target %s %v through another link", l.target, err))
+				removed = true
+				continue
+			}
+			kept = append(kept, l)
+		}
+		created = kept
+	}
+	return nil
+}
+
+// maxSymlinkHops bounds how many links resolveIn follows, as the kernel does.
+const maxSymlinkHops = 40
+
+// resolveIn resolves rel below root component by component, following
+// symbolic links the way the kernel would, and fails if the path leaves
+// root. Components that do not exist yet are resolved lexically.
+func resolveIn(root, rel string) (string, error) {
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	cur := root
+	hops := 0
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if cur == root {
+				return "", errLeavesBundle
+			}
+			cur = filepath.Dir(cur)
+			continue
+		}
+		next := filepath.Join(cur, part)
+		st, err := os.Lstat(next)
+		if err != nil || st.Mode()&os.ModeSymlink == 0 {
+			cur = next
+			continue
+		}
+		if hops++; hops > maxSymlinkHops {
+			return "", errors.New("has too many levels of symbolic links")
+		}
+		target, err := os.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			return "", errLeavesBundle
+		}
+		parts = append(strings.Split(filepath.ToSlash(target), "/"), parts...)
+	}
+	return cur, nil
+}
+
+func (x *extractor) checkFile(name string, size int64) error {
+	if max := x.limits.maxFileBytes; max > 0 && size > max {
+		return &extractLimitError{limitFileSize, fmt.Sprintf("%s is larger than %s", name, formatMemory(max))}
+	}
+	return nil
+}
+
+// charge accounts for n more bytes of the file name, which then holds
+// fileBytes bytes, before they are written.
+func (x *extractor) charge(name string, fileBytes, n int64) error {
+	if err := x.checkFile(name, fileBytes); err != nil {
+		return err
+	}
+	total := x.written + n
+	if max := x.limits.maxBytes; max > 0 && total > max {
+		return &extractLimitError{limitBundleSize, fmt.Sprintf("bundle unpacks to more than %s", formatMemory(max))}
+	}
+	if max := x.limits.maxRatio; max > 0 && total > ratioFloor && total > max*x.archiveSize {
+		return &extractLimitError{limitRatio, fmt.Sprintf("bundle unpacks to more than %d times its compressed size of %d bytes", max, x.archiveSize)}
+	}
+	x.written = total
+	return nil
+}
+
+// limitedFile writes a file's bytes, charging them to the extractor first.
+type limitedFile struct {
+	x    *extractor
+	name string
+	n    int64
+	w    io.Writer
+}
+
+func (f *limitedFile) Write(p []byte) (int, error) {
+	if err := f.x.charge(f.name, f.n+int64(len(p)), int64(len(p))); err != nil {
+		return 0, err
+	}
+	n, err := f.w.Write(p)
+	f.n += int64(n)
+	return n, err
+}
+
+// pathDepth counts the path components of an archive entry name.
+func pathDepth(name string) int {
+	depth := 0
+	for _, part := range strings.Split(filepath.ToSlash(filepath.Clean(name)), "/") {
+		if part != "" && part != "." {
+			depth++
+		}
+	}
+	return depth
+}
+
+// contextReader fails reads once ctx is done, so a long copy stops at the
+// phase deadline.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+type tarEntry struct {
+	hdr     tar.Header
+	content string
+}
+
+func fileEntry(name, content string) tarEntry {
+	return tarEntry{tar.Header{Name: name, Mode: 0o644, Size: int64(len(content)), Typeflag: tar.TypeReg}, content}
+}
+
+func symlinkEntry(name, target string) tarEntry {
+	return tarEntry{tar.Header{Name: name, Linkname: target, Mode: 0o777, Typeflag: tar.TypeSymlink}, ""}
+}
+
+func hardlinkEntry(name, target string) tarEntry {
+	return tarEntry{tar.Header{Name: name, Linkname: target, Mode: 0o644, Typeflag: tar.TypeLink}, ""}
+}
+
+// tarOf packs entries, in order, into an uncompressed tarball.
+func tarOf(t *testing.T, entries ...tarEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := e.hdr
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func gzipped(t *testing.T, raw []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(raw); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// extractTo unpacks bundle into the src directory of a fresh work
+// directory, next to a file named outside that nothing may touch.
+func extractTo(t *testing.T, bundle []byte, limits extractLimits) (string, []SkippedEntry, error) {
+	t.Helper()
+	workDir := t.TempDir()
+	bundlePath := filepath.Join(workDir, "bundle")
+	if err := os.WriteFile(bundlePath, bundle, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(workDir, "outside"), []byte("untouched"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	outDir := filepath.Join(workDir, "src")
+	if err := os.MkdirAll(outDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	skipped, err := extractBundle(context.Background(), bundlePath, outDir, limits)
+	t.Cleanup(func() {
+		if raw, _ := os.ReadFile(filepath.Join(workDir, "outside")); string(raw) != "untouched" {
+			t.Errorf("extraction wrote outside the bundle: outside = %q", raw)
+		}
+	})
+	return outDir, skipped, err
+}
+
+func TestExtractLimits(t *testing.T) {
+	zeros := strings.Repeat("\x00", 2<<20)
+	for _, tc := range []struct {
+		name   string
+		bundle []byte
+		limits extractLimits
+		code   string
+	}{
+		{"total size", tarOf(t, fileEntry("a", "0123456789"), fileEntry("b", "0123456789")), extractLimits{maxBytes: 15}, limitBundleSize},
+		{"file size", tarOf(t, fileEntry("small", "01234"), fileEntry("big", "0123456789")), extractLimits{maxFileBytes: 8}, limitFileSize},
+		{"entries", tarOf(t, fileEntry("a", "a"), fileEntry("b", "b"), fileEntry("c", "c")), extractLimits{maxEntries: 2}, limitEntries},
+		{"depth", tarOf(t, fileEntry("a/b/c/d", "deep")), extractLimits{maxDepth: 3}, limitDepth},
+		{"compression ratio", gzipped(t, tarOf(t, fileEntry("zeros", zeros))), extractLimits{maxRatio: 100}, limitRatio},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := extractTo(t, tc.bundle, tc.limits)
+			var le *extractLimitError
+			if !errors.As(err, &le) || le.code != tc.code {
+				t.Fatalf("extractBundle = %v, want limit %s", err, tc.code)
+			}
+		})
+	}
+
+	// Within every limit, and under the ratio floor however compressible.
+	_, _, err := extractTo(t, gzipped(t, tarOf(t, fileEntry("a/b/c", "abc"), fileEntry("zeros", zeros[:ratioFloor/2]))), extractLimitsFromEnv())
+	if err != nil {
+		t.Fatalf("extractBundle within limits: %v", err)
+	}
+}
+
+func TestExtractRefusesPathEscape(t *testing.T) {
+	for _, name := range []string{"../outside", "a/../../outside"} {
+		_, _, err := extractTo(t, tarOf(t, fileEntry(name, "pwned")), extractLimits{})
+		if err == nil || !strings.Contains(err.Error(), "invalid archive path") {
+			t.Fatalf("entry %s: extractBundle = %v, want invalid archive path", name, err)
+		}
+	}
+}
+
+func TestExtractSkipsEscapingLinks(t *testing.T) {
+	outDir, skipped, err := extractTo(t, tarOf(t,
+		fileEntry("app/main.go", "package main\n"),
+		symlinkEntry("abs", "/etc"),
+		symlinkEntry("rel", "../outside"),
+		symlinkEntry("app/up", "../../outside"),
+		// here -> . keeps lexical checks happy, so here/esc -> .. only
+		// escapes once here is followed.
+		symlinkEntry("here", "."),
+		symlinkEntry("here/esc", ".."),
+		// first is fine when created; the later d -> . redirects it out.
+		symlinkEntry("first", "d/../outside"),
+		symlinkEntry("d", "."),
+		hardlinkEntry("hard-abs", "/etc/passwd"),
+		hardlinkEntry("hard-rel", "../outside"),
+		hardlinkEntry("hard-missing", "app/none.go"),
+		// A file entry after a link of the same name must not write
+		// through it.
+		symlinkEntry("through", "../outside"),
+		fileEntry("through", "pwned"),
+	), extractLimits{})
+	if err != nil {
+		t.Fatalf("extractBundle: %v", err)
+	}
+
+	reasons := map[string]string{}
+	for _, s := range skipped {
+		reasons[s.Name] = s.Type + ": " + s.Reason
+	}
+	for name, want := range map[string]string{
+		"abs":          "symlink: target \"/etc\" is not a relative path",
+		"rel":          "symlink: target ../outside resolves outside the bundle",
+		"app/up":       "symlink: target ../../outside resolves outside the bundle",
+		"here/esc":     "symlink: target .. resolves outside the bundle",
+		"first":        "symlink: target d/../outside resolves outside the bundle through another link",
+		"hard-abs":     "hardlink: target /etc/passwd resolves outside the bundle",
+		"hard-rel":     "hardlink: target ../outside resolves outside the bundle",
+		"hard-missing": "hardlink: target app/none.go is not a file unpacked before it",
+		"through":      "symlink: target ../outside resolves outside the bundle",
+	} {
+		if got := reasons[name]; got != want {
+			t.Errorf("skipped %s = %q, want %q", name, got, want)
+		}
+	}
+	for _, name := range []string{"abs", "rel", "app/up", "esc", "first", "hard-abs", "hard-rel", "hard-missing"} {
+		if _, err := os.Lstat(filepath.Join(outDir, name)); err == nil {
+			t.Errorf("%s was created", name)
+		}
+	}
+	if raw, err := os.ReadFile(filepath.Join(outDir, "through")); err != nil || string(raw) != "pwned" {
+		t.Errorf("through = %q, %v; want the file entry", raw, err)
+	}
+	if target, err := os.Readlink(filepath.Join(outDir, "d")); err != nil || target != "." {
+		t.Errorf("d = %q, %v; want a link to .", target, err)
+	}
+}
+
+func TestExtractRecreatesLinksAndExecBits(t *testing.T) {
+	script := fileEntry("bin/run.sh", "#!/bin/sh\necho hi\n")
+	script.hdr.Mode = 0o700
+	outDir, skipped, err := extractTo(t, gzipped(t, tarOf(t,
+		script,
+		fileEntry("config/app.conf", "port=8080\n"),
+		symlinkEntry("run", "bin/run.sh"),
+		symlinkEntry("bin/conf", "../config"),
+		symlinkEntry("current", "releases/v1"),
+		fileEntry("releases/v1/VERSION", "1\n"),
+		hardlinkEntry("start.sh", "bin/run.sh"),
+		tarEntry{tar.Header{Name: "fifo", Mode: 0o644, Typeflag: tar.TypeFifo}, ""},
+	)), extractLimits{})
+	if err != nil {
+		t.Fatalf("extractBundle: %v", err)
+	}
+	if len(skipped) != 1 || skipped[0].Name != "fifo" || skipped[0].Type != "fifo" {
+		t.Fatalf("skipped = %+v, want only the fifo", skipped)
+	}
+
+	for name, want := range map[string]string{"run": "bin/run.sh", "bin/conf": "../config", "current": "releases/v1"} {
+		if target, err := os.Readlink(filepath.Join(outDir, name)); err != nil || target != want {
+			t.Errorf("%s = %q, %v; want a link to %s", name, target, err, want)
+		}
+	}
+	if raw, err := os.ReadFile(filepath.Join(outDir, "bin/conf/app.conf")); err != nil || string(raw) != "port=8080\n" {
+		t.Errorf("bin/conf/app.conf = %q, %v", raw, err)
+	}
+	if raw, err := os.ReadFile(filepath.Join(outDir, "current/VERSION")); err != nil || string(raw) != "1\n" {
+		t.Errorf("current/VERSION = %q, %v", raw, err)
+	}
+	a, _ := os.Stat(filepath.Join(outDir, "bin/run.sh"))
+	b, _ := os.Stat(filepath.Join(outDir, "start.sh"))
+	if a == nil || b == nil || !os.SameFile(a, b) {
+		t.Errorf("start.sh is not a hardlink of bin/run.sh")
+	}
+
+	for name, exec := range map[string]bool{"bin/run.sh": true, "config/app.conf": false} {
+		st, err := os.Stat(filepath.Join(outDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := st.Mode().Perm()&0o100 != 0; got != exec {
+			t.Errorf("%s mode = %v, want executable %v", name, st.Mode().Perm(), exec)
+		}
+	}
+}
+
+func TestExtractZipKeepsExecBits(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, mode := range map[string]os.FileMode{"gradlew": 0o755, "build.gradle": 0o644} {
+		h := &zip.FileHeader{Name: name, Method: zip.Deflate}
+		h.SetMode(mode)
+		w, err := zw.CreateHeader(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("#!/bin/sh\n"))
+	}
+	h := &zip.FileHeader{Name: "gradle"}
+	h.SetMode(os.ModeSymlink | 0o777)
+	w, _ := zw.CreateHeader(h)
+	w.Write([]byte("gradlew"))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	outDir, _, err := extractTo(t, buf.Bytes(), extractLimits{})
+	if err != nil {
+		t.Fatalf("extractBundle: %v", err)
+	}
+	if st, err := os.Stat(filepath.Join(outDir, "gradlew")); err != nil || st.Mode().Perm()&0o100 == 0 {
+		t.Errorf("gradlew lost its exec bit: %v, %v", st, err)
+	}
+	if st, err := os.Stat(filepath.Join(outDir, "build.gradle")); err != nil || st.Mode().Perm()&0o111 != 0 {
+		t.Errorf("build.gradle became executable: %v, %v", st, err)
+	}
+	if target, err := os.Readlink(filepath.Join(outDir, "gradle")); err != nil || target != "gradlew" {
+		t.Errorf("gradle = %q, %v; want a link to gradlew", target, err)
+	}
+}
+
+// v7Tar rewrites the first header of a ustar tarball as a pre-POSIX one:
+// no magic, only a checksum.
+func v7Tar(t *testing.T, raw []byte) []byte {
+	t.Helper()
+	raw = append([]byte(nil), raw...)
+	copy(raw[257:265], make([]byte, 8))
+	copy(raw[148:156], "        ")
+	var sum int
+	for _, c := range raw[:512] {
+		sum += int(c)
+	}
+	copy(raw[148:156], fmt.Sprintf("%06o\x00 ", sum))
+	return raw
+}
+
+func zstdOf(t *testing.T, raw []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw, err := zstd.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.Write(raw)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func xzOf(t *testing.T, raw []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	xw, err := xz.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xw.Write(raw)
+	if err := xw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zipOf(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDetectBundleFormat(t *testing.T) {
+	plain := tarOf(t, fileEntry("Dockerfile", testDockerfile))
+	for name, tc := range map[string]struct {
+		bundle []byte
+		want   string
+	}{
+		"zip":                      {zipOf(t, map[string]string{"Dockerfile": testDockerfile}), formatZip},
+		"empty zip":                {zipOf(t, nil), formatZip},
+		"ustar":                    {plain, formatTar},
+		"v7 tar":                   {v7Tar(t, plain), formatTar},
+		"gzip":                     {gzipped(t, plain), formatTarGzip},
+		"zstd":                     {zstdOf(t, plain), formatTarZstd},
+		"xz":                       {xzOf(t, plain), formatTarXz},
+		"bzip2":                    {[]byte("BZh91AY&SY"), formatTarBzip2},
+		"Dockerfile":               {[]byte(testDockerfile), formatDockerfile},
+		"Dockerfile with preamble": {[]byte("# syntax=docker/dockerfile:1\n\n# base image\nARG BASE=busybox\n  from ${BASE}\nCMD [\"true\"]\n"), formatDockerfile},
+	} {
+		if got, err := detectBundleFormat(bytes.NewReader(tc.bundle)); err != nil || got != tc.want {
+			t.Errorf("%s: detectBundleFormat = %q, %v; want %q", name, got, err, tc.want)
+		}
+	}
+
+	badChecksum := v7Tar(t, plain)
+	copy(badChecksum[148:156], "0000000\x00")
+	for name, junk := range map[string][]byte{
+		"empty":             nil,
+		"text":              []byte("hello world\n"),
+		"instruction first": []byte("RUN echo hi\nFROM busybox\n"),
+		"comments only":     []byte("# FROM busybox\n"),
+		"FROM after NUL":    []byte("FROM busybox\n\x00"),
+		"short tar":         plain[:300],
+		"v7 bad checksum":   badChecksum,
+	} {
+		if got, err := detectBundleFormat(bytes.NewReader(junk)); err != errUnsupportedBundle {
+			t.Errorf("%s: detectBundleFormat = %q, %v; want errUnsupportedBundle", name, got, err)
+		}
+	}
+}
+
+func TestExtractCompressedTarballs(t *testing.T) {
+	plain := tarOf(t, fileEntry("Dockerfile", testDockerfile), fileEntry("app/main.go", "package main\n"))
+	for name, bundle := range map[string][]byte{
+		"tar":  plain,
+		"v7":   v7Tar(t, plain),
+		"zstd": zstdOf(t, plain),
+		"xz":   xzOf(t, plain),
+		"zip":  zipOf(t, map[string]string{"Dockerfile": testDockerfile, "app/main.go": "package main\n"}),
+	} {
+		outDir, _, err := extractTo(t, bundle, extractLimitsFromEnv())
+		if err != nil {
+			t.Fatalf("%s: extractBundle: %v", name, err)
+		}
+		if raw, err := os.ReadFile(filepath.Join(outDir, "app/main.go")); err != nil || string(raw) != "package main\n" {
+			t.Errorf("%s: app/main.go = %q, %v", name, raw, err)
+		}
+	}
+
+	outDir, _, err := extractTo(t, []byte(testDockerfile), extractLimitsFromEnv())
+	if err != nil {
+		t.Fatalf("Dockerfile: extractBundle: %v", err)
+	}
+	if raw, err := os.ReadFile(filepath.Join(outDir, "Dockerfile")); err != nil || string(raw) != testDockerfile {
+		t.Errorf("bare Dockerfile unpacked as %q, %v", raw, err)
+	}
+}
+
+func TestExtractRejectsCompressedNonTar(t *testing.T) {
+	for name, tc := range map[string]struct {
+		bundle []byte
+		want   string
+	}{
+		"gzip": {gzipped(t, []byte("just some text, not a tarball\n")), "gzip stream does not contain a tar archive"},
+		"zstd": {zstdOf(t, []byte(testDockerfile)), "zstd stream does not contain a tar archive"},
+		"xz":   {xzOf(t, zipOf(t, map[string]string{"a": "a"})), "xz stream does not contain a tar archive"},
+	} {
+		if _, _, err := extractTo(t, tc.bundle, extractLimitsFromEnv()); err == nil || err.Error() != tc.want {
+			t.Errorf("%s: extractBundle = %v, want %q", name, err, tc.want)
+		}
+	}
+}
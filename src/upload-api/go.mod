@@ -1,3 +1,9 @@
 module knative-appdev/upload-api
 
 go 1.22
+
+require (
+	github.com/klauspost/compress v1.17.11
+	github.com/ulikunitz/xz v0.5.12
+	sigs.k8s.io/yaml v1.4.0
+)
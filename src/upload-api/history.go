@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+type ServiceHistory struct {
+	Namespace       string          `json:"namespace"`
+	ServiceName     string          `json:"serviceName"`
+	CurrentRevision string          `json:"currentRevision,omitempty"`
+	Traffic         []TrafficTarget `json:"traffic,omitempty"`
+	ClusterError    string          `json:"clusterError,omitempty"`
+	Entries         []HistoryEntry  `json:"entries"`
+}
+
+// HistoryEntry links one deployment to the revision it produced.
+type HistoryEntry struct {
+	DeploymentID     string     `json:"deploymentId"`
+	Kind             string     `json:"kind,omitempty"`
+	RollbackOf       string     `json:"rollbackOf,omitempty"`
+	Status           string     `json:"status"`
+	Revision         string     `json:"revision,omitempty"`
+	PreviousRevision string     `json:"previousRevision,omitempty"`
+	Image            string     `json:"image,omitempty"`
+	ImageTag         string     `json:"imageTag,omitempty"`
+	BundleSHA256     string     `json:"bundleSha256,omitempty"`
+	TrafficPercent   int64      `json:"trafficPercent"`
+	Serving          bool       `json:"serving"`
+	CreatedAt        time.Time  `json:"createdAt"`
+	ReadyAt          *time.Time `json:"readyAt,omitempty"`
+	UpdatedAt        time.Time  `json:"updatedAt"`
+}
+
+// handleServices routes /services/{namespace}/{name}/{action} and
+// DELETE /services/{namespace}/{name}.
+func (s *Server) handleServices(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/services/"), "/"), "/")
+	if len(parts) == 2 && parts[0] != "" && parts[1] != "" {
+		if r.Method != http.MethodDelete {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		if !s.authorize(w, r, actionDelete, parts[0]) {
+			return
+		}
+		s.handleDeleteService(w, r, parts[0], parts[1])
+		return
+	}
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "expected /services/{namespace}/{name}/{action}"})
+		return
+	}
+	namespace, name, action := parts[0], parts[1], parts[2]
+
+	switch action {
+	case "history":
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		if !s.authorize(w, r, actionLogs, namespace) {
+			return
+		}
+		s.handleServiceHistory(w, r, namespace, name)
+	case "rollback":
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		if !s.authorize(w, r, actionRollback, namespace) {
+			return
+		}
+		s.handleRollback(w, r, namespace, name)
+	case "traffic":
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		if !s.authorize(w, r, actionDeploy, namespace) {
+			return
+		}
+		s.handleTraffic(w, r, namespace, name)
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown service action: " + action})
+	}
+}
+
+func (s *Server) handleServiceHistory(w http.ResponseWriter, r *http.Request, namespace, name string) {
+	entries := serviceEntries(s.store.List(), namespace, name)
+
+	h := ServiceHistory{Namespace: namespace, ServiceName: name, Entries: entries}
+	st, err := s.services.GetService(r.Context(), namespace, name)
+	if err != nil {
+		h.ClusterError = err.Error()
+	} else {
+		h.CurrentRevision = st.primaryRevision()
+		h.Traffic = st.Traffic
+		for i := range h.Entries {
+			if h.Entries[i].Revision == "" {
+				continue
+			}
+			h.Entries[i].TrafficPercent = st.servingPercent(h.Entries[i].Revision)
+			h.Entries[i].Serving = h.Entries[i].TrafficPercent > 0
+		}
+	}
+
+	if len(h.Entries) == 0 && err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no history for service"})
+		return
+	}
+	writeJSON(w, http.StatusOK, h)
+}
+
+// serviceEntries builds the newest-first revision chain for one service from
+// its ID-ordered deployment records.
+func serviceEntries(all []*Deployment, namespace, name string) []HistoryEntry {
+	entries := []HistoryEntry{}
+	previous := ""
+	for _, d := range all {
+		if d.Namespace != namespace || d.ServiceName != name {
+			continue
+		}
+		entries = append(entries, HistoryEntry{
+			DeploymentID:     d.ID,
+			Kind:             d.Kind,
+			RollbackOf:       d.RollbackOf,
+			Status:           d.Status,
+			Revision:         d.Revision,
+			PreviousRevision: previous,
+			Image:            d.Image,
+			ImageTag:         d.ImageTag,
+			BundleSHA256:     d.BundleSHA256,
+			CreatedAt:        d.CreatedAt,
+			ReadyAt:          d.ReadyAt,
+			UpdatedAt:        d.UpdatedAt,
+		})
+		if d.Revision != "" && d.Revision != previous {
+			previous = d.Revision
+		}
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestServiceEntries(t *testing.T) {
+	at := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	record := func(id, namespace, service, status, revision string) *Deployment {
+		return &Deployment{ID: id, Namespace: namespace, ServiceName: service, Status: status, Revision: revision, CreatedAt: at}
+	}
+	all := []*Deployment{
+		record("dep-000001", "demo-apps", "hello", statusReady, "hello-00001"),
+		record("dep-000002", "demo-apps", "other", statusReady, "other-00001"),
+		record("dep-000003", "team-a", "hello", statusReady, "hello-00001"),
+		record("dep-000004", "demo-apps", "hello", statusFailed, ""),
+		record("dep-000005", "demo-apps", "hello", statusReady, "hello-00002"),
+		// A traffic rollback points back at an older revision.
+		record("dep-000006", "demo-apps", "hello", statusReady, "hello-00001"),
+		record("dep-000007", "demo-apps", "hello", statusQueued, ""),
+	}
+	all[5].Kind, all[5].RollbackOf = kindRollback, "dep-000001"
+
+	type entry struct{ id, revision, previous string }
+	var got []entry
+	for _, e := range serviceEntries(all, "demo-apps", "hello") {
+		got = append(got, entry{e.DeploymentID, e.Revision, e.PreviousRevision})
+	}
+	want := []entry{
+		{"dep-000007", "", "hello-00001"},
+		{"dep-000006", "hello-00001", "hello-00002"},
+		{"dep-000005", "hello-00002", "hello-00001"},
+		{"dep-000004", "", "hello-00001"},
+		{"dep-000001", "hello-00001", ""},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("entries = %v, want %v", got, want)
+	}
+
+	if entries := serviceEntries(all, "demo-apps", "missing"); entries == nil || len(entries) != 0 {
+		t.Fatalf("entries of unknown service = %#v, want empty slice", entries)
+	}
+}
+
+func TestServiceHistoryLinksUploadsToServingRevisions(t *testing.T) {
+	s := newPipelineServer(t)
+	fields := map[string]string{"service": "hello", "namespace": "demo-apps"}
+	files := map[string]string{"Dockerfile": testDockerfile}
+	first := deployAndWait(t, s, fields, files)
+	files["main.go"] = "package main\n"
+	second := deployAndWait(t, s, fields, files)
+	for _, d := range []*Deployment{first, second} {
+		if d.Status != statusReady {
+			t.Fatalf("%s status = %s (%s), want READY", d.ID, d.Status, d.Error)
+
+		}
+	}
+
+	history := func() ServiceHistory {
+		t.Helper()
+		code, body := get(t, s.handleServices, "/services/demo-apps/hello/history", nil)
+		if code != http.StatusOK {
+			t.Fatalf("history = %d %s, want 200", code, body)
+		}
+		var h ServiceHistory
+		if err := json.Unmarshal(body, &h); err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	h := history()
+	if h.CurrentRevision != "hello-00002" || len(h.Entries) != 2 {
+		t.Fatalf("history = %+v, want 2 entries serving hello-00002", h)
+	}
+	for i, tc := range []struct {
+		d        *Deployment
+		revision string
+		previous string
+		percent  int64
+	}{
+		{second, "hello-00002", "hello-00001", 100},
+		{first, "hello-00001", "", 0},
+	} {
+		e := h.Entries[i]
+		if e.DeploymentID != tc.d.ID || e.Revision != tc.revision || e.PreviousRevision != tc.previous {
+			t.Errorf("entry %d = %s %s (previous %q), want %s %s (previous %q)", i, e.DeploymentID, e.Revision, e.PreviousRevision, tc.d.ID, tc.revision, tc.previous)
+		}
+		if e.Image != tc.d.Image || e.ImageTag != tc.d.ID || e.BundleSHA256 == "" || e.BundleSHA256 != tc.d.BundleSHA256 {
+			t.Errorf("entry %d image %s:%s bundle %q, want %s:%s bundle %q", i, e.Image, e.ImageTag, e.BundleSHA256, tc.d.Image, tc.d.ID, tc.d.BundleSHA256)
+		}
+		if e.TrafficPercent != tc.percent || e.Serving != (tc.percent > 0) || e.ReadyAt == nil {
+			t.Errorf("entry %d traffic %d serving %v readyAt %v, want %d", i, e.TrafficPercent, e.Serving, e.ReadyAt, tc.percent)
+		}
+	}
+	if first.BundleSHA256 == second.BundleSHA256 {
+		t.Fatal("different bundles recorded the same checksum")
+	}
+
+	if _, err := s.services.SetTraffic(testContext(t), "demo-apps", "hello", []TrafficTarget{
+		{RevisionName: "hello-00001", Percent: 70},
+		{RevisionName: "hello-00002", Percent: 30},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	h = history()
+	if h.CurrentRevision != "hello-00001" || h.Entries[0].TrafficPercent != 30 || h.Entries[1].TrafficPercent != 70 || !h.Entries[1].Serving {
+		t.Fatalf("history after split = %+v", h)
+	}
+}
+
+func TestServiceHistoryRequests(t *testing.T) {
+	s := newTestServer(t)
+	// Recorded, but the service is gone from the cluster.
+	s.store.Put(&Deployment{ID: "dep-000001", Namespace: "demo-apps", ServiceName: "gone", Status: statusReady, Revision: "gone-00001"})
+
+	for _, tc := range []struct {
+		method, target string
+		want           int
+	}{
+		{http.MethodGet, "/services/demo-apps/gone/history", http.StatusOK},
+		{http.MethodGet, "/services/demo-apps/never/history", http.StatusNotFound},
+		{http.MethodPost, "/services/demo-apps/gone/history", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/services/demo-apps/gone/versions", http.StatusNotFound},
+		// Two segments name a service to delete.
+		{http.MethodGet, "/services/demo-apps/gone", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/services/demo-apps/gone/history/extra", http.StatusNotFound},
+	} {
+		rec := httptest.NewRecorder()
+		s.handleServices(rec, httptest.NewRequest(tc.method, tc.target, nil))
+		if rec.Code != tc.want {
+			t.Errorf("%s %s = %d %s, want %d", tc.method, tc.target, rec.Code, rec.Body, tc.want)
+		}
+	}
+
+	_, body := get(t, s.handleServices, "/services/demo-apps/gone/history", nil)
+	var h ServiceHistory
+	if err := json.Unmarshal(body, &h); err != nil {
+		t.Fatal(err)
+	}
+	if h.ClusterError == "" || h.CurrentRevision != "" || len(h.Entries) != 1 || h.Entries[0].Serving {
+		t.Fatalf("history of a deleted service = %+v, want the record and a cluster error", h)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// When a hook runs relative to its pipeline step.
+const (
+	hookPre  = "pre"
+	hookPost = "post"
+)
+
+// Hook extends the upload pipeline. It is called before every step and
+// after every step that succeeded; an error fails the step.
+type Hook interface {
+	Run(ctx context.Context, when, step string, d *Deployment, logs io.Writer) error
+}
+
+// execHooks runs executables named <when>-<step> (e.g. pre-build,
+// post-ready) from dir. Steps without a matching file are left alone.
+type execHooks struct {
+	dir string
+}
+
+func (h execHooks) Run(ctx context.Context, when, step string, d *Deployment, logs io.Writer) error {
+	name := when + "-" + step
+	path := filepath.Join(h.dir, name)
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() || info.Mode()&0o111 == 0 {
+		return fmt.Errorf("hook %s is not an executable file", path)
+	}
+
+	fmt.Fprintf(logs, "[hook] running %s\n", name)
+	cmd := commandContext(ctx, path)
+	cmd.Dir = d.ExtractedPath
+	cmd.Env = append(os.Environ(),
+		"HOOK="+when,
+		"STEP="+step,
+		"DEPLOYMENT_ID="+d.ID,
+		"SERVICE_NAME="+d.ServiceName,
+		"NAMESPACE="+d.Namespace,
+		"APP_DIR="+d.ExtractedPath,
+		"BUILDER="+d.Builder,
+		"IMAGE="+d.Image,
+		"REVISION="+d.Revision,
+	)
+	cmd.Stdout = logs
+	cmd.Stderr = logs
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("hook %s: %w", name, err)
+	}
+	return nil
+}
+
+// configuredHooks returns the hooks enabled by HOOKS_DIR.
+func configuredHooks() []Hook {
+	dir := envOr("HOOKS_DIR", "")
+	if dir == "" {
+		return nil
+	}
+	return []Hook{execHooks{dir: dir}}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const kanikoPollInterval = 2 * time.Second
+
+// contextTokens holds the one-time credentials build Jobs present to
+// download their context. Each deployment has at most one outstanding
+// token, kept as a SHA-256 digest.
+type contextTokens struct {
+	mu     sync.Mutex
+	tokens map[string][32]byte
+}
+
+func newContextTokens() *contextTokens {
+	return &contextTokens{tokens: map[string][32]byte{}}
+}
+
+// issue returns a fresh token for deploymentID, replacing any earlier one.
+func (c *contextTokens) issue(deploymentID string) string {
+	var b [32]byte
+	_, _ = rand.Read(b[:])
+	token := hex.EncodeToString(b[:])
+	c.mu.Lock()
+	c.tokens[deploymentID] = sha256.Sum256([]byte(token))
+	c.mu.Unlock()
+	return token
+}
+
+// redeem reports whether token is the outstanding token of deploymentID and
+// consumes it, so the context can be fetched only once.
+func (c *contextTokens) redeem(deploymentID, token string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	want, ok := c.tokens[deploymentID]
+	if !ok || token == "" || sha256.Sum256([]byte(token)) != want {
+		return false
+	}
+	delete(c.tokens, deploymentID)
+	return true
+}
+
+// revoke drops the outstanding token of deploymentID, if any.
+func (c *contextTokens) revoke(deploymentID string) {
+	c.mu.Lock()
+	delete(c.tokens, deploymentID)
+	c.mu.Unlock()
+}
+
+// kanikoBuilder runs each build as a Kubernetes Job. An init container
+// downloads the build context from upload-api's
+// /deployments/{id}/context endpoint, and kaniko pushes the result to the
+// image registry, so the registry must be reachable from the cluster.
+type kanikoBuilder struct {
+	kube         *kubeClient
+	namespace    string
+	image        string
+	fetchImage   string
+	uploadAPIURL string
+	insecure     bool
+	// tokens issues the credential the init container sends to fetch the
+	// context. It is revoked when the build returns.
+	tokens *contextTokens
+}
+
+func (kanikoBuilder) Name() string { return "kaniko" }
+
+func (b kanikoBuilder) Build(ctx context.Context, req BuildRequest, logs io.Writer) error {
+	if strings.HasPrefix(req.Image, localRegistryPrefix) {
+		return fmt.Errorf("kaniko pushes to a registry; set IMAGE_REGISTRY to a registry reachable from the cluster (got %s)", req.Image)
+	}
+	if b.uploadAPIURL == "" {
+		return errors.New("kaniko builder requires UPLOAD_API_URL so the job can fetch the build context")
+	}
+
+	token := b.tokens.issue(req.DeploymentID)
+	defer b.tokens.revoke(req.DeploymentID)
+
+	jobName := "kaniko-" + req.DeploymentID
+	secretName := jobName + "-context"
+	secretPath := fmt.Sprintf("/api/v1/namespaces/%s/secrets", b.namespace)
+	if err := b.kube.do(ctx, http.MethodPost, secretPath, "", b.tokenSecret(secretName, req, token), nil); err != nil {
+		return fmt.Errorf("create kaniko context token secret: %w", err)
+	}
+	defer b.deleteObject(secretPath + "/" + secretName)
+
+	jobPath := fmt.Sprintf("/apis/batch/v1/namespaces/%s/jobs", b.namespace)
+	if err := b.kube.do(ctx, http.MethodPost, jobPath, "", b.job(jobName, secretName, req), nil); err != nil {
+		return fmt.Errorf("create kaniko job: %w", err)
+	}
+	fmt.Fprintf(logs, "[kaniko] created job %s/%s for %s\n", b.namespace, jobName, req.Image)
+	defer b.deleteJob(jobName)
+
+	pod, err := b.waitForPod(ctx, jobName)
+	if err != nil {
+		return err
+	}
+	if err := b.followLogs(ctx, pod, logs); err != nil {
+		fmt.Fprintf(logs, "[kaniko] log stream ended: %v\n", err)
+	}
+	return b.waitForJob(ctx, jobName)
+}
+
+// contextTokenDir is where the init container mounts the Secret holding
+// its context token.
+const contextTokenDir = "/var/run/secrets/upload-api"
+
+// fetchContextScript downloads the build context, authenticating with the
+// job's one-time context token.
+const fetchContextScript = `CONTEXT_TOKEN=$(cat "$CONTEXT_TOKEN_FILE") && wget -q --header "Authorization: Bearer $CONTEXT_TOKEN" -O /workspace/context.tar.gz "$CONTEXT_URL"`
+
+// tokenSecret is the Secret that hands the context token to the init
+// container, so the token never appears in the Job spec. It is deleted when
+// the build returns.
+func (b kanikoBuilder) tokenSecret(name string, req BuildRequest, token string) map[string]any {
+	return map[string]any{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"type":       "Opaque",
+		"metadata": map[string]any{
+			"name":      name,
+			"namespace": b.namespace,
+			"labels": map[string]string{
+				"app.kubernetes.io/managed-by": "upload-api",
+				"knative-appdev/deployment-id": req.DeploymentID,
+			},
+		},
+		"stringData": map[string]string{"token": token},
+	}
+}
+
+func (b kanikoBuilder) job(name, secretName string, req BuildRequest) map[string]any {
+	contextURL := strings.TrimRight(b.uploadAPIURL, "/") + "/deployments/" + url.PathEscape(req.DeploymentID) + "/context"
+	args := []string{
+		"--context=tar:///workspace/context.tar.gz",
+		"--dockerfile=Dockerfile",
+		"--destination=" + req.Image,
+	}
+	if b.insecure {
+		args = append(args, "--insecure", "--skip-tls-verify")
+	}
+	workspace := []map[string]any{{"name": "workspace", "mountPath": "/workspace"}}
+	return map[string]any{
+		"apiVersion": "batch/v1",
+		"kind":       "Job",
+		"metadata": map[string]any{
+			"name":      name,
+			"namespace": b.namespace,
+			"labels": map[string]string{
+				"app.kubernetes.io/managed-by": "upload-api",
+				"knative-appdev/deployment-id": req.DeploymentID,
+			},
+		},
+		"spec": map[string]any{
+			"backoffLimit":            0,
+			"ttlSecondsAfterFinished": 600,
+			"template": map[string]any{
+				"spec": map[string]any{
+					"restartPolicy": "Never",
+					"initContainers": []map[string]any{{
+						"name":    "fetch-context",
+						"image":   b.fetchImage,
+						"command": []string{"sh", "-c", fetchContextScript},
+						"env": []map[string]string{
+							{"name": "CONTEXT_URL", "value": contextURL},
+							{"name": "CONTEXT_TOKEN_FILE", "value": contextTokenDir + "/token"},
+						},
+						"volumeMounts": []map[string]any{
+							{"name": "workspace", "mountPath": "/workspace"},
+							{"name": "context-token", "mountPath": contextTokenDir, "readOnly": true},
+						},
+					}},
+					"containers": []map[string]any{{
+						"name":         "kaniko",
+						"image":        b.image,
+						"args":         args,
+						"volumeMounts": workspace,
+					}},
+					"volumes": []map[string]any{
+						{"name": "workspace", "emptyDir": map[string]any{}},
+						{"name": "context-token", "secret": map[string]any{"secretName": secretName, "defaultMode": 0o400}},
+					},
+				},
+			},
+		},
+	}
+}
+
+// kanikoPod is the part of a pod the builder watches.
+type kanikoPod struct {
+	Metadata struct {
+		Name string `json:"name"`
+	} `json:"metadata"`
+	Status struct {
+		Phase                 string `json:"phase"`
+		InitContainerStatuses []struct {
+			Name  string `json:"name"`
+			State struct {
+				Waiting *struct {
+					Reason  string `json:"reason"`
+					Message string `json:"message"`
+				} `json:"waiting"`
+				Terminated *struct {
+					ExitCode int    `json:"exitCode"`
+					Reason   string `json:"reason"`
+					Message  string `json:"message"`
+				} `json:"terminated"`
+			} `json:"state"`
+		} `json:"initContainerStatuses"`
+	} `json:"status"`
+}
+
+// initFailure returns why an init container (the context fetch) can no
+// longer succeed, or nil while it is pending, running or done.
+func (p kanikoPod) initFailure() error {
+	for _, c := range p.Status.InitContainerStatuses {
+		if t := c.State.Terminated; t != nil && t.ExitCode != 0 {
+			return fmt.Errorf("kaniko init container %s exited with code %d: %s", c.Name, t.ExitCode, strings.TrimSpace(t.Reason+" "+t.Message))
+		}
+		if w := c.State.Waiting; w != nil && w.Reason == "CrashLoopBackOff" {
+			return fmt.Errorf("kaniko init container %s is in CrashLoopBackOff: %s", c.Name, w.Message)
+		}
+	}
+	return nil
+}
+
+// waitForPod returns the job's pod once its kaniko container has started
+// (or the pod already finished), so logs can be followed. It fails fast when
+// the init container that fetches the context fails, since the pod would
+// otherwise never leave Pending.
+func (b kanikoBuilder) waitForPod(ctx context.Context, jobName string) (string, error) {
+	path := fmt.Sprintf("/api/v1/namespaces/%s/pods?labelSelector=%s", b.namespace, url.QueryEscape("job-name="+jobName))
+	for {
+		var pods struct {
+			Items []kanikoPod `json:"items"`
+		}
+		if err := b.kube.do(ctx, http.MethodGet, path, "", nil, &pods); err != nil {
+			return "", fmt.Errorf("list kaniko pods: %w", err)
+		}
+		for _, p := range pods.Items {
+			if err := p.initFailure(); err != nil {
+				return "", err
+			}
+			switch p.Status.Phase {
+			case "Running", "Succeeded", "Failed":
+				return p.Metadata.Name, nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(kanikoPollInterval):
+		}
+	}
+}
+
+func (b kanikoBuilder) followLogs(ctx context.Context, pod string, logs io.Writer) error {
+	body, err := b.kube.stream(ctx, fmt.Sprintf("/api/v1/namespaces/%s/pods/%s/log?container=kaniko&follow=true", b.namespace, pod))
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	_, err = io.Copy(logs, body)
+	return err
+}
+
+func (b kanikoBuilder) waitForJob(ctx context.Context, jobName string) error {
+	path := fmt.Sprintf("/apis/batch/v1/namespaces/%s/jobs/%s", b.namespace, jobName)
+	for {
+		var job struct {
+			Status struct {
+				Succeeded int `json:"succeeded"`
+				Failed    int `json:"failed"`
+			} `json:"status"`
+		}
+		if err := b.kube.do(ctx, http.MethodGet, path, "", nil, &job); err != nil {
+			return fmt.Errorf("get kaniko job: %w", err)
+		}
+		if job.Status.Succeeded > 0 {
+			return nil
+		}
+		if job.Status.Failed > 0 {
+			return fmt.Errorf("kaniko job %s failed", jobName)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(kanikoPollInterval):
+		}
+	}
+}
+
+// deleteJob removes the job and its pods.
+func (b kanikoBuilder) deleteJob(jobName string) {
+	b.deleteObject(fmt.Sprintf("/apis/batch/v1/namespaces/%s/jobs/%s?propagationPolicy=Background", b.namespace, jobName))
+}
+
+// deleteObject deletes the object at path. It uses a fresh context so it
+// also runs after the build context was cancelled.
+func (b kanikoBuilder) deleteObject(path string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_ = b.kube.do(ctx, http.MethodDelete, path, "", nil, nil)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestKanikoWaitForPodFailsFastOnInitContainer(t *testing.T) {
+	for _, tc := range []struct {
+		name, pod, want string
+	}{
+		{
+			name: "terminated",
+			pod:  `{"phase":"Pending","initContainerStatuses":[{"name":"fetch-context","state":{"terminated":{"exitCode":1,"reason":"Error"}}}]}`,
+			want: "fetch-context exited with code 1",
+		},
+		{
+			name: "crashloop",
+			pod:  `{"phase":"Pending","initContainerStatuses":[{"name":"fetch-context","state":{"waiting":{"reason":"CrashLoopBackOff","message":"back-off 10s"}}}]}`,
+			want: "CrashLoopBackOff: back-off 10s",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := kanikoBuilder{kube: fakePods(t, tc.pod), namespace: "builds"}
+			_, err := b.waitForPod(testContext(t), "kaniko-dep-000001")
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("waitForPod error = %v, want %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestKanikoWaitForPodReturnsStartedPod(t *testing.T) {
+	pod := `{"phase":"Running","initContainerStatuses":[{"name":"fetch-context","state":{"terminated":{"exitCode":0,"reason":"Completed"}}}]}`
+	b := kanikoBuilder{kube: fakePods(t, pod), namespace: "builds"}
+	name, err := b.waitForPod(testContext(t), "kaniko-dep-000001")
+	if err != nil {
+		t.Fatalf("waitForPod: %v", err)
+	}
+	if name != "kaniko-dep-000001-abcde" {
+		t.Fatalf("pod = %q, want kaniko-dep-000001-abcde", name)
+	}
+}
+
+// fakePods serves a pod list holding one pod of the job with the given
+// status JSON.
+func fakePods(t *testing.T, status string) *kubeClient {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/namespaces/builds/pods" || r.URL.Query().Get("labelSelector") != "job-name=kaniko-dep-000001" {
+			http.Error(w, "unexpected request", http.StatusNotImplemented)
+			return
+		}
+		fmt.Fprintf(w, `{"items":[{"metadata":{"name":"kaniko-dep-000001-abcde"},"status":%s}]}`, status)
+	}))
+	t.Cleanup(srv.Close)
+	return &kubeClient{baseURL: srv.URL, http: srv.Client()}
+}
+
+// fakeKanikoCluster records the Secret and Job a kaniko build creates. When
+// the build first lists pods, it runs the Job's init container script
+// locally with a wget stub that records its arguments, replays the
+// recorded request twice against upload-api, and then reports the pod as
+// finished.
+type fakeKanikoCluster struct {
+	t *testing.T
+
+	mu       sync.Mutex
+	secret   map[string]any
+	job      map[string]any
+	deleted  []string
+	wgetArgs []string
+	fetches  []int // status of each replayed context download
+}
+
+func (f *fakeKanikoCluster) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/api/v1/namespaces/builds/secrets":
+		json.NewDecoder(r.Body).Decode(&f.secret)
+	case r.Method == http.MethodPost && r.URL.Path == "/apis/batch/v1/namespaces/builds/jobs":
+		json.NewDecoder(r.Body).Decode(&f.job)
+	case r.Method == http.MethodGet && r.URL.Path == "/api/v1/namespaces/builds/pods":
+		if f.wgetArgs == nil {
+			f.wgetArgs = f.runInitContainer()
+			f.fetches = []int{f.replayFetch(), f.replayFetch()}
+		}
+		fmt.Fprint(w, `{"items":[{"metadata":{"name":"kaniko-dep-000001-abcde"},"status":{"phase":"Succeeded"}}]}`)
+		return
+	case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/log"):
+		fmt.Fprintln(w, "pushed image")
+		return
+	case r.Method == http.MethodGet && r.URL.Path == "/apis/batch/v1/namespaces/builds/jobs/kaniko-dep-000001":
+		fmt.Fprint(w, `{"status":{"succeeded":1}}`)
+		return
+	case r.Method == http.MethodDelete:
+		f.deleted = append(f.deleted, r.URL.Path)
+	default:
+		http.Error(w, "unexpected request", http.StatusNotImplemented)
+		return
+	}
+	fmt.Fprint(w, "{}")
+}
+
+// runInitContainer runs the fetch-context container of the recorded Job
+// with its env, its secret volume backed by the recorded Secret, and a
+// wget stub on PATH. It returns the arguments wget was called with.
+func (f *fakeKanikoCluster) runInitContainer() []string {
+	t := f.t
+	var spec struct {
+		Spec struct {
+			Template struct {
+				Spec struct {
+					InitContainers []struct {
+						Command []string `json:"command"`
+						Env     []struct {
+							Name  string `json:"name"`
+							Value string `json:"value"`
+						} `json:"env"`
+						VolumeMounts []struct {
+							Name      string `json:"name"`
+							MountPath string `json:"mountPath"`
+						} `json:"volumeMounts"`
+					} `json:"initContainers"`
+					Volumes []struct {
+						Name   string `json:"name"`
+						Secret *struct {
+							SecretName string `json:"secretName"`
+						} `json:"secret"`
+					} `json:"volumes"`
+				} `json:"spec"`
+			} `json:"template"`
+		} `json:"spec"`
+	}
+	raw, _ := json.Marshal(f.job)
+	if err := json.Unmarshal(raw, &spec); err != nil || len(spec.Spec.Template.Spec.InitContainers) != 1 {
+		t.Errorf("job spec %s: %v", raw, err)
+		return []string{}
+	}
+	pod := spec.Spec.Template.Spec
+	init := pod.InitContainers[0]
+
+	// Lay out the secret volume under a temporary root standing in for
+	// the container's file system.
+	root := t.TempDir()
+	secretName := f.secret["metadata"].(map[string]any)["name"]
+	token, _ := f.secret["stringData"].(map[string]any)["token"].(string)
+	for _, v := range pod.Volumes {
+		for _, m := range init.VolumeMounts {
+			if m.Name == v.Name && v.Secret != nil && v.Secret.SecretName == secretName {
+				dir := filepath.Join(root, m.MountPath)
+				os.MkdirAll(dir, 0o755)
+				os.WriteFile(filepath.Join(dir, "token"), []byte(token), 0o400)
+			}
+		}
+	}
+
+	bin := t.TempDir()
+	argsFile := filepath.Join(root, "wget-args")
+	stub := "#!/bin/sh\nfor a in \"$@\"; do printf '%s\\n' \"$a\"; done > " + argsFile + "\n"
+	if err := os.WriteFile(filepath.Join(bin, "wget"), []byte(stub), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(init.Command[0], init.Command[1:]...)
+	cmd.Env = []string{"PATH=" + bin + ":/usr/bin:/bin"}
+	for _, e := range init.Env {
+		if strings.HasPrefix(e.Value, "/") && e.Name != "CONTEXT_URL" {
+			e.Value = filepath.Join(root, e.Value)
+		}
+		cmd.Env = append(cmd.Env, e.Name+"="+e.Value)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("init container script: %v: %s", err, out)
+		return []string{}
+	}
+	recorded, _ := os.ReadFile(argsFile)
+	return strings.Split(strings.TrimSpace(string(recorded)), "\n")
+}
+
+// replayFetch sends the request wget was asked to make and returns the
+// response status.
+func (f *fakeKanikoCluster) replayFetch() int {
+	var header string
+	for i, a := range f.wgetArgs {
+		if a == "--header" && i+1 < len(f.wgetArgs) {
+			header = f.wgetArgs[i+1]
+		}
+	}
+	r, err := http.NewRequest(http.MethodGet, f.wgetArgs[len(f.wgetArgs)-1], nil)
+	if err != nil {
+		f.t.Errorf("replay %v: %v", f.wgetArgs, err)
+		return 0
+	}
+	if name, value, ok := strings.Cut(header, ": "); ok {
+		r.Header.Set(name, value)
+	}
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		f.t.Errorf("replay %v: %v", f.wgetArgs, err)
+		return 0
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestKanikoJobFetchesContextWithIssuedToken(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "Dockerfile"), []byte("FROM scratch\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{store: newMemoryStore(), contextTokens: newContextTokens()}
+	if err := s.store.Put(&Deployment{ID: "dep-000001", Namespace: "demo-apps", ExtractedPath: dir}); err != nil {
+		t.Fatal(err)
+	}
+	api := httptest.NewServer(http.HandlerFunc(s.handleDeploymentRoutes))
+	t.Cleanup(api.Close)
+	cluster := &fakeKanikoCluster{t: t}
+	kube := httptest.NewServer(http.HandlerFunc(cluster.serve))
+	t.Cleanup(kube.Close)
+
+	b := kanikoBuilder{
+		kube:         &kubeClient{baseURL: kube.URL, http: kube.Client()},
+		namespace:    "builds",
+		image:        "kaniko",
+		fetchImage:   "busybox",
+		uploadAPIURL: api.URL + "/",
+		tokens:       s.contextTokens,
+	}
+	req := BuildRequest{DeploymentID: "dep-000001", ServiceName: "hello", Namespace: "demo-apps", ContextDir: dir, Image: "registry.example/hello:dep-000001"}
+	if err := b.Build(testContext(t), req, io.Discard); err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+
+	token, _ := cluster.secret["stringData"].(map[string]any)["token"].(string)
+	if token == "" {
+		t.Fatalf("no token secret created: %v", cluster.secret)
+	}
+	want := []string{"-q", "--header", "Authorization: Bearer " + token, "-O", "/workspace/context.tar.gz", api.URL + "/deployments/dep-000001/context"}
+	if strings.Join(cluster.wgetArgs, " ") != strings.Join(want, " ") {
+		t.Errorf("init container ran wget %q, want %q", cluster.wgetArgs, want)
+	}
+	if len(cluster.fetches) != 2 || cluster.fetches[0] != http.StatusOK || cluster.fetches[1] != http.StatusForbidden {
+		t.Errorf("context downloads = %v, want [200 403]", cluster.fetches)
+	}
+	if raw, _ := json.Marshal(cluster.job); strings.Contains(string(raw), token) {
+		t.Errorf("job spec carries the token in plain text: %s", raw)
+	}
+	deleted := strings.Join(cluster.deleted, " ")
+	if !strings.Contains(deleted, "/secrets/kaniko-dep-000001-context") || !strings.Contains(deleted, "/jobs/kaniko-dep-000001") {
+		t.Errorf("deleted %v, want the job and the token secret", cluster.deleted)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	serviceReadyTimeout = 300 * time.Second
+	servicePollInterval = 2 * time.Second
+	localRegistryPrefix = "dev.local/"
+	knativeConfigNS     = "knative-serving"
+	skipTagResolvingKey = "registriesSkippingTagResolving"
+	mergePatchJSON      = "application/merge-patch+json"
+)
+
+// knativeServices drives serving.knative.dev/v1 Services through the
+// Kubernetes REST API.
+type knativeServices struct {
+	kube *kubeClient
+	// createNamespaces lets Apply and ApplySecret create a missing namespace.
+	createNamespaces bool
+	// patchLocalRegistry lets Apply add dev.local to Knative's
+	// registriesSkippingTagResolving. Off by default: the ConfigMap is
+	// cluster-wide and normally set once by install-knative-serving.sh.
+	patchLocalRegistry bool
+
+	skipMu   sync.Mutex
+	skipDone bool
+}
+
+func newKnativeServices(kube *kubeClient, createNamespaces, patchLocalRegistry bool) *knativeServices {
+	return &knativeServices{kube: kube, createNamespaces: createNamespaces, patchLocalRegistry: patchLocalRegistry}
+}
+
+func servicePath(namespace, name string) string {
+	return fmt.Sprintf("/apis/serving.knative.dev/v1/namespaces/%s/services/%s", namespace, name)
+}
+
+func (k *knativeServices) GetService(ctx context.Context, namespace, name string) (*ServiceState, error) {
+	var obj ksvcObject
+	if err := k.kube.do(ctx, http.MethodGet, servicePath(namespace, name), "", nil, &obj); err != nil {
+		return nil, err
+	}
+	return obj.state(), nil
+}
+
+func (k *knativeServices) Apply(ctx context.Context, namespace, name string, spec RevisionSpec, traffic []TrafficTarget) (int64, error) {
+	if traffic == nil {
+		latest := true
+		traffic = []TrafficTarget{{LatestRevision: &latest, Percent: 100}}
+	}
+	if k.patchLocalRegistry && strings.HasPrefix(spec.Image, localRegistryPrefix) {
+		k.ensureLocalRegistrySkipped(ctx)
+	}
+
+	body := map[string]any{
+		"spec": map[string]any{
+			"template": revisionTemplate(spec, true),
+			"traffic":  traffic,
+		},
+	}
+
+	var applied ksvcObject
+	err := k.kube.do(ctx, http.MethodPatch, servicePath(namespace, name), mergePatchJSON, body, &applied)
+	if isNotFound(err) {
+		if err := k.ensureNamespace(ctx, namespace); err != nil {
+			return 0, err
+		}
+		body["spec"].(map[string]any)["template"] = revisionTemplate(spec, false)
+		body["apiVersion"] = "serving.knative.dev/v1"
+		body["kind"] = "Service"
+		body["metadata"] = map[string]any{"name": name, "namespace": namespace}
+		err = k.kube.do(ctx, http.MethodPost, fmt.Sprintf("/apis/serving.knative.dev/v1/namespaces/%s/services", namespace), "", body, &applied)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("apply ksvc %s/%s: %w", namespace, name, err)
+	}
+	return applied.Metadata.Generation, nil
+}
+
+func (k *knativeServices) WaitReady(ctx context.Context, namespace, name string, generation int64) (*ServiceState, error) {
+	return k.waitSettled(ctx, namespace, name, generation)
+}
+
+func (k *knativeServices) SetTraffic(ctx context.Context, namespace, name string, targets []TrafficTarget) (*ServiceState, error) {
+	var applied ksvcObject
+	body := map[string]any{"spec": map[string]any{"traffic": targets}}
+	if err := k.kube.do(ctx, http.MethodPatch, servicePath(namespace, name), mergePatchJSON, body, &applied); err != nil {
+		return nil, fmt.Errorf("patch traffic for ksvc %s/%s: %w", namespace, name, err)
+	}
+	return k.waitSettled(ctx, namespace, name, applied.Metadata.Generation)
+}
+
+func (k *knativeServices) Delete(ctx context.Context, namespace, name string) error {
+	if err := k.kube.do(ctx, http.MethodDelete, servicePath(namespace, name), "", nil, nil); err != nil {
+		return fmt.Errorf("delete ksvc %s/%s: %w", namespace, name, err)
+	}
+	return nil
+}
+
+// waitSettled polls until the controller has observed generation and the
+// service is Ready (or has failed). Once settled, latestCreatedRevisionName
+// is the revision produced by that generation, not a guess from listing.
+func (k *knativeServices) waitSettled(ctx context.Context, namespace, name string, generation int64) (*ServiceState, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, serviceReadyTimeout)
+		defer cancel()
+	}
+	for {
+		var obj ksvcObject
+		if err := k.kube.do(ctx, http.MethodGet, servicePath(namespace, name), "", nil, &obj); err != nil {
+			return nil, err
+		}
+		if done, err := obj.settled(generation); done {
+			return obj.state(), err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for ksvc %s/%s generation %d: %w", namespace, name, generation, ctx.Err())
+		case <-time.After(servicePollInterval):
+		}
+	}
+}
+
+// ApplySecret writes data to the Opaque Secret namespace/name, creating the
+// namespace and the Secret as needed.
+func (k *knativeServices) ApplySecret(ctx context.Context, namespace, name string, data map[string]string) error {
+	if err := k.ensureNamespace(ctx, namespace); err != nil {
+		return err
+	}
+	body := map[string]any{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"type":       "Opaque",
+		"metadata": map[string]any{
+			"name":      name,
+			"namespace": namespace,
+			"labels":    map[string]string{"app.kubernetes.io/managed-by": "upload-api"},
+		},
+		"stringData": data,
+	}
+	path := fmt.Sprintf("/api/v1/namespaces/%s/secrets", namespace)
+	err := k.kube.do(ctx, http.MethodPost, path, "", body, nil)
+	var apiErr *kubeAPIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusConflict {
+		err = k.kube.do(ctx, http.MethodPatch, path+"/"+name, mergePatchJSON, map[string]any{"stringData": data}, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("apply secret %s/%s: %w", namespace, name, err)
+	}
+	return nil
+}
+
+func (k *knativeServices) NamespaceExists(ctx context.Context, namespace string) (bool, error) {
+	err := k.kube.do(ctx, http.MethodGet, "/api/v1/namespaces/"+namespace, "", nil, nil)
+	if isNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (k *knativeServices) ensureNamespace(ctx context.Context, namespace string) error {
+	exists, err := k.NamespaceExists(ctx, namespace)
+	if exists || err != nil {
+		return err
+	}
+	if !k.createNamespaces {
+		return fmt.Errorf("namespace %s does not exist and namespace creation is disabled", namespace)
+	}
+	body := map[string]any{
+		"apiVersion": "v1",
+		"kind":       "Namespace",
+		"metadata":   map[string]any{"name": namespace},
+	}
+	log.Printf("creating namespace %s", namespace)
+	return k.kube.do(ctx, http.MethodPost, "/api/v1/namespaces", "", body, nil)
+}
+
+// ensureLocalRegistrySkipped adds dev.local to Knative's
+// registriesSkippingTagResolving so locally built images are not resolved
+// against a remote registry. Failures are logged, not fatal: the setting may
+// already be managed by the cluster admin.
+func (k *knativeServices) ensureLocalRegistrySkipped(ctx context.Context) {
+	k.skipMu.Lock()
+	defer k.skipMu.Unlock()
+	if k.skipDone {
+		return
+	}
+
+	path := fmt.Sprintf("/api/v1/namespaces/%s/configmaps/config-deployment", knativeConfigNS)
+	var cm struct {
+		Data map[string]string `json:"data"`
+	}
+	if err := k.kube.do(ctx, http.MethodGet, path, "", nil, &cm); err != nil {
+		log.Printf("failed to read knative config-deployment: %v", err)
+		return
+	}
+	current := cm.Data[skipTagResolvingKey]
+	registry := strings.TrimSuffix(localRegistryPrefix, "/")
+	for _, entry := range strings.Split(current, ",") {
+		if strings.TrimSpace(entry) == registry {
+			k.skipDone = true
+			return
+		}
+	}
+	next := registry
+	if current != "" {
+		next = current + "," + registry
+	}
+	patch := map[string]any{"data": map[string]string{skipTagResolvingKey: next}}
+	if err := k.kube.do(ctx, http.MethodPatch, path, mergePatchJSON, patch, nil); err != nil {
+		log.Printf("failed to patch knative %s: %v", skipTagResolvingKey, err)
+		return
+	}
+	log.Printf("configured knative %s=%s", skipTagResolvingKey, next)
+	k.skipDone = true
+}
+
+// revisionTemplate renders spec as a service template, either for a merge
+// patch of an existing service or for a new one.
+func revisionTemplate(spec RevisionSpec, patch bool) map[string]any {
+	container := map[string]any{
+		"image":           spec.Image,
+		"imagePullPolicy": "IfNotPresent",
+	}
+	if spec.Port > 0 {
+		container["ports"] = []map[string]any{{"containerPort": spec.Port}}
+	}
+	if len(spec.Env) > 0 {
+		container["env"] = spec.Env
+	}
+	if len(spec.EnvFrom) > 0 {
+		container["envFrom"] = spec.EnvFrom
+	}
+	if spec.Resources != nil {
+		container["resources"] = spec.Resources.container()
+	}
+	if spec.Probes != nil && spec.Probes.Readiness != nil {
+		container["readinessProbe"] = spec.Probes.Readiness.container()
+	}
+	if spec.Probes != nil && spec.Probes.Liveness != nil {
+		container["livenessProbe"] = spec.Probes.Liveness.container()
+	}
+
+	// A merge patch replaces the container list as a whole, but merges
+	// annotations key by key, so owned annotations that are no longer set
+	// must be removed explicitly.
+	annotations := map[string]any{}
+	if patch {
+		for _, key := range autoscalingAnnotations {
+			annotations[key] = nil
+		}
+	}
+	for k, v := range spec.Annotations {
+		annotations[k] = v
+	}
+	template := map[string]any{"containers": []map[string]any{container}}
+	if spec.ContainerConcurrency != nil {
+		template["containerConcurrency"] = *spec.ContainerConcurrency
+	} else if patch {
+		template["containerConcurrency"] = nil
+	}
+	return map[string]any{
+		"metadata": map[string]any{"annotations": annotations},
+		"spec":     template,
+	}
+}
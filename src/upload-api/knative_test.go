@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeKnative is a minimal serving.knative.dev/v1 API server. Each service
+// write bumps metadata.generation, and the "controller" observes it lag GETs
+// later as revision <name>-<generation, zero-padded to 5 digits>.
+type fakeKnative struct {
+	mu         sync.Mutex
+	lag        int
+	notReady   string
+	namespaces map[string]bool
+	services   map[string]*fakeKsvc
+	configMap  map[string]string
+	requests   []string
+}
+
+type fakeKsvc struct {
+	namespace, name string
+	generation      int64
+	observed        int64
+	pending         int
+	template        map[string]any
+	contentType     string
+}
+
+func newFakeKnative(t *testing.T, namespaces ...string) (*fakeKnative, *kubeClient) {
+	t.Helper()
+	f := &fakeKnative{namespaces: map[string]bool{}, services: map[string]*fakeKsvc{}, configMap: map[string]string{}}
+	for _, ns := range namespaces {
+		f.namespaces[ns] = true
+	}
+	srv := httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(srv.Close)
+	return f, &kubeClient{baseURL: srv.URL, http: srv.Client()}
+}
+
+func (f *fakeKnative) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+
+	var body map[string]any
+	if r.Body != nil {
+		_ = json.NewDecoder(r.Body).Decode(&body)
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.URL.Path == "/api/v1/namespaces" && r.Method == http.MethodPost:
+		f.namespaces[body["metadata"].(map[string]any)["name"].(string)] = true
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, "{}")
+	case len(parts) == 4 && parts[2] == "namespaces" && r.Method == http.MethodGet:
+		if !f.namespaces[parts[3]] {
+			http.Error(w, "namespace not found", http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, "{}")
+	case strings.HasSuffix(r.URL.Path, "/configmaps/config-deployment"):
+		if r.Method == http.MethodPatch {
+			for k, v := range body["data"].(map[string]any) {
+				f.configMap[k] = v.(string)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"data": f.configMap})
+	case strings.HasPrefix(r.URL.Path, "/apis/serving.knative.dev/v1/namespaces/"):
+		f.serveKsvc(w, r, parts, body)
+	default:
+		http.Error(w, "unexpected request", http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeKnative) serveKsvc(w http.ResponseWriter, r *http.Request, parts []string, body map[string]any) {
+	ns := parts[4]
+	if r.Method == http.MethodPost {
+		if !f.namespaces[ns] {
+			http.Error(w, "namespace not found", http.StatusNotFound)
+			return
+		}
+		name := body["metadata"].(map[string]any)["name"].(string)
+		svc := &fakeKsvc{namespace: ns, name: name}
+		f.services[ns+"/"+name] = svc
+		f.write(svc, r, body)
+		f.encode(w, svc)
+		return
+	}
+	svc, ok := f.services[ns+"/"+parts[6]]
+	if !ok {
+		http.Error(w, "service not found", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodPatch:
+		f.write(svc, r, body)
+	case http.MethodGet:
+		if svc.observed < svc.generation {
+			if svc.pending == 0 {
+				svc.observed = svc.generation
+			} else {
+				svc.pending--
+			}
+		}
+	}
+	f.encode(w, svc)
+}
+
+func (f *fakeKnative) write(svc *fakeKsvc, r *http.Request, body map[string]any) {
+	svc.generation++
+	svc.pending = f.lag
+	svc.contentType = r.Header.Get("Content-Type")
+	svc.template, _ = body["spec"].(map[string]any)["template"].(map[string]any)
+}
+
+func (f *fakeKnative) encode(w http.ResponseWriter, svc *fakeKsvc) {
+	var obj ksvcObject
+	obj.Metadata.Name = svc.name
+	obj.Metadata.Namespace = svc.namespace
+	obj.Metadata.Generation = svc.generation
+	obj.Status.ObservedGeneration = svc.observed
+	if svc.observed > 0 {
+		revision := fmt.Sprintf("%s-%05d", svc.name, svc.observed)
+		obj.Status.LatestCreatedRevisionName = revision
+		obj.Status.LatestReadyRevisionName = revision
+		obj.Status.Traffic = []TrafficTarget{{RevisionName: revision, Percent: 100}}
+		obj.Status.Conditions = append(obj.Status.Conditions, struct {
+			Type    string `json:"type"`
+			Status  string `json:"status"`
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		}{Type: "Ready", Status: "True"})
+		if f.notReady != "" {
+			obj.Status.Conditions[0].Status = "False"
+			obj.Status.Conditions[0].Reason = "RevisionFailed"
+			obj.Status.Conditions[0].Message = f.notReady
+		}
+	}
+	json.NewEncoder(w).Encode(obj)
+}
+
+func (f *fakeKnative) sawRequest(prefix string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, r := range f.requests {
+		if strings.HasPrefix(r, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func testContext(t *testing.T) context.Context {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestKnativeApplyCreatesServiceAndNamespace(t *testing.T) {
+	fake, kube := newFakeKnative(t)
+	k := newKnativeServices(kube, true, false)
+	ctx := testContext(t)
+
+	generation, err := k.Apply(ctx, "demo-apps", "hello", RevisionSpec{Image: "dev.local/hello:dep-000001"}, nil)
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if generation != 1 {
+		t.Fatalf("generation = %d, want 1", generation)
+	}
+	if !fake.namespaces["demo-apps"] {
+		t.Fatalf("namespace demo-apps was not created")
+	}
+	if fake.sawRequest("GET /api/v1/namespaces/knative-serving/configmaps") {
+		t.Fatalf("Apply read config-deployment although patchLocalRegistry is off")
+	}
+
+	state, err := k.WaitReady(ctx, "demo-apps", "hello", generation)
+	if err != nil {
+		t.Fatalf("WaitReady: %v", err)
+	}
+	if state.LatestCreatedRevision != "hello-00001" {
+		t.Fatalf("LatestCreatedRevision = %q, want hello-00001", state.LatestCreatedRevision)
+	}
+}
+
+func TestKnativeApplyRefusesMissingNamespace(t *testing.T) {
+	fake, kube := newFakeKnative(t)
+	k := newKnativeServices(kube, false, false)
+
+	_, err := k.Apply(testContext(t), "demo-apps", "hello", RevisionSpec{Image: "dev.local/hello:1"}, nil)
+	if err == nil || !strings.Contains(err.Error(), "namespace creation is disabled") {
+		t.Fatalf("Apply error = %v, want namespace creation disabled", err)
+	}
+	if fake.sawRequest("POST ") {
+		t.Fatalf("Apply created objects with namespace creation disabled: %v", fake.requests)
+	}
+}
+
+func TestKnativeWaitReadyResolvesRevisionOfAppliedGeneration(t *testing.T) {
+	fake, kube := newFakeKnative(t, "demo-apps")
+	k := newKnativeServices(kube, false, false)
+	ctx := testContext(t)
+
+	first, err := k.Apply(ctx, "demo-apps", "hello", RevisionSpec{Image: "dev.local/hello:1"}, nil)
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if _, err := k.WaitReady(ctx, "demo-apps", "hello", first); err != nil {
+		t.Fatalf("WaitReady: %v", err)
+	}
+
+	// The controller still reports the previous generation on the next GET,
+	// so a stale Ready=True must not resolve to hello-00001.
+	fake.lag = 1
+	spec := RevisionSpec{Image: "dev.local/hello:2", Annotations: map[string]string{annotationMinScale: "1"}}
+	second, err := k.Apply(ctx, "demo-apps", "hello", spec, nil)
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if second != 2 {
+		t.Fatalf("generation = %d, want 2", second)
+	}
+	svc := fake.services["demo-apps/hello"]
+	if svc.contentType != mergePatchJSON {
+		t.Fatalf("update Content-Type = %q, want %q", svc.contentType, mergePatchJSON)
+	}
+	annotations := svc.template["metadata"].(map[string]any)["annotations"].(map[string]any)
+	if annotations[annotationMinScale] != "1" {
+		t.Fatalf("min-scale annotation = %v, want 1", annotations[annotationMinScale])
+	}
+	if v, ok := annotations[annotationMaxScale]; !ok || v != nil {
+		t.Fatalf("max-scale annotation = %v (present %v), want explicit null", v, ok)
+	}
+
+	state, err := k.WaitReady(ctx, "demo-apps", "hello", second)
+	if err != nil {
+		t.Fatalf("WaitReady: %v", err)
+	}
+	if state.LatestCreatedRevision != "hello-00002" {
+		t.Fatalf("LatestCreatedRevision = %q, want hello-00002", state.LatestCreatedRevision)
+	}
+}
+
+func TestKnativeWaitReadyReportsReadyFalse(t *testing.T) {
+	fake, kube := newFakeKnative(t, "demo-apps")
+	fake.notReady = "container exited with 1"
+	k := newKnativeServices(kube, false, false)
+	ctx := testContext(t)
+
+	generation, err := k.Apply(ctx, "demo-apps", "hello", RevisionSpec{Image: "dev.local/hello:1"}, nil)
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	_, err = k.WaitReady(ctx, "demo-apps", "hello", generation)
+	if err == nil || !strings.Contains(err.Error(), "RevisionFailed: container exited with 1") {
+		t.Fatalf("WaitReady error = %v, want RevisionFailed", err)
+	}
+}
+
+func TestKnativeApplyPatchesLocalRegistryOnlyWhenEnabled(t *testing.T) {
+	fake, kube := newFakeKnative(t, "demo-apps")
+	fake.configMap[skipTagResolvingKey] = "kind.local"
+	k := newKnativeServices(kube, false, true)
+	ctx := testContext(t)
+
+	if _, err := k.Apply(ctx, "demo-apps", "hello", RevisionSpec{Image: "registry.example.com/hello:1"}, nil); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if fake.configMap[skipTagResolvingKey] != "kind.local" {
+		t.Fatalf("remote image changed %s to %q", skipTagResolvingKey, fake.configMap[skipTagResolvingKey])
+	}
+	if _, err := k.Apply(ctx, "demo-apps", "hello", RevisionSpec{Image: "dev.local/hello:2"}, nil); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if got := fake.configMap[skipTagResolvingKey]; got != "kind.local,dev.local" {
+		t.Fatalf("%s = %q, want kind.local,dev.local", skipTagResolvingKey, got)
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	inClusterAPIURL   = "https://kubernetes.default.svc"
+)
+
+// kubeClient is a minimal Kubernetes REST client. It authenticates with the
+// pod service account in-cluster, or with the current kubeconfig context.
+type kubeClient struct {
+	baseURL string
+	token   string
+	user    string
+	pass    string
+	http    *http.Client
+}
+
+type kubeAPIError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *kubeAPIError) Error() string {
+	return fmt.Sprintf("kubernetes api status %d: %s", e.StatusCode, e.Body)
+}
+
+func isNotFound(err error) bool {
+	var apiErr *kubeAPIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// newKubeClient resolves cluster access in order: KUBE_API_URL (plain URL,
+// e.g. kubectl proxy or a fake API server), in-cluster service account,
+// then KUBECONFIG / ~/.kube/config.
+func newKubeClient() (*kubeClient, error) {
+	if raw := strings.TrimSpace(os.Getenv("KUBE_API_URL")); raw != "" {
+		return &kubeClient{
+			baseURL: strings.TrimRight(raw, "/"),
+			token:   strings.TrimSpace(os.Getenv("KUBE_TOKEN")),
+			http:    &http.Client{Timeout: 30 * time.Second},
+		}, nil
+	}
+	if inCluster() {
+		return inClusterClient()
+	}
+	return kubeconfigClient(kubeconfigPath())
+}
+
+func inCluster() bool {
+	_, err := os.Stat(filepath.Join(serviceAccountDir, "token"))
+	return err == nil
+}
+
+func inClusterClient() (*kubeClient, error) {
+	tokenBytes, err := os.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return nil, err
+	}
+	caBytes, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caBytes) {
+		return nil, fmt.Errorf("failed to parse serviceaccount ca")
+	}
+
+	return &kubeClient{
+		baseURL: inClusterAPIURL,
+		token:   strings.TrimSpace(string(tokenBytes)),
+		http: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+type kubeconfig struct {
+	CurrentContext string `json:"current-context"`
+	Contexts       []struct {
+		Name    string `json:"name"`
+		Context struct {
+			Cluster string `json:"cluster"`
+			User    string `json:"user"`
+		} `json:"context"`
+	} `json:"contexts"`
+	Clusters []struct {
+		Name    string `json:"name"`
+		Cluster struct {
+			Server                   string `json:"server"`
+			CertificateAuthority     string `json:"certificate-authority"`
+			CertificateAuthorityData string `json:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `json:"insecure-skip-tls-verify"`
+		} `json:"cluster"`
+	} `json:"clusters"`
+	Users []struct {
+		Name string `json:"name"`
+		User struct {
+			Token                 string `json:"token"`
+			TokenFile             string `json:"tokenFile"`
+			ClientCertificate     string `json:"client-certificate"`
+			ClientCertificateData string `json:"client-certificate-data"`
+			ClientKey             string `json:"client-key"`
+			ClientKeyData         string `json:"client-key-data"`
+			Username              string `json:"username"`
+			Password              string `json:"password"`
+		} `json:"user"`
+	} `json:"users"`
+}
+
+func kubeconfigPath() string {
+	if raw := strings.TrimSpace(os.Getenv("KUBECONFIG")); raw != "" {
+		return filepath.SplitList(raw)[0]
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".kube/config"
+	}
+	return filepath.Join(home, ".kube", "config")
+}
+
+func kubeconfigClient(path string) (*kubeClient, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read kubeconfig: %w", err)
+	}
+	var cfg kubeconfig
+	if err := yaml.Unmarshal(raw, &cfg); err != nil {
+		return nil, fmt.Errorf("parse kubeconfig %s: %w", path, err)
+	}
+
+	var clusterName, userName string
+	for _, c := range cfg.Contexts {
+		if c.Name == cfg.CurrentContext {
+			clusterName, userName = c.Context.Cluster, c.Context.User
+		}
+	}
+	if clusterName == "" {
+		return nil, fmt.Errorf("kubeconfig %s: current context %q not found", path, cfg.CurrentContext)
+	}
+
+	baseDir := filepath.Dir(path)
+	tlsConfig := &tls.Config{}
+	client := &kubeClient{}
+	for _, c := range cfg.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+		client.baseURL = strings.TrimRight(c.Cluster.Server, "/")
+		tlsConfig.InsecureSkipVerify = c.Cluster.InsecureSkipTLSVerify
+		ca, err := inlineOrFile(c.Cluster.CertificateAuthorityData, c.Cluster.CertificateAuthority, baseDir)
+		if err != nil {
+			return nil, fmt.Errorf("kubeconfig cluster %s: %w", clusterName, err)
+		}
+		if len(ca) > 0 {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("kubeconfig cluster %s: invalid certificate authority", clusterName)
+			}
+			tlsConfig.RootCAs = pool
+		}
+	}
+	if client.baseURL == "" {
+		return nil, fmt.Errorf("kubeconfig %s: cluster %q not found", path, clusterName)
+	}
+
+	for _, u := range cfg.Users {
+		if u.Name != userName {
+			continue
+		}
+		client.token = u.User.Token
+		if client.token == "" && u.User.TokenFile != "" {
+			tok, err := os.ReadFile(resolvePath(u.User.TokenFile, baseDir))
+			if err != nil {
+				return nil, fmt.Errorf("kubeconfig user %s: %w", userName, err)
+			}
+			client.token = strings.TrimSpace(string(tok))
+		}
+		client.user, client.pass = u.User.Username, u.User.Password
+
+		cert, err := inlineOrFile(u.User.ClientCertificateData, u.User.ClientCertificate, baseDir)
+		if err != nil {
+			return nil, fmt.Errorf("kubeconfig user %s: %w", userName, err)
+		}
+		key, err := inlineOrFile(u.User.ClientKeyData, u.User.ClientKey, baseDir)
+		if err != nil {
+			return nil, fmt.Errorf("kubeconfig user %s: %w", userName, err)
+		}
+		if len(cert) > 0 && len(key) > 0 {
+			pair, err := tls.X509KeyPair(cert, key)
+			if err != nil {
+				return nil, fmt.Errorf("kubeconfig user %s: %w", userName, err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{pair}
+		}
+	}
+
+	client.http = &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+	return client, nil
+}
+
+// inlineOrFile returns base64-decoded inline data, or the contents of path
+// (relative to baseDir) when no inline data is set.
+func inlineOrFile(data, path, baseDir string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if path == "" {
+		return nil, nil
+	}
+	return os.ReadFile(resolvePath(path, baseDir))
+}
+
+func resolvePath(path, baseDir string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(baseDir, path)
+}
+
+// do sends a JSON request and decodes a JSON response into out (if non-nil).
+// Non-2xx responses are returned as *kubeAPIError.
+func (c *kubeClient) do(ctx context.Context, method, path, contentType string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		req.Header.Set("Content-Type", contentType)
+	}
+	c.authorize(req)
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		data, _ := io.ReadAll(io.LimitReader(res.Body, 2000))
+		return &kubeAPIError{StatusCode: res.StatusCode, Body: strings.TrimSpace(string(data))}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// stream issues a GET whose body is consumed incrementally (e.g. follow=true
+// pod logs), so the client-wide timeout does not apply.
+func (c *kubeClient) stream(ctx context.Context, path string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.authorize(req)
+
+	client := *c.http
+	client.Timeout = 0
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 300 {
+		defer res.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(res.Body, 2000))
+		return nil, &kubeAPIError{StatusCode: res.StatusCode, Body: strings.TrimSpace(string(data))}
+	}
+	return res.Body, nil
+}
+
+func (c *kubeClient) authorize(req *http.Request) {
+	switch {
+	case c.token != "":
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	case c.user != "":
+		req.SetBasicAuth(c.user, c.pass)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 200
+)
+
+type DeploymentList struct {
+	Items      []*Deployment `json:"items"`
+	NextCursor string        `json:"nextCursor,omitempty"`
+}
+
+type deploymentFilter struct {
+	serviceName   string
+	namespace     string
+	createdBy     string
+	statuses      map[string]bool
+	createdAfter  time.Time
+	createdBefore time.Time
+	descending    bool
+	limit         int
+	afterID       string
+	// visible reports whether the caller may see deployments in a
+	// namespace; nil shows every namespace.
+	visible func(namespace string) bool
+}
+
+func (s *Server) handleListDeployments(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	f, err := parseDeploymentFilter(r.URL.Query())
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	// Records are listed only in namespaces whose logs the caller may read,
+	// as for GET /deployments/{id}/logs. Filtering before the page is cut
+	// keeps limit and nextCursor consistent.
+	f.visible = func(namespace string) bool { return s.permits(r, actionLogs, namespace) }
+	list := listDeployments(s.store.List(), f)
+	for _, d := range list.Items {
+		s.withQueuePosition(d)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func parseDeploymentFilter(q url.Values) (deploymentFilter, error) {
+	f := deploymentFilter{
+		serviceName: strings.TrimSpace(q.Get("serviceName")),
+		namespace:   strings.TrimSpace(q.Get("namespace")),
+		createdBy:   strings.TrimSpace(q.Get("createdBy")),
+		descending:  true,
+		limit:       defaultListLimit,
+	}
+
+	if raw := strings.TrimSpace(q.Get("status")); raw != "" {
+		f.statuses = map[string]bool{}
+		for _, status := range strings.Split(raw, ",") {
+			if status = strings.ToUpper(strings.TrimSpace(status)); status != "" {
+				f.statuses[status] = true
+			}
+		}
+	}
+
+	var err error
+	if f.createdAfter, err = parseTimeParam(q, "createdAfter"); err != nil {
+		return f, err
+	}
+	if f.createdBefore, err = parseTimeParam(q, "createdBefore"); err != nil {
+		return f, err
+	}
+
+	switch strings.ToLower(strings.TrimSpace(q.Get("order"))) {
+	case "", "desc":
+	case "asc":
+		f.descending = false
+	default:
+		return f, fmt.Errorf("order must be asc or desc")
+	}
+
+	if raw := strings.TrimSpace(q.Get("limit")); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxListLimit {
+			return f, fmt.Errorf("limit must be between 1 and %d", maxListLimit)
+		}
+		f.limit = n
+	}
+
+	if raw := strings.TrimSpace(q.Get("cursor")); raw != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(raw)
+		if err != nil {
+			return f, fmt.Errorf("invalid cursor")
+		}
+		if _, ok := parseID(string(decoded)); !ok {
+			return f, fmt.Errorf("invalid cursor")
+		}
+		f.afterID = string(decoded)
+	}
+	return f, nil
+}
+
+func parseTimeParam(q url.Values, key string) (time.Time, error) {
+	raw := strings.TrimSpace(q.Get(key))
+	if raw == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be an RFC3339 timestamp", key)
+	}
+	return t, nil
+}
+
+// listDeployments applies f to all (ID-ordered) deployments. The cursor is
+// the encoded ID of the last item on the previous page, which stays stable
+// while new deployments are added.
+func listDeployments(all []*Deployment, f deploymentFilter) DeploymentList {
+	if f.descending {
+		for i, j := 0, len(all)-1; i < j; i, j = i+1, j-1 {
+			all[i], all[j] = all[j], all[i]
+		}
+	}
+
+	items := make([]*Deployment, 0, f.limit)
+	more := false
+	for _, d := range all {
+		if f.afterID != "" {
+			if f.descending && !idLess(d.ID, f.afterID) {
+				continue
+			}
+			if !f.descending && !idLess(f.afterID, d.ID) {
+				continue
+			}
+		}
+		if !f.matches(d) {
+			continue
+		}
+		if len(items) == f.limit {
+			more = true
+			break
+		}
+		items = append(items, d)
+	}
+
+	list := DeploymentList{Items: items}
+	if more {
+		list.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(items[len(items)-1].ID))
+	}
+	return list
+}
+
+func (f deploymentFilter) matches(d *Deployment) bool {
+	if f.serviceName != "" && d.ServiceName != f.serviceName {
+		return false
+	}
+	if f.namespace != "" && d.Namespace != f.namespace {
+		return false
+	}
+	if f.createdBy != "" && d.CreatedBy != f.createdBy {
+		return false
+	}
+	if f.statuses != nil && !f.statuses[d.Status] {
+		return false
+	}
+	if !f.createdAfter.IsZero() && d.CreatedAt.Before(f.createdAfter) {
+		return false
+	}
+	if !f.createdBefore.IsZero() && !d.CreatedAt.Before(f.createdBefore) {
+		return false
+	}
+	if f.visible != nil && !f.visible(d.Namespace) {
+		return false
+	}
+	return true
+}
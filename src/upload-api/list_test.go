@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func listIDs(list DeploymentList) []string {
+	var ids []string
+	for _, d := range list.Items {
+		ids = append(ids, d.ID)
+	}
+	return ids
+}
+
+// listFixture returns deployments dep-000001..dep-000012, an hour apart,
+// in the order the store lists them. They cycle through two services, two
+// namespaces, two creators and three statuses.
+func listFixture() []*Deployment {
+	base := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	statuses := []string{statusReady, statusFailed, statusQueued}
+	var all []*Deployment
+	for i := 1; i <= 12; i++ {
+		all = append(all, &Deployment{
+			ID:          fmt.Sprintf("dep-%06d", i),
+			ServiceName: []string{"api", "web"}[i%2],
+			Namespace:   []string{"demo-apps", "staging"}[i/7],
+			CreatedBy:   []string{"alice", "ci-bot"}[i%3/2],
+			Status:      statuses[i%3],
+			CreatedAt:   base.Add(time.Duration(i) * time.Hour),
+		})
+	}
+	return all
+}
+
+func TestListDeploymentsFilters(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		want  string
+	}{
+		{"", "dep-000012,dep-000011,dep-000010,dep-000009,dep-000008,dep-000007,dep-000006,dep-000005,dep-000004,dep-000003,dep-000002,dep-000001"},
+		{"order=asc&limit=3", "dep-000001,dep-000002,dep-000003"},
+		{"serviceName=api&namespace=demo-apps", "dep-000006,dep-000004,dep-000002"},
+		{"namespace=staging&order=ASC", "dep-000007,dep-000008,dep-000009,dep-000010,dep-000011,dep-000012"},
+		{"createdBy=ci-bot", "dep-000011,dep-000008,dep-000005,dep-000002"},
+		{"status=ready", "dep-000012,dep-000009,dep-000006,dep-000003"},
+		{"status=READY,%20failed&limit=4", "dep-000012,dep-000010,dep-000009,dep-000007"},
+		{"createdAfter=2026-10-01T10:00:00Z", "dep-000012,dep-000011,dep-000010"},
+		{"createdBefore=2026-10-01T03:00:00Z", "dep-000002,dep-000001"},
+		{"createdAfter=2026-10-01T04:00:00Z&createdBefore=2026-10-01T06:00:00%2B00:00&order=asc", "dep-000004,dep-000005"},
+		{"serviceName=nope", ""},
+	} {
+		q, _ := url.ParseQuery(tc.query)
+		f, err := parseDeploymentFilter(q)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.query, err)
+		}
+		list := listDeployments(listFixture(), f)
+		if got := strings.Join(listIDs(list), ","); got != tc.want {
+			t.Errorf("%q = %s, want %s", tc.query, got, tc.want)
+		}
+	}
+}
+
+func TestListDeploymentsCursor(t *testing.T) {
+	for _, order := range []string{"desc", "asc"} {
+		var seen []string
+		cursor := ""
+		for pages := 0; ; pages++ {
+			if pages > 5 {
+				t.Fatalf("%s: cursor never ran out", order)
+			}
+			q := url.Values{"order": {order}, "limit": {"5"}, "status": {"READY,FAILED"}}
+			if cursor != "" {
+				q.Set("cursor", cursor)
+			}
+			f, err := parseDeploymentFilter(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			list := listDeployments(listFixture(), f)
+			seen = append(seen, listIDs(list)...)
+			if list.NextCursor == "" {
+				break
+			}
+			if len(list.Items) != 5 {
+				t.Fatalf("%s: page of %d items has a cursor", order, len(list.Items))
+			}
+			cursor = list.NextCursor
+		}
+		if len(seen) != 8 {
+			t.Fatalf("%s: pages held %v, want the 8 READY or FAILED deployments", order, seen)
+		}
+		for i := 1; i < len(seen); i++ {
+			if (order == "desc") != idLess(seen[i], seen[i-1]) {
+				t.Fatalf("%s: pages out of order: %v", order, seen)
+			}
+		}
+	}
+
+	// A page that ends exactly on the last match has no cursor.
+	f, _ := parseDeploymentFilter(url.Values{"limit": {"4"}, "status": {"READY"}})
+	if list := listDeployments(listFixture(), f); list.NextCursor != "" {
+		t.Fatalf("full last page has cursor %q", list.NextCursor)
+	}
+
+	// The cursor is the last ID, so records added meanwhile do not shift
+	// the next page.
+	f, _ = parseDeploymentFilter(url.Values{"limit": {"2"}})
+	first := listDeployments(listFixture(), f)
+	newer := append(listFixture(), &Deployment{ID: "dep-000013", Status: statusQueued})
+	f, _ = parseDeploymentFilter(url.Values{"limit": {"2"}, "cursor": {first.NextCursor}})
+	if got := strings.Join(listIDs(listDeployments(newer, f)), ","); got != "dep-000010,dep-000009" {
+		t.Fatalf("page after new deployment = %s, want dep-000010,dep-000009", got)
+	}
+}
+
+func TestParseDeploymentFilterRejectsInvalid(t *testing.T) {
+	for query, want := range map[string]string{
+		"limit=0":                 "limit must be between 1 and 200",
+		"limit=201":               "limit must be between 1 and 200",
+		"limit=ten":               "limit must be between 1 and 200",
+		"order=newest":            "order must be asc or desc",
+		"createdAfter=yesterday":  "createdAfter must be an RFC3339 timestamp",
+		"createdBefore=2026-10-1": "createdBefore must be an RFC3339 timestamp",
+		"cursor=!!!":              "invalid cursor",
+		"cursor=" + base64.RawURLEncoding.EncodeToString([]byte("not-an-id")): "invalid cursor",
+	} {
+		q, _ := url.ParseQuery(query)
+		if _, err := parseDeploymentFilter(q); err == nil || err.Error() != want {
+			t.Errorf("%q: err = %v, want %q", query, err, want)
+		}
+	}
+}
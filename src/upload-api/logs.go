@@ -0,0 +1,217 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	logFlushInterval = time.Second
+	// logRingLines bounds the lines kept per running deployment; older lines
+	// are dropped and followers are told how many they missed.
+	logRingLines = 5000
+	// logMaxLineBytes splits runaway lines (e.g. \r progress bars).
+	logMaxLineBytes = 16 << 10
+)
+
+// deploymentLog captures the output of one build/deploy run in a ring buffer
+// of lines. Followers read it live through /deployments/{id}/logs, and it is
+// periodically copied into Deployment.Output.
+type deploymentLog struct {
+	s  *Server
+	id string
+
+	mu      sync.Mutex
+	lines   []string // ring; line seq n lives at lines[n%logRingLines]
+	first   uint64   // seq of the oldest retained line
+	next    uint64   // seq of the next line to be written
+	partial []byte
+	closed  bool
+	changed chan struct{} // closed and replaced on every append
+	dirty   bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// openLog starts capturing output for id and registers it for followers.
+func (s *Server) openLog(id string) *deploymentLog {
+	l := &deploymentLog{
+		s:       s,
+		id:      id,
+		changed: make(chan struct{}),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	s.logsMu.Lock()
+	s.liveLogs[id] = l
+	s.logsMu.Unlock()
+	go l.flushLoop()
+	return l
+}
+
+func (s *Server) liveLog(id string) *deploymentLog {
+	s.logsMu.Lock()
+	defer s.logsMu.Unlock()
+	return s.liveLogs[id]
+}
+
+func (l *deploymentLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, b := range p {
+		if b == '\n' || len(l.partial) >= logMaxLineBytes {
+			l.appendLine(strings.TrimSuffix(string(l.partial), "\r"))
+			l.partial = l.partial[:0]
+			if b == '\n' {
+				continue
+			}
+		}
+		l.partial = append(l.partial, b)
+	}
+	return len(p), nil
+}
+
+func (l *deploymentLog) appendLine(line string) {
+	if l.lines == nil {
+		l.lines = make([]string, logRingLines)
+	}
+	l.lines[l.next%logRingLines] = line
+	l.next++
+	if l.next-l.first > logRingLines {
+		l.first = l.next - logRingLines
+	}
+	l.dirty = true
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// since returns the retained lines with seq >= from, the seq of the first
+// returned line, the seq after the last one, whether the log is closed, and
+// a channel closed on the next write.
+func (l *deploymentLog) since(from uint64) ([]string, uint64, uint64, bool, <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if from < l.first {
+		from = l.first
+	}
+	var out []string
+	for seq := from; seq < l.next; seq++ {
+		out = append(out, l.lines[seq%logRingLines])
+	}
+	return out, from, l.next, l.closed, l.changed
+}
+
+// mark returns the seq of the next line to be written.
+func (l *deploymentLog) mark() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.next
+}
+
+// tail returns up to n of the last retained lines with seq >= from,
+// including an unterminated last line.
+func (l *deploymentLog) tail(from uint64, n int) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if from < l.first {
+		from = l.first
+	}
+	var lines []string
+	for seq := from; seq < l.next; seq++ {
+		lines = append(lines, l.lines[seq%logRingLines])
+	}
+	if len(l.partial) > 0 {
+		lines = append(lines, string(l.partial))
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// String returns the retained output, including an unterminated last line.
+func (l *deploymentLog) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.retained()
+}
+
+// snapshot returns the retained output and the seq of its first line.
+func (l *deploymentLog) snapshot() (string, uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.retained(), l.first
+}
+
+func (l *deploymentLog) retained() string {
+	var b strings.Builder
+	for seq := l.first; seq < l.next; seq++ {
+		b.WriteString(l.lines[seq%logRingLines])
+		b.WriteByte('\n')
+	}
+	b.Write(l.partial)
+	return b.String()
+}
+
+// Close ends the log: pending output becomes a final line, followers are
+// woken, and the log is unregistered. Record the final status before
+// calling Close so followers that see the end also see a terminal status.
+func (l *deploymentLog) Close() {
+	close(l.stop)
+	<-l.done
+
+	l.mu.Lock()
+	if len(l.partial) > 0 {
+		l.appendLine(string(l.partial))
+		l.partial = nil
+	}
+	l.closed = true
+	close(l.changed)
+	l.changed = make(chan struct{})
+	l.mu.Unlock()
+
+	// Store the final output before unregistering, so followers that fall
+	// back to the record replay the same seq numbers.
+	l.store()
+	l.s.logsMu.Lock()
+	if l.s.liveLogs[l.id] == l {
+		delete(l.s.liveLogs, l.id)
+	}
+	l.s.logsMu.Unlock()
+}
+
+func (l *deploymentLog) flushLoop() {
+	defer close(l.done)
+	ticker := time.NewTicker(logFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			l.flush()
+		}
+	}
+}
+
+func (l *deploymentLog) flush() {
+	l.mu.Lock()
+	dirty := l.dirty
+	l.dirty = false
+	l.mu.Unlock()
+	if dirty {
+		l.store()
+	}
+}
+
+// store copies the retained output into the deployment record, with the
+// seq of its first line: once the ring has dropped lines that is not 0.
+func (l *deploymentLog) store() {
+	output, first := l.snapshot()
+	l.s.updateDeployment(l.id, func(d *Deployment) {
+		d.Output = output
+		d.OutputOffset = first
+	})
+}
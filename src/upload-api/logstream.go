@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	logWaitInterval   = 500 * time.Millisecond
+	logKeepaliveEvery = 15 * time.Second
+)
+
+// Log stream event names, shared by SSE and WebSocket.
+const (
+	logEventLine      = "log"
+	logEventTruncated = "truncated"
+	logEventDone      = "done"
+)
+
+// logEmitter writes one stream event. An empty event is a keepalive.
+type logEmitter func(event string, seq uint64, data string) error
+
+// handleLogs serves GET /deployments/{id}/logs. Without follow it returns the
+// captured output as text. With follow=true it streams lines as Server-Sent
+// Events until the deployment ends; a WebSocket upgrade request streams the
+// same events as JSON messages.
+func (s *Server) handleLogs(w http.ResponseWriter, r *http.Request, d *Deployment) {
+	from, err := logStartSeq(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	if isWebSocketUpgrade(r) {
+		s.serveLogsWebSocket(w, r, d.ID, from)
+		return
+	}
+	if r.URL.Query().Get("follow") != "true" {
+		output := d.Output
+		if l := s.liveLog(d.ID); l != nil {
+			output = l.String()
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = io.WriteString(w, output)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "streaming not supported"})
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	_ = s.followLogs(r.Context(), d.ID, from, func(event string, seq uint64, data string) error {
+		var err error
+		if event == "" {
+			_, err = io.WriteString(w, ": keepalive\n\n")
+		} else {
+			if event == logEventLine {
+				_, err = fmt.Fprintf(w, "id: %d\n", seq)
+			}
+			if err == nil {
+				// A bare CR would end the SSE data line early.
+				_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, strings.ReplaceAll(data, "\r", ""))
+			}
+		}
+		flusher.Flush()
+		return err
+	})
+}
+
+// logStartSeq reads the first line to send from Last-Event-ID (SSE
+// reconnects) or the since query parameter.
+func logStartSeq(r *http.Request) (uint64, error) {
+	if raw := strings.TrimSpace(r.Header.Get("Last-Event-ID")); raw != "" {
+		last, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid Last-Event-ID %q", raw)
+		}
+		return last + 1, nil
+	}
+	if raw := strings.TrimSpace(r.URL.Query().Get("since")); raw != "" {
+		since, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("since must be a line number")
+		}
+		return since, nil
+	}
+	return 0, nil
+}
+
+// followLogs emits log lines from seq from until the deployment reaches a
+// terminal status, then emits a done event carrying the final status.
+// Deployments without a live log (not started yet, or finished before this
+// process started) are waited on and then replayed from Deployment.Output.
+func (s *Server) followLogs(ctx context.Context, id string, from uint64, emit logEmitter) error {
+	keepalive := time.NewTicker(logKeepaliveEvery)
+	defer keepalive.Stop()
+
+	for {
+		if l := s.liveLog(id); l != nil {
+			next, err := followLive(ctx, l, from, emit, keepalive.C)
+			if err != nil {
+				return err
+			}
+			if d, ok := s.store.Get(id); ok && isTerminalStatus(d.Status) {
+				return emitDone(emit, d)
+			}
+			from = next
+			continue
+		}
+
+		d, ok := s.store.Get(id)
+		if !ok {
+			return fmt.Errorf("deployment %s not found", id)
+		}
+		if isTerminalStatus(d.Status) {
+			return replayOutput(d, from, emit)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-keepalive.C:
+			if err := emit("", 0, ""); err != nil {
+				return err
+			}
+		case <-time.After(logWaitInterval):
+		}
+	}
+}
+
+// followLive streams l until it is closed and returns the next unread seq.
+func followLive(ctx context.Context, l *deploymentLog, from uint64, emit logEmitter, keepalive <-chan time.Time) (uint64, error) {
+	for {
+		lines, first, next, closed, changed := l.since(from)
+		if first > from {
+			if err := emit(logEventTruncated, 0, strconv.FormatUint(first-from, 10)); err != nil {
+				return from, err
+			}
+		}
+		for i, line := range lines {
+			if err := emit(logEventLine, first+uint64(i), line); err != nil {
+				return from, err
+			}
+		}
+		from = next
+		if closed {
+			return from, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return from, ctx.Err()
+		case <-keepalive:
+			if err := emit("", 0, ""); err != nil {
+				return from, err
+			}
+		case <-changed:
+		}
+	}
+}
+
+// replayOutput emits the stored output of a finished deployment from seq
+// from, then the done event. The output's first line has seq
+// d.OutputOffset, the oldest line the ring still held; a follower asking
+// for older lines is told how many it missed, as on the live stream.
+func replayOutput(d *Deployment, from uint64, emit logEmitter) error {
+	if d.Output != "" {
+		lines := strings.Split(strings.TrimSuffix(d.Output, "\n"), "\n")
+		first := d.OutputOffset
+		if from < first {
+			if err := emit(logEventTruncated, 0, strconv.FormatUint(first-from, 10)); err != nil {
+				return err
+			}
+			from = first
+		}
+		for seq := from; seq < first+uint64(len(lines)); seq++ {
+			if err := emit(logEventLine, seq, lines[seq-first]); err != nil {
+				return err
+			}
+		}
+	}
+	return emitDone(emit, d)
+}
+
+func emitDone(emit logEmitter, d *Deployment) error {
+	data, err := json.Marshal(map[string]string{"status": d.Status, "error": d.Error, "revision": d.Revision})
+	if err != nil {
+		return err
+	}
+	return emit(logEventDone, 0, string(data))
+}
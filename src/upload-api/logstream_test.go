@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type logEvent struct {
+	event string
+	seq   uint64
+	data  string
+}
+
+func collectLogs(t *testing.T, s *Server, id string, from uint64) []logEvent {
+	t.Helper()
+	var events []logEvent
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := s.followLogs(ctx, id, from, func(event string, seq uint64, data string) error {
+		if event != "" {
+			events = append(events, logEvent{event, seq, data})
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("followLogs: %v", err)
+	}
+	return events
+}
+
+// finishedWithLog runs a deployment's log through the ring buffer: n lines
+// "line <seq>", then a FAILED status and Close, as the pipeline does.
+func finishedWithLog(t *testing.T, n int) *Server {
+	t.Helper()
+	s := newTestServer(t)
+	now := time.Now().UTC()
+	if err := s.store.Put(&Deployment{ID: "dep-000001", Status: statusBuild, CreatedAt: now, UpdatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	l := s.openLog("dep-000001")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(l, "line %d\n", i)
+	}
+	s.updateStatus("dep-000001", statusFailed, l.String(), "build failed")
+	l.Close()
+	return s
+}
+
+func TestFollowLogsReplaysFinishedOutputWithLiveSeqs(t *testing.T) {
+	total := logRingLines + 250
+	first := uint64(total - logRingLines)
+	s := finishedWithLog(t, total)
+	if d, _ := s.store.Get("dep-000001"); d.OutputOffset != first {
+		t.Fatalf("outputOffset = %d, want %d", d.OutputOffset, first)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		from      uint64
+		truncated string
+		firstSeq  uint64
+	}{
+		{"from the start", 0, strconv.FormatUint(first, 10), first},
+		{"just before the ring", first - 1, "1", first},
+		{"at the ring start", first, "", first},
+		{"Last-Event-ID inside the ring", first + 100, "", first + 100},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			events := collectLogs(t, s, "dep-000001", tc.from)
+			if tc.truncated != "" {
+				if events[0].event != logEventTruncated || events[0].data != tc.truncated {
+					t.Fatalf("first event = %+v, want truncated %s", events[0], tc.truncated)
+				}
+				events = events[1:]
+			}
+			lines := events[:len(events)-1]
+			if want := uint64(total) - tc.firstSeq; uint64(len(lines)) != want {
+				t.Fatalf("replayed %d lines, want %d", len(lines), want)
+			}
+			for i, e := range lines {
+				seq := tc.firstSeq + uint64(i)
+				if e.event != logEventLine || e.seq != seq || e.data != fmt.Sprintf("line %d", seq) {
+					t.Fatalf("event %d = %+v, want line %d", i, e, seq)
+				}
+			}
+			if done := events[len(events)-1]; done.event != logEventDone {
+				t.Fatalf("last event = %+v, want done", done)
+			}
+		})
+	}
+
+	// Resuming after the last line only gets the done event.
+	if events := collectLogs(t, s, "dep-000001", uint64(total)); len(events) != 1 || events[0].event != logEventDone {
+		t.Fatalf("resume after the end = %+v, want only done", events)
+	}
+}
+
+func TestFollowLogsReplaysShortOutputFromZero(t *testing.T) {
+	s := finishedWithLog(t, 3)
+	events := collectLogs(t, s, "dep-000001", 1)
+	if len(events) != 3 || events[0].seq != 1 || events[0].data != "line 1" || events[1].data != "line 2" || events[2].event != logEventDone {
+		t.Fatalf("events = %+v, want lines 1 and 2 then done", events)
+	}
+}
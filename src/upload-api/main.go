@@ -1,9 +1,9 @@
 package main
 
 import (
-	"archive/tar"
-	"archive/zip"
-	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,47 +12,178 @@ import (
 	"mime/multipart"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"sort"
+	"strconv"
 	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 )
 
 const (
-	statusPending = "PENDING_UPLOAD_VALIDATION"
-	statusBuild   = "BUILD_IN_PROGRESS"
-	statusDeploy  = "DEPLOY_IN_PROGRESS"
-	statusReady   = "READY"
-	statusFailed  = "FAILED"
+	kindUpload   = "upload"
+	kindRollback = "rollback"
+	kindTraffic  = "traffic"
+	kindDelete   = "delete"
+)
+
+const (
+	statusQueued    = "QUEUED"
+	statusBuild     = "BUILD_IN_PROGRESS"
+	statusDeploy    = "DEPLOY_IN_PROGRESS"
+	statusReady     = "READY"
+	statusFailed    = "FAILED"
+	statusCancelled = "CANCELLED"
+	statusTimedOut  = "TIMED_OUT"
 )
 
 type Deployment struct {
-	ID            string    `json:"id"`
-	ServiceName   string    `json:"serviceName"`
-	Namespace     string    `json:"namespace"`
-	BundlePath    string    `json:"bundlePath"`
-	ExtractedPath string    `json:"extractedPath"`
-	Status        string    `json:"status"`
-	Revision      string    `json:"revision,omitempty"`
-	LogsHint      string    `json:"logsHint"`
-	Error         string    `json:"error,omitempty"`
-	Output        string    `json:"output,omitempty"`
-	CreatedAt     time.Time `json:"createdAt"`
-	UpdatedAt     time.Time `json:"updatedAt"`
+	ID            string          `json:"id"`
+	Kind          string          `json:"kind,omitempty"`
+	ServiceName   string          `json:"serviceName"`
+	Namespace     string          `json:"namespace"`
+	BundlePath    string          `json:"bundlePath,omitempty"`
+	ExtractedPath string          `json:"extractedPath,omitempty"`
+	BundleSHA256  string          `json:"bundleSha256,omitempty"`
+	BundleFormat  string          `json:"bundleFormat,omitempty"`
+	Skipped       []SkippedEntry  `json:"skippedEntries,omitempty"`
+	Builder       string          `json:"builder,omitempty"`
+	Language      string          `json:"language,omitempty"`
+	Dockerfile    string          `json:"dockerfile,omitempty"`
+	Image         string          `json:"image,omitempty"`
+	ImageTag      string          `json:"imageTag,omitempty"`
+	Status        string          `json:"status"`
+	QueuePosition int             `json:"queuePosition,omitempty"`
+	SupersededBy  string          `json:"supersededBy,omitempty"`
+	Revision      string          `json:"revision,omitempty"`
+	RollbackOf    string          `json:"rollbackOf,omitempty"`
+	Strategy      string          `json:"strategy,omitempty"`
+	CanaryPercent int64           `json:"canaryPercent,omitempty"`
+	Traffic       []TrafficTarget `json:"traffic,omitempty"`
+	AppManifest   string          `json:"appManifest,omitempty"`
+	Port          int32           `json:"port,omitempty"`
+	Env           []EnvVar        `json:"env,omitempty"`
+	EnvFrom       []EnvFromSource `json:"envFrom,omitempty"`
+	Resources     *Resources      `json:"resources,omitempty"`
+	Autoscaling   *Autoscaling    `json:"autoscaling,omitempty"`
+	Probes        *Probes         `json:"probes,omitempty"`
+	LogsHint      string          `json:"logsHint"`
+	Error         string          `json:"error,omitempty"`
+	FailedPhase   string          `json:"failedPhase,omitempty"`
+	FailedAfterMs int64           `json:"failedAfterMs,omitempty"`
+	Phases        []PhaseRecord   `json:"phases,omitempty"`
+	Output        string          `json:"output,omitempty"`
+	OutputOffset  uint64          `json:"outputOffset,omitempty"`
+	LogsRedacted  bool            `json:"logsRedacted,omitempty"`
+	CreatedBy     string          `json:"createdBy,omitempty"`
+	CreatedAt     time.Time       `json:"createdAt"`
+	UpdatedAt     time.Time       `json:"updatedAt"`
+	ReadyAt       *time.Time      `json:"readyAt,omitempty"`
+}
+
+// clone returns a copy of d that can be handed out without sharing state
+// with the store.
+func (d *Deployment) clone() *Deployment {
+	c := *d
+	c.Traffic = append([]TrafficTarget(nil), d.Traffic...)
+	for i := range c.Traffic {
+		c.Traffic[i].LatestRevision = clonePtr(c.Traffic[i].LatestRevision)
+	}
+	c.Phases = append([]PhaseRecord(nil), d.Phases...)
+	for i := range c.Phases {
+		c.Phases[i].EndedAt = clonePtr(c.Phases[i].EndedAt)
+		c.Phases[i].ExitCode = clonePtr(c.Phases[i].ExitCode)
+	}
+	c.Env = append([]EnvVar(nil), d.Env...)
+	for i := range c.Env {
+		if v := c.Env[i].ValueFrom; v != nil {
+			c.Env[i].ValueFrom = &EnvVarSource{
+				ConfigMapKeyRef: clonePtr(v.ConfigMapKeyRef),
+				SecretKeyRef:    clonePtr(v.SecretKeyRef),
+			}
+		}
+	}
+	c.EnvFrom = append([]EnvFromSource(nil), d.EnvFrom...)
+	for i := range c.EnvFrom {
+		c.EnvFrom[i].ConfigMapRef = clonePtr(c.EnvFrom[i].ConfigMapRef)
+		c.EnvFrom[i].SecretRef = clonePtr(c.EnvFrom[i].SecretRef)
+	}
+	c.Skipped = append([]SkippedEntry(nil), d.Skipped...)
+	c.Resources = clonePtr(d.Resources)
+	if a := d.Autoscaling; a != nil {
+		ac := *a
+		ac.MinScale = clonePtr(a.MinScale)
+		ac.MaxScale = clonePtr(a.MaxScale)
+		ac.InitialScale = clonePtr(a.InitialScale)
+		ac.Target = clonePtr(a.Target)
+		ac.ContainerConcurrency = clonePtr(a.ContainerConcurrency)
+		c.Autoscaling = &ac
+	}
+	if p := d.Probes; p != nil {
+		c.Probes = &Probes{Readiness: clonePtr(p.Readiness), Liveness: clonePtr(p.Liveness)}
+	}
+	c.ReadyAt = clonePtr(d.ReadyAt)
+	return &c
+}
+
+// clonePtr returns a pointer to a shallow copy of *p, or nil.
+func clonePtr[T any](p *T) *T {
+	if p == nil {
+		return nil
+	}
+	v := *p
+	return &v
+}
+
+func isTerminalStatus(status string) bool {
+	switch status {
+	case statusReady, statusFailed, statusCancelled, statusTimedOut:
+		return true
+	}
+	return false
 }
 
 type Server struct {
-	mu            sync.RWMutex
-	deployments   map[string]*Deployment
-	latestID      string
-	idCounter     uint64
+	store         DeploymentStore
+	services      ServiceClient
 	uploadRoot    string
-	scriptPath    string
+	builders      map[string]Builder
+	builder       string
+	imageRegistry string
 	maxUploadSize int64
+	extractLimits extractLimits
 	mockDeploy    bool
+	timeouts      map[string]time.Duration
+	hooks         []Hook
+	sinks         []eventSink
+	contextTokens *contextTokens
+	webhooks      *webhookNotifier
+	resources     resourcePolicy
+	quota         namespaceQuota
+
+	// authenticators are tried in order; none means auth is disabled.
+	authenticators []authenticator
+	// policy is nil without AUTH_POLICY_FILE: every caller may act in
+	// every namespace that is not protected.
+	policy              *policyFile
+	protectedNamespaces map[string]bool
+	createNamespaces    bool
+	// allowedOrigins lists the browser origins, lower-cased, that may open
+	// log WebSockets besides the API's own; "*" allows any.
+	allowedOrigins map[string]bool
+
+	// quotaMu guards quota checks and quotaReserved: uploads that passed
+	// the check but are not queued yet, so concurrent uploads cannot both
+	// take the last slot while one of them is still being stored.
+	quotaMu       sync.Mutex
+	quotaReserved map[string]*Deployment
+
+	logsMu   sync.Mutex
+	liveLogs map[string]*deploymentLog
+
+	runsMu sync.Mutex
+	runs   map[string]context.CancelCauseFunc
+
+	queue *buildQueue
 }
 
 type DeployResponse struct {
@@ -65,17 +196,94 @@ func main() {
 	uploadRoot := envOr("UPLOAD_ROOT", filepath.Join(os.TempDir(), "knative-appdev", "uploads"))
 	maxUploadSize := int64(50 << 20) // 50MiB
 	scriptPath := envOr("BUILD_DEPLOY_SCRIPT", detectScriptPath())
+	storeBackend := envOr("STORE_BACKEND", "file")
+	storeDir := envOr("STORE_DIR", filepath.Join(uploadRoot, "_state"))
 
 	if err := os.MkdirAll(uploadRoot, 0o755); err != nil {
 		log.Fatalf("failed to create upload root: %v", err)
 	}
 
+	store, err := openStore(storeBackend, storeDir, uploadRoot)
+	if err != nil {
+		log.Fatalf("failed to open %s deployment store: %v", storeBackend, err)
+	}
+	recoverInterrupted(store)
+
 	s := &Server{
-		deployments:   map[string]*Deployment{},
+		store:         store,
 		uploadRoot:    uploadRoot,
-		scriptPath:    scriptPath,
+		builder:       envOr("BUILDER", "minikube"),
+		imageRegistry: strings.TrimRight(envOr("IMAGE_REGISTRY", "dev.local"), "/"),
 		maxUploadSize: maxUploadSize,
-		mockDeploy:    strings.EqualFold(envOr("MOCK_DEPLOY", "false"), "true"),
+		extractLimits: extractLimitsFromEnv(),
+		mockDeploy:    envTrue("MOCK_DEPLOY"),
+		timeouts:      phaseTimeouts(),
+		hooks:         configuredHooks(),
+		resources:     resourcePolicyFromEnv(),
+		quota:         namespaceQuotaFromEnv(),
+		liveLogs:      map[string]*deploymentLog{},
+		runs:          map[string]context.CancelCauseFunc{},
+		contextTokens: newContextTokens(),
+	}
+	s.quotaReserved = map[string]*Deployment{}
+	s.createNamespaces = !strings.EqualFold(envOr("NAMESPACE_AUTO_CREATE", "true"), "false")
+	s.protectedNamespaces = map[string]bool{}
+	for _, ns := range splitList(envOr("PROTECTED_NAMESPACES", defaultProtectedNamespaces)) {
+		s.protectedNamespaces[ns] = true
+	}
+	s.allowedOrigins = map[string]bool{}
+	for _, origin := range splitList(envOr("WEBSOCKET_ALLOWED_ORIGINS", "")) {
+		s.allowedOrigins[strings.ToLower(strings.TrimRight(origin, "/"))] = true
+	}
+	if n := newWebhookNotifier(); n != nil {
+		s.webhooks = n
+		s.sinks = append(s.sinks, n)
+	}
+	if c := newCloudEventSink(); c != nil {
+		s.sinks = append(s.sinks, c)
+	}
+	var kube *kubeClient
+	if s.mockDeploy {
+		mock := newMockServices()
+		mock.restore(store.List())
+		s.services = mock
+	} else {
+		kube, err = newKubeClient()
+		if err != nil {
+			log.Fatalf("failed to configure kubernetes client: %v", err)
+		}
+		s.services = newKnativeServices(kube, s.createNamespaces, envTrue("KNATIVE_PATCH_LOCAL_REGISTRY"))
+	}
+	s.authenticators = configuredAuthenticators(func() (*kubeClient, error) {
+		if kube != nil {
+			return kube, nil
+		}
+		return newKubeClient()
+	})
+	if len(s.authenticators) == 0 {
+		log.Printf("authentication disabled: set AUTH_TOKENS_FILE, AUTH_OIDC_JWKS_FILE or AUTH_TOKENREVIEW")
+	}
+	if path := envOr("AUTH_POLICY_FILE", ""); path != "" {
+		if len(s.authenticators) == 0 {
+			log.Fatalf("AUTH_POLICY_FILE needs an authentication provider")
+		}
+		if s.policy, err = loadPolicyFile(path); err != nil {
+			log.Fatalf("failed to load AUTH_POLICY_FILE: %v", err)
+		}
+	}
+	s.builders = configuredBuilders(scriptPath, kube, s.contextTokens)
+	if _, ok := s.builders[s.builder]; !ok {
+		log.Fatalf("unknown BUILDER %q (available: %s)", s.builder, strings.Join(builderNames(s.builders), ", "))
+	}
+	perNamespace := envInt("BUILD_NAMESPACE_LIMIT", 0)
+	if perNamespace > 0 && s.quota.maxBuilds > 0 && perNamespace >= s.quota.maxBuilds {
+		log.Printf("BUILD_NAMESPACE_LIMIT=%d has no effect: QUOTA_MAX_BUILDS=%d already rejects uploads beyond that many queued or running builds per namespace", perNamespace, s.quota.maxBuilds)
+	}
+	s.queue = newBuildQueue(envInt("BUILD_WORKERS", 2), perNamespace, s.runBuildDeploy, s.markSuperseded)
+	for _, d := range store.List() {
+		if d.Status == statusQueued {
+			s.queue.enqueue(d)
+		}
 	}
 
 	mux := http.NewServeMux()
@@ -83,10 +291,14 @@ func main() {
 	mux.HandleFunc("/deploy", s.handleDeploy)
 	mux.HandleFunc("/status/latest", s.handleLatestStatus)
 	mux.HandleFunc("/status/", s.handleStatusByID)
+	mux.HandleFunc("/deployments", s.handleListDeployments)
+	mux.HandleFunc("/deployments/", s.handleDeploymentRoutes)
+	mux.HandleFunc("/services/", s.handleServices)
+	mux.HandleFunc("/webhooks/deliveries", s.handleWebhookDeliveries)
 
 	addr := envOr("PORT", "8080")
-	log.Printf("upload-api listening on :%s (script: %s)", addr, scriptPath)
-	if err := http.ListenAndServe(":"+addr, loggingMiddleware(mux)); err != nil {
+	log.Printf("upload-api listening on :%s (builder: %s, store: %s)", addr, s.builder, storeBackend)
+	if err := http.ListenAndServe(":"+addr, loggingMiddleware(s.requireAuth(mux))); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -109,27 +321,85 @@ func (s *Server) handleDeploy(w http.ResponseWriter, r *http.Request) {
 
 	serviceName := defaultServiceName(r.FormValue("service"))
 	namespace := defaultNamespace(r.FormValue("namespace"))
+	strategy, canaryPercent, err := parseRollout(r.FormValue("strategy"), r.FormValue("percent"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	// Body fields only, so secret values never travel in a logged URL.
+	env, err := parseEnvForm(r.PostForm)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	port, err := parsePort(r.FormValue("port"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	scaling, err := parseAutoscalingForm(r.Form)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	resources, err := parseResourcesForm(r.Form)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	builder := strings.TrimSpace(r.FormValue("builder"))
+	if builder == "" {
+		builder = s.builder
+	}
+	if _, ok := s.builders[builder]; !ok {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("builder must be one of: %s", strings.Join(builderNames(s.builders), ", "))})
+		return
+	}
 
-	file, header, err := r.FormFile("bundle")
+	// Refuse before anything is written to disk. Without a namespace field
+	// app.yaml may still pick the namespace, so until it has been read only
+	// callers who may deploy somewhere get further.
+	namespaceChecked := strings.TrimSpace(r.FormValue("namespace")) != ""
+	if namespaceChecked && !s.authorize(w, r, actionDeploy, namespace) {
+		return
+	}
+	if !namespaceChecked && !s.authorizeAnywhere(w, r, actionDeploy) {
+		return
+	}
+
+	file, _, err := r.FormFile("bundle")
 	if err != nil {
 		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "bundle field is required"})
 		return
 	}
 	defer file.Close()
 
-	if !isSupportedBundle(header.Filename) {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "bundle must be one of: .zip, .tar, .tar.gz, .tgz"})
+	format, err := detectBundleFormat(file)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 		return
 	}
 
-	id := s.nextID()
+	id, err := s.store.NextID()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("failed to allocate deployment id: %v", err)})
+		return
+	}
 	workDir := filepath.Join(s.uploadRoot, id)
 	if err := os.MkdirAll(workDir, 0o755); err != nil {
 		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("failed to create workdir: %v", err)})
 		return
 	}
+	// Until a stored record refers to the upload, every early return frees
+	// the disk it took.
+	keepWorkDir := false
+	defer func() {
+		if !keepWorkDir {
+			os.RemoveAll(workDir)
+		}
+	}()
 
-	bundlePath, err := saveBundle(file, header, workDir)
+	bundlePath, checksum, err := saveBundle(file, workDir)
 	if err != nil {
 		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("failed to save bundle: %v", err)})
 		return
@@ -141,288 +411,248 @@ func (s *Server) handleDeploy(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := extractBundle(bundlePath, extractPath); err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("failed to extract bundle: %v", err)})
-		return
-	}
-
 	d := &Deployment{
 		ID:            id,
+		Kind:          kindUpload,
 		ServiceName:   serviceName,
 		Namespace:     namespace,
 		BundlePath:    bundlePath,
 		ExtractedPath: extractPath,
-		Status:        statusPending,
+		BundleSHA256:  checksum,
+		BundleFormat:  format,
+		Builder:       builder,
+		Image:         imageRef(s.imageRegistry, serviceName, id),
+		ImageTag:      id,
+		Strategy:      strategy,
+		CanaryPercent: canaryPercent,
+		Port:          port,
+		Autoscaling:   scaling,
+		Resources:     resources,
+		Env:           env.Env,
+		EnvFrom:       env.EnvFrom,
+		Status:        statusQueued,
 		LogsHint:      logsHint(serviceName, namespace),
+		CreatedBy:     createdBy(r),
 		CreatedAt:     time.Now().UTC(),
 		UpdatedAt:     time.Now().UTC(),
 	}
 
-	s.storeDeployment(d)
-	go s.runBuildDeploy(id)
-
-	writeJSON(w, http.StatusAccepted, DeployResponse{
-		ID:      id,
-		Status:  d.Status,
-		Message: "bundle accepted; build and deploy started",
-	})
-}
-
-func (s *Server) handleLatestStatus(w http.ResponseWriter, _ *http.Request) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	if s.latestID == "" {
-		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no deployments yet"})
+	extract := s.startPhase(r.Context(), "", phaseExtract, nil)
+	skipped, err := extractBundle(extract.ctx, bundlePath, extractPath, s.extractLimits)
+	extract.end(err)
+	d.Skipped = skipped
+	d.Phases = append(d.Phases, extract.record)
+	if extract.timedOut {
+		// Keep a record so the timeout shows up like any other failed deploy.
+		d.Status = statusTimedOut
+		d.Error = fmt.Sprintf("%s timed out after %s", phaseExtract, extract.timeout)
+		d.FailedPhase = phaseExtract
+		d.FailedAfterMs = extract.elapsed.Milliseconds()
+		if err := s.store.Put(d); err != nil {
+			log.Printf("failed to record deployment %s: %v", id, err)
+		} else {
+			keepWorkDir = true
+		}
+		s.announce("", d)
+		writeJSON(w, http.StatusUnprocessableEntity, DeployResponse{ID: id, Status: d.Status, Message: d.Error})
 		return
 	}
-	writeJSON(w, http.StatusOK, s.deployments[s.latestID])
-}
-
-func (s *Server) handleStatusByID(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	if err != nil {
+		var le *extractLimitError
+		if errors.As(err, &le) {
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": le.msg, "code": le.code})
+			return
+		}
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("failed to extract bundle: %v", err)})
 		return
 	}
 
-	id := strings.TrimPrefix(r.URL.Path, "/status/")
-	if id == "" {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "missing deployment id"})
+	manifest, manifestFile, err := loadAppManifest(extractPath)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 		return
 	}
-
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	d, ok := s.deployments[id]
-	if !ok {
-		writeJSON(w, http.StatusNotFound, map[string]string{"error": "deployment not found"})
+	if manifest != nil {
+		manifest.applyTo(d, r.Form)
+		d.AppManifest = manifestFile
+		if _, ok := s.builders[d.Builder]; !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("%s: build.builder must be one of: %s", manifestFile, strings.Join(builderNames(s.builders), ", "))})
+			return
+		}
+		d.Image = imageRef(s.imageRegistry, d.ServiceName, id)
+		d.LogsHint = logsHint(d.ServiceName, d.Namespace)
+		if manifest.Build != nil && manifest.Build.Dockerfile != "" && d.Builder != builderBuildpacks {
+			if err := useManifestDockerfile(extractPath, manifest.Build.Dockerfile); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("%s: %v", manifestFile, err)})
+				return
+			}
+		}
+	}
+	if !namespaceChecked && !s.authorize(w, r, actionDeploy, d.Namespace) {
 		return
 	}
-
-	writeJSON(w, http.StatusOK, d)
-}
-
-func (s *Server) runBuildDeploy(id string) {
-	d, ok := s.getDeployment(id)
-	if !ok {
+	if !s.createNamespaces {
+		exists, err := s.services.NamespaceExists(r.Context(), d.Namespace)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("failed to look up namespace %s: %v", d.Namespace, err)})
+			return
+		}
+		if !exists {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": fmt.Sprintf("namespace %s does not exist and namespace creation is disabled; ask an admin to create it", d.Namespace)})
+			return
+		}
+	}
+	if err := d.Autoscaling.validate(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if d.Resources, err = s.resources.apply(d.Resources); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 		return
 	}
 
-	s.updateStatus(id, statusBuild, "", "")
-	if s.mockDeploy {
-		time.Sleep(1 * time.Second)
-		s.updateStatus(id, statusDeploy, "mock deploy executed", "")
-		time.Sleep(1 * time.Second)
-		s.updateReady(id, "mock deploy executed", "mock-revision-00001")
+	source, err := inspectSource(extractPath)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 		return
 	}
+	dockerfile := dockerfileBundled
+	if !source.HasDockerfile {
+		dockerfile = ""
+		if d.Builder != builderBuildpacks {
+			if err := writeDockerfile(extractPath, source); err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("failed to generate Dockerfile: %v", err)})
+				return
+			}
+			dockerfile = dockerfileGenerated
+		}
+	}
 
-	cmd := exec.Command(s.scriptPath)
-	cmd.Env = append(os.Environ(),
-		"APP_DIR="+d.ExtractedPath,
-		"SERVICE_NAME="+d.ServiceName,
-		"NAMESPACE="+d.Namespace,
-		"DEPLOYMENT_ID="+d.ID,
-		"IMAGE_TAG="+d.ID,
-	)
-	output, err := cmd.CombinedOutput()
+	d.Language = source.Language
+	d.Dockerfile = dockerfile
 
-	if err != nil {
-		s.updateStatus(id, statusFailed, string(output), fmt.Sprintf("build/deploy failed: %v", err))
+	if qe := s.reserveQuota(d); qe != nil {
+		writeJSON(w, qe.status, map[string]string{"error": qe.msg, "quota": qe.quota})
 		return
 	}
+	// A no-op once d is queued; before that it gives the slot back.
+	defer s.releaseQuota(d.ID)
 
-	s.updateStatus(id, statusDeploy, string(output), "")
-	revision := latestRevision(d.ServiceName, d.Namespace)
-	s.updateReady(id, string(output), revision)
-}
+	if len(env.SecretValues) > 0 {
+		secretName := envSecretName(d.ServiceName, id)
+		if err := s.services.ApplySecret(r.Context(), d.Namespace, secretName, env.SecretValues); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("failed to store secret env: %v", err)})
+			return
+		}
+		bindSecretValues(d.Env, env.SecretValues, secretName)
+	}
 
-func latestRevision(serviceName, namespace string) string {
-	cmd := exec.Command(
-		"kubectl",
-		"get", "revision",
-		"-n", namespace,
-		"-l", "serving.knative.dev/service="+serviceName,
-		"-o", "jsonpath={range .items[*]}{.metadata.name}{"+"\n"+"}{end}",
-	)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return ""
+	if err := s.store.Put(d); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("failed to record deployment: %v", err)})
+		return
 	}
-	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
-	if len(lines) == 0 || lines[0] == "" {
-		return ""
+	s.announce("", d)
+	message := "bundle accepted; build and deploy started"
+	if position := s.enqueueReserved(d); position > 0 {
+		message = fmt.Sprintf("bundle accepted; queued for build at position %d", position)
 	}
-	sort.Strings(lines)
-	return lines[len(lines)-1]
-}
+	keepWorkDir = true
 
-func (s *Server) nextID() string {
-	n := atomic.AddUint64(&s.idCounter, 1)
-	return fmt.Sprintf("dep-%06d", n)
+	writeJSON(w, http.StatusAccepted, DeployResponse{
+		ID:      id,
+		Status:  d.Status,
+		Message: message,
+	})
 }
 
-func (s *Server) storeDeployment(d *Deployment) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.deployments[d.ID] = d
-	s.latestID = d.ID
+func (s *Server) handleLatestStatus(w http.ResponseWriter, r *http.Request) {
+	d, ok := s.store.Latest()
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no deployments yet"})
+		return
+	}
+	writeJSON(w, http.StatusOK, s.redactLogs(r, s.withQueuePosition(d)))
 }
 
-func (s *Server) getDeployment(id string) (*Deployment, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	d, ok := s.deployments[id]
-	return d, ok
-}
+func (s *Server) handleStatusByID(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
 
-func (s *Server) updateStatus(id, status, output, errMsg string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	d, ok := s.deployments[id]
-	if !ok {
+	id := strings.TrimPrefix(r.URL.Path, "/status/")
+	if id == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "missing deployment id"})
 		return
 	}
-	d.Status = status
-	d.Output = output
-	d.Error = errMsg
-	d.UpdatedAt = time.Now().UTC()
-}
 
-func (s *Server) updateReady(id, output, revision string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	d, ok := s.deployments[id]
+	d, ok := s.store.Get(id)
 	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "deployment not found"})
 		return
 	}
-	d.Status = statusReady
-	d.Output = output
-	d.Revision = revision
-	d.Error = ""
-	d.UpdatedAt = time.Now().UTC()
+
+	writeJSON(w, http.StatusOK, s.redactLogs(r, s.withQueuePosition(d)))
 }
 
-func saveBundle(src multipart.File, header *multipart.FileHeader, workDir string) (string, error) {
-	name := filepath.Base(header.Filename)
-	dstPath := filepath.Join(workDir, name)
-	dst, err := os.Create(dstPath)
-	if err != nil {
-		return "", err
-	}
-	defer dst.Close()
-	if _, err = io.Copy(dst, src); err != nil {
-		return "", err
-	}
-	return dstPath, nil
+func (s *Server) updateStatus(id, status, output, errMsg string) {
+	s.updateDeployment(id, func(d *Deployment) {
+		d.Status = status
+		d.Output = output
+		d.Error = errMsg
+	})
 }
 
-func extractBundle(bundlePath, outDir string) error {
-	lower := strings.ToLower(bundlePath)
-	switch {
-	case strings.HasSuffix(lower, ".zip"):
-		return extractZip(bundlePath, outDir)
-	case strings.HasSuffix(lower, ".tar"):
-		f, err := os.Open(bundlePath)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-		return extractTar(f, outDir)
-	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
-		f, err := os.Open(bundlePath)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-		gr, err := gzip.NewReader(f)
-		if err != nil {
-			return err
-		}
-		defer gr.Close()
-		return extractTar(gr, outDir)
-	default:
-		return errors.New("unsupported archive format")
-	}
+func (s *Server) updateReady(id, output, revision string, traffic []TrafficTarget) {
+	s.updateDeployment(id, func(d *Deployment) {
+		d.Status = statusReady
+		d.Output = output
+		d.Revision = revision
+		d.Traffic = traffic
+		d.Error = ""
+		readyAt := time.Now().UTC()
+		d.ReadyAt = &readyAt
+	})
 }
 
-func extractZip(path, outDir string) error {
-	zr, err := zip.OpenReader(path)
+// updateDeployment applies fn to the stored record and announces any status
+// change it made.
+func (s *Server) updateDeployment(id string, fn func(d *Deployment)) {
+	var from string
+	var updated *Deployment
+	err := s.store.Update(id, func(d *Deployment) {
+		from = d.Status
+		fn(d)
+		d.UpdatedAt = time.Now().UTC()
+		if d.Status != from {
+			updated = d.clone()
+		}
+	})
 	if err != nil {
-		return err
+		log.Printf("failed to update deployment %s: %v", id, err)
+		return
 	}
-	defer zr.Close()
-
-	for _, f := range zr.File {
-		target, err := safeJoin(outDir, f.Name)
-		if err != nil {
-			return err
-		}
-		if f.FileInfo().IsDir() {
-			if err := os.MkdirAll(target, 0o755); err != nil {
-				return err
-			}
-			continue
-		}
-		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
-			return err
-		}
-		rc, err := f.Open()
-		if err != nil {
-			return err
-		}
-		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
-		if err != nil {
-			rc.Close()
-			return err
-		}
-		if _, err := io.Copy(out, rc); err != nil {
-			rc.Close()
-			out.Close()
-			return err
-		}
-		rc.Close()
-		out.Close()
+	if updated != nil {
+		s.announce(from, updated)
 	}
-	return nil
 }
 
-func extractTar(r io.Reader, outDir string) error {
-	tr := tar.NewReader(r)
-	for {
-		hdr, err := tr.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return err
-		}
-
-		target, err := safeJoin(outDir, hdr.Name)
-		if err != nil {
-			return err
-		}
-
-		switch hdr.Typeflag {
-		case tar.TypeDir:
-			if err := os.MkdirAll(target, 0o755); err != nil {
-				return err
-			}
-		case tar.TypeReg:
-			if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
-				return err
-			}
-			out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
-			if err != nil {
-				return err
-			}
-			if _, err := io.Copy(out, tr); err != nil {
-				out.Close()
-				return err
-			}
-			out.Close()
-		}
+// saveBundle writes the uploaded bundle to workDir/bundle and returns its
+// path and hex-encoded SHA-256 checksum. The client's file name is not used:
+// the format is sniffed from the content, and names such as "src" or "/"
+// would collide with the work directory's layout.
+func saveBundle(src multipart.File, workDir string) (string, string, error) {
+	dstPath := filepath.Join(workDir, "bundle")
+	dst, err := os.Create(dstPath)
+	if err != nil {
+		return "", "", err
 	}
-	return nil
+	defer dst.Close()
+	sum := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(dst, sum), src); err != nil {
+		return "", "", err
+	}
+	return dstPath, hex.EncodeToString(sum.Sum(nil)), nil
 }
 
 func safeJoin(baseDir, name string) (string, error) {
@@ -445,14 +675,6 @@ func safeJoin(baseDir, name string) (string, error) {
 	return target, nil
 }
 
-func isSupportedBundle(name string) bool {
-	lower := strings.ToLower(name)
-	return strings.HasSuffix(lower, ".zip") ||
-		strings.HasSuffix(lower, ".tar") ||
-		strings.HasSuffix(lower, ".tar.gz") ||
-		strings.HasSuffix(lower, ".tgz")
-}
-
 func defaultServiceName(raw string) string {
 	if raw == "" {
 		return "uploaded-app"
@@ -494,6 +716,10 @@ func sanitizeK8sName(v string) string {
 	return result
 }
 
+func imageRef(registry, service, tag string) string {
+	return fmt.Sprintf("%s/%s:%s", registry, service, tag)
+}
+
 func logsHint(service, namespace string) string {
 	return fmt.Sprintf("kubectl logs -n %s -l serving.knative.dev/service=%s --tail=100", namespace, service)
 }
@@ -519,6 +745,34 @@ func envOr(key, fallback string) string {
 	return fallback
 }
 
+func envInt(key string, fallback int) int {
+	raw := envOr(key, "")
+	if raw == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 {
+		log.Fatalf("%s must be a non-negative integer, got %q", key, raw)
+	}
+	return n
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	raw := envOr(key, "")
+	if raw == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		log.Fatalf("%s must be a positive duration such as 90s or 10m, got %q", key, raw)
+	}
+	return d
+}
+
+func envTrue(key string) bool {
+	return strings.EqualFold(envOr(key, "false"), "true")
+}
+
 func writeJSON(w http.ResponseWriter, status int, payload any) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
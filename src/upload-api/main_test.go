@@ -0,0 +1,342 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestServer returns a mock-mode server whose build queue never runs
+// anything: started jobs block until the test ends, so they stay in flight
+// and deployments stay QUEUED.
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	s := &Server{
+		store:               newMemoryStore(),
+		services:            newMockServices(),
+		uploadRoot:          t.TempDir(),
+		builder:             "minikube",
+		imageRegistry:       "dev.local",
+		maxUploadSize:       10 << 20,
+		extractLimits:       extractLimitsFromEnv(),
+		mockDeploy:          true,
+		timeouts:            phaseTimeouts(),
+		resources:           resourcePolicyFromEnv(),
+		quota:               namespaceQuotaFromEnv(),
+		liveLogs:            map[string]*deploymentLog{},
+		runs:                map[string]context.CancelCauseFunc{},
+		contextTokens:       newContextTokens(),
+		createNamespaces:    true,
+		protectedNamespaces: map[string]bool{"kube-system": true},
+		allowedOrigins:      map[string]bool{},
+		quotaReserved:       map[string]*Deployment{},
+	}
+	s.builders = configuredBuilders("", nil, s.contextTokens)
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	s.queue = newBuildQueue(1, 0, func(string) { <-done }, s.markSuperseded)
+	return s
+}
+
+// instantBuilder stands in for a real image builder. It fails with err
+// when set.
+type instantBuilder struct{ err error }
+
+func (instantBuilder) Name() string { return "minikube" }
+
+func (b instantBuilder) Build(_ context.Context, req BuildRequest, logs io.Writer) error {
+	fmt.Fprintf(logs, "built %s\n", req.Image)
+	return b.err
+}
+
+// newPipelineServer returns a test server whose accepted uploads run the
+// real pipeline steps against mockServices, without the MOCK_DEPLOY delays.
+func newPipelineServer(t *testing.T) *Server {
+	t.Helper()
+	s := newTestServer(t)
+	s.mockDeploy = false
+	s.builders = map[string]Builder{"minikube": instantBuilder{}}
+	s.queue = newBuildQueue(1, 0, s.runBuildDeploy, s.markSuperseded)
+	return s
+}
+
+// waitFinished polls until deployment id reached a terminal status and its
+// run has ended, and returns the record.
+func waitFinished(t *testing.T, s *Server, id string) *Deployment {
+	t.Helper()
+	running := func() bool {
+		s.runsMu.Lock()
+		defer s.runsMu.Unlock()
+		_, ok := s.runs[id]
+		return ok
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		d, ok := s.store.Get(id)
+		if ok && isTerminalStatus(d.Status) && !running() {
+			return d
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("deployment %s did not finish: %+v", id, d)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// deployAndWait uploads files through a pipeline server and waits for the
+// deployment to finish.
+func deployAndWait(t *testing.T, s *Server, fields map[string]string, files map[string]string) *Deployment {
+	t.Helper()
+	code, out := deploy(t, s, deployRequest(t, fields, "app.tar.gz", tarGz(t, files)))
+	if code != http.StatusAccepted {
+		t.Fatalf("status = %d (%v), want 202", code, out)
+	}
+	return waitFinished(t, s, out["id"].(string))
+}
+
+// tarGz packs files (name to content) into a gzip-compressed tarball.
+func tarGz(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// deployRequest builds a POST /deploy with the given form fields and bundle.
+func deployRequest(t *testing.T, fields map[string]string, filename string, bundle []byte) *http.Request {
+	t.Helper()
+	form := url.Values{}
+	for k, v := range fields {
+		form.Set(k, v)
+	}
+	return deployFormRequest(t, form, filename, bundle)
+}
+
+// deployFormRequest is deployRequest for forms that repeat a field.
+func deployFormRequest(t *testing.T, form url.Values, filename string, bundle []byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, values := range form {
+		for _, v := range values {
+			if err := mw.WriteField(k, v); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	fw, err := mw.CreateFormFile("bundle", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(bundle)
+	mw.Close()
+	r := httptest.NewRequest(http.MethodPost, "/deploy", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+func deploy(t *testing.T, s *Server, r *http.Request) (int, map[string]any) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.handleDeploy(rec, r)
+	var out map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+		t.Fatalf("decode response %q: %v", rec.Body.String(), err)
+	}
+	return rec.Code, out
+}
+
+// workDirs lists the deployment directories left in the upload root.
+func workDirs(t *testing.T, s *Server) []string {
+	t.Helper()
+	dirs, err := filepath.Glob(filepath.Join(s.uploadRoot, "dep-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dirs
+}
+
+const testDockerfile = "FROM busybox\nCMD [\"true\"]\n"
+
+func TestDeployRemovesWorkDirWhenRejected(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		fields map[string]string
+		files  map[string]string
+		setup  func(s *Server)
+		status int
+	}{
+		{
+			name:   "invalid manifest",
+			files:  map[string]string{"Dockerfile": testDockerfile, "app.yaml": "nope: true\n"},
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "protected namespace",
+			fields: map[string]string{"namespace": "kube-system"},
+			files:  map[string]string{"Dockerfile": testDockerfile},
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "invalid autoscaling",
+			fields: map[string]string{"minScale": "5", "maxScale": "1"},
+			files:  map[string]string{"Dockerfile": testDockerfile},
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "no Dockerfile or language marker",
+			files:  map[string]string{"README.md": "hello\n"},
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "quota",
+			files:  map[string]string{"Dockerfile": testDockerfile},
+			setup:  func(s *Server) { s.quota.maxServices = 0; s.quota.maxBuilds = 0; s.quota.maxMemory = 1 },
+			status: http.StatusForbidden,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t)
+			if tc.setup != nil {
+				tc.setup(s)
+			}
+			code, out := deploy(t, s, deployRequest(t, tc.fields, "app.tar.gz", tarGz(t, tc.files)))
+			if code != tc.status {
+				t.Fatalf("status = %d (%v), want %d", code, out, tc.status)
+			}
+			if dirs := workDirs(t, s); len(dirs) != 0 {
+				t.Fatalf("rejected upload left %v behind", dirs)
+			}
+		})
+	}
+}
+
+func TestDeployKeepsWorkDirOfAcceptedUpload(t *testing.T) {
+	s := newTestServer(t)
+	code, out := deploy(t, s, deployRequest(t, nil, "app.tar.gz", tarGz(t, map[string]string{"Dockerfile": testDockerfile})))
+	if code != http.StatusAccepted {
+		t.Fatalf("status = %d (%v), want 202", code, out)
+	}
+	d, ok := s.store.Get(out["id"].(string))
+	if !ok {
+		t.Fatalf("deployment %v not stored", out["id"])
+	}
+	if _, err := os.Stat(filepath.Join(d.ExtractedPath, "Dockerfile")); err != nil {
+		t.Fatalf("accepted upload lost its source: %v", err)
+	}
+}
+
+func TestDeployAuthorizesBeforeSavingBundle(t *testing.T) {
+	s := newTestServer(t)
+	withPolicy(t, s, testPolicy)
+	dev := &Identity{Username: "bob", Groups: []string{"devs"}, Provider: "oidc"}
+
+	r := deployRequest(t, map[string]string{"namespace": "staging"}, "app.tar.gz", tarGz(t, map[string]string{"Dockerfile": testDockerfile}))
+	code, out := deploy(t, s, asCaller(r, dev))
+	if code != http.StatusForbidden {
+		t.Fatalf("status = %d (%v), want 403", code, out)
+	}
+	if ids := s.store.List(); len(ids) != 0 {
+		t.Fatalf("denied upload stored %d records", len(ids))
+	}
+	if entries, _ := os.ReadDir(s.uploadRoot); len(entries) != 0 {
+		t.Fatalf("denied upload wrote %d entries to the upload root", len(entries))
+	}
+
+	// Without a namespace field, a caller who may not deploy anywhere is
+	// refused up front, and app.yaml's namespace is checked once read.
+	nobody := &Identity{Username: "mallory", Provider: "oidc"}
+	r = deployRequest(t, nil, "app.tar.gz", tarGz(t, map[string]string{"Dockerfile": testDockerfile}))
+	if code, out = deploy(t, s, asCaller(r, nobody)); code != http.StatusForbidden {
+		t.Fatalf("caller without deploy rights = %d (%v), want 403", code, out)
+	}
+	if entries, _ := os.ReadDir(s.uploadRoot); len(entries) != 0 {
+		t.Fatalf("denied upload wrote %d entries to the upload root", len(entries))
+	}
+	r = deployRequest(t, nil, "app.tar.gz", tarGz(t, map[string]string{"Dockerfile": testDockerfile, "app.yaml": "namespace: staging\n"}))
+	if code, out = deploy(t, s, asCaller(r, dev)); code != http.StatusForbidden {
+		t.Fatalf("app.yaml namespace staging = %d (%v), want 403", code, out)
+	}
+	r = deployRequest(t, nil, "app.tar.gz", tarGz(t, map[string]string{"Dockerfile": testDockerfile, "app.yaml": "namespace: demo-apps\n"}))
+	if code, out = deploy(t, s, asCaller(r, dev)); code != http.StatusAccepted {
+		t.Fatalf("app.yaml namespace demo-apps = %d (%v), want 202", code, out)
+	}
+
+	r = deployRequest(t, map[string]string{"namespace": "demo-apps"}, "app.tar.gz", tarGz(t, map[string]string{"Dockerfile": testDockerfile}))
+	if code, out = deploy(t, s, asCaller(r, dev)); code != http.StatusAccepted {
+		t.Fatalf("allowed upload status = %d (%v), want 202", code, out)
+	}
+}
+
+func TestDeploySavesBundleUnderFixedName(t *testing.T) {
+	for _, filename := range []string{"app.tar.gz", "src", ".", "/", "..", "Dockerfile"} {
+		s := newTestServer(t)
+		code, out := deploy(t, s, deployRequest(t, nil, filename, tarGz(t, map[string]string{"Dockerfile": testDockerfile})))
+		if code != http.StatusAccepted {
+			t.Fatalf("filename %q: status = %d (%v), want 202", filename, code, out)
+		}
+		d, _ := s.store.Get(out["id"].(string))
+		if want := filepath.Join(s.uploadRoot, d.ID, "bundle"); d.BundlePath != want {
+			t.Errorf("filename %q: bundle saved as %s, want %s", filename, d.BundlePath, want)
+		}
+		if _, err := os.Stat(filepath.Join(d.ExtractedPath, "Dockerfile")); err != nil {
+			t.Errorf("filename %q: source not extracted: %v", filename, err)
+		}
+	}
+}
+
+func TestDeploySniffsFormatWhateverTheName(t *testing.T) {
+	s := newTestServer(t)
+	for filename, tc := range map[string]struct {
+		bundle []byte
+		format string
+	}{
+		"app.tar.gz": {zipOf(t, map[string]string{"Dockerfile": testDockerfile}), formatZip},
+		"app.zip":    {tarGz(t, map[string]string{"Dockerfile": testDockerfile}), formatTarGzip},
+		"Dockerfile": {[]byte(testDockerfile), formatDockerfile},
+		"bundle":     {zstdOf(t, tarOf(t, fileEntry("Dockerfile", testDockerfile))), formatTarZstd},
+	} {
+		code, out := deploy(t, s, deployRequest(t, nil, filename, tc.bundle))
+		if code != http.StatusAccepted {
+			t.Fatalf("%s: status = %d (%v), want 202", filename, code, out)
+		}
+		if d, _ := s.store.Get(out["id"].(string)); d.BundleFormat != tc.format {
+			t.Errorf("%s: bundle format = %q, want %s", filename, d.BundleFormat, tc.format)
+		}
+	}
+
+	code, out := deploy(t, s, deployRequest(t, nil, "app.tar.gz", []byte("not a bundle\n")))
+	if code != http.StatusBadRequest || out["error"] != errUnsupportedBundle.Error() {
+		t.Fatalf("junk upload = %d %v, want 400 %q", code, out, errUnsupportedBundle)
+	}
+	if dirs := workDirs(t, s); len(dirs) != 4 {
+		t.Fatalf("work dirs = %v, want only the 4 accepted uploads", dirs)
+	}
+}
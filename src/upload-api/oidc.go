@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jwtLeeway tolerates clock skew between the issuer and this server.
+const jwtLeeway = time.Minute
+
+// oidcAuthenticator validates OIDC ID tokens (signed JWTs) against the keys
+// of a local JWKS file. The file is re-read when it changes, so keys can be
+// rotated without a restart.
+type oidcAuthenticator struct {
+	jwksPath      string
+	issuer        string
+	audience      string
+	usernameClaim string
+	groupsClaim   string
+
+	mu      sync.Mutex
+	keys    []jwk
+	modTime time.Time
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+
+	public crypto.PublicKey
+}
+
+// jwtAlgorithms are the accepted signature algorithms. Symmetric and
+// "none" algorithms are never accepted. Each ES algorithm is only verified
+// with a key on its own curve.
+var jwtAlgorithms = map[string]struct {
+	hash crypto.Hash
+	kty  string
+	crv  string
+}{
+	"RS256": {crypto.SHA256, "RSA", ""},
+	"RS384": {crypto.SHA384, "RSA", ""},
+	"RS512": {crypto.SHA512, "RSA", ""},
+	"ES256": {crypto.SHA256, "EC", "P-256"},
+	"ES384": {crypto.SHA384, "EC", "P-384"},
+	"ES512": {crypto.SHA512, "EC", "P-521"},
+}
+
+func newOIDCAuthenticator(jwksPath string) (*oidcAuthenticator, error) {
+	a := &oidcAuthenticator{
+		jwksPath:      jwksPath,
+		issuer:        envOr("AUTH_OIDC_ISSUER", ""),
+		audience:      envOr("AUTH_OIDC_AUDIENCE", ""),
+		usernameClaim: envOr("AUTH_OIDC_USERNAME_CLAIM", "sub"),
+		groupsClaim:   envOr("AUTH_OIDC_GROUPS_CLAIM", "groups"),
+	}
+	if a.issuer == "" || a.audience == "" {
+		return nil, errors.New("AUTH_OIDC_ISSUER and AUTH_OIDC_AUDIENCE are required with AUTH_OIDC_JWKS_FILE")
+	}
+	if _, err := a.currentKeys(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (*oidcAuthenticator) name() string { return "oidc" }
+
+// currentKeys returns the JWKS keys, reloading the file if it changed. A
+// file that fails to load keeps the previous keys in use.
+func (a *oidcAuthenticator) currentKeys() ([]jwk, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	st, err := os.Stat(a.jwksPath)
+	if err != nil {
+		if a.keys != nil {
+			return a.keys, nil
+		}
+		return nil, err
+	}
+	if a.keys != nil && st.ModTime().Equal(a.modTime) {
+		return a.keys, nil
+	}
+	keys, err := loadJWKS(a.jwksPath)
+	if err != nil {
+		if a.keys != nil {
+			return a.keys, nil
+		}
+		return nil, err
+	}
+	a.keys, a.modTime = keys, st.ModTime()
+	return keys, nil
+}
+
+func loadJWKS(path string) ([]jwk, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(raw, &set); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	var keys []jwk
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("%s: keys[%d]: %v", path, i, err)
+		}
+		k.public = pub
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s has no signing keys", path)
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+		y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+		if err1 != nil || err2 != nil {
+			return nil, errors.New("invalid EC key")
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("invalid EC key")
+		}
+		return pub, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func (a *oidcAuthenticator) authenticate(_ context.Context, token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		// Not a JWT; leave it to the other providers.
+		return nil, nil
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	alg, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	keys, err := a.currentKeys()
+	if err != nil {
+		return nil, err
+	}
+	h := alg.hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	digest := h.Sum(nil)
+	verified := false
+	for _, k := range keys {
+		if k.Kty != alg.kty || k.Crv != alg.crv || (header.Kid != "" && k.Kid != header.Kid) || (k.Alg != "" && k.Alg != header.Alg) {
+			continue
+		}
+		if verifyJWTSignature(k.public, alg.hash, digest, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("token signature does not match any key")
+	}
+
+	var claims map[string]any
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, errors.New("malformed token claims")
+	}
+	if err := a.checkClaims(claims, time.Now()); err != nil {
+		return nil, err
+	}
+	username, _ := claims[a.usernameClaim].(string)
+	if username == "" {
+		return nil, fmt.Errorf("token has no %s claim", a.usernameClaim)
+	}
+	id := &Identity{Username: username}
+	switch groups := claims[a.groupsClaim].(type) {
+	case string:
+		id.Groups = []string{groups}
+	case []any:
+		for _, g := range groups {
+			if s, ok := g.(string); ok {
+				id.Groups = append(id.Groups, s)
+			}
+		}
+	}
+	return id, nil
+}
+
+func (a *oidcAuthenticator) checkClaims(claims map[string]any, now time.Time) error {
+	if iss, _ := claims["iss"].(string); iss != a.issuer {
+		return fmt.Errorf("token issuer %q is not trusted", iss)
+	}
+	audOK := false
+	switch aud := claims["aud"].(type) {
+	case string:
+		audOK = aud == a.audience
+	case []any:
+		for _, v := range aud {
+			if v == a.audience {
+				audOK = true
+			}
+		}
+	}
+	if !audOK {
+		return errors.New("token audience does not include " + a.audience)
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("token has no exp claim")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token not valid yet")
+	}
+	return nil
+}
+
+func decodeJWTPart(part string, out any) error {
+	raw, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, out)
+}
+
+// verifyJWTSignature checks a JWS signature: PKCS #1 v1.5 for RSA keys and
+// the fixed-size r||s encoding for ECDSA keys.
+func verifyJWTSignature(pub crypto.PublicKey, hash crypto.Hash, digest, sig []byte) bool {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, hash, digest, sig) == nil
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(k, digest, r, s)
+	}
+	return false
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testIssuer   = "https://issuer.example"
+	testAudience = "upload-api"
+)
+
+var b64 = base64.RawURLEncoding
+
+func rsaJWK(kid string, k *rsa.PrivateKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA", "kid": kid, "use": "sig",
+		"n": b64.EncodeToString(k.N.Bytes()),
+		"e": b64.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+	}
+}
+
+func ecJWK(kid string, k *ecdsa.PrivateKey) map[string]string {
+	size := (k.Curve.Params().BitSize + 7) / 8
+	return map[string]string{
+		"kty": "EC", "kid": kid, "crv": k.Curve.Params().Name,
+		"x": b64.EncodeToString(k.X.FillBytes(make([]byte, size))),
+		"y": b64.EncodeToString(k.Y.FillBytes(make([]byte, size))),
+	}
+}
+
+func writeJWKS(t *testing.T, path string, keys ...map[string]string) {
+	t.Helper()
+	raw, err := json.Marshal(map[string]any{"keys": keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, raw, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// signJWT returns a compact JWS of claims. key is an *rsa.PrivateKey or
+// *ecdsa.PrivateKey, or nil for an unsigned token.
+func signJWT(t *testing.T, alg, kid string, claims map[string]any, key any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	hash := crypto.SHA256
+	if a, ok := jwtAlgorithms[alg]; ok {
+		hash = a.hash
+	}
+	digest := hash.New()
+	digest.Write([]byte(input))
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, hash, digest.Sum(nil)); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest.Sum(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+	}
+	return input + "." + b64.EncodeToString(sig)
+}
+
+func validClaims() map[string]any {
+	return map[string]any{
+		"iss":    testIssuer,
+		"aud":    testAudience,
+		"sub":    "alice",
+		"groups": []string{"devs", "admins"},
+		"exp":    time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func newTestOIDC(t *testing.T, keys ...map[string]string) (*oidcAuthenticator, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path, keys...)
+	t.Setenv("AUTH_OIDC_ISSUER", testIssuer)
+	t.Setenv("AUTH_OIDC_AUDIENCE", testAudience)
+	a, err := newOIDCAuthenticator(path)
+	if err != nil {
+		t.Fatalf("newOIDCAuthenticator: %v", err)
+	}
+	return a, path
+}
+
+func TestOIDCAcceptsSignedTokens(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	a, _ := newTestOIDC(t, rsaJWK("rsa-1", rsaKey), ecJWK("ec-1", ecKey))
+
+	for _, token := range []string{
+		signJWT(t, "RS256", "rsa-1", validClaims(), rsaKey),
+		signJWT(t, "ES256", "ec-1", validClaims(), ecKey),
+		signJWT(t, "ES256", "", validClaims(), ecKey),
+	} {
+		id, err := a.authenticate(context.Background(), token)
+		if err != nil {
+			t.Fatalf("authenticate: %v", err)
+		}
+		if id.Username != "alice" || strings.Join(id.Groups, ",") != "devs,admins" {
+			t.Fatalf("identity = %+v, want alice in devs,admins", id)
+		}
+	}
+
+	claims := validClaims()
+	claims["aud"] = []string{"other", testAudience}
+	claims["groups"] = "devs"
+	id, err := a.authenticate(context.Background(), signJWT(t, "RS256", "rsa-1", claims, rsaKey))
+	if err != nil {
+		t.Fatalf("authenticate with audience list: %v", err)
+	}
+	if len(id.Groups) != 1 || id.Groups[0] != "devs" {
+		t.Fatalf("groups = %v, want [devs]", id.Groups)
+	}
+}
+
+func TestOIDCRejectsInvalidTokens(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	a, _ := newTestOIDC(t, rsaJWK("rsa-1", rsaKey))
+
+	with := func(edit func(map[string]any)) map[string]any {
+		c := validClaims()
+		edit(c)
+		return c
+	}
+	valid := signJWT(t, "RS256", "rsa-1", validClaims(), rsaKey)
+	parts := strings.Split(valid, ".")
+	forged := with(func(c map[string]any) { c["sub"] = "mallory" })
+	forgedPayload, _ := json.Marshal(forged)
+
+	for name, tc := range map[string]struct {
+		token, want string
+	}{
+		"other key":      {signJWT(t, "RS256", "rsa-1", validClaims(), otherKey), "signature does not match"},
+		"unknown kid":    {signJWT(t, "RS256", "rsa-2", validClaims(), rsaKey), "signature does not match"},
+		"alg none":       {signJWT(t, "none", "rsa-1", validClaims(), nil), `unsupported signing algorithm "none"`},
+		"alg HS256":      {signJWT(t, "HS256", "rsa-1", validClaims(), nil), `unsupported signing algorithm "HS256"`},
+		"alg mismatch":   {signJWT(t, "ES256", "rsa-1", validClaims(), rsaKey), "signature does not match"},
+		"swapped claims": {parts[0] + "." + b64.EncodeToString(forgedPayload) + "." + parts[2], "signature does not match"},
+		"wrong issuer":   {signJWT(t, "RS256", "rsa-1", with(func(c map[string]any) { c["iss"] = "https://evil.example" }), rsaKey), "issuer"},
+		"wrong audience": {signJWT(t, "RS256", "rsa-1", with(func(c map[string]any) { c["aud"] = "other" }), rsaKey), "audience"},
+		"expired":        {signJWT(t, "RS256", "rsa-1", with(func(c map[string]any) { c["exp"] = time.Now().Add(-2 * jwtLeeway).Unix() }), rsaKey), "expired"},
+		"no exp":         {signJWT(t, "RS256", "rsa-1", with(func(c map[string]any) { delete(c, "exp") }), rsaKey), "no exp"},
+		"not yet valid":  {signJWT(t, "RS256", "rsa-1", with(func(c map[string]any) { c["nbf"] = time.Now().Add(2 * jwtLeeway).Unix() }), rsaKey), "not valid yet"},
+		"no username":    {signJWT(t, "RS256", "rsa-1", with(func(c map[string]any) { delete(c, "sub") }), rsaKey), "no sub claim"},
+		"bad header":     {"!!." + parts[1] + "." + parts[2], "malformed token header"},
+		"bad signature":  {parts[0] + "." + parts[1] + ".!!", "malformed token signature"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			id, err := a.authenticate(context.Background(), tc.token)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("authenticate = %+v, %v; want error containing %q", id, err, tc.want)
+			}
+		})
+	}
+
+	// Opaque tokens are left to the other providers.
+	if id, err := a.authenticate(context.Background(), "s3cret"); id != nil || err != nil {
+		t.Fatalf("opaque token = %+v, %v; want nil, nil", id, err)
+	}
+}
+
+func TestOIDCTiesECDSACurveToAlgorithm(t *testing.T) {
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	p521, _ := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	a, _ := newTestOIDC(t, ecJWK("p256", p256), ecJWK("p384", p384), ecJWK("p521", p521))
+
+	for _, tc := range []struct {
+		alg, kid string
+		key      *ecdsa.PrivateKey
+		ok       bool
+	}{
+		{"ES256", "p256", p256, true},
+		{"ES384", "p384", p384, true},
+		{"ES512", "p521", p521, true},
+		{"ES256", "p384", p384, false},
+		{"ES256", "p521", p521, false},
+		{"ES384", "p256", p256, false},
+		{"ES384", "p521", p521, false},
+		{"ES512", "p256", p256, false},
+		{"ES512", "p384", p384, false},
+		{"ES256", "", p384, false},
+	} {
+		_, err := a.authenticate(context.Background(), signJWT(t, tc.alg, tc.kid, validClaims(), tc.key))
+		if tc.ok && err != nil {
+			t.Errorf("%s with key %s: %v", tc.alg, tc.kid, err)
+		}
+		if !tc.ok && (err == nil || !strings.Contains(err.Error(), "signature does not match")) {
+			t.Errorf("%s with key %s = %v, want a signature mismatch", tc.alg, tc.kid, err)
+		}
+	}
+}
+
+func TestOIDCReloadsRotatedKeys(t *testing.T) {
+	oldKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	newKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	a, path := newTestOIDC(t, rsaJWK("old", oldKey))
+
+	if _, err := a.authenticate(context.Background(), signJWT(t, "RS256", "new", validClaims(), newKey)); err == nil {
+		t.Fatalf("token of an unpublished key was accepted")
+	}
+	writeJWKS(t, path, rsaJWK("new", newKey))
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.authenticate(context.Background(), signJWT(t, "RS256", "new", validClaims(), newKey)); err != nil {
+		t.Fatalf("token of the rotated key: %v", err)
+	}
+	if _, err := a.authenticate(context.Background(), signJWT(t, "RS256", "old", validClaims(), oldKey)); err == nil {
+		t.Fatalf("token of a removed key was accepted")
+	}
+
+	// A broken file keeps the last good keys in use.
+	if err := os.WriteFile(path, []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.authenticate(context.Background(), signJWT(t, "RS256", "new", validClaims(), newKey)); err != nil {
+		t.Fatalf("token after a broken JWKS edit: %v", err)
+	}
+}
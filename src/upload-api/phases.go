@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// Pipeline phases. All but queued run under their own deadline.
+const (
+	phaseQueued   = "queued"
+	phaseExtract  = "extract"
+	phaseValidate = "validate"
+	phaseBuild    = "build"
+	phasePush     = "push"
+	phaseDeploy   = "deploy"
+	phaseReady    = "ready"
+	phaseResolve  = "resolve"
+)
+
+// Phase outcomes besides the FAILED, TIMED_OUT and CANCELLED deployment
+// statuses, which phases share.
+const (
+	phaseStatusRunning   = "RUNNING"
+	phaseStatusSucceeded = "SUCCEEDED"
+)
+
+// phaseExcerptLines bounds the log lines kept on each phase record.
+const phaseExcerptLines = 20
+
+var errPhaseTimeout = errors.New("phase deadline exceeded")
+
+// PhaseRecord is one entry of a deployment's timeline.
+type PhaseRecord struct {
+	Name       string     `json:"name"`
+	Status     string     `json:"status"`
+	StartedAt  time.Time  `json:"startedAt"`
+	EndedAt    *time.Time `json:"endedAt,omitempty"`
+	DurationMs int64      `json:"durationMs"`
+	ExitCode   *int       `json:"exitCode,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	LogExcerpt string     `json:"logExcerpt,omitempty"`
+}
+
+// phaseTimeouts reads the per-phase deadlines from the environment.
+func phaseTimeouts() map[string]time.Duration {
+	return map[string]time.Duration{
+		phaseExtract:  envDuration("EXTRACT_TIMEOUT", 2*time.Minute),
+		phaseValidate: envDuration("VALIDATE_TIMEOUT", 1*time.Minute),
+		phaseBuild:    envDuration("BUILD_TIMEOUT", 20*time.Minute),
+		phasePush:     envDuration("PUSH_TIMEOUT", 10*time.Minute),
+		phaseDeploy:   envDuration("DEPLOY_TIMEOUT", 2*time.Minute),
+		phaseReady:    envDuration("READY_TIMEOUT", serviceReadyTimeout),
+		phaseResolve:  envDuration("RESOLVE_TIMEOUT", 1*time.Minute),
+	}
+}
+
+// phaseRun times one phase of a job and keeps its timeline entry up to
+// date. Its context carries the phase deadline on top of the job's
+// cancellation.
+type phaseRun struct {
+	name     string
+	timeout  time.Duration
+	started  time.Time
+	elapsed  time.Duration
+	timedOut bool
+	record   PhaseRecord
+
+	s       *Server
+	id      string // empty when the deployment is not stored yet
+	index   int
+	logs    *deploymentLog
+	logFrom uint64
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// startPhase opens phase name for deployment id and appends it to the
+// timeline as RUNNING. With an empty id nothing is stored and the caller
+// adds p.record to the deployment itself once the phase has ended.
+func (s *Server) startPhase(ctx context.Context, id, name string, logs *deploymentLog) *phaseRun {
+	p := &phaseRun{name: name, timeout: s.timeouts[name], started: time.Now(), s: s, id: id, logs: logs}
+	p.ctx, p.cancel = context.WithTimeoutCause(ctx, p.timeout, fmt.Errorf("%s: %w", name, errPhaseTimeout))
+	if logs != nil {
+		p.logFrom = logs.mark()
+	}
+	p.record = PhaseRecord{Name: name, Status: phaseStatusRunning, StartedAt: p.started.UTC()}
+	if id != "" {
+		s.updateDeployment(id, func(d *Deployment) {
+			p.index = len(d.Phases)
+			d.Phases = append(d.Phases, p.record)
+		})
+	}
+	return p
+}
+
+// end stops the phase clock, records how the phase finished and releases
+// its context. It must be called before inspecting elapsed or timedOut.
+func (p *phaseRun) end(err error) {
+	p.elapsed = time.Since(p.started)
+	cause := context.Cause(p.ctx)
+	p.timedOut = errors.Is(cause, errPhaseTimeout)
+	p.cancel()
+
+	endedAt := p.started.Add(p.elapsed).UTC()
+	p.record.EndedAt = &endedAt
+	p.record.DurationMs = p.elapsed.Milliseconds()
+	switch {
+	case err == nil:
+		p.record.Status = phaseStatusSucceeded
+	case p.timedOut:
+		p.record.Status = statusTimedOut
+	case errors.Is(cause, errCancelRequested):
+		p.record.Status = statusCancelled
+	default:
+		p.record.Status = statusFailed
+	}
+	if err != nil {
+		p.record.Error = err.Error()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			code := exitErr.ExitCode()
+			p.record.ExitCode = &code
+		}
+	}
+	if p.logs != nil {
+		p.record.LogExcerpt = p.logs.tail(p.logFrom, phaseExcerptLines)
+	}
+
+	if p.id != "" {
+		p.s.updateDeployment(p.id, func(d *Deployment) {
+			if p.index < len(d.Phases) {
+				d.Phases[p.index] = p.record
+			}
+		})
+	}
+}
+
+// recordQueued adds the time the job waited for a worker to the timeline,
+// counted from the end of the previous phase (extraction, for uploads).
+func (s *Server) recordQueued(id string) {
+	now := time.Now().UTC()
+	s.updateDeployment(id, func(d *Deployment) {
+		since := d.CreatedAt
+		if n := len(d.Phases); n > 0 && d.Phases[n-1].EndedAt != nil {
+			since = *d.Phases[n-1].EndedAt
+		}
+		d.Phases = append(d.Phases, PhaseRecord{
+			Name:       phaseQueued,
+			Status:     phaseStatusSucceeded,
+			StartedAt:  since,
+			EndedAt:    &now,
+			DurationMs: now.Sub(since).Milliseconds(),
+		})
+	})
+}
+
+// failPhase records a job that stopped in phase p. A phase that ran past its
+// deadline ends the job as TIMED_OUT instead of FAILED.
+func (s *Server) failPhase(id, output string, p *phaseRun, errMsg string) {
+	status := statusFailed
+	if p.timedOut {
+		status = statusTimedOut
+		errMsg = fmt.Sprintf("%s timed out after %s", p.name, p.timeout)
+	}
+	s.updateDeployment(id, func(d *Deployment) {
+		d.Status = status
+		d.Output = output
+		d.Error = errMsg
+		d.FailedPhase = p.name
+		d.FailedAfterMs = p.elapsed.Milliseconds()
+	})
+}
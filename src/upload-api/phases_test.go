@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPhaseTimeoutsFromEnv(t *testing.T) {
+	t.Setenv("BUILD_TIMEOUT", "90s")
+	t.Setenv("READY_TIMEOUT", "10m")
+	want := map[string]time.Duration{
+		phaseExtract:  2 * time.Minute,
+		phaseValidate: time.Minute,
+		phaseBuild:    90 * time.Second,
+		phasePush:     10 * time.Minute,
+		phaseDeploy:   2 * time.Minute,
+		phaseReady:    10 * time.Minute,
+		phaseResolve:  time.Minute,
+	}
+	got := phaseTimeouts()
+	for phase, d := range want {
+		if got[phase] != d {
+			t.Errorf("timeout of %s = %v, want %v", phase, got[phase], d)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("phaseTimeouts has %d phases, want %d", len(got), len(want))
+	}
+}
+
+func TestPhaseDeadlines(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		setup      func(s *Server)
+		wantStatus string
+		wantPhase  string
+		wantError  string
+	}{
+		{
+			name: "build runs past its deadline",
+			setup: func(s *Server) {
+				s.builders["minikube"] = blockingBuilder{started: make(chan string, 1)}
+				s.timeouts[phaseBuild] = 50 * time.Millisecond
+			},
+			wantStatus: statusTimedOut,
+			wantPhase:  phaseBuild,
+			wantError:  "build timed out after 50ms",
+		},
+		{
+			name: "revision never becomes ready",
+			setup: func(s *Server) {
+				s.services = stuckServices{mockServices: s.services.(*mockServices), waiting: make(chan string, 1)}
+				s.timeouts[phaseReady] = 50 * time.Millisecond
+			},
+			wantStatus: statusTimedOut,
+			wantPhase:  phaseReady,
+			wantError:  "ready timed out after 50ms",
+		},
+		{
+			name:       "build fails within its deadline",
+			setup:      func(s *Server) { s.builders["minikube"] = instantBuilder{err: errors.New("exit status 2")} },
+			wantStatus: statusFailed,
+			wantPhase:  phaseBuild,
+			wantError:  "build failed: builder minikube: exit status 2",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newPipelineServer(t)
+			tc.setup(s)
+			d := deployAndWait(t, s, map[string]string{"service": "hello"}, map[string]string{"Dockerfile": testDockerfile})
+			if d.Status != tc.wantStatus || d.FailedPhase != tc.wantPhase || d.Error != tc.wantError {
+				t.Fatalf("deployment = %s in %q (%s), want %s in %s (%s)", d.Status, d.FailedPhase, d.Error, tc.wantStatus, tc.wantPhase, tc.wantError)
+			}
+			last := d.Phases[len(d.Phases)-1]
+			if last.Name != tc.wantPhase || last.Status != tc.wantStatus {
+				t.Fatalf("last phase = %s %s, want %s %s", last.Name, last.Status, tc.wantPhase, tc.wantStatus)
+			}
+			if tc.wantStatus == statusTimedOut && (d.FailedAfterMs < 50 || last.DurationMs < 50) {
+				t.Fatalf("failedAfterMs %d, phase duration %d, want at least the 50ms deadline", d.FailedAfterMs, last.DurationMs)
+			}
+		})
+	}
+}
+
+func TestTimedOutIsTerminal(t *testing.T) {
+	s := newTestServer(t)
+	s.store.Put(&Deployment{ID: "dep-000001", Status: statusTimedOut})
+	if code, body := cancelDeployment(t, s, http.MethodPost, "dep-000001"); code != http.StatusConflict {
+		t.Fatalf("cancel of a timed-out deployment = %d %s, want 409", code, body)
+	}
+}
+
+// scriptBuild runs a shell script through runLogged, as the real builders
+// run their CLIs.
+type scriptBuild struct{ script string }
+
+func (scriptBuild) Name() string { return "minikube" }
+
+func (b scriptBuild) Build(ctx context.Context, _ BuildRequest, logs io.Writer) error {
+	return runLogged(ctx, logs, "sh", "-c", b.script)
+}
+
+func TestPhaseTimeline(t *testing.T) {
+	s := newPipelineServer(t)
+	d := deployAndWait(t, s, map[string]string{"service": "hello"}, map[string]string{"Dockerfile": testDockerfile})
+	if d.Status != statusReady {
+		t.Fatalf("status = %s (%s), want READY", d.Status, d.Error)
+	}
+
+	code, body := get(t, s.handleStatusByID, "/status/"+d.ID, nil)
+	if code != http.StatusOK {
+		t.Fatalf("status = %d %s", code, body)
+	}
+	var status Deployment
+	if err := json.Unmarshal(body, &status); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, p := range status.Phases {
+		names = append(names, p.Name)
+	}
+	// The instant builder loads nothing, so there is no push phase.
+	want := []string{phaseExtract, phaseQueued, phaseValidate, phaseBuild, phaseDeploy, phaseReady, phaseResolve}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("phases = %v, want %v", names, want)
+	}
+	var previousEnd time.Time
+	for _, p := range status.Phases {
+		if p.Status != phaseStatusSucceeded || p.EndedAt == nil || p.Error != "" || p.ExitCode != nil {
+			t.Fatalf("phase %s = %+v, want SUCCEEDED with an end time", p.Name, p)
+		}
+		if p.StartedAt.Before(previousEnd) || p.EndedAt.Before(p.StartedAt) {
+			t.Fatalf("phase %s runs %v..%v, before the previous phase ended at %v", p.Name, p.StartedAt, p.EndedAt, previousEnd)
+		}
+		if got := p.EndedAt.Sub(p.StartedAt).Milliseconds(); got != p.DurationMs {
+			t.Fatalf("phase %s durationMs = %d, want %d", p.Name, p.DurationMs, got)
+		}
+		previousEnd = *p.EndedAt
+	}
+	for _, tc := range []struct{ phase, excerpt string }{
+		{phaseValidate, "validated source for default/hello"},
+		{phaseBuild, "built " + d.Image},
+		{phaseResolve, "revision hello-00001 ready"},
+	} {
+		for _, p := range status.Phases {
+			if p.Name == tc.phase && !strings.Contains(p.LogExcerpt, tc.excerpt) {
+				t.Errorf("%s excerpt = %q, want %q", p.Name, p.LogExcerpt, tc.excerpt)
+			}
+		}
+	}
+}
+
+func TestPhaseRecordsExitCodeAndExcerpt(t *testing.T) {
+	var script strings.Builder
+	for i := 1; i <= phaseExcerptLines+5; i++ {
+		fmt.Fprintf(&script, "echo step %d; ", i)
+	}
+	script.WriteString("exit 3")
+
+	s := newPipelineServer(t)
+	s.builders["minikube"] = scriptBuild{script: script.String()}
+	d := deployAndWait(t, s, map[string]string{"service": "hello"}, map[string]string{"Dockerfile": testDockerfile})
+
+	build := d.Phases[len(d.Phases)-1]
+	if d.Status != statusFailed || build.Name != phaseBuild || build.Status != statusFailed {
+		t.Fatalf("deployment %s, last phase %s %s, want FAILED in build", d.Status, build.Name, build.Status)
+	}
+	if build.ExitCode == nil || *build.ExitCode != 3 {
+		t.Fatalf("exit code = %v, want 3", build.ExitCode)
+	}
+	lines := strings.Split(build.LogExcerpt, "\n")
+	if len(lines) != phaseExcerptLines || lines[0] != "step 6" || lines[len(lines)-1] != fmt.Sprintf("step %d", phaseExcerptLines+5) {
+		t.Fatalf("excerpt = %q, want the last %d lines", build.LogExcerpt, phaseExcerptLines)
+	}
+}
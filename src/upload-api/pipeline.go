@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// pipelineStep is one Go-driven stage of an upload job. Each step runs as
+// its own timed phase, wrapped by the configured hooks.
+type pipelineStep struct {
+	name   string // phase name, also used for hooks and timeouts
+	status string // deployment status while the step runs
+	skip   func(s *Server, j *pipelineJob) bool
+	run    func(ctx context.Context, s *Server, j *pipelineJob) error
+}
+
+// pipelineJob carries state between the steps of one upload.
+type pipelineJob struct {
+	d    *Deployment
+	logs *deploymentLog
+	req  BuildRequest
+
+	// Set by the deploy step; used to undo a cancelled apply.
+	applied    bool
+	before     *ServiceState
+	beforeErr  error
+	traffic    []TrafficTarget
+	generation int64
+
+	state *ServiceState
+}
+
+// uploadPipeline lists the steps of an upload in order.
+var uploadPipeline = []pipelineStep{
+	{name: phaseValidate, status: statusBuild, run: validateStep},
+	{name: phaseBuild, status: statusBuild, run: buildStep},
+	{name: phasePush, status: statusBuild, skip: skipPush, run: pushStep},
+	{name: phaseDeploy, status: statusDeploy, run: deployStep},
+	{name: phaseReady, status: statusDeploy, run: readyStep},
+	{name: phaseResolve, status: statusDeploy, run: resolveStep},
+}
+
+func (s *Server) runBuildDeploy(id string) {
+	d, ok := s.store.Get(id)
+	if !ok {
+		return
+	}
+	ctx, end, ok := s.beginRun(id)
+	if !ok {
+		return
+	}
+	defer end()
+	s.recordQueued(id)
+	logs := s.openLog(id)
+	defer logs.Close()
+
+	j := &pipelineJob{
+		d:    d,
+		logs: logs,
+		req: BuildRequest{
+			DeploymentID: d.ID,
+			ServiceName:  d.ServiceName,
+			Namespace:    d.Namespace,
+			ContextDir:   d.ExtractedPath,
+			Image:        d.Image,
+		},
+	}
+	status := d.Status
+	for _, step := range uploadPipeline {
+		if step.skip != nil && step.skip(s, j) {
+			continue
+		}
+		if step.status != status {
+			status = step.status
+			s.updateStatus(id, status, logs.String(), "")
+		}
+
+		p := s.startPhase(ctx, id, step.name, logs)
+		err := s.runStep(p.ctx, step, j)
+		p.end(err)
+		if cancelRequested(ctx) {
+			if j.applied {
+				s.revertApply(d, j.before, j.beforeErr, logs)
+			}
+			s.markCancelled(id, logs.String(), step.name)
+			return
+		}
+		if err != nil {
+			s.failPhase(id, logs.String(), p, fmt.Sprintf("%s failed: %v", step.name, err))
+			return
+		}
+	}
+	s.updateReady(id, logs.String(), j.d.Revision, j.state.Traffic)
+}
+
+// runStep runs step between its pre and post hooks.
+func (s *Server) runStep(ctx context.Context, step pipelineStep, j *pipelineJob) error {
+	for _, h := range s.hooks {
+		if err := h.Run(ctx, hookPre, step.name, j.d, j.logs); err != nil {
+			return err
+		}
+	}
+	if err := step.run(ctx, s, j); err != nil {
+		return err
+	}
+	for _, h := range s.hooks {
+		if err := h.Run(ctx, hookPost, step.name, j.d, j.logs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateStep checks that the job has what the later steps need before
+// any image is built.
+func validateStep(_ context.Context, s *Server, j *pipelineJob) error {
+	d := j.d
+	if _, ok := s.builders[d.Builder]; !ok {
+		return fmt.Errorf("unknown builder %q", d.Builder)
+	}
+	if info, err := os.Stat(d.ExtractedPath); err != nil || !info.IsDir() {
+		return fmt.Errorf("extracted source %s is missing", d.ExtractedPath)
+	}
+	if d.Builder != builderBuildpacks {
+		if _, err := os.Stat(filepath.Join(d.ExtractedPath, "Dockerfile")); err != nil {
+			return fmt.Errorf("no Dockerfile in build context")
+		}
+	}
+	if d.Dockerfile == dockerfileGenerated {
+		fmt.Fprintf(j.logs, "no Dockerfile in bundle; generated one from the %s template\n", d.Language)
+	}
+	fmt.Fprintf(j.logs, "validated source for %s/%s (builder %s, image %s)\n", d.Namespace, d.ServiceName, d.Builder, d.Image)
+	return nil
+}
+
+func buildStep(ctx context.Context, s *Server, j *pipelineJob) error {
+	if s.mockDeploy {
+		if err := sleepContext(ctx, 1*time.Second); err != nil {
+			return err
+		}
+		fmt.Fprintf(j.logs, "mock build executed (builder %s)\n", j.d.Builder)
+		return nil
+	}
+	if err := s.builders[j.d.Builder].Build(ctx, j.req, j.logs); err != nil {
+		return fmt.Errorf("builder %s: %w", j.d.Builder, err)
+	}
+	return nil
+}
+
+// skipPush skips the push step for builders that load or push the image as
+// part of the build.
+func skipPush(s *Server, j *pipelineJob) bool {
+	pusher, ok := s.builders[j.d.Builder].(imagePusher)
+	return s.mockDeploy || !ok || !pusher.Pushes()
+}
+
+func pushStep(ctx context.Context, s *Server, j *pipelineJob) error {
+	if err := s.builders[j.d.Builder].(imagePusher).Push(ctx, j.req, j.logs); err != nil {
+		return fmt.Errorf("builder %s: %w", j.d.Builder, err)
+	}
+	return nil
+}
+
+// deployStep creates or patches the Knative Service. The service state from
+// before is kept so a cancelled deployment can be reverted.
+func deployStep(ctx context.Context, s *Server, j *pipelineJob) error {
+	d := j.d
+	j.before, j.beforeErr = s.services.GetService(ctx, d.Namespace, d.ServiceName)
+	if d.Strategy == strategyCanary {
+		if j.beforeErr == nil && j.before.LatestReadyRevision != "" {
+			j.traffic = canaryTraffic(j.before.LatestReadyRevision, d.CanaryPercent)
+		} else {
+			fmt.Fprintln(j.logs, "canary requested but no ready revision exists; routing 100% to the new revision")
+		}
+	}
+
+	fmt.Fprintf(j.logs, "applying ksvc %s/%s with image %s\n", d.Namespace, d.ServiceName, d.Image)
+	if s.mockDeploy {
+		if err := sleepContext(ctx, 1*time.Second); err != nil {
+			return err
+		}
+	}
+	j.applied = true
+	generation, err := s.services.Apply(ctx, d.Namespace, d.ServiceName, revisionSpecFor(d), j.traffic)
+	if err != nil {
+		return err
+	}
+	j.generation = generation
+	return nil
+}
+
+func readyStep(ctx context.Context, s *Server, j *pipelineJob) error {
+	st, err := s.services.WaitReady(ctx, j.d.Namespace, j.d.ServiceName, j.generation)
+	if err != nil {
+		return err
+	}
+	j.state = st
+	return nil
+}
+
+// resolveStep settles which revision this deployment produced and checks
+// that it is the one Knative reports as ready.
+func resolveStep(ctx context.Context, s *Server, j *pipelineJob) error {
+	d := j.d
+	if j.state.LatestCreatedRevision == "" {
+		st, err := s.services.GetService(ctx, d.Namespace, d.ServiceName)
+		if err != nil {
+			return err
+		}
+		j.state = st
+	}
+	revision := j.state.LatestCreatedRevision
+	if revision == "" {
+		return fmt.Errorf("ksvc %s/%s reports no created revision", d.Namespace, d.ServiceName)
+	}
+	if j.state.LatestReadyRevision != revision {
+		return fmt.Errorf("revision %s is not ready (latest ready: %q)", revision, j.state.LatestReadyRevision)
+	}
+	d.Revision = revision
+	fmt.Fprintf(j.logs, "applied ksvc %s/%s: revision %s ready\n", d.Namespace, d.ServiceName, revision)
+	return nil
+}
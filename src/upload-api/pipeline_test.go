@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingHook notes each call with the deployment status stored at that
+// point, and fails the call named failAt (e.g. "pre-build").
+type recordingHook struct {
+	s      *Server
+	failAt string
+
+	mu    sync.Mutex
+	calls []string
+}
+
+func (h *recordingHook) Run(_ context.Context, when, step string, d *Deployment, _ io.Writer) error {
+	stored, _ := h.s.store.Get(d.ID)
+	h.mu.Lock()
+	h.calls = append(h.calls, fmt.Sprintf("%s-%s %s", when, step, stored.Status))
+	h.mu.Unlock()
+	if when+"-"+step == h.failAt {
+		return errors.New("hook refused")
+	}
+	return nil
+}
+
+// testJob records d and returns a job for it, with a log that is closed
+// when the test ends.
+func testJob(t *testing.T, s *Server, d *Deployment) *pipelineJob {
+	t.Helper()
+	s.store.Put(d)
+	logs := s.openLog(d.ID)
+	t.Cleanup(logs.Close)
+	return &pipelineJob{d: d, logs: logs}
+}
+
+func TestPipelineStepStatusesAndHooks(t *testing.T) {
+	s := newPipelineServer(t)
+	hook := &recordingHook{s: s}
+	s.hooks = []Hook{hook}
+	d := deployAndWait(t, s, map[string]string{"service": "hello"}, map[string]string{"Dockerfile": testDockerfile})
+	if d.Status != statusReady {
+		t.Fatalf("status = %s (%s), want READY", d.Status, d.Error)
+	}
+
+	// Each step runs under the status it reports, between its hooks.
+	var want []string
+	for _, step := range []struct{ name, status string }{
+		{phaseValidate, statusBuild},
+		{phaseBuild, statusBuild},
+		{phaseDeploy, statusDeploy},
+		{phaseReady, statusDeploy},
+		{phaseResolve, statusDeploy},
+	} {
+		want = append(want, hookPre+"-"+step.name+" "+step.status, hookPost+"-"+step.name+" "+step.status)
+	}
+	if !reflect.DeepEqual(hook.calls, want) {
+		t.Fatalf("hook calls:\n%s\nwant:\n%s", strings.Join(hook.calls, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestPipelineHookFailures(t *testing.T) {
+	for _, tc := range []struct {
+		failAt    string
+		wantPhase string
+		wantBuilt bool
+		wantCalls int
+	}{
+		{failAt: "pre-validate", wantPhase: phaseValidate, wantCalls: 1},
+		{failAt: "pre-build", wantPhase: phaseBuild, wantCalls: 3},
+		{failAt: "post-build", wantPhase: phaseBuild, wantBuilt: true, wantCalls: 4},
+		{failAt: "post-resolve", wantPhase: phaseResolve, wantBuilt: true, wantCalls: 10},
+	} {
+		t.Run(tc.failAt, func(t *testing.T) {
+			s := newPipelineServer(t)
+			hook := &recordingHook{s: s, failAt: tc.failAt}
+			s.hooks = []Hook{hook}
+			d := deployAndWait(t, s, map[string]string{"service": "hello"}, map[string]string{"Dockerfile": testDockerfile})
+
+			if d.Status != statusFailed || d.FailedPhase != tc.wantPhase || d.Error != tc.wantPhase+" failed: hook refused" {
+				t.Fatalf("deployment = %s in %q (%s), want FAILED in %s", d.Status, d.FailedPhase, d.Error, tc.wantPhase)
+			}
+			if len(hook.calls) != tc.wantCalls {
+				t.Fatalf("hook calls = %v, want %d of them", hook.calls, tc.wantCalls)
+			}
+			if built := strings.Contains(d.Output, "built "+d.Image); built != tc.wantBuilt {
+				t.Fatalf("image built = %v, want %v:\n%s", built, tc.wantBuilt, d.Output)
+			}
+		})
+	}
+}
+
+func TestExecHooks(t *testing.T) {
+	dir := t.TempDir()
+	for name, script := range map[string]string{
+		"pre-build":  "#!/bin/sh\necho \"$HOOK $STEP $DEPLOYMENT_ID $NAMESPACE/$SERVICE_NAME $BUILDER $IMAGE\"\npwd\n",
+		"post-build": "#!/bin/sh\necho cleaning up\nexit 4\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "pre-deploy"), []byte("#!/bin/sh\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	app := t.TempDir()
+	d := &Deployment{ID: "dep-000001", Namespace: "demo-apps", ServiceName: "hello", ExtractedPath: app, Builder: "docker", Image: "dev.local/hello:dep-000001"}
+
+	for _, tc := range []struct {
+		when, step string
+		wantLogs   string
+		wantErr    string
+	}{
+		{when: hookPre, step: phaseBuild, wantLogs: "[hook] running pre-build\npre build dep-000001 demo-apps/hello docker dev.local/hello:dep-000001\n" + app + "\n"},
+		{when: hookPost, step: phaseBuild, wantLogs: "[hook] running post-build\ncleaning up\n", wantErr: "hook post-build: exit status 4"},
+		{when: hookPre, step: phaseDeploy, wantErr: "is not an executable file"},
+		{when: hookPre, step: phaseValidate},
+	} {
+		t.Run(tc.when+"-"+tc.step, func(t *testing.T) {
+			var logs bytes.Buffer
+			err := execHooks{dir: dir}.Run(testContext(t), tc.when, tc.step, d, &logs)
+			if tc.wantErr == "" && err != nil || tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+				t.Fatalf("error = %v, want %q", err, tc.wantErr)
+			}
+			if logs.String() != tc.wantLogs {
+				t.Fatalf("logs = %q, want %q", logs.String(), tc.wantLogs)
+			}
+		})
+	}
+}
+
+func TestConfiguredHooks(t *testing.T) {
+	t.Setenv("HOOKS_DIR", "")
+	if hooks := configuredHooks(); hooks != nil {
+		t.Fatalf("hooks without HOOKS_DIR = %v", hooks)
+	}
+	t.Setenv("HOOKS_DIR", "/etc/upload-api/hooks")
+	if hooks := configuredHooks(); !reflect.DeepEqual(hooks, []Hook{execHooks{dir: "/etc/upload-api/hooks"}}) {
+		t.Fatalf("hooks = %v, want exec hooks from HOOKS_DIR", hooks)
+	}
+}
+
+func TestValidateStep(t *testing.T) {
+	withDockerfile := t.TempDir()
+	if err := os.WriteFile(filepath.Join(withDockerfile, "Dockerfile"), []byte(testDockerfile), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	empty := t.TempDir()
+
+	for _, tc := range []struct {
+		name     string
+		d        Deployment
+		wantErr  string
+		wantLogs string
+	}{
+		{name: "bundled Dockerfile", d: Deployment{Builder: "docker", ExtractedPath: withDockerfile}, wantLogs: "validated source for demo-apps/hello (builder docker"},
+		{
+			name:     "generated Dockerfile",
+			d:        Deployment{Builder: "docker", ExtractedPath: withDockerfile, Dockerfile: dockerfileGenerated, Language: langNode},
+			wantLogs: "generated one from the node template",
+		},
+		{name: "buildpacks without Dockerfile", d: Deployment{Builder: builderBuildpacks, ExtractedPath: empty}, wantLogs: "validated source"},
+
+		{name: "unknown builder", d: Deployment{Builder: "bazel", ExtractedPath: withDockerfile}, wantErr: `unknown builder "bazel"`},
+		{name: "source removed", d: Deployment{Builder: "docker", ExtractedPath: filepath.Join(empty, "gone")}, wantErr: "is missing"},
+		{name: "no Dockerfile", d: Deployment{Builder: "docker", ExtractedPath: empty}, wantErr: "no Dockerfile in build context"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t)
+			d := tc.d
+			d.ID, d.Namespace, d.ServiceName = "dep-000001", "demo-apps", "hello"
+			j := testJob(t, s, &d)
+			err := validateStep(testContext(t), s, j)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(j.logs.String(), tc.wantLogs) {
+				t.Fatalf("logs = %q, want %q", j.logs.String(), tc.wantLogs)
+			}
+		})
+	}
+}
+
+func TestSkipPush(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		builder Builder
+		mock    bool
+		want    bool
+	}{
+		{name: "builder without push step", builder: instantBuilder{}, want: true},
+		{name: "pusher with push disabled", builder: dockerBuilder{}, want: true},
+		{name: "pusher with push enabled", builder: dockerBuilder{push: true}, want: false},
+		{name: "mock deploy", builder: dockerBuilder{push: true}, mock: true, want: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t)
+			s.mockDeploy = tc.mock
+			s.builders = map[string]Builder{tc.builder.Name(): tc.builder}
+			if got := skipPush(s, &pipelineJob{d: &Deployment{Builder: tc.builder.Name()}}); got != tc.want {
+				t.Fatalf("skipPush = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestResolveStep(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		state        ServiceState
+		wantRevision string
+		wantErr      string
+	}{
+		{name: "ready revision", state: ServiceState{LatestCreatedRevision: "hello-00002", LatestReadyRevision: "hello-00002"}, wantRevision: "hello-00002"},
+		// The applied mock service has hello-00001 ready.
+		{name: "wait reported no revision", wantRevision: "hello-00001"},
+		{name: "created revision not ready", state: ServiceState{LatestCreatedRevision: "hello-00002", LatestReadyRevision: "hello-00001"}, wantErr: `revision hello-00002 is not ready (latest ready: "hello-00001")`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t)
+			if _, err := s.services.Apply(testContext(t), "demo-apps", "hello", RevisionSpec{}, nil); err != nil {
+				t.Fatal(err)
+			}
+			j := testJob(t, s, &Deployment{ID: "dep-000001", Namespace: "demo-apps", ServiceName: "hello"})
+			state := tc.state
+			j.state = &state
+			err := resolveStep(testContext(t), s, j)
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("error = %v, want %q", err, tc.wantErr)
+				}
+				if j.d.Revision != "" {
+					t.Fatalf("failed resolve recorded revision %s", j.d.Revision)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if j.d.Revision != tc.wantRevision {
+				t.Fatalf("revision = %s, want %s", j.d.Revision, tc.wantRevision)
+			}
+		})
+	}
+
+	s := newTestServer(t)
+	j := testJob(t, s, &Deployment{ID: "dep-000001", Namespace: "demo-apps", ServiceName: "gone"})
+	j.state = &ServiceState{}
+	if err := resolveStep(testContext(t), s, j); !serviceNotFound(err) {
+		t.Fatalf("resolve of a missing service = %v, want not found", err)
+	}
+}
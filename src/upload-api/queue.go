@@ -0,0 +1,163 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// buildQueue runs upload build/deploy jobs on a bounded number of workers.
+// Jobs start in FIFO order, skipping jobs whose namespace is at its
+// concurrency cap. Enqueuing a job for a service supersedes any job for the
+// same service that is still waiting.
+//
+// The per-namespace cap only delays jobs. The builds quota
+// (namespaceQuota.maxBuilds) is checked against inFlight before a job is
+// enqueued and rejects uploads instead, so a cap at or above the quota never
+// holds anything back.
+type buildQueue struct {
+	workers      int
+	perNamespace int // 0 means no per-namespace cap
+	run          func(id string)
+	supersede    func(id, by string)
+
+	mu      sync.Mutex
+	pending []queuedJob
+	running map[string]int // by namespace
+	active  int
+}
+
+type queuedJob struct {
+	id        string
+	namespace string
+	service   string
+}
+
+func newBuildQueue(workers, perNamespace int, run func(id string), supersede func(id, by string)) *buildQueue {
+	if workers < 1 {
+		workers = 1
+	}
+	return &buildQueue{
+		workers:      workers,
+		perNamespace: perNamespace,
+		run:          run,
+		supersede:    supersede,
+		running:      map[string]int{},
+	}
+}
+
+// enqueue adds a job and returns its 1-based queue position, or 0 if it
+// started right away.
+func (q *buildQueue) enqueue(d *Deployment) int {
+	q.mu.Lock()
+	kept := q.pending[:0]
+	var superseded []string
+	for _, job := range q.pending {
+		if job.namespace == d.Namespace && job.service == d.ServiceName {
+			superseded = append(superseded, job.id)
+			continue
+		}
+		kept = append(kept, job)
+	}
+	q.pending = append(kept, queuedJob{id: d.ID, namespace: d.Namespace, service: d.ServiceName})
+	q.mu.Unlock()
+
+	for _, id := range superseded {
+		log.Printf("deployment %s superseded by %s", id, d.ID)
+		q.supersede(id, d.ID)
+	}
+	q.dispatch()
+	return q.position(d.ID)
+}
+
+// position returns the 1-based position of id among waiting jobs, or 0 if
+// it is not waiting.
+func (q *buildQueue) position(id string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, job := range q.pending {
+		if job.id == id {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// remove drops a waiting job, e.g. after it was cancelled.
+func (q *buildQueue) remove(id string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, job := range q.pending {
+		if job.id == id {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// dispatch starts as many waiting jobs as the limits allow.
+func (q *buildQueue) dispatch() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i := 0; i < len(q.pending) && q.active < q.workers; {
+		job := q.pending[i]
+		if q.perNamespace > 0 && q.running[job.namespace] >= q.perNamespace {
+			i++
+			continue
+		}
+		q.pending = append(q.pending[:i], q.pending[i+1:]...)
+		q.active++
+		q.running[job.namespace]++
+		go q.work(job)
+	}
+}
+
+func (q *buildQueue) work(job queuedJob) {
+	defer func() {
+		q.mu.Lock()
+		q.active--
+		q.running[job.namespace]--
+		if q.running[job.namespace] == 0 {
+			delete(q.running, job.namespace)
+		}
+		q.mu.Unlock()
+		q.dispatch()
+	}()
+	q.run(job.id)
+}
+
+// markSuperseded cancels a queued deployment that a newer upload for the
+// same service replaced.
+func (s *Server) markSuperseded(id, by string) {
+	s.runsMu.Lock()
+	defer s.runsMu.Unlock()
+	s.updateDeployment(id, func(d *Deployment) {
+		if isTerminalStatus(d.Status) {
+			return
+		}
+		d.Status = statusCancelled
+		d.SupersededBy = by
+		d.Error = "superseded by " + by
+	})
+}
+
+// withQueuePosition fills in QueuePosition for a QUEUED deployment.
+func (s *Server) withQueuePosition(d *Deployment) *Deployment {
+	if d.Status == statusQueued {
+		d.QueuePosition = s.queue.position(d.ID)
+	}
+	return d
+}
+
+// inFlight counts the jobs of namespace that are waiting or running. Waiting
+// jobs of service are left out, since a new upload for it supersedes them.
+func (q *buildQueue) inFlight(namespace, service string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := q.running[namespace]
+	for _, job := range q.pending {
+		if job.namespace == namespace && job.service != service {
+			n++
+		}
+	}
+	return n
+}
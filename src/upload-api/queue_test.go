@@ -0,0 +1,188 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// queueHarness drives a buildQueue whose jobs block until finish is called.
+type queueHarness struct {
+	q       *buildQueue
+	started chan string
+
+	mu         sync.Mutex
+	gates      map[string]chan struct{}
+	superseded map[string]string
+}
+
+func newQueueHarness(workers, perNamespace int) *queueHarness {
+	h := &queueHarness{started: make(chan string, 16), gates: map[string]chan struct{}{}, superseded: map[string]string{}}
+	h.q = newBuildQueue(workers, perNamespace, func(id string) {
+		h.started <- id
+		<-h.gate(id)
+	}, func(id, by string) {
+		h.mu.Lock()
+		h.superseded[id] = by
+		h.mu.Unlock()
+	})
+	return h
+}
+
+func (h *queueHarness) gate(id string) chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.gates[id] == nil {
+		h.gates[id] = make(chan struct{})
+	}
+	return h.gates[id]
+}
+
+func (h *queueHarness) finish(id string) { close(h.gate(id)) }
+
+func (h *queueHarness) enqueue(id, namespace, service string) int {
+	return h.q.enqueue(&Deployment{ID: id, Namespace: namespace, ServiceName: service})
+}
+
+// expectStarted waits for exactly ids to start, in any order.
+func (h *queueHarness) expectStarted(t *testing.T, ids ...string) {
+	t.Helper()
+	var got []string
+	for range ids {
+		select {
+		case id := <-h.started:
+			got = append(got, id)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("started %v, want %v", got, ids)
+		}
+	}
+	select {
+	case id := <-h.started:
+		t.Fatalf("%s started too, want only %v", id, ids)
+	case <-time.After(50 * time.Millisecond):
+	}
+	want := append([]string(nil), ids...)
+	sort.Strings(got)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("started %v, want %v", got, want)
+	}
+}
+
+func (h *queueHarness) pending() []string {
+	h.q.mu.Lock()
+	defer h.q.mu.Unlock()
+	var ids []string
+	for _, job := range h.q.pending {
+		ids = append(ids, job.id)
+	}
+	return ids
+}
+
+func TestBuildQueueStartsJobsInOrder(t *testing.T) {
+	h := newQueueHarness(1, 0)
+	for i, tc := range []struct{ id, service string }{{"dep-1", "a"}, {"dep-2", "b"}, {"dep-3", "c"}} {
+		if pos := h.enqueue(tc.id, "demo-apps", tc.service); pos != i {
+			t.Fatalf("enqueue(%s) position = %d, want %d", tc.id, pos, i)
+		}
+	}
+	h.expectStarted(t, "dep-1")
+
+	h.finish("dep-1")
+	h.expectStarted(t, "dep-2")
+	if pos := h.q.position("dep-3"); pos != 1 {
+		t.Fatalf("position(dep-3) = %d, want 1", pos)
+	}
+
+	h.q.remove("dep-3")
+	h.finish("dep-2")
+	h.expectStarted(t)
+	if pos := h.q.position("dep-3"); pos != 0 {
+		t.Fatalf("removed job position = %d, want 0", pos)
+	}
+}
+
+func TestBuildQueueCoalescesWaitingJobsOfAService(t *testing.T) {
+	h := newQueueHarness(1, 0)
+	h.enqueue("dep-1", "demo-apps", "api")
+	h.expectStarted(t, "dep-1")
+	h.enqueue("dep-2", "demo-apps", "api")
+	h.enqueue("dep-3", "demo-apps", "web")
+	h.enqueue("dep-4", "team-b", "api")
+
+	if pos := h.enqueue("dep-5", "demo-apps", "api"); pos != 3 {
+		t.Fatalf("enqueue(dep-5) position = %d, want 3", pos)
+	}
+	// The running job and same-named services in other namespaces stay.
+	if want := map[string]string{"dep-2": "dep-5"}; !reflect.DeepEqual(h.superseded, want) {
+		t.Fatalf("superseded = %v, want %v", h.superseded, want)
+	}
+	if got, want := h.pending(), []string{"dep-3", "dep-4", "dep-5"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("pending = %v, want %v", got, want)
+	}
+	h.finish("dep-1")
+	h.expectStarted(t, "dep-3")
+}
+
+func TestBuildQueueNamespaceCap(t *testing.T) {
+	h := newQueueHarness(3, 1)
+	h.enqueue("dep-1", "team-a", "api")
+	h.enqueue("dep-2", "team-a", "web")
+	h.enqueue("dep-3", "team-b", "api")
+	// dep-2 waits for team-a's slot; dep-3 starts past it.
+	h.expectStarted(t, "dep-1", "dep-3")
+	if pos := h.q.position("dep-2"); pos != 1 {
+		t.Fatalf("position(dep-2) = %d, want 1", pos)
+	}
+
+	for _, tc := range []struct {
+		namespace, service string
+		want               int
+	}{
+		{"team-a", "worker", 2}, // dep-1 running, dep-2 waiting
+		{"team-a", "web", 1},    // a new web upload supersedes dep-2
+		{"team-b", "api", 1},
+		{"team-c", "api", 0},
+	} {
+		if n := h.q.inFlight(tc.namespace, tc.service); n != tc.want {
+			t.Errorf("inFlight(%s, %s) = %d, want %d", tc.namespace, tc.service, n, tc.want)
+		}
+	}
+
+	h.finish("dep-3")
+	h.expectStarted(t)
+	h.finish("dep-1")
+	h.expectStarted(t, "dep-2")
+	h.finish("dep-2")
+}
+
+func TestMarkSuperseded(t *testing.T) {
+	s := newTestServer(t)
+	files := map[string]string{"Dockerfile": testDockerfile}
+	var ids []string
+	for _, service := range []string{"api", "web", "web"} {
+		code, out := deploy(t, s, deployRequest(t, map[string]string{"service": service}, "app.tar.gz", tarGz(t, files)))
+		if code != http.StatusAccepted {
+			t.Fatalf("status = %d (%v), want 202", code, out)
+		}
+		ids = append(ids, out["id"].(string))
+	}
+
+	old, _ := s.store.Get(ids[1])
+	if old.Status != statusCancelled || old.SupersededBy != ids[2] || old.Error != "superseded by "+ids[2] {
+		t.Fatalf("superseded record = %s supersededBy=%q error=%q", old.Status, old.SupersededBy, old.Error)
+	}
+	if pos := s.queue.position(ids[2]); pos != 1 {
+		t.Fatalf("position of the newer upload = %d, want 1", pos)
+	}
+
+	// A deployment that already finished keeps its outcome.
+	s.store.Update(ids[0], func(d *Deployment) { d.Status = statusReady })
+	s.markSuperseded(ids[0], ids[2])
+	if d, _ := s.store.Get(ids[0]); d.Status != statusReady || d.SupersededBy != "" {
+		t.Fatalf("finished record = %s supersededBy=%q, want READY and not superseded", d.Status, d.SupersededBy)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// namespaceQuota caps what one namespace may hold. Zero disables a cap.
+type namespaceQuota struct {
+	maxServices int
+	maxMemory   int64 // bytes of memory limits, summed over services
+	maxBuilds   int   // uploads queued or building at once, see buildQueue.inFlight
+}
+
+func namespaceQuotaFromEnv() namespaceQuota {
+	q := namespaceQuota{
+		maxServices: envInt("QUOTA_MAX_SERVICES", 20),
+		maxBuilds:   envInt("QUOTA_MAX_BUILDS", 3),
+	}
+	if raw := envOr("QUOTA_MAX_MEMORY", "8Gi"); raw != "0" {
+		n, err := memoryBytes(raw)
+		if err != nil {
+			log.Fatalf("QUOTA_MAX_MEMORY must be a memory quantity such as 8Gi, or 0, got %q", raw)
+		}
+		q.maxMemory = n
+	}
+	return q
+}
+
+// quotaError rejects an upload that would take its namespace past a quota.
+type quotaError struct {
+	status int
+	quota  string
+	msg    string
+}
+
+func (e *quotaError) Error() string { return e.msg }
+
+// serviceMemory returns the memory charge of each service in namespace.
+// Each service counts with its newest deployment that is READY or still in
+// flight; services whose deployments all failed or were cancelled, or that
+// were deleted since, do not count.
+func serviceMemory(all []*Deployment, namespace string) map[string]int64 {
+	latest := map[string]*Deployment{}
+	for _, d := range all {
+		if d.Namespace != namespace || d.Kind == kindTraffic {
+			continue
+		}
+		if isTerminalStatus(d.Status) && d.Status != statusReady {
+			continue
+		}
+		if cur, ok := latest[d.ServiceName]; !ok || d.CreatedAt.After(cur.CreatedAt) {
+			latest[d.ServiceName] = d
+		}
+	}
+	out := map[string]int64{}
+	for name, d := range latest {
+		if d.Kind == kindDelete {
+			continue
+		}
+		out[name] = d.Resources.memoryCharge()
+	}
+	return out
+}
+
+// reserveQuota checks d against its namespace's quotas and, if it fits,
+// holds its slot until enqueueReserved or releaseQuota. quotaMu is held only
+// for the check, not while d's secret and record are written.
+func (s *Server) reserveQuota(d *Deployment) *quotaError {
+	s.quotaMu.Lock()
+	defer s.quotaMu.Unlock()
+	if qe := s.checkQuota(d); qe != nil {
+		return qe
+	}
+	s.quotaReserved[d.ID] = d
+	return nil
+}
+
+// releaseQuota gives back the slot of an upload that was rejected after
+// reserveQuota.
+func (s *Server) releaseQuota(id string) {
+	s.quotaMu.Lock()
+	delete(s.quotaReserved, id)
+	s.quotaMu.Unlock()
+}
+
+// enqueueReserved queues d and hands its slot over to the build queue in one
+// step, so d is never counted twice or not at all.
+func (s *Server) enqueueReserved(d *Deployment) int {
+	s.quotaMu.Lock()
+	defer s.quotaMu.Unlock()
+	delete(s.quotaReserved, d.ID)
+	return s.queue.enqueue(d)
+}
+
+// checkQuota reports whether d fits its namespace's quotas, counting
+// reserved uploads like queued ones. A deployment to an existing service
+// replaces that service's memory charge rather than adding to it. The caller
+// holds quotaMu.
+func (s *Server) checkQuota(d *Deployment) *quotaError {
+	q := s.quota
+	all := s.store.List()
+	builds := 0
+	for _, r := range s.quotaReserved {
+		all = append(all, r)
+		// Like pending jobs, a reserved upload of the same service is
+		// superseded by d rather than counted.
+		if r.Namespace == d.Namespace && r.ServiceName != d.ServiceName {
+			builds++
+		}
+	}
+	if q.maxBuilds > 0 {
+		if n := s.queue.inFlight(d.Namespace, d.ServiceName) + builds; n >= q.maxBuilds {
+			return &quotaError{
+				status: http.StatusTooManyRequests,
+				quota:  "builds",
+				msg:    fmt.Sprintf("quota exceeded: namespace %s already has %d of %d builds queued or running; retry when one finishes", d.Namespace, n, q.maxBuilds),
+			}
+		}
+	}
+
+	services := serviceMemory(all, d.Namespace)
+	_, existing := services[d.ServiceName]
+	if q.maxServices > 0 && !existing && len(services) >= q.maxServices {
+		return &quotaError{
+			status: http.StatusForbidden,
+			quota:  "services",
+			msg:    fmt.Sprintf("quota exceeded: namespace %s already has %d of %d services", d.Namespace, len(services), q.maxServices),
+		}
+	}
+	if q.maxMemory > 0 {
+		services[d.ServiceName] = d.Resources.memoryCharge()
+		var total int64
+		for _, n := range services {
+			total += n
+		}
+		if total > q.maxMemory {
+			return &quotaError{
+				status: http.StatusForbidden,
+				quota:  "memory",
+				msg:    fmt.Sprintf("quota exceeded: namespace %s would need %s of memory limits, above its %s quota", d.Namespace, formatMemory(total), formatMemory(q.maxMemory)),
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestReservedUploadsCountAgainstQuota(t *testing.T) {
+	s := newTestServer(t)
+	s.quota = namespaceQuota{maxBuilds: 1}
+	first := &Deployment{ID: "dep-000001", Namespace: "demo-apps", ServiceName: "api"}
+	second := &Deployment{ID: "dep-000002", Namespace: "demo-apps", ServiceName: "web"}
+
+	if qe := s.reserveQuota(first); qe != nil {
+		t.Fatalf("first reservation: %v", qe)
+	}
+	if qe := s.reserveQuota(second); qe == nil || qe.quota != "builds" {
+		t.Fatalf("second reservation = %v, want builds quota error", qe)
+	}
+	// Another upload of the same service supersedes the reserved one.
+	if qe := s.reserveQuota(&Deployment{ID: "dep-000003", Namespace: "demo-apps", ServiceName: "api"}); qe != nil {
+		t.Fatalf("same-service reservation: %v", qe)
+	}
+	s.releaseQuota("dep-000003")
+
+	s.releaseQuota(first.ID)
+	if qe := s.reserveQuota(second); qe != nil {
+		t.Fatalf("reservation after release: %v", qe)
+	}
+	s.enqueueReserved(second)
+	if len(s.quotaReserved) != 0 {
+		t.Fatalf("queued upload still reserved: %v", s.quotaReserved)
+	}
+	if qe := s.reserveQuota(first); qe == nil || qe.quota != "builds" {
+		t.Fatalf("reservation after enqueue = %v, want builds quota error", qe)
+	}
+}
+
+// failingSecrets fails ApplySecret and records whether quotaMu was free
+// while it ran.
+type failingSecrets struct {
+	ServiceClient
+	s           *Server
+	lockWasFree bool
+}
+
+func (f *failingSecrets) ApplySecret(context.Context, string, string, map[string]string) error {
+	if f.s.quotaMu.TryLock() {
+		f.lockWasFree = true
+		f.s.quotaMu.Unlock()
+	}
+	return errors.New("secrets are forbidden")
+}
+
+func TestDeployReleasesQuotaWhenSecretFails(t *testing.T) {
+	s := newTestServer(t)
+	s.quota = namespaceQuota{maxBuilds: 1}
+	secrets := &failingSecrets{ServiceClient: s.services, s: s}
+	s.services = secrets
+
+	fields := map[string]string{"secretEnv": "TOKEN=hunter2"}
+	code, out := deploy(t, s, deployRequest(t, fields, "app.tar.gz", tarGz(t, map[string]string{"Dockerfile": testDockerfile})))
+	if code != http.StatusInternalServerError {
+		t.Fatalf("status = %d (%v), want 500", code, out)
+	}
+	if !secrets.lockWasFree {
+		t.Fatalf("quotaMu was held across ApplySecret")
+	}
+	if len(s.quotaReserved) != 0 {
+		t.Fatalf("failed upload kept its quota slot: %v", s.quotaReserved)
+	}
+
+	s.services = secrets.ServiceClient
+	code, out = deploy(t, s, deployRequest(t, fields, "app.tar.gz", tarGz(t, map[string]string{"Dockerfile": testDockerfile})))
+	if code != http.StatusAccepted {
+		t.Fatalf("retry status = %d (%v), want 202", code, out)
+	}
+}
+
+func TestBuildsQuotaCountsQueuedJobs(t *testing.T) {
+	s := newTestServer(t)
+	s.quota = namespaceQuota{maxBuilds: 2}
+	s.queue.perNamespace = 1
+	files := map[string]string{"Dockerfile": testDockerfile}
+
+	// The first upload builds, the second waits behind the namespace cap and
+	// still counts, so the third is over the quota.
+	for i, tc := range []struct {
+		service string
+		status  int
+	}{
+		{"api", http.StatusAccepted},
+		{"web", http.StatusAccepted},
+		{"worker", http.StatusTooManyRequests},
+	} {
+		code, out := deploy(t, s, deployRequest(t, map[string]string{"service": tc.service}, "app.tar.gz", tarGz(t, files)))
+		if code != tc.status {
+			t.Fatalf("upload %d: status = %d (%v), want %d", i+1, code, out, tc.status)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Resources is the CPU/memory part of a container's resource requirements,
+// in Kubernetes quantity notation ("250m", "512Mi").
+type Resources struct {
+	Requests ResourceList `json:"requests,omitempty"`
+	Limits   ResourceList `json:"limits,omitempty"`
+}
+
+type ResourceList struct {
+	CPU    string `json:"cpu,omitempty"`
+	Memory string `json:"memory,omitempty"`
+}
+
+func (l ResourceList) empty() bool {
+	return l.CPU == "" && l.Memory == ""
+}
+
+var quantityPattern = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)(m|k|M|G|T|Ki|Mi|Gi|Ti)?$`)
+
+var quantitySuffixes = map[string]float64{
+	"":   1,
+	"m":  1e-3,
+	"k":  1e3,
+	"M":  1e6,
+	"G":  1e9,
+	"T":  1e12,
+	"Ki": 1 << 10,
+	"Mi": 1 << 20,
+	"Gi": 1 << 30,
+	"Ti": 1 << 40,
+}
+
+// parseQuantity returns the value of a Kubernetes quantity such as "500m"
+// (0.5) or "1Gi" (1073741824). Exponent notation is not accepted.
+func parseQuantity(q string) (float64, error) {
+	m := quantityPattern.FindStringSubmatch(q)
+	if m == nil {
+		return 0, fmt.Errorf("invalid quantity %q", q)
+	}
+	n, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid quantity %q", q)
+	}
+	return n * quantitySuffixes[m[2]], nil
+}
+
+// milliCPU returns a CPU quantity in millicores.
+func milliCPU(q string) (int64, error) {
+	v, err := parseQuantity(q)
+	if err != nil {
+		return 0, err
+	}
+	return int64(math.Ceil(v * 1000)), nil
+}
+
+// memoryBytes returns a memory quantity in bytes.
+func memoryBytes(q string) (int64, error) {
+	v, err := parseQuantity(q)
+	if err != nil {
+		return 0, err
+	}
+	return int64(math.Ceil(v)), nil
+}
+
+// validate checks the quantities and that no request exceeds its limit.
+func (r *Resources) validate() error {
+	if r == nil {
+		return nil
+	}
+	type pair struct {
+		name           string
+		request, limit string
+		parse          func(string) (int64, error)
+	}
+	for _, p := range []pair{
+		{"cpu", r.Requests.CPU, r.Limits.CPU, milliCPU},
+		{"memory", r.Requests.Memory, r.Limits.Memory, memoryBytes},
+	} {
+		var request, limit int64
+		var err error
+		if p.request != "" {
+			if request, err = p.parse(p.request); err != nil || request <= 0 {
+				return fmt.Errorf("resources.requests.%s: invalid quantity %q", p.name, p.request)
+			}
+		}
+		if p.limit != "" {
+			if limit, err = p.parse(p.limit); err != nil || limit <= 0 {
+				return fmt.Errorf("resources.limits.%s: invalid quantity %q", p.name, p.limit)
+			}
+		}
+		if p.request != "" && p.limit != "" && request > limit {
+			return fmt.Errorf("resources.requests.%s (%s) exceeds resources.limits.%s (%s)", p.name, p.request, p.name, p.limit)
+		}
+	}
+	return nil
+}
+
+// container renders r as a container "resources" block.
+func (r *Resources) container() map[string]any {
+	out := map[string]any{}
+	if !r.Requests.empty() {
+		out["requests"] = r.Requests
+	}
+	if !r.Limits.empty() {
+		out["limits"] = r.Limits
+	}
+	return out
+}
+
+// parseResourcesForm reads the cpuRequest, memoryRequest, cpuLimit and
+// memoryLimit form fields of POST /deploy. It returns nil when none is set.
+func parseResourcesForm(form url.Values) (*Resources, error) {
+	r := &Resources{
+		Requests: ResourceList{CPU: strings.TrimSpace(form.Get("cpuRequest")), Memory: strings.TrimSpace(form.Get("memoryRequest"))},
+		Limits:   ResourceList{CPU: strings.TrimSpace(form.Get("cpuLimit")), Memory: strings.TrimSpace(form.Get("memoryLimit"))},
+	}
+	if r.Requests.empty() && r.Limits.empty() {
+		return nil, nil
+	}
+	return r, r.validate()
+}
+
+// overlay returns r with the quantities set in o replacing its own.
+func (r *Resources) overlay(o *Resources) *Resources {
+	if r == nil {
+		return o
+	}
+	out := *r
+	if o == nil {
+		return &out
+	}
+	for _, f := range []struct {
+		dst *string
+		src string
+	}{
+		{&out.Requests.CPU, o.Requests.CPU},
+		{&out.Requests.Memory, o.Requests.Memory},
+		{&out.Limits.CPU, o.Limits.CPU},
+		{&out.Limits.Memory, o.Limits.Memory},
+	} {
+		if f.src != "" {
+			*f.dst = f.src
+		}
+	}
+	return &out
+}
+
+// memoryCharge is the memory a deployment counts against its namespace
+// quota: its memory limit, else its request.
+func (r *Resources) memoryCharge() int64 {
+	if r == nil {
+		return 0
+	}
+	q := r.Limits.Memory
+	if q == "" {
+		q = r.Requests.Memory
+	}
+	if q == "" {
+		return 0
+	}
+	n, _ := memoryBytes(q)
+	return n
+}
+
+// resourcePolicy is the admin-configured resource policy: the requests and
+// limits given to deployments that do not set their own, and the largest
+// request or limit a deployment may ask for.
+type resourcePolicy struct {
+	defaults Resources
+	max      ResourceList
+}
+
+func resourcePolicyFromEnv() resourcePolicy {
+	p := resourcePolicy{
+		defaults: Resources{
+			Requests: ResourceList{CPU: envOr("DEFAULT_CPU_REQUEST", "100m"), Memory: envOr("DEFAULT_MEMORY_REQUEST", "128Mi")},
+			Limits:   ResourceList{CPU: envOr("DEFAULT_CPU_LIMIT", "1"), Memory: envOr("DEFAULT_MEMORY_LIMIT", "512Mi")},
+		},
+		max: ResourceList{CPU: envOr("MAX_CPU", "2"), Memory: envOr("MAX_MEMORY", "2Gi")},
+	}
+	if err := p.defaults.validate(); err != nil {
+		log.Fatalf("invalid default resources: %v", err)
+	}
+	if _, err := milliCPU(p.max.CPU); err != nil {
+		log.Fatalf("MAX_CPU must be a CPU quantity such as 2 or 1500m, got %q", p.max.CPU)
+	}
+	if _, err := memoryBytes(p.max.Memory); err != nil {
+		log.Fatalf("MAX_MEMORY must be a memory quantity such as 2Gi, got %q", p.max.Memory)
+	}
+	if err := p.withinMax(&p.defaults); err != nil {
+		log.Fatalf("invalid default resources: %v", err)
+	}
+	return p
+}
+
+// apply returns the effective resources of a deployment that asked for r:
+// unset quantities take the defaults. A defaulted request is lowered to an
+// explicit limit below it, and a defaulted limit raised to an explicit
+// request above it, so a single override never conflicts with a default.
+func (p resourcePolicy) apply(r *Resources) (*Resources, error) {
+	if r == nil {
+		r = &Resources{}
+	}
+	if err := r.validate(); err != nil {
+		return nil, err
+	}
+	out := p.defaults.overlay(r)
+	for _, f := range []struct {
+		request, limit   *string
+		setReq, setLimit bool
+		parse            func(string) (int64, error)
+	}{
+		{&out.Requests.CPU, &out.Limits.CPU, r.Requests.CPU != "", r.Limits.CPU != "", milliCPU},
+		{&out.Requests.Memory, &out.Limits.Memory, r.Requests.Memory != "", r.Limits.Memory != "", memoryBytes},
+	} {
+		if *f.request == "" || *f.limit == "" {
+			continue
+		}
+		request, _ := f.parse(*f.request)
+		limit, _ := f.parse(*f.limit)
+		switch {
+		case request <= limit:
+		case !f.setReq:
+			*f.request = *f.limit
+		case !f.setLimit:
+			*f.limit = *f.request
+		}
+	}
+	if err := out.validate(); err != nil {
+		return nil, err
+	}
+	if err := p.withinMax(out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// withinMax reports the first request or limit of r above the ceilings.
+func (p resourcePolicy) withinMax(r *Resources) error {
+	for _, f := range []struct {
+		field, value, max string
+		parse             func(string) (int64, error)
+	}{
+		{"resources.requests.cpu", r.Requests.CPU, p.max.CPU, milliCPU},
+		{"resources.limits.cpu", r.Limits.CPU, p.max.CPU, milliCPU},
+		{"resources.requests.memory", r.Requests.Memory, p.max.Memory, memoryBytes},
+		{"resources.limits.memory", r.Limits.Memory, p.max.Memory, memoryBytes},
+	} {
+		if f.value == "" {
+			continue
+		}
+		v, _ := f.parse(f.value)
+		max, _ := f.parse(f.max)
+		if v > max {
+			return fmt.Errorf("%s (%s) exceeds the maximum of %s", f.field, f.value, f.max)
+		}
+	}
+	return nil
+}
+
+// formatMemory renders a byte count as a binary quantity, e.g. 1536Mi.
+func formatMemory(n int64) string {
+	switch {
+	case n%(1<<30) == 0:
+		return fmt.Sprintf("%dGi", n>>30)
+	case n%(1<<20) == 0:
+		return fmt.Sprintf("%dMi", n>>20)
+	case n%(1<<10) == 0:
+		return fmt.Sprintf("%dKi", n>>10)
+	}
+	return strconv.FormatInt(n, 10)
+}
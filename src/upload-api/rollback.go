@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	rollbackTraffic = "traffic"
+	rollbackImage   = "image"
+)
+
+// RollbackRequest selects the deployment or revision to return to. Mode
+// "traffic" pins 100% of traffic to the old revision; mode "image"
+// re-applies the stored image, which creates a fresh revision.
+type RollbackRequest struct {
+	DeploymentID string `json:"deploymentId,omitempty"`
+	Revision     string `json:"revision,omitempty"`
+	Mode         string `json:"mode,omitempty"`
+}
+
+func (s *Server) handleRollback(w http.ResponseWriter, r *http.Request, namespace, name string) {
+	var req RollbackRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid rollback request: %v", err)})
+		return
+	}
+
+	target, mode, revision, err := s.resolveRollback(namespace, name, req)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	id, err := s.store.NextID()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("failed to allocate deployment id: %v", err)})
+		return
+	}
+
+	d := &Deployment{
+		ID:          id,
+		Kind:        kindRollback,
+		ServiceName: name,
+		Namespace:   namespace,
+		Status:      statusDeploy,
+		LogsHint:    logsHint(name, namespace),
+		CreatedBy:   createdBy(r),
+		CreatedAt:   time.Now().UTC(),
+		UpdatedAt:   time.Now().UTC(),
+	}
+	if target != nil {
+		d.RollbackOf = target.ID
+		d.Image = target.Image
+		d.ImageTag = target.ImageTag
+		d.BundleSHA256 = target.BundleSHA256
+		// The target's generated env Secret is kept, so its refs still resolve.
+		d.Env = target.Env
+		d.EnvFrom = target.EnvFrom
+		d.AppManifest = target.AppManifest
+		d.Port = target.Port
+		d.Resources = target.Resources
+		d.Autoscaling = target.Autoscaling
+		d.Probes = target.Probes
+	}
+
+	if err := s.store.Put(d); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("failed to record deployment: %v", err)})
+		return
+	}
+	s.announce("", d)
+	go s.runRollback(id, mode, revision)
+
+	writeJSON(w, http.StatusAccepted, DeployResponse{
+		ID:      id,
+		Status:  d.Status,
+		Message: fmt.Sprintf("rollback accepted (mode: %s)", mode),
+	})
+}
+
+// resolveRollback finds the deployment record behind req and settles the
+// rollback mode. A bare revision name is allowed for traffic rollbacks even
+// when no upload recorded it.
+func (s *Server) resolveRollback(namespace, name string, req RollbackRequest) (*Deployment, string, string, error) {
+	req.DeploymentID = strings.TrimSpace(req.DeploymentID)
+	req.Revision = strings.TrimSpace(req.Revision)
+	mode := strings.ToLower(strings.TrimSpace(req.Mode))
+
+	if (req.DeploymentID == "") == (req.Revision == "") {
+		return nil, "", "", fmt.Errorf("exactly one of deploymentId or revision is required")
+	}
+	if mode != "" && mode != rollbackTraffic && mode != rollbackImage {
+		return nil, "", "", fmt.Errorf("mode must be %s or %s", rollbackTraffic, rollbackImage)
+	}
+
+	var target *Deployment
+	if req.DeploymentID != "" {
+		d, ok := s.store.Get(req.DeploymentID)
+		if !ok || d.Namespace != namespace || d.ServiceName != name {
+			return nil, "", "", fmt.Errorf("deployment %s not found for service %s/%s", req.DeploymentID, namespace, name)
+		}
+		target = d
+	} else {
+		all := s.store.List()
+		for i := len(all) - 1; i >= 0; i-- {
+			d := all[i]
+			if d.Namespace == namespace && d.ServiceName == name && d.Revision == req.Revision {
+				target = d
+				break
+			}
+		}
+	}
+
+	revision := req.Revision
+	if target != nil && revision == "" {
+		revision = target.Revision
+	}
+	if mode == "" {
+		mode = rollbackTraffic
+		if revision == "" {
+			mode = rollbackImage
+		}
+	}
+
+	switch mode {
+	case rollbackTraffic:
+		if revision == "" {
+			return nil, "", "", fmt.Errorf("deployment %s has no recorded revision; use mode %s", target.ID, rollbackImage)
+		}
+	case rollbackImage:
+		if target == nil || target.Image == "" {
+			return nil, "", "", fmt.Errorf("no stored image for rollback target; use mode %s", rollbackTraffic)
+		}
+	}
+	return target, mode, revision, nil
+}
+
+func (s *Server) runRollback(id, mode, revision string) {
+	d, ok := s.store.Get(id)
+	if !ok {
+		return
+	}
+	ctx, end, ok := s.beginRun(id)
+	if !ok {
+		return
+	}
+	defer end()
+
+	var (
+		st     *ServiceState
+		err    error
+		output string
+		phase  *phaseRun
+	)
+	switch mode {
+	case rollbackTraffic:
+		output = fmt.Sprintf("pinned 100%% of traffic to revision %s", revision)
+		phase = s.startPhase(ctx, id, phaseReady, nil)
+		st, err = s.services.SetTraffic(phase.ctx, d.Namespace, d.ServiceName, []TrafficTarget{{RevisionName: revision, Percent: 100}})
+		phase.end(err)
+	case rollbackImage:
+		output = fmt.Sprintf("re-applied image %s", d.Image)
+		var generation int64
+		phase = s.startPhase(ctx, id, phaseDeploy, nil)
+		generation, err = s.services.Apply(phase.ctx, d.Namespace, d.ServiceName, revisionSpecFor(d), nil)
+		phase.end(err)
+		if err == nil && !cancelRequested(ctx) {
+			phase = s.startPhase(ctx, id, phaseReady, nil)
+			st, err = s.services.WaitReady(phase.ctx, d.Namespace, d.ServiceName, generation)
+			phase.end(err)
+		}
+		if err == nil && st != nil {
+			revision = st.LatestCreatedRevision
+		}
+	}
+	if cancelRequested(ctx) {
+		s.markCancelled(id, output, "rollback")
+		return
+	}
+	if err != nil {
+		s.failPhase(id, output, phase, fmt.Sprintf("rollback failed: %v", err))
+		return
+	}
+	s.updateReady(id, output, revision, st.Traffic)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// rollback posts body to the rollback endpoint of demo-apps/hello.
+func rollback(t *testing.T, s *Server, body string) (int, map[string]any) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.handleServices(rec, httptest.NewRequest(http.MethodPost, "/services/demo-apps/hello/rollback", strings.NewReader(body)))
+	var out map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+		t.Fatalf("decode response %q: %v", rec.Body.String(), err)
+	}
+	return rec.Code, out
+}
+
+func TestResolveRollback(t *testing.T) {
+	s := newTestServer(t)
+	for _, d := range []*Deployment{
+		{ID: "dep-000001", Namespace: "demo-apps", ServiceName: "hello", Status: statusReady, Revision: "hello-00001", Image: "dev.local/hello:dep-000001"},
+		{ID: "dep-000002", Namespace: "demo-apps", ServiceName: "hello", Status: statusFailed, Image: "dev.local/hello:dep-000002"},
+		{ID: "dep-000003", Namespace: "demo-apps", ServiceName: "other", Status: statusReady, Revision: "other-00001", Image: "dev.local/other:dep-000003"},
+		{ID: "dep-000004", Namespace: "demo-apps", ServiceName: "hello", Status: statusFailed},
+	} {
+		s.store.Put(d)
+	}
+
+	for _, tc := range []struct {
+		name         string
+		req          RollbackRequest
+		wantTarget   string
+		wantMode     string
+		wantRevision string
+		wantErr      string
+	}{
+		{name: "deployment defaults to traffic", req: RollbackRequest{DeploymentID: "dep-000001"}, wantTarget: "dep-000001", wantMode: rollbackTraffic, wantRevision: "hello-00001"},
+		{name: "deployment in image mode", req: RollbackRequest{DeploymentID: "dep-000001", Mode: " Image "}, wantTarget: "dep-000001", wantMode: rollbackImage, wantRevision: "hello-00001"},
+		{name: "deployment without revision defaults to image", req: RollbackRequest{DeploymentID: "dep-000002"}, wantTarget: "dep-000002", wantMode: rollbackImage},
+		{name: "recorded revision", req: RollbackRequest{Revision: "hello-00001"}, wantTarget: "dep-000001", wantMode: rollbackTraffic, wantRevision: "hello-00001"},
+		{name: "unrecorded revision", req: RollbackRequest{Revision: "hello-00009"}, wantMode: rollbackTraffic, wantRevision: "hello-00009"},
+
+		{name: "neither", req: RollbackRequest{}, wantErr: "exactly one of deploymentId or revision"},
+		{name: "both", req: RollbackRequest{DeploymentID: "dep-000001", Revision: "hello-00001"}, wantErr: "exactly one of deploymentId or revision"},
+		{name: "unknown mode", req: RollbackRequest{DeploymentID: "dep-000001", Mode: "rebuild"}, wantErr: "mode must be traffic or image"},
+		{name: "unknown deployment", req: RollbackRequest{DeploymentID: "dep-000099"}, wantErr: "deployment dep-000099 not found for service demo-apps/hello"},
+		{name: "deployment of another service", req: RollbackRequest{DeploymentID: "dep-000003"}, wantErr: "not found for service demo-apps/hello"},
+		{name: "traffic without revision", req: RollbackRequest{DeploymentID: "dep-000002", Mode: "traffic"}, wantErr: "has no recorded revision; use mode image"},
+		{name: "image without stored image", req: RollbackRequest{DeploymentID: "dep-000004"}, wantErr: "no stored image"},
+		{name: "image of unrecorded revision", req: RollbackRequest{Revision: "hello-00009", Mode: "image"}, wantErr: "no stored image"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			target, mode, revision, err := s.resolveRollback("demo-apps", "hello", tc.req)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			targetID := ""
+			if target != nil {
+				targetID = target.ID
+			}
+			if targetID != tc.wantTarget || mode != tc.wantMode || revision != tc.wantRevision {
+				t.Fatalf("resolveRollback = %q %s %q, want %q %s %q", targetID, mode, revision, tc.wantTarget, tc.wantMode, tc.wantRevision)
+			}
+		})
+	}
+}
+
+func TestRollbackRejectsInvalidRequests(t *testing.T) {
+	s := newTestServer(t)
+	for _, body := range []string{`{`, `{"deploymentId": 1}`, `{}`, `{"revision": "hello-00001", "mode": "rebuild"}`} {
+		if code, out := rollback(t, s, body); code != http.StatusBadRequest {
+			t.Errorf("rollback %s = %d %v, want 400", body, code, out)
+		}
+	}
+	if list := s.store.List(); len(list) != 0 {
+		t.Fatalf("rejected rollbacks recorded %d deployments", len(list))
+	}
+}
+
+func TestRollbackModes(t *testing.T) {
+	s := newPipelineServer(t)
+	fields := map[string]string{"service": "hello", "namespace": "demo-apps", "port": "3000", "memoryLimit": "256Mi"}
+	first := deployAndWait(t, s, fields, map[string]string{"Dockerfile": testDockerfile})
+	delete(fields, "port")
+	deployAndWait(t, s, fields, map[string]string{"Dockerfile": testDockerfile, "v2": "2"})
+
+	for _, tc := range []struct {
+		mode         string
+		wantRevision string
+		wantPhase    string
+	}{
+		// Traffic mode routes back to the old revision without a new one.
+		{rollbackTraffic, "hello-00001", phaseReady},
+		// Image mode re-applies the old image as a fresh revision.
+		{rollbackImage, "hello-00003", phaseDeploy},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			code, out := rollback(t, s, `{"deploymentId": "`+first.ID+`", "mode": "`+tc.mode+`"}`)
+			if code != http.StatusAccepted {
+				t.Fatalf("rollback = %d %v, want 202", code, out)
+			}
+			d := waitFinished(t, s, out["id"].(string))
+			if d.Status != statusReady || d.Kind != kindRollback || d.RollbackOf != first.ID || d.Revision != tc.wantRevision {
+				t.Fatalf("rollback record = %s %s of %q revision %s (%s), want READY rollback of %s revision %s",
+					d.Status, d.Kind, d.RollbackOf, d.Revision, d.Error, first.ID, tc.wantRevision)
+			}
+			if d.Image != first.Image || d.Port != 3000 || d.Resources == nil || d.Resources.Limits.Memory != "256Mi" {
+				t.Fatalf("rollback did not copy the target's settings: image %s port %d resources %+v", d.Image, d.Port, d.Resources)
+			}
+			if len(d.Phases) == 0 || d.Phases[0].Name != tc.wantPhase {
+				t.Fatalf("phases = %+v, want to start with %s", d.Phases, tc.wantPhase)
+			}
+			st, err := s.services.GetService(testContext(t), "demo-apps", "hello")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if st.primaryRevision() != tc.wantRevision || st.servingPercent(tc.wantRevision) != 100 {
+				t.Fatalf("traffic after rollback = %+v, want 100%% to %s", st.Traffic, tc.wantRevision)
+			}
+		})
+	}
+}
+
+func TestRollbackToUnknownRevisionFails(t *testing.T) {
+	s := newPipelineServer(t)
+	deployAndWait(t, s, map[string]string{"service": "hello", "namespace": "demo-apps"}, map[string]string{"Dockerfile": testDockerfile})
+
+	code, out := rollback(t, s, `{"revision": "hello-00042"}`)
+	if code != http.StatusAccepted {
+		t.Fatalf("rollback = %d %v, want 202", code, out)
+	}
+	d := waitFinished(t, s, out["id"].(string))
+	if d.Status != statusFailed || !strings.Contains(d.Error, `revision "hello-00042" not found`) {
+		t.Fatalf("rollback record = %s (%s), want FAILED for a missing revision", d.Status, d.Error)
+	}
+}
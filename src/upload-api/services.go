@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ServiceClient reads and updates Knative Services.
+type ServiceClient interface {
+	GetService(ctx context.Context, namespace, name string) (*ServiceState, error)
+	// Apply creates or updates the service template from spec and returns
+	// the generation to pass to WaitReady. A nil traffic block routes all
+	// traffic to the latest revision.
+	Apply(ctx context.Context, namespace, name string, spec RevisionSpec, traffic []TrafficTarget) (int64, error)
+	// WaitReady returns the state once generation has been reconciled and
+	// its revision is ready.
+	WaitReady(ctx context.Context, namespace, name string, generation int64) (*ServiceState, error)
+	// SetTraffic replaces the service traffic block and returns the state
+	// once the route is ready.
+	SetTraffic(ctx context.Context, namespace, name string, targets []TrafficTarget) (*ServiceState, error)
+	// Delete removes the service and its revisions.
+	Delete(ctx context.Context, namespace, name string) error
+	// ApplySecret creates or replaces an Opaque Secret holding data.
+	ApplySecret(ctx context.Context, namespace, name string, data map[string]string) error
+	// NamespaceExists reports whether the namespace exists.
+	NamespaceExists(ctx context.Context, namespace string) (bool, error)
+}
+
+var errServiceNotFound = errors.New("service not found")
+
+// serviceNotFound reports whether err from a ServiceClient means the
+// service does not exist.
+func serviceNotFound(err error) bool {
+	return errors.Is(err, errServiceNotFound) || isNotFound(err)
+}
+
+// RevisionSpec is the part of the Knative Service template upload-api owns.
+type RevisionSpec struct {
+	Image       string            `json:"image"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// ContainerConcurrency limits concurrent requests per replica; 0 means
+	// unlimited and nil leaves it to the cluster default.
+	ContainerConcurrency *int            `json:"containerConcurrency,omitempty"`
+	Port                 int32           `json:"port,omitempty"`
+	Env                  []EnvVar        `json:"env,omitempty"`
+	EnvFrom              []EnvFromSource `json:"envFrom,omitempty"`
+	Resources            *Resources      `json:"resources,omitempty"`
+	Probes               *Probes         `json:"probes,omitempty"`
+}
+
+// revisionSpecFor returns the revision spec that runs d: its image, runtime
+// environment, autoscaling and the settings from its app manifest.
+func revisionSpecFor(d *Deployment) RevisionSpec {
+	return RevisionSpec{
+		Image:                d.Image,
+		Annotations:          d.Autoscaling.annotations(),
+		ContainerConcurrency: d.Autoscaling.containerConcurrency(),
+		Port:                 d.Port,
+		Env:                  d.Env,
+		EnvFrom:              d.EnvFrom,
+		Resources:            d.Resources,
+		Probes:               d.Probes,
+	}
+}
+
+type ServiceState struct {
+	Namespace             string          `json:"namespace"`
+	Name                  string          `json:"name"`
+	LatestCreatedRevision string          `json:"latestCreatedRevision,omitempty"`
+	LatestReadyRevision   string          `json:"latestReadyRevision,omitempty"`
+	Traffic               []TrafficTarget `json:"traffic,omitempty"`
+}
+
+type TrafficTarget struct {
+	RevisionName   string `json:"revisionName,omitempty"`
+	LatestRevision *bool  `json:"latestRevision,omitempty"`
+	Percent        int64  `json:"percent"`
+	Tag            string `json:"tag,omitempty"`
+}
+
+// servingPercent returns the share of traffic routed to revision.
+func (st *ServiceState) servingPercent(revision string) int64 {
+	var total int64
+	for _, t := range st.Traffic {
+		if t.RevisionName == revision {
+			total += t.Percent
+		}
+	}
+	return total
+}
+
+// primaryRevision returns the revision receiving the largest traffic share.
+func (st *ServiceState) primaryRevision() string {
+	best, bestPercent := "", int64(-1)
+	for _, t := range st.Traffic {
+		if p := st.servingPercent(t.RevisionName); p > bestPercent {
+			best, bestPercent = t.RevisionName, p
+		}
+	}
+	if best == "" {
+		return st.LatestReadyRevision
+	}
+	return best
+}
+
+type ksvcObject struct {
+	Metadata struct {
+		Name       string `json:"name"`
+		Namespace  string `json:"namespace"`
+		Generation int64  `json:"generation"`
+	} `json:"metadata"`
+	Status struct {
+		ObservedGeneration        int64           `json:"observedGeneration"`
+		LatestCreatedRevisionName string          `json:"latestCreatedRevisionName"`
+		LatestReadyRevisionName   string          `json:"latestReadyRevisionName"`
+		Traffic                   []TrafficTarget `json:"traffic"`
+		Conditions                []struct {
+			Type    string `json:"type"`
+			Status  string `json:"status"`
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		} `json:"conditions"`
+	} `json:"status"`
+}
+
+// settled reports whether the controller has reconciled generation and the
+// service reached a terminal Ready condition.
+func (o ksvcObject) settled(generation int64) (bool, error) {
+	if o.Status.ObservedGeneration < generation {
+		return false, nil
+	}
+	for _, c := range o.Status.Conditions {
+		if c.Type != "Ready" {
+			continue
+		}
+		switch c.Status {
+		case "True":
+			return true, nil
+		case "False":
+			return true, fmt.Errorf("service not ready: %s: %s", c.Reason, c.Message)
+		}
+	}
+	return false, nil
+}
+
+func (o ksvcObject) state() *ServiceState {
+	return &ServiceState{
+		Namespace:             o.Metadata.Namespace,
+		Name:                  o.Metadata.Name,
+		LatestCreatedRevision: o.Status.LatestCreatedRevisionName,
+		LatestReadyRevision:   o.Status.LatestReadyRevisionName,
+		Traffic:               o.Status.Traffic,
+	}
+}
+
+// mockServices simulates Knative revision bookkeeping for MOCK_DEPLOY runs.
+type mockServices struct {
+	mu       sync.Mutex
+	services map[string]*mockService
+}
+
+type mockService struct {
+	generation int
+	state      ServiceState
+}
+
+func newMockServices() *mockServices {
+	return &mockServices{services: map[string]*mockService{}}
+}
+
+func (m *mockServices) GetService(_ context.Context, namespace, name string) (*ServiceState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	svc, ok := m.services[namespace+"/"+name]
+	if !ok {
+		return nil, fmt.Errorf("service %s/%s: %w", namespace, name, errServiceNotFound)
+	}
+	return svc.snapshot(), nil
+}
+
+// Apply creates the next revision of a mock service and routes traffic to it.
+func (m *mockServices) Apply(_ context.Context, namespace, name string, _ RevisionSpec, traffic []TrafficTarget) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	svc := m.service(namespace, name)
+	for _, t := range traffic {
+		if t.RevisionName != "" && !svc.hasRevision(t.RevisionName) {
+			return 0, fmt.Errorf("revision %q not found for service %s/%s", t.RevisionName, namespace, name)
+		}
+	}
+	svc.generation++
+	revision := fmt.Sprintf("%s-%05d", name, svc.generation)
+	svc.state.LatestCreatedRevision = revision
+	svc.state.LatestReadyRevision = revision
+	if traffic == nil {
+		svc.routeAll(revision)
+	} else {
+		svc.route(traffic)
+	}
+	return int64(svc.generation), nil
+}
+
+// WaitReady returns the mock state right away; mock revisions are ready as
+// soon as they are applied.
+func (m *mockServices) WaitReady(ctx context.Context, namespace, name string, _ int64) (*ServiceState, error) {
+	return m.GetService(ctx, namespace, name)
+}
+
+// ApplySecret is a no-op: mock revisions never read their environment.
+func (m *mockServices) ApplySecret(context.Context, string, string, map[string]string) error {
+	return nil
+}
+
+func (m *mockServices) NamespaceExists(context.Context, string) (bool, error) {
+	return true, nil
+}
+
+func (m *mockServices) SetTraffic(_ context.Context, namespace, name string, targets []TrafficTarget) (*ServiceState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	svc, ok := m.services[namespace+"/"+name]
+	if !ok {
+		return nil, fmt.Errorf("service %s/%s: %w", namespace, name, errServiceNotFound)
+	}
+	for _, t := range targets {
+		if t.RevisionName != "" && !svc.hasRevision(t.RevisionName) {
+			return nil, fmt.Errorf("revision %q not found for service %s/%s", t.RevisionName, namespace, name)
+		}
+	}
+	svc.route(targets)
+	return svc.snapshot(), nil
+}
+
+func (m *mockServices) Delete(_ context.Context, namespace, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.services[namespace+"/"+name]; !ok {
+		return fmt.Errorf("service %s/%s: %w", namespace, name, errServiceNotFound)
+	}
+	delete(m.services, namespace+"/"+name)
+	return nil
+}
+
+// restore replays revisions recorded in the store so mock revision numbers
+// keep increasing across restarts.
+func (m *mockServices) restore(all []*Deployment) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, d := range all {
+		if d.Kind == kindDelete && d.Status == statusReady {
+			delete(m.services, d.Namespace+"/"+d.ServiceName)
+			continue
+		}
+		if d.Status != statusReady || d.Revision == "" {
+			continue
+		}
+		generation, ok := revisionGeneration(d.ServiceName, d.Revision)
+		if !ok {
+			continue
+		}
+		svc := m.service(d.Namespace, d.ServiceName)
+		if generation > svc.generation {
+			svc.generation = generation
+		}
+		svc.routeAll(d.Revision)
+	}
+}
+
+func (m *mockServices) service(namespace, name string) *mockService {
+	key := namespace + "/" + name
+	svc, ok := m.services[key]
+	if !ok {
+		svc = &mockService{state: ServiceState{Namespace: namespace, Name: name}}
+		m.services[key] = svc
+	}
+	return svc
+}
+
+func (svc *mockService) snapshot() *ServiceState {
+	st := svc.state
+	st.Traffic = append([]TrafficTarget(nil), svc.state.Traffic...)
+	return &st
+}
+
+func (svc *mockService) hasRevision(revision string) bool {
+	generation, ok := revisionGeneration(svc.state.Name, revision)
+	return ok && generation >= 1 && generation <= svc.generation
+}
+
+// route resolves latestRevision targets the way the Knative route status
+// reports them.
+func (svc *mockService) route(targets []TrafficTarget) {
+	resolved := make([]TrafficTarget, 0, len(targets))
+	for _, t := range targets {
+		if t.LatestRevision != nil && *t.LatestRevision {
+			t.RevisionName = svc.state.LatestReadyRevision
+		}
+		resolved = append(resolved, t)
+	}
+	svc.state.Traffic = resolved
+}
+
+func (svc *mockService) routeAll(revision string) {
+	latest := true
+	svc.state.LatestReadyRevision = revision
+	svc.state.Traffic = []TrafficTarget{{RevisionName: revision, LatestRevision: &latest, Percent: 100}}
+}
+
+// revisionGeneration parses the numeric suffix of a <service>-NNNNN revision.
+func revisionGeneration(service, revision string) (int, bool) {
+	suffix, ok := strings.CutPrefix(revision, service+"-")
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(suffix)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+const (
+	langGo     = "go"
+	langNode   = "node"
+	langPython = "python"
+	langRust   = "rust"
+)
+
+// Values of Deployment.Dockerfile. It is empty for buildpacks builds.
+const (
+	dockerfileBundled   = "bundle"
+	dockerfileGenerated = "generated"
+)
+
+// languageMarkers are checked in order at the root of the extracted source.
+var languageMarkers = []struct {
+	file     string
+	language string
+}{
+	{"go.mod", langGo},
+	{"Cargo.toml", langRust},
+	{"package.json", langNode},
+	{"requirements.txt", langPython},
+}
+
+var pythonEntrypoints = []string{"app.py", "main.py", "server.py"}
+
+// SourceInfo describes an extracted bundle.
+type SourceInfo struct {
+	Language      string
+	HasDockerfile bool
+	// Entrypoint is the python script to run, or the rust binary name.
+	Entrypoint string
+}
+
+// inspectSource detects the language of dir and whether it brings its own
+// Dockerfile. It fails when the source can be built neither way.
+func inspectSource(dir string) (SourceInfo, error) {
+	var info SourceInfo
+	info.HasDockerfile = fileExists(filepath.Join(dir, "Dockerfile"))
+	for _, m := range languageMarkers {
+		if fileExists(filepath.Join(dir, m.file)) {
+			info.Language = m.language
+			break
+		}
+	}
+	if info.Language == "" {
+		if info.HasDockerfile {
+			return info, nil
+		}
+		markers := make([]string, 0, len(languageMarkers))
+		for _, m := range languageMarkers {
+			markers = append(markers, m.file)
+		}
+		return info, fmt.Errorf("bundle has no Dockerfile and no supported language marker (%s) at its root", strings.Join(markers, ", "))
+	}
+
+	var err error
+	switch info.Language {
+	case langPython:
+		info.Entrypoint, err = pythonEntrypoint(dir)
+	case langRust:
+		info.Entrypoint, err = cargoPackageName(filepath.Join(dir, "Cargo.toml"))
+	}
+	if err != nil && !info.HasDockerfile {
+		return info, err
+	}
+	return info, nil
+}
+
+func pythonEntrypoint(dir string) (string, error) {
+	for _, name := range pythonEntrypoints {
+		if fileExists(filepath.Join(dir, name)) {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("python bundle without a Dockerfile needs one of: %s", strings.Join(pythonEntrypoints, ", "))
+}
+
+// cargoPackageName reads name from the [package] table, which is also the
+// default binary name.
+func cargoPackageName(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	inPackage := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			inPackage = line == "[package]"
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if inPackage && ok && strings.TrimSpace(key) == "name" {
+			return strings.Trim(strings.TrimSpace(value), `"'`), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("Cargo.toml has no [package] name")
+}
+
+func fileExists(path string) bool {
+	st, err := os.Stat(path)
+	return err == nil && st.Mode().IsRegular()
+}
+
+// dockerfileTemplates are used for bundles that ship without a Dockerfile.
+// Each mirrors the matching samples/* app and listens on PORT.
+var dockerfileTemplates = map[string]*template.Template{
+	langGo: template.Must(template.New(langGo).Parse(`FROM golang:1.22-alpine AS build
+WORKDIR /src
+COPY . .
+RUN go mod download && CGO_ENABLED=0 go build -o /out/app .
+
+FROM alpine:3.20
+WORKDIR /app
+COPY . .
+COPY --from=build /out/app ./app
+ENV PORT=8080
+EXPOSE 8080
+CMD ["./app"]
+`)),
+	langNode: template.Must(template.New(langNode).Parse(`FROM node:20-alpine
+WORKDIR /app
+COPY package*.json ./
+RUN npm install
+COPY . .
+RUN npm run build --if-present && npm prune --omit=dev
+ENV NODE_ENV=production
+ENV PORT=8080
+EXPOSE 8080
+CMD ["npm", "start"]
+`)),
+	langPython: template.Must(template.New(langPython).Parse(`FROM python:3.12-slim
+WORKDIR /app
+COPY requirements.txt ./
+RUN pip install --no-cache-dir -r requirements.txt
+COPY . .
+ENV PORT=8080
+EXPOSE 8080
+CMD ["python", "{{.Entrypoint}}"]
+`)),
+	langRust: template.Must(template.New(langRust).Parse(`FROM rust:1.81-slim AS builder
+WORKDIR /app
+COPY . .
+RUN cargo build --release
+
+FROM debian:bookworm-slim
+RUN useradd --create-home appuser
+WORKDIR /app
+COPY . .
+COPY --from=builder /app/target/release/{{.Entrypoint}} /app/{{.Entrypoint}}
+ENV PORT=8080
+EXPOSE 8080
+USER appuser
+CMD ["/app/{{.Entrypoint}}"]
+`)),
+}
+
+// writeDockerfile renders the language template into dir/Dockerfile, so
+// every Dockerfile-based builder can build the bundle unchanged.
+func writeDockerfile(dir string, info SourceInfo) error {
+	tmpl, ok := dockerfileTemplates[info.Language]
+	if !ok {
+		return fmt.Errorf("no Dockerfile template for language %q", info.Language)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, info); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "Dockerfile"), buf.Bytes(), 0o644)
+}
+
+// buildpacksBuilder builds with Cloud Native Buildpacks through the pack
+// CLI. It ignores any Dockerfile. Without publish the image lands in the
+// docker daemon pack talks to (DOCKER_HOST).
+type buildpacksBuilder struct {
+	builder string
+	publish bool
+}
+
+const builderBuildpacks = "buildpacks"
+
+func (buildpacksBuilder) Name() string { return builderBuildpacks }
+
+func (b buildpacksBuilder) Build(ctx context.Context, req BuildRequest, logs io.Writer) error {
+	args := []string{"build", req.Image, "--path", req.ContextDir, "--builder", b.builder, "--trust-builder"}
+	if b.publish {
+		args = append(args, "--publish")
+	}
+	fmt.Fprintf(logs, "[buildpacks] building %s with %s\n", req.Image, b.builder)
+	return runLogged(ctx, logs, "pack", args...)
+}
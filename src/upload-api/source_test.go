@@ -0,0 +1,175 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInspectSource(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		files   map[string]string
+		want    SourceInfo
+		wantErr string
+	}{
+		{name: "go", files: map[string]string{"go.mod": "module hello\n"}, want: SourceInfo{Language: langGo}},
+		{name: "go wins over node", files: map[string]string{"go.mod": "module hello\n", "package.json": "{}"}, want: SourceInfo{Language: langGo}},
+		{name: "node", files: map[string]string{"package.json": "{}"}, want: SourceInfo{Language: langNode}},
+		{
+			name:  "python",
+			files: map[string]string{"requirements.txt": "flask\n", "main.py": "", "server.py": ""},
+			want:  SourceInfo{Language: langPython, Entrypoint: "main.py"},
+		},
+		{
+			name:  "rust",
+			files: map[string]string{"Cargo.toml": "[workspace]\nname = \"no\"\n\n[package]\nname = \"hello-rs\"\nversion = \"0.1.0\"\n"},
+			want:  SourceInfo{Language: langRust, Entrypoint: "hello-rs"},
+		},
+		{
+			name:  "language with Dockerfile",
+			files: map[string]string{"go.mod": "module hello\n", "Dockerfile": testDockerfile},
+			want:  SourceInfo{Language: langGo, HasDockerfile: true},
+		},
+		{name: "Dockerfile only", files: map[string]string{"Dockerfile": testDockerfile}, want: SourceInfo{HasDockerfile: true}},
+		{
+			// The Dockerfile decides how to run it, so no entrypoint is needed.
+			name:  "python without entrypoint but with Dockerfile",
+			files: map[string]string{"requirements.txt": "", "Dockerfile": testDockerfile},
+			want:  SourceInfo{Language: langPython, HasDockerfile: true},
+		},
+
+		{name: "nothing to build", files: map[string]string{"README.md": "hi"}, wantErr: "no Dockerfile and no supported language marker (go.mod, Cargo.toml, package.json, requirements.txt)"},
+		{name: "marker in a subdirectory", files: map[string]string{"app/go.mod": "module hello\n"}, wantErr: "no supported language marker"},
+		{name: "python without entrypoint", files: map[string]string{"requirements.txt": "", "worker.py": ""}, wantErr: "needs one of: app.py, main.py, server.py"},
+		{name: "rust without package name", files: map[string]string{"Cargo.toml": "[workspace]\nmembers = []\n"}, wantErr: "Cargo.toml has no [package] name"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range tc.files {
+				path := filepath.Join(dir, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := inspectSource(dir)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Fatalf("inspectSource = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWriteDockerfile(t *testing.T) {
+	for _, tc := range []struct {
+		info SourceInfo
+		want []string
+	}{
+		{SourceInfo{Language: langGo}, []string{"FROM golang:", "go build", "ENV PORT=8080"}},
+		{SourceInfo{Language: langNode}, []string{"FROM node:", "npm install", `CMD ["npm", "start"]`}},
+		{SourceInfo{Language: langPython, Entrypoint: "server.py"}, []string{"pip install", `CMD ["python", "server.py"]`}},
+		{SourceInfo{Language: langRust, Entrypoint: "hello-rs"}, []string{"cargo build --release", "target/release/hello-rs", `CMD ["/app/hello-rs"]`}},
+	} {
+		t.Run(tc.info.Language, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := writeDockerfile(dir, tc.info); err != nil {
+				t.Fatal(err)
+			}
+			raw, err := os.ReadFile(filepath.Join(dir, "Dockerfile"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(string(raw), want) {
+					t.Errorf("Dockerfile lacks %q:\n%s", want, raw)
+				}
+			}
+		})
+	}
+	if err := writeDockerfile(t.TempDir(), SourceInfo{Language: "cobol"}); err == nil {
+		t.Fatal("writeDockerfile accepted a language without a template")
+	}
+}
+
+func TestDeployRecordsSourceAndDockerfile(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		fields         map[string]string
+		files          map[string]string
+		wantLanguage   string
+		wantDockerfile string
+		wantFile       string // expected start of the extracted Dockerfile; empty means none
+	}{
+		{
+			name:           "bundled Dockerfile",
+			files:          map[string]string{"Dockerfile": testDockerfile, "go.mod": "module hello\n"},
+			wantLanguage:   langGo,
+			wantDockerfile: dockerfileBundled,
+			wantFile:       "FROM busybox",
+		},
+		{
+			name:           "generated from template",
+			files:          map[string]string{"package.json": "{}"},
+			wantLanguage:   langNode,
+			wantDockerfile: dockerfileGenerated,
+			wantFile:       "FROM node:",
+		},
+		{
+			name:         "buildpacks needs no Dockerfile",
+			fields:       map[string]string{"builder": builderBuildpacks},
+			files:        map[string]string{"requirements.txt": "flask\n", "app.py": ""},
+			wantLanguage: langPython,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t)
+			code, out := deploy(t, s, deployRequest(t, tc.fields, "app.tar.gz", tarGz(t, tc.files)))
+			if code != http.StatusAccepted {
+				t.Fatalf("status = %d (%v), want 202", code, out)
+			}
+			d, _ := s.store.Get(out["id"].(string))
+			if d.Language != tc.wantLanguage || d.Dockerfile != tc.wantDockerfile {
+				t.Fatalf("language %q dockerfile %q, want %q %q", d.Language, d.Dockerfile, tc.wantLanguage, tc.wantDockerfile)
+			}
+			raw, err := os.ReadFile(filepath.Join(d.ExtractedPath, "Dockerfile"))
+			if tc.wantFile == "" {
+				if err == nil {
+					t.Fatalf("buildpacks upload got a Dockerfile:\n%s", raw)
+				}
+				return
+			}
+			if !strings.HasPrefix(string(raw), tc.wantFile) {
+				t.Fatalf("Dockerfile = %q, want it to start with %q", raw, tc.wantFile)
+			}
+		})
+	}
+}
+
+func TestDeployRejectsUnbuildableSource(t *testing.T) {
+	for name, files := range map[string]map[string]string{
+		"no marker":                 {"index.html": "<h1>hi</h1>"},
+		"python without entrypoint": {"requirements.txt": "flask\n"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			s := newTestServer(t)
+			code, out := deploy(t, s, deployRequest(t, nil, "app.tar.gz", tarGz(t, files)))
+			if code != http.StatusBadRequest {
+				t.Fatalf("status = %d (%v), want 400", code, out)
+			}
+		})
+	}
+}
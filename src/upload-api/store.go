@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errDeploymentNotFound = errors.New("deployment not found")
+
+// DeploymentStore persists deployment records and the deployment ID counter.
+// Implementations return copies so callers never share state with the store.
+type DeploymentStore interface {
+	NextID() (string, error)
+	Put(d *Deployment) error
+	Get(id string) (*Deployment, bool)
+	Latest() (*Deployment, bool)
+	Update(id string, fn func(d *Deployment)) error
+	List() []*Deployment
+}
+
+func openStore(backend, dir, uploadRoot string) (DeploymentStore, error) {
+	seed := highestUploadID(uploadRoot)
+	switch strings.ToLower(backend) {
+	case "memory":
+		s := newMemoryStore()
+		s.counter = seed
+		return s, nil
+	case "file", "":
+		return newFileStore(dir, seed)
+	default:
+		return nil, fmt.Errorf("unknown store backend %q (expected file or memory)", backend)
+	}
+}
+
+type memoryStore struct {
+	mu          sync.RWMutex
+	deployments map[string]*Deployment
+	latestID    string
+	counter     uint64
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{deployments: map[string]*Deployment{}}
+}
+
+func (m *memoryStore) NextID() (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counter++
+	return formatID(m.counter), nil
+}
+
+func (m *memoryStore) Put(d *Deployment) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.put(d.clone())
+	return nil
+}
+
+func (m *memoryStore) put(d *Deployment) {
+	m.deployments[d.ID] = d
+	n, _ := parseID(d.ID)
+	if latest, _ := parseID(m.latestID); m.latestID == "" || n > latest {
+		m.latestID = d.ID
+	}
+	if n > m.counter {
+		m.counter = n
+	}
+}
+
+func (m *memoryStore) Get(id string) (*Deployment, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	d, ok := m.deployments[id]
+	if !ok {
+		return nil, false
+	}
+	return d.clone(), true
+}
+
+func (m *memoryStore) Latest() (*Deployment, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.latestID == "" {
+		return nil, false
+	}
+	return m.deployments[m.latestID].clone(), true
+}
+
+func (m *memoryStore) Update(id string, fn func(d *Deployment)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, ok := m.deployments[id]
+	if !ok {
+		return errDeploymentNotFound
+	}
+	fn(d)
+	return nil
+}
+
+func (m *memoryStore) List() []*Deployment {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := make([]*Deployment, 0, len(m.deployments))
+	for _, d := range m.deployments {
+		out = append(out, d.clone())
+	}
+	sort.Slice(out, func(i, j int) bool { return idLess(out[i].ID, out[j].ID) })
+	return out
+}
+
+// fileStore keeps one JSON document per deployment under dir/deployments and
+// the ID counter in dir/counter. Records are cached in memory and every
+// mutation is written through with an atomic rename.
+type fileStore struct {
+	mem *memoryStore
+	dir string
+}
+
+func newFileStore(dir string, seed uint64) (*fileStore, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "deployments"), 0o755); err != nil {
+		return nil, err
+	}
+	fs := &fileStore{mem: newMemoryStore(), dir: dir}
+	fs.mem.counter = seed
+
+	raw, err := os.ReadFile(filepath.Join(dir, "counter"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if n, err := strconv.ParseUint(strings.TrimSpace(string(raw)), 10, 64); err == nil && n > fs.mem.counter {
+		fs.mem.counter = n
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, "deployments"))
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, "deployments", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var d Deployment
+		if err := json.Unmarshal(data, &d); err != nil {
+			return nil, fmt.Errorf("decode %s: %w", entry.Name(), err)
+		}
+		fs.mem.put(&d)
+	}
+	return fs, nil
+}
+
+func (f *fileStore) NextID() (string, error) {
+	f.mem.mu.Lock()
+	defer f.mem.mu.Unlock()
+	f.mem.counter++
+	if err := writeFileAtomic(filepath.Join(f.dir, "counter"), []byte(strconv.FormatUint(f.mem.counter, 10)+"\n")); err != nil {
+		return "", err
+	}
+	return formatID(f.mem.counter), nil
+}
+
+func (f *fileStore) Put(d *Deployment) error {
+	f.mem.mu.Lock()
+	defer f.mem.mu.Unlock()
+	if err := f.persist(d); err != nil {
+		return err
+	}
+	f.mem.put(d.clone())
+	return nil
+}
+
+func (f *fileStore) Get(id string) (*Deployment, bool) { return f.mem.Get(id) }
+
+func (f *fileStore) Latest() (*Deployment, bool) { return f.mem.Latest() }
+
+func (f *fileStore) List() []*Deployment { return f.mem.List() }
+
+func (f *fileStore) Update(id string, fn func(d *Deployment)) error {
+	f.mem.mu.Lock()
+	defer f.mem.mu.Unlock()
+	d, ok := f.mem.deployments[id]
+	if !ok {
+		return errDeploymentNotFound
+	}
+	next := d.clone()
+	fn(next)
+	if err := f.persist(next); err != nil {
+		return err
+	}
+	f.mem.deployments[id] = next
+	return nil
+}
+
+func (f *fileStore) persist(d *Deployment) error {
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(f.dir, "deployments", d.ID+".json"), data)
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// recoverInterrupted fails deployments that were still in flight when the
+// process stopped; their build goroutines did not survive the restart.
+// QUEUED deployments never started and are re-queued by main instead.
+func recoverInterrupted(store DeploymentStore) {
+	for _, d := range store.List() {
+		if isTerminalStatus(d.Status) || d.Status == statusQueued {
+			continue
+		}
+		err := store.Update(d.ID, func(d *Deployment) {
+			d.Status = statusFailed
+			d.Error = "interrupted by upload-api restart"
+			for i := range d.Phases {
+				if d.Phases[i].Status == phaseStatusRunning {
+					d.Phases[i].Status = statusFailed
+					d.Phases[i].Error = "interrupted by upload-api restart"
+				}
+			}
+			d.UpdatedAt = time.Now().UTC()
+		})
+		if err != nil {
+			log.Printf("failed to mark %s as interrupted: %v", d.ID, err)
+		}
+	}
+}
+
+// highestUploadID returns the largest dep-NNNNNN directory number under
+// uploadRoot so new IDs never reuse an existing upload directory.
+func highestUploadID(uploadRoot string) uint64 {
+	entries, err := os.ReadDir(uploadRoot)
+	if err != nil {
+		return 0
+	}
+	var max uint64
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if n, ok := parseID(entry.Name()); ok && n > max {
+			max = n
+		}
+	}
+	return max
+}
+
+func formatID(n uint64) string {
+	return fmt.Sprintf("dep-%06d", n)
+}
+
+func idLess(a, b string) bool {
+	na, okA := parseID(a)
+	nb, okB := parseID(b)
+	if okA && okB && na != nb {
+		return na < nb
+	}
+	return a < b
+}
+
+func parseID(id string) (uint64, bool) {
+	if !strings.HasPrefix(id, "dep-") {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(strings.TrimPrefix(id, "dep-"), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
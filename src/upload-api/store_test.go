@@ -0,0 +1,337 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func intPtr(n int) *int { return &n }
+
+// fullDeployment sets every field, including every nested pointer, so the
+// round-trip and clone tests notice fields that are dropped or shared.
+func fullDeployment(id string) *Deployment {
+	at := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	ended := at.Add(time.Minute)
+	ready := at.Add(2 * time.Minute)
+	latest := true
+	return &Deployment{
+		ID:            id,
+		Kind:          "upload",
+		ServiceName:   "hello",
+		Namespace:     "team-a",
+		BundlePath:    "/uploads/" + id + "/bundle",
+		ExtractedPath: "/uploads/" + id + "/src",
+		BundleSHA256:  "5d41402abc4b2a76b9719d911017c592",
+		BundleFormat:  "tar.gz",
+		Skipped:       []SkippedEntry{{Name: "link", Type: "symlink", Reason: "points outside the bundle"}},
+		Builder:       "kaniko",
+		Language:      "go",
+		Dockerfile:    "build/Dockerfile",
+		Image:         "registry.local/hello",
+		ImageTag:      id,
+		Status:        statusReady,
+		QueuePosition: 2,
+		SupersededBy:  "dep-000099",
+		Revision:      "hello-00002",
+		RollbackOf:    "dep-000001",
+		Strategy:      "canary",
+		CanaryPercent: 10,
+		Traffic: []TrafficTarget{
+			{RevisionName: "hello-00001", Percent: 90, Tag: "previous"},
+			{LatestRevision: &latest, Percent: 10},
+		},
+		AppManifest: "app.yaml",
+		Port:        8080,
+		Env: []EnvVar{
+			{Name: "MODE", Value: "prod"},
+			{Name: "DB_URL", ValueFrom: &EnvVarSource{
+				ConfigMapKeyRef: &KeySelector{Name: "db", Key: "url"},
+				SecretKeyRef:    &KeySelector{Name: "db-creds", Key: "password"},
+			}},
+		},
+		EnvFrom: []EnvFromSource{{ConfigMapRef: &NameRef{Name: "common"}, SecretRef: &NameRef{Name: "tokens"}}},
+		Resources: &Resources{
+			Requests: ResourceList{CPU: "100m", Memory: "128Mi"},
+			Limits:   ResourceList{CPU: "1", Memory: "512Mi"},
+		},
+		Autoscaling: &Autoscaling{
+			MinScale:             intPtr(1),
+			MaxScale:             intPtr(5),
+			InitialScale:         intPtr(2),
+			Metric:               "rps",
+			Target:               intPtr(50),
+			ContainerConcurrency: intPtr(10),
+			ScaleDownDelay:       "5m",
+		},
+		Probes: &Probes{
+			Readiness: &Probe{Path: "/ready", InitialDelaySeconds: 1, PeriodSeconds: 2, TimeoutSeconds: 3, FailureThreshold: 4},
+			Liveness:  &Probe{Path: "/live", InitialDelaySeconds: 5, PeriodSeconds: 6, TimeoutSeconds: 7, FailureThreshold: 8},
+		},
+		LogsHint:      "kubectl logs -n team-a -l serving.knative.dev/service=hello",
+		Error:         "none",
+		FailedPhase:   phaseBuild,
+		FailedAfterMs: 1500,
+		Phases: []PhaseRecord{{
+			Name:       phaseBuild,
+			Status:     "SUCCEEDED",
+			StartedAt:  at,
+			EndedAt:    &ended,
+			DurationMs: 60000,
+			ExitCode:   intPtr(0),
+			Error:      "retried",
+			LogExcerpt: "step 1/3",
+		}},
+		Output:       "line 1\nline 2\n",
+		OutputOffset: 40,
+		LogsRedacted: true,
+		CreatedBy:    "alice",
+		CreatedAt:    at,
+		UpdatedAt:    ended,
+		ReadyAt:      &ready,
+	}
+}
+
+// requireAllSet fails for every zero value reachable from v.
+func requireAllSet(t *testing.T, v reflect.Value, path string) {
+	t.Helper()
+	if v.IsZero() {
+		t.Errorf("%s is not set in fullDeployment", path)
+		return
+	}
+	switch v.Kind() {
+	case reflect.Pointer:
+		// A non-nil pointer to a zero scalar (exit code 0) counts as set.
+		if v.Elem().Kind() == reflect.Struct {
+			requireAllSet(t, v.Elem(), path)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			requireAllSet(t, v.Index(i), path+"[]")
+		}
+	case reflect.Struct:
+		if v.Type() == reflect.TypeOf(time.Time{}) {
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Field(i)
+			// Slices of alternatives (env sources, traffic targets) only
+			// need each field set in one element.
+			if f.IsZero() && path != "Deployment" {
+				continue
+			}
+			requireAllSet(t, f, path+"."+v.Type().Field(i).Name)
+		}
+	}
+}
+
+// requireUnshared fails if a and b hold the same pointer or slice backing
+// array anywhere below the top level.
+func requireUnshared(t *testing.T, a, b reflect.Value, path string) {
+	t.Helper()
+	switch a.Kind() {
+	case reflect.Pointer:
+		if a.IsNil() {
+			return
+		}
+		if a.Pointer() == b.Pointer() {
+			t.Errorf("%s is shared between the original and the clone", path)
+			return
+		}
+		requireUnshared(t, a.Elem(), b.Elem(), path)
+	case reflect.Slice:
+		if a.Len() == 0 {
+			return
+		}
+		if a.Pointer() == b.Pointer() {
+			t.Errorf("%s is shared between the original and the clone", path)
+			return
+		}
+		for i := 0; i < a.Len(); i++ {
+			requireUnshared(t, a.Index(i), b.Index(i), path+"[]")
+		}
+	case reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			if !a.Type().Field(i).IsExported() {
+				continue
+			}
+			requireUnshared(t, a.Field(i), b.Field(i), path+"."+a.Type().Field(i).Name)
+		}
+	}
+}
+
+func TestFullDeploymentSetsEveryField(t *testing.T) {
+	requireAllSet(t, reflect.ValueOf(fullDeployment("dep-000001")).Elem(), "Deployment")
+}
+
+func TestDeploymentCloneSharesNothing(t *testing.T) {
+	d := fullDeployment("dep-000001")
+	c := d.clone()
+	if !reflect.DeepEqual(c, d) {
+		t.Fatalf("clone differs from the original:\n got %+v\nwant %+v", c, d)
+	}
+	requireUnshared(t, reflect.ValueOf(d).Elem(), reflect.ValueOf(c).Elem(), "Deployment")
+
+	*c.Autoscaling.MinScale = 9
+	c.Resources.Limits.CPU = "4"
+	c.Probes.Readiness.Path = "/changed"
+	c.Env[1].ValueFrom.SecretKeyRef.Key = "changed"
+	if !reflect.DeepEqual(d, fullDeployment("dep-000001")) {
+		t.Fatal("mutating the clone changed the original")
+	}
+}
+
+func TestFileStoreRoundTripsEveryField(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := newFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fullDeployment("dep-000004")
+	if err := fs.Put(want); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Update(want.ID, func(d *Deployment) { *d.Autoscaling.MaxScale = 7 }); err != nil {
+		t.Fatal(err)
+	}
+	*want.Autoscaling.MaxScale = 7
+
+	reopened, err := newFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := reopened.Get(want.ID)
+	if !ok {
+		t.Fatalf("%s missing after reload", want.ID)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("reloaded deployment differs:\n got %+v\nwant %+v", got, want)
+	}
+	if latest, ok := reopened.Latest(); !ok || latest.ID != want.ID {
+		t.Fatalf("Latest() = %v, %v; want %s", latest, ok, want.ID)
+	}
+	if id, _ := reopened.NextID(); id != "dep-000005" {
+		t.Fatalf("NextID() after reload = %s, want dep-000005", id)
+	}
+}
+
+func TestOpenStoreSeedsCounter(t *testing.T) {
+	uploads := t.TempDir()
+	for _, name := range []string{"dep-000007", "dep-000003", "scratch"} {
+		if err := os.Mkdir(filepath.Join(uploads, name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A file with an ID-like name is not an upload directory.
+	if err := os.WriteFile(filepath.Join(uploads, "dep-000050"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		backend string
+		counter string
+		want    string
+	}{
+		{"memory from uploads", "memory", "", "dep-000008"},
+		{"file from uploads", "file", "", "dep-000008"},
+		{"file counter ahead of uploads", "file", "12\n", "dep-000013"},
+		{"file counter behind uploads", "file", "2\n", "dep-000008"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tc.counter != "" {
+				if err := os.WriteFile(filepath.Join(dir, "counter"), []byte(tc.counter), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			store, err := openStore(tc.backend, dir, uploads)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id, _ := store.NextID(); id != tc.want {
+				t.Fatalf("NextID() = %s, want %s", id, tc.want)
+			}
+		})
+	}
+
+	if _, err := openStore("etcd", t.TempDir(), uploads); err == nil {
+		t.Fatal("unknown backend accepted")
+	}
+}
+
+func TestFileStoreCounterSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := newFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := fs.NextID(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// IDs handed out but never stored are not reused.
+	reopened, err := newFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := reopened.NextID(); id != "dep-000004" {
+		t.Fatalf("NextID() after restart = %s, want dep-000004", id)
+	}
+}
+
+func TestRecoverInterrupted(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := newFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := time.Now().UTC().Add(-time.Minute)
+	ended := started.Add(time.Second)
+	records := []*Deployment{
+		{ID: "dep-000001", Status: statusReady},
+		{ID: "dep-000002", Status: statusQueued},
+		{ID: "dep-000003", Status: statusBuild, Phases: []PhaseRecord{
+			{Name: phaseExtract, Status: "SUCCEEDED", StartedAt: started, EndedAt: &ended},
+			{Name: phaseBuild, Status: phaseStatusRunning, StartedAt: ended},
+		}},
+		{ID: "dep-000004", Status: statusDeploy},
+		{ID: "dep-000005", Status: statusCancelled},
+	}
+	for _, d := range records {
+		if err := fs.Put(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recoverInterrupted(fs)
+
+	reopened, err := newFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"dep-000001": statusReady,
+		"dep-000002": statusQueued,
+		"dep-000003": statusFailed,
+		"dep-000004": statusFailed,
+		"dep-000005": statusCancelled,
+	}
+	for id, status := range want {
+		d, _ := reopened.Get(id)
+		if d.Status != status {
+			t.Errorf("%s status = %s, want %s", id, d.Status, status)
+		}
+		if status == statusFailed && d.Error != "interrupted by upload-api restart" {
+			t.Errorf("%s error = %q", id, d.Error)
+		}
+	}
+	d, _ := reopened.Get("dep-000003")
+	if d.Phases[0].Status != "SUCCEEDED" || d.Phases[1].Status != statusFailed || d.Phases[1].Error == "" {
+		t.Fatalf("phases after recovery = %+v", d.Phases)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// tokenReviewAuthenticator asks the Kubernetes API to validate the token,
+// so service account tokens and whatever the cluster trusts are accepted.
+// Results are cached briefly to avoid a review per request.
+type tokenReviewAuthenticator struct {
+	kube      *kubeClient
+	audiences []string
+	ttl       time.Duration
+
+	mu    sync.Mutex
+	cache map[[32]byte]tokenReviewResult
+}
+
+type tokenReviewResult struct {
+	id      *Identity
+	err     error
+	expires time.Time
+}
+
+type tokenReview struct {
+	APIVersion string             `json:"apiVersion"`
+	Kind       string             `json:"kind"`
+	Spec       tokenReviewSpec    `json:"spec"`
+	Status     *tokenReviewStatus `json:"status,omitempty"`
+}
+
+type tokenReviewSpec struct {
+	Token     string   `json:"token"`
+	Audiences []string `json:"audiences,omitempty"`
+}
+
+type tokenReviewStatus struct {
+	Authenticated bool   `json:"authenticated"`
+	Error         string `json:"error,omitempty"`
+	User          struct {
+		Username string   `json:"username"`
+		Groups   []string `json:"groups,omitempty"`
+	} `json:"user"`
+}
+
+func newTokenReviewAuthenticator(kube *kubeClient) *tokenReviewAuthenticator {
+	return &tokenReviewAuthenticator{
+		kube:      kube,
+		audiences: splitList(envOr("AUTH_TOKENREVIEW_AUDIENCES", "")),
+		ttl:       envDuration("AUTH_TOKENREVIEW_CACHE_TTL", time.Minute),
+		cache:     map[[32]byte]tokenReviewResult{},
+	}
+}
+
+func (*tokenReviewAuthenticator) name() string { return "tokenreview" }
+
+func (a *tokenReviewAuthenticator) authenticate(ctx context.Context, token string) (*Identity, error) {
+	if token == "" {
+		return nil, nil
+	}
+	key := sha256.Sum256([]byte(token))
+	now := time.Now()
+	a.mu.Lock()
+	cached, ok := a.cache[key]
+	a.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.identity()
+	}
+
+	review := tokenReview{
+		APIVersion: "authentication.k8s.io/v1",
+		Kind:       "TokenReview",
+		Spec:       tokenReviewSpec{Token: token, Audiences: a.audiences},
+	}
+	var out tokenReview
+	if err := a.kube.do(ctx, http.MethodPost, "/apis/authentication.k8s.io/v1/tokenreviews", "", review, &out); err != nil {
+		// Not cached: the API may only be briefly unavailable.
+		log.Printf("token review request failed: %v", err)
+		return nil, errors.New("token review failed")
+	}
+	var result tokenReviewResult
+	switch st := out.Status; {
+	case st != nil && !st.Authenticated && st.Error != "":
+		result.err = errors.New(st.Error)
+	case st == nil || !st.Authenticated || st.User.Username == "":
+		result.err = errors.New("token not authenticated")
+	default:
+		result.id = &Identity{Username: st.User.Username, Groups: st.User.Groups}
+	}
+	result.expires = now.Add(a.ttl)
+
+	a.mu.Lock()
+	for k, v := range a.cache {
+		if now.After(v.expires) {
+			delete(a.cache, k)
+		}
+	}
+	a.cache[key] = result
+	a.mu.Unlock()
+	return result.identity()
+}
+
+// identity returns a copy of the cached identity, which callers are free to
+// modify (Server.authenticate sets its Provider).
+func (r tokenReviewResult) identity() (*Identity, error) {
+	if r.id == nil {
+		return nil, r.err
+	}
+	id := *r.id
+	id.Groups = append([]string(nil), r.id.Groups...)
+	return &id, nil
+}
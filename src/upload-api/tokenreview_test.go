@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeTokenReviews accepts the token "good" as alice in devs and counts
+// the reviews it answers.
+func fakeTokenReviews(t *testing.T) (*kubeClient, *atomic.Int32) {
+	t.Helper()
+	var reviews atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var review tokenReview
+		if r.URL.Path != "/apis/authentication.k8s.io/v1/tokenreviews" || json.NewDecoder(r.Body).Decode(&review) != nil {
+			http.Error(w, "unexpected request", http.StatusNotImplemented)
+			return
+		}
+		reviews.Add(1)
+		review.Status = &tokenReviewStatus{Authenticated: review.Spec.Token == "good"}
+		if review.Status.Authenticated {
+			review.Status.User.Username = "alice"
+			review.Status.User.Groups = []string{"devs"}
+		}
+		json.NewEncoder(w).Encode(review)
+	}))
+	t.Cleanup(srv.Close)
+	return &kubeClient{baseURL: srv.URL, http: srv.Client()}, &reviews
+}
+
+func TestTokenReviewCachesWithoutSharingIdentities(t *testing.T) {
+	kube, reviews := fakeTokenReviews(t)
+	a := &tokenReviewAuthenticator{kube: kube, ttl: time.Minute, cache: map[[32]byte]tokenReviewResult{}}
+	s := &Server{authenticators: []authenticator{a}}
+
+	first, err := s.authenticate(context.Background(), "good")
+	if err != nil || first.Username != "alice" || first.Provider != "tokenreview" {
+		t.Fatalf("authenticate = %+v, %v", first, err)
+	}
+	first.Username = "mallory"
+	first.Groups[0] = "admins"
+
+	// Concurrent cache hits each get their own identity; run with -race.
+	var wg sync.WaitGroup
+	ids := make([]*Identity, 8)
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ids[i], _ = s.authenticate(context.Background(), "good")
+		}(i)
+	}
+	wg.Wait()
+	for i, id := range ids {
+		if id == nil || id.Username != "alice" || id.Groups[0] != "devs" || id.Provider != "tokenreview" {
+			t.Fatalf("cached lookup %d = %+v, want alice in devs", i, id)
+		}
+		if i > 0 && id == ids[0] {
+			t.Fatalf("cached lookups share one identity")
+		}
+	}
+	if n := reviews.Load(); n != 1 {
+		t.Fatalf("token reviews = %d, want 1 for cached lookups", n)
+	}
+
+	if _, err := s.authenticate(context.Background(), "bad"); err == nil {
+		t.Fatalf("unauthenticated token accepted")
+	}
+	if _, err := s.authenticate(context.Background(), "bad"); err == nil || reviews.Load() != 2 {
+		t.Fatalf("cached rejection = %v after %d reviews, want an error from the cache", err, reviews.Load())
+	}
+}
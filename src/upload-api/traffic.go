@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	strategyAll    = "all"
+	strategyCanary = "canary"
+
+	canaryTag  = "canary"
+	currentTag = "current"
+)
+
+type TrafficRequest struct {
+	Targets []TrafficTarget `json:"targets"`
+}
+
+// parseRollout validates the strategy/percent form fields of /deploy.
+func parseRollout(rawStrategy, rawPercent string) (string, int64, error) {
+	strategy := strings.ToLower(strings.TrimSpace(rawStrategy))
+	switch strategy {
+	case "", strategyAll:
+		if strings.TrimSpace(rawPercent) != "" {
+			return "", 0, fmt.Errorf("percent is only valid with strategy=%s", strategyCanary)
+		}
+		return strategyAll, 0, nil
+	case strategyCanary:
+		percent, err := strconv.ParseInt(strings.TrimSpace(rawPercent), 10, 64)
+		if err != nil || percent < 1 || percent > 99 {
+			return "", 0, fmt.Errorf("canary percent must be an integer between 1 and 99")
+		}
+		return strategyCanary, percent, nil
+	default:
+		return "", 0, fmt.Errorf("strategy must be %s or %s", strategyAll, strategyCanary)
+	}
+}
+
+// canaryTraffic routes percent to the revision about to be created and the
+// rest to the currently ready one.
+func canaryTraffic(previous string, percent int64) []TrafficTarget {
+	latest := true
+	return []TrafficTarget{
+		{LatestRevision: &latest, Percent: percent, Tag: canaryTag},
+		{RevisionName: previous, Percent: 100 - percent, Tag: currentTag},
+	}
+}
+
+func validateTraffic(targets []TrafficTarget) error {
+	if len(targets) == 0 {
+		return fmt.Errorf("at least one traffic target is required")
+	}
+	var total int64
+	tags := map[string]bool{}
+	for i, t := range targets {
+		latest := t.LatestRevision != nil && *t.LatestRevision
+		if latest == (t.RevisionName != "") {
+			return fmt.Errorf("target %d: set exactly one of revisionName or latestRevision", i)
+		}
+		if t.Percent < 0 || t.Percent > 100 {
+			return fmt.Errorf("target %d: percent must be between 0 and 100", i)
+		}
+		if t.Tag != "" {
+			if sanitizeK8sName(t.Tag) != t.Tag {
+				return fmt.Errorf("target %d: tag %q must be a lowercase DNS label", i, t.Tag)
+			}
+			if tags[t.Tag] {
+				return fmt.Errorf("target %d: duplicate tag %q", i, t.Tag)
+			}
+			tags[t.Tag] = true
+		}
+		total += t.Percent
+	}
+	if total != 100 {
+		return fmt.Errorf("traffic percentages must sum to 100, got %d", total)
+	}
+	return nil
+}
+
+func (s *Server) handleTraffic(w http.ResponseWriter, r *http.Request, namespace, name string) {
+	var req TrafficRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid traffic request: %v", err)})
+		return
+	}
+	if err := validateTraffic(req.Targets); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	id, err := s.store.NextID()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("failed to allocate deployment id: %v", err)})
+		return
+	}
+
+	d := &Deployment{
+		ID:          id,
+		Kind:        kindTraffic,
+		ServiceName: name,
+		Namespace:   namespace,
+		Status:      statusDeploy,
+		LogsHint:    logsHint(name, namespace),
+		CreatedBy:   createdBy(r),
+		CreatedAt:   time.Now().UTC(),
+		UpdatedAt:   time.Now().UTC(),
+	}
+	if err := s.store.Put(d); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("failed to record deployment: %v", err)})
+		return
+	}
+	s.announce("", d)
+	go s.runTrafficShift(id, req.Targets)
+
+	writeJSON(w, http.StatusAccepted, DeployResponse{
+		ID:      id,
+		Status:  d.Status,
+		Message: "traffic update accepted",
+	})
+}
+
+func (s *Server) runTrafficShift(id string, targets []TrafficTarget) {
+	d, ok := s.store.Get(id)
+	if !ok {
+		return
+	}
+	ctx, end, ok := s.beginRun(id)
+	if !ok {
+		return
+	}
+	defer end()
+
+	output := "traffic: " + describeTraffic(targets)
+	ready := s.startPhase(ctx, id, phaseReady, nil)
+	st, err := s.services.SetTraffic(ready.ctx, d.Namespace, d.ServiceName, targets)
+	ready.end(err)
+	if cancelRequested(ctx) {
+		s.markCancelled(id, output, "traffic update")
+		return
+	}
+	if err != nil {
+		s.failPhase(id, output, ready, fmt.Sprintf("traffic update failed: %v", err))
+		return
+	}
+	s.updateReady(id, output, st.LatestReadyRevision, st.Traffic)
+}
+
+func describeTraffic(targets []TrafficTarget) string {
+	parts := make([]string, 0, len(targets))
+	for _, t := range targets {
+		name := t.RevisionName
+		if t.LatestRevision != nil && *t.LatestRevision {
+			name = "@latest"
+		}
+		part := fmt.Sprintf("%s=%d%%", name, t.Percent)
+		if t.Tag != "" {
+			part += " (tag " + t.Tag + ")"
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	webhookQueueSize      = 256
+	webhookRequestTimeout = 10 * time.Second
+	webhookFirstBackoff   = time.Second
+	webhookMaxBackoff     = time.Minute
+	// webhookLogSize bounds the deliveries kept for /webhooks/deliveries.
+	webhookLogSize = 500
+)
+
+// Delivery states.
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+	deliveryDropped   = "dropped"
+)
+
+// WebhookDelivery records one event sent (or being sent) to one URL.
+type WebhookDelivery struct {
+	ID           string           `json:"id"`
+	EventID      string           `json:"eventId"`
+	EventType    string           `json:"eventType"`
+	DeploymentID string           `json:"deploymentId"`
+	URL          string           `json:"url"`
+	Status       string           `json:"status"`
+	Attempts     []WebhookAttempt `json:"attempts"`
+	CreatedAt    time.Time        `json:"createdAt"`
+	UpdatedAt    time.Time        `json:"updatedAt"`
+}
+
+type WebhookAttempt struct {
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"durationMs"`
+}
+
+// webhookNotifier POSTs lifecycle events to the configured URLs. Each URL
+// has its own worker, so events reach it in order; failed attempts are
+// retried with exponential backoff before the worker moves on.
+type webhookNotifier struct {
+	endpoints   []*webhookEndpoint
+	secret      []byte
+	events      map[string]bool // nil means every event
+	maxAttempts int
+	client      *http.Client
+
+	mu         sync.Mutex
+	deliveries []*WebhookDelivery // oldest first
+	seq        int
+}
+
+type webhookEndpoint struct {
+	url   string
+	queue chan webhookJob
+}
+
+type webhookJob struct {
+	delivery *WebhookDelivery
+	body     []byte
+}
+
+// newWebhookNotifier reads the WEBHOOK_* settings. It returns nil when no
+// webhook URL is configured.
+func newWebhookNotifier() *webhookNotifier {
+	var urls []string
+	for _, raw := range strings.Split(envOr("WEBHOOK_URLS", ""), ",") {
+		if raw = strings.TrimSpace(raw); raw != "" {
+			urls = append(urls, raw)
+		}
+	}
+	if len(urls) == 0 {
+		return nil
+	}
+
+	n := &webhookNotifier{
+		secret:      []byte(envOr("WEBHOOK_SECRET", "")),
+		maxAttempts: envInt("WEBHOOK_MAX_ATTEMPTS", 5),
+		client:      &http.Client{Timeout: webhookRequestTimeout},
+	}
+	if n.maxAttempts < 1 {
+		n.maxAttempts = 1
+	}
+	if raw := envOr("WEBHOOK_EVENTS", ""); raw != "" {
+		n.events = map[string]bool{}
+		for _, event := range strings.Split(raw, ",") {
+			n.events[strings.TrimSpace(event)] = true
+		}
+	}
+	for _, u := range urls {
+		ep := &webhookEndpoint{url: u, queue: make(chan webhookJob, webhookQueueSize)}
+		n.endpoints = append(n.endpoints, ep)
+		go n.work(ep)
+	}
+	return n
+}
+
+func (n *webhookNotifier) publish(e DeploymentEvent) {
+	if n.events != nil && !n.events[e.Type] {
+		return
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("failed to encode %s event for %s: %v", e.Type, e.Deployment.ID, err)
+		return
+	}
+	for _, ep := range n.endpoints {
+		d := n.record(e, ep.url)
+		select {
+		case ep.queue <- webhookJob{delivery: d, body: body}:
+		default:
+			log.Printf("webhook queue for %s is full; dropping %s for %s", ep.url, e.Type, e.Deployment.ID)
+			n.update(d, func(d *WebhookDelivery) { d.Status = deliveryDropped })
+		}
+	}
+}
+
+// record adds a pending delivery to the log.
+func (n *webhookNotifier) record(e DeploymentEvent, url string) *WebhookDelivery {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.seq++
+	d := &WebhookDelivery{
+		ID:           fmt.Sprintf("dlv-%06d", n.seq),
+		EventID:      e.ID,
+		EventType:    e.Type,
+		DeploymentID: e.Deployment.ID,
+		URL:          url,
+		Status:       deliveryPending,
+		CreatedAt:    e.OccurredAt,
+		UpdatedAt:    e.OccurredAt,
+	}
+	n.deliveries = append(n.deliveries, d)
+	if len(n.deliveries) > webhookLogSize {
+		n.deliveries = n.deliveries[len(n.deliveries)-webhookLogSize:]
+	}
+	return d
+}
+
+func (n *webhookNotifier) update(d *WebhookDelivery, fn func(d *WebhookDelivery)) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	fn(d)
+	d.UpdatedAt = time.Now().UTC()
+}
+
+func (n *webhookNotifier) work(ep *webhookEndpoint) {
+	for job := range ep.queue {
+		n.deliver(ep.url, job)
+	}
+}
+
+// deliver sends job and records every attempt on its delivery.
+func (n *webhookNotifier) deliver(url string, job webhookJob) {
+	newRequest := func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(job.body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "knative-appdev-upload-api")
+		req.Header.Set("X-Upload-API-Event", job.delivery.EventType)
+		req.Header.Set("X-Upload-API-Delivery", job.delivery.ID)
+		if len(n.secret) > 0 {
+			req.Header.Set("X-Upload-API-Signature", "sha256="+signPayload(n.secret, job.body))
+		}
+		return req, nil
+	}
+	delivered := sendWithRetry(n.client, n.maxAttempts, newRequest, func(a WebhookAttempt, final bool) {
+		n.update(job.delivery, func(d *WebhookDelivery) {
+			d.Attempts = append(d.Attempts, a)
+			switch {
+			case a.Error == "":
+				d.Status = deliveryDelivered
+			case final:
+				d.Status = deliveryFailed
+			}
+		})
+	})
+	if !delivered {
+		log.Printf("webhook %s for %s to %s failed", job.delivery.EventType, job.delivery.DeploymentID, url)
+	}
+}
+
+// sendWithRetry sends requests from newRequest until one is accepted, one is
+// rejected with a status that retrying will not fix, or maxAttempts is
+// reached. Failed requests and 429/5xx answers are retried with exponential
+// backoff. attempted is called after every attempt.
+func sendWithRetry(client *http.Client, maxAttempts int, newRequest func() (*http.Request, error), attempted func(a WebhookAttempt, final bool)) bool {
+	backoff := webhookFirstBackoff
+	for attempt := 1; ; attempt++ {
+		started := time.Now()
+		code, err := send(client, newRequest)
+		a := WebhookAttempt{At: started.UTC(), StatusCode: code, DurationMs: time.Since(started).Milliseconds()}
+		if err != nil {
+			a.Error = err.Error()
+		}
+		retryable := err != nil && (code == 0 || code == http.StatusTooManyRequests || code >= 500)
+		final := err == nil || !retryable || attempt >= maxAttempts
+		attempted(a, final)
+		if final {
+			return err == nil
+		}
+		time.Sleep(backoff)
+		backoff = min(backoff*2, webhookMaxBackoff)
+	}
+}
+
+// send performs one request and returns the response status. Any status
+// outside 2xx is an error.
+func send(client *http.Client, newRequest func() (*http.Request, error)) (int, error) {
+	req, err := newRequest()
+	if err != nil {
+		return 0, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+	if res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("status %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+// signPayload returns the hex HMAC-SHA256 of body under secret.
+func signPayload(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// list returns copies of the logged deliveries, newest first, optionally
+// limited to one deployment and/or status.
+func (n *webhookNotifier) list(deploymentID, status string) []WebhookDelivery {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	out := []WebhookDelivery{}
+	for i := len(n.deliveries) - 1; i >= 0; i-- {
+		d := n.deliveries[i]
+		if (deploymentID != "" && d.DeploymentID != deploymentID) || (status != "" && d.Status != status) {
+			continue
+		}
+		c := *d
+		c.Attempts = append([]WebhookAttempt(nil), d.Attempts...)
+		out = append(out, c)
+	}
+	return out
+}
+
+// handleWebhookDeliveries serves GET /webhooks/deliveries.
+func (s *Server) handleWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if s.webhooks == nil {
+		writeJSON(w, http.StatusOK, map[string]any{"items": []WebhookDelivery{}})
+		return
+	}
+	q := r.URL.Query()
+	items := s.webhooks.list(strings.TrimSpace(q.Get("deploymentId")), strings.TrimSpace(q.Get("status")))
+	// Only deliveries of deployments whose logs the caller may read.
+	visible := map[string]bool{}
+	kept := items[:0]
+	for _, item := range items {
+		ok, seen := visible[item.DeploymentID]
+		if !seen {
+			d, found := s.store.Get(item.DeploymentID)
+			ok = found && s.permits(r, actionLogs, d.Namespace)
+			visible[item.DeploymentID] = ok
+		}
+		if ok {
+			kept = append(kept, item)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"items": kept})
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLifecycleEvent(t *testing.T) {
+	for _, tc := range []struct {
+		from, to, kind string
+		want           string
+	}{
+		{"", statusQueued, "", eventAccepted},
+		{statusQueued, statusBuild, "", eventBuildStarted},
+		{statusBuild, statusDeploy, "", eventDeployStarted},
+		{statusDeploy, statusReady, "", eventReady},
+		{statusQueued, statusFailed, "", eventBuildFailed},
+		{statusBuild, statusFailed, "", eventBuildFailed},
+		{statusDeploy, statusFailed, "", eventDeployFailed},
+		{statusBuild, statusCancelled, "", eventCancelled},
+		{statusDeploy, statusTimedOut, "", eventTimedOut},
+		// Rollbacks and deletes skip the build and start deploying.
+		{"", statusDeploy, kindRollback, eventAccepted},
+		{statusDeploy, statusReady, kindRollback, eventRolledBack},
+		{statusDeploy, statusReady, kindDelete, eventDeleted},
+		{statusDeploy, statusFailed, kindRollback, eventDeployFailed},
+		{statusDeploy, statusReady, kindTraffic, eventReady},
+
+		{statusBuild, statusBuild, "", ""},
+		{statusQueued, "PAUSED", "", ""},
+	} {
+		d := &Deployment{Status: tc.to, Kind: tc.kind}
+		if got := lifecycleEvent(tc.from, d); got != tc.want {
+			t.Errorf("%q -> %s (%s) = %q, want %q", tc.from, tc.to, tc.kind, got, tc.want)
+		}
+	}
+}
+
+// webhookDeliveries polls n until deployment id has want deliveries that
+// are no longer pending, and returns them.
+func webhookDeliveries(t *testing.T, n *webhookNotifier, id string, want int) []WebhookDelivery {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		settled := n.list(id, deliveryDelivered)
+		settled = append(settled, n.list(id, deliveryFailed)...)
+		if len(settled) >= want {
+			return settled
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("deliveries for %s = %+v, want %d settled", id, n.list(id, ""), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebhookSignsDeliveries(t *testing.T) {
+	url, received := cloudEventReceiver(t, 0)
+	t.Setenv("WEBHOOK_URLS", " "+url+" ,")
+	t.Setenv("WEBHOOK_SECRET", "s3cret")
+	n := newWebhookNotifier()
+	if len(n.endpoints) != 1 || n.maxAttempts != 5 || n.events != nil {
+		t.Fatalf("notifier = %d endpoints, %d attempts, events %v", len(n.endpoints), n.maxAttempts, n.events)
+	}
+
+	n.publish(DeploymentEvent{
+		ID:         "evt-1",
+		Type:       eventReady,
+		OccurredAt: time.Now().UTC(),
+		Deployment: &Deployment{ID: "dep-000007", ServiceName: "hello", Namespace: "demo-apps", Status: statusReady},
+	})
+	ev := waitEvent(t, received)
+
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(ev.body)
+	for name, want := range map[string]string{
+		"Content-Type":           "application/json",
+		"X-Upload-Api-Event":     eventReady,
+		"X-Upload-Api-Delivery":  "dlv-000001",
+		"X-Upload-Api-Signature": "sha256=" + hex.EncodeToString(mac.Sum(nil)),
+	} {
+		if got := ev.header.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	var e DeploymentEvent
+	if err := json.Unmarshal(ev.body, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.ID != "evt-1" || e.Type != eventReady || e.Deployment.ID != "dep-000007" {
+		t.Fatalf("payload = %+v", e)
+	}
+
+	d := webhookDeliveries(t, n, "dep-000007", 1)[0]
+	if d.Status != deliveryDelivered || d.EventID != "evt-1" || d.URL != url || len(d.Attempts) != 1 || d.Attempts[0].StatusCode != http.StatusAccepted {
+		t.Fatalf("delivery = %+v, want one accepted attempt", d)
+	}
+}
+
+func TestWebhookWithoutSecretIsUnsigned(t *testing.T) {
+	url, received := cloudEventReceiver(t, 0)
+	t.Setenv("WEBHOOK_URLS", url)
+	t.Setenv("WEBHOOK_SECRET", "")
+	newWebhookNotifier().publish(DeploymentEvent{ID: "evt-1", Type: eventReady, Deployment: &Deployment{ID: "dep-000007"}})
+	if _, ok := waitEvent(t, received).header["X-Upload-Api-Signature"]; ok {
+		t.Fatal("delivery signed without WEBHOOK_SECRET")
+	}
+}
+
+func TestWebhookNotifierFromEnv(t *testing.T) {
+	t.Setenv("WEBHOOK_URLS", " , ")
+	if n := newWebhookNotifier(); n != nil {
+		t.Fatalf("notifier without URLs = %+v", n)
+	}
+	t.Setenv("WEBHOOK_URLS", "http://127.0.0.1:1/a,http://127.0.0.1:1/b")
+	t.Setenv("WEBHOOK_MAX_ATTEMPTS", "0")
+	t.Setenv("WEBHOOK_EVENTS", eventReady+", "+eventBuildFailed)
+	n := newWebhookNotifier()
+	if len(n.endpoints) != 2 || n.maxAttempts != 1 {
+		t.Fatalf("notifier = %d endpoints, %d attempts, want 2 and 1", len(n.endpoints), n.maxAttempts)
+	}
+	if want := map[string]bool{eventReady: true, eventBuildFailed: true}; !reflect.DeepEqual(n.events, want) {
+		t.Fatalf("events = %v, want %v", n.events, want)
+	}
+}
+
+func TestSendWithRetry(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		codes       []int // answered in turn; the last one repeats
+		maxAttempts int
+		wantCodes   []int
+		wantOK      bool
+	}{
+		{name: "accepted", codes: []int{http.StatusNoContent}, maxAttempts: 3, wantCodes: []int{204}, wantOK: true},
+		{name: "unavailable then accepted", codes: []int{503, 200}, maxAttempts: 3, wantCodes: []int{503, 200}, wantOK: true},
+		{name: "rate limited then accepted", codes: []int{429, 200}, maxAttempts: 3, wantCodes: []int{429, 200}, wantOK: true},
+		{name: "client error is not retried", codes: []int{400}, maxAttempts: 3, wantCodes: []int{400}},
+		{name: "attempts exhausted", codes: []int{500}, maxAttempts: 2, wantCodes: []int{500, 500}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				i := int(calls.Add(1)) - 1
+				w.WriteHeader(tc.codes[min(i, len(tc.codes)-1)])
+			}))
+			defer srv.Close()
+
+			var codes []int
+			var finals []bool
+			ok := sendWithRetry(srv.Client(), tc.maxAttempts, func() (*http.Request, error) {
+				return http.NewRequest(http.MethodPost, srv.URL, nil)
+			}, func(a WebhookAttempt, final bool) {
+				codes = append(codes, a.StatusCode)
+				finals = append(finals, final)
+				if (a.Error == "") != (a.StatusCode < 300) {
+					t.Errorf("attempt %+v: error does not match the status", a)
+				}
+			})
+			if ok != tc.wantOK || !reflect.DeepEqual(codes, tc.wantCodes) {
+				t.Fatalf("sendWithRetry = %v after %v, want %v after %v", ok, codes, tc.wantOK, tc.wantCodes)
+			}
+			for i, final := range finals {
+				if final != (i == len(finals)-1) {
+					t.Fatalf("final flags = %v, want only the last set", finals)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookDeliveryLog(t *testing.T) {
+	url, received := cloudEventReceiver(t, 0)
+	t.Setenv("WEBHOOK_URLS", url+",http://127.0.0.1:1/unreachable")
+	t.Setenv("WEBHOOK_MAX_ATTEMPTS", "1")
+	t.Setenv("WEBHOOK_EVENTS", eventBuildFailed+","+eventReady)
+	s := newTestServer(t)
+	s.webhooks = newWebhookNotifier()
+	for _, d := range []*Deployment{
+		{ID: "dep-000001", Namespace: "demo-apps", Status: statusReady},
+		{ID: "dep-000002", Namespace: "demo-apps", Status: statusFailed},
+	} {
+		s.store.Put(d)
+	}
+	for _, e := range []DeploymentEvent{
+		{ID: "evt-1", Type: eventAccepted, Deployment: &Deployment{ID: "dep-000001"}},
+		{ID: "evt-2", Type: eventReady, Deployment: &Deployment{ID: "dep-000001"}},
+		{ID: "evt-3", Type: eventBuildFailed, Deployment: &Deployment{ID: "dep-000002"}},
+	} {
+		s.webhooks.publish(e)
+	}
+	// Filtered out events are neither sent nor logged.
+	for range 2 {
+		if ev := waitEvent(t, received); ev.header.Get("X-Upload-Api-Event") == eventAccepted {
+			t.Fatal("delivered an event outside WEBHOOK_EVENTS")
+		}
+	}
+	webhookDeliveries(t, s.webhooks, "dep-000001", 2)
+	webhookDeliveries(t, s.webhooks, "dep-000002", 2)
+
+	for _, tc := range []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"dlv-000004", "dlv-000003", "dlv-000002", "dlv-000001"}},
+		{"?deploymentId=dep-000001", []string{"dlv-000002", "dlv-000001"}},
+		{"?status=failed", []string{"dlv-000004", "dlv-000002"}},
+		{"?deploymentId=dep-000002&status=delivered", []string{"dlv-000003"}},
+		{"?deploymentId=dep-000099", nil},
+	} {
+		code, body := get(t, s.handleWebhookDeliveries, "/webhooks/deliveries"+tc.query, nil)
+		if code != http.StatusOK {
+			t.Fatalf("deliveries%s = %d %s", tc.query, code, body)
+		}
+		var out struct{ Items []WebhookDelivery }
+		if err := json.Unmarshal(body, &out); err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, d := range out.Items {
+			ids = append(ids, d.ID)
+		}
+		if !reflect.DeepEqual(ids, tc.want) {
+			t.Errorf("deliveries%s = %v, want %v", tc.query, ids, tc.want)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	s.handleWebhookDeliveries(rec, httptest.NewRequest(http.MethodPost, "/webhooks/deliveries", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST deliveries = %d, want 405", rec.Code)
+	}
+	s.webhooks = nil
+	if code, body := get(t, s.handleWebhookDeliveries, "/webhooks/deliveries", nil); code != http.StatusOK || string(body) != `{"items":[]}`+"\n" {
+		t.Fatalf("deliveries without webhooks = %d %s, want an empty list", code, body)
+	}
+}
+
+func TestWebhookFollowsUploadLifecycle(t *testing.T) {
+	url, received := cloudEventReceiver(t, 0)
+	t.Setenv("WEBHOOK_URLS", url)
+	s := newPipelineServer(t)
+	s.webhooks = newWebhookNotifier()
+	s.sinks = []eventSink{s.webhooks}
+	d := deployAndWait(t, s, map[string]string{"service": "hello"}, map[string]string{"Dockerfile": testDockerfile})
+
+	var got []string
+	for _, want := range []string{eventAccepted, eventBuildStarted, eventDeployStarted, eventReady} {
+		var e DeploymentEvent
+		if err := json.Unmarshal(waitEvent(t, received).body, &e); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, e.Type)
+		if e.Type != want || e.Deployment.ID != d.ID || e.Deployment.Output != "" {
+			t.Fatalf("events = %v (deployment %s), want %s next for %s without output", got, e.Deployment.ID, want, d.ID)
+		}
+	}
+}
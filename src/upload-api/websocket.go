@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Minimal server-side WebSocket (RFC 6455) support for streaming logs: text
+// messages out, and only close/ping handling for frames coming in.
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var (
+	errWebSocketHandshake = errors.New("invalid websocket handshake")
+	// errWebSocketHijacked means the handshake failed after the connection
+	// was taken over, so no HTTP response can be written any more.
+	errWebSocketHijacked = errors.New("websocket handshake failed after hijack")
+)
+
+const (
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xA
+)
+
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+type wsConn struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+	mu   sync.Mutex
+}
+
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := strings.TrimSpace(r.Header.Get("Sec-WebSocket-Key"))
+	if key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, errWebSocketHandshake
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errWebSocketHandshake
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	rw.WriteString("Upgrade: websocket\r\nConnection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %v", errWebSocketHijacked, err)
+	}
+	return &wsConn{conn: conn, rw: rw}, nil
+}
+
+// websocketOriginAllowed reports whether a browser on the request's Origin
+// may open a socket. Requests without Origin come from non-browser clients.
+// Otherwise the origin must be the API's own host or be listed in
+// WEBSOCKET_ALLOWED_ORIGINS, so other sites cannot read logs with the
+// visitor's credentials.
+func (s *Server) websocketOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if s.allowedOrigins["*"] || s.allowedOrigins[strings.ToLower(origin)] {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && strings.EqualFold(u.Host, r.Host)
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+	if _, err := c.rw.Write(header); err != nil {
+		return err
+	}
+	if _, err := c.rw.Write(payload); err != nil {
+		return err
+	}
+	return c.rw.Flush()
+}
+
+// readLoop answers pings and returns when the client closes the connection
+// or it fails. Client data frames are ignored.
+func (c *wsConn) readLoop() {
+	for {
+		var head [2]byte
+		if _, err := io.ReadFull(c.rw, head[:]); err != nil {
+			return
+		}
+		opcode := head[0] & 0x0F
+		length := uint64(head[1] & 0x7F)
+		switch length {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(c.rw, ext[:]); err != nil {
+				return
+			}
+			length = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(c.rw, ext[:]); err != nil {
+				return
+			}
+			length = binary.BigEndian.Uint64(ext[:])
+		}
+		if length > 1<<20 {
+			return
+		}
+		var mask [4]byte
+		if head[1]&0x80 != 0 {
+			if _, err := io.ReadFull(c.rw, mask[:]); err != nil {
+				return
+			}
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.rw, payload); err != nil {
+			return
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+
+		switch opcode {
+		case wsOpClose:
+			_ = c.writeFrame(wsOpClose, nil)
+			return
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// serveLogsWebSocket streams the same events as the SSE endpoint, each as a
+// JSON text message: {"type": "log", "seq": 3, "data": "..."}.
+func (s *Server) serveLogsWebSocket(w http.ResponseWriter, r *http.Request, id string, from uint64) {
+	if !s.websocketOriginAllowed(r) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "websocket origin not allowed: " + r.Header.Get("Origin")})
+		return
+	}
+	ws, err := upgradeWebSocket(w, r)
+	if errors.Is(err, errWebSocketHijacked) {
+		log.Printf("websocket log stream for %s: %v", id, err)
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid websocket handshake"})
+		return
+	}
+	defer ws.conn.Close()
+
+	// The request context is not cancelled for hijacked connections, so the
+	// read loop signals the client going away.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		ws.readLoop()
+		cancel()
+	}()
+
+	err = s.followLogs(ctx, id, from, func(event string, seq uint64, data string) error {
+		if event == "" {
+			return ws.writeFrame(wsOpPing, nil)
+		}
+		var payload any = data
+		if event == logEventDone {
+			payload = json.RawMessage(data)
+		}
+		msg, err := json.Marshal(map[string]any{"type": event, "seq": seq, "data": payload})
+		if err != nil {
+			return err
+		}
+		return ws.writeFrame(wsOpText, msg)
+	})
+	if err != nil && ctx.Err() == nil {
+		log.Printf("websocket log stream for %s ended: %v", id, err)
+	}
+	_ = ws.writeFrame(wsOpClose, []byte{0x03, 0xE8}) // 1000 normal closure
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebSocketOriginAllowed(t *testing.T) {
+	s := &Server{allowedOrigins: map[string]bool{"http://app-dashboard.platform-system.localhost:8081": true}}
+	for origin, want := range map[string]bool{
+		"":                                true,
+		"http://upload-api.example:8080":  true,
+		"HTTPS://UPLOAD-API.EXAMPLE:8080": true,
+		"http://app-dashboard.platform-system.localhost:8081": true,
+		"http://APP-DASHBOARD.platform-system.localhost:8081": true,
+		"http://evil.example":            false,
+		"http://upload-api.example:9090": false,
+		"null":                           false,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "http://upload-api.example:8080/deployments/dep-000001/logs?follow=true", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		if got := s.websocketOriginAllowed(r); got != want {
+			t.Errorf("websocketOriginAllowed(Origin %q) = %v, want %v", origin, got, want)
+		}
+	}
+
+	s.allowedOrigins = map[string]bool{"*": true}
+	r := httptest.NewRequest(http.MethodGet, "http://upload-api.example:8080/", nil)
+	r.Header.Set("Origin", "http://evil.example")
+	if !s.websocketOriginAllowed(r) {
+		t.Errorf("websocketOriginAllowed with * = false, want true")
+	}
+}
+
+func TestServeLogsWebSocketRejectsForeignOrigin(t *testing.T) {
+	s := &Server{allowedOrigins: map[string]bool{}}
+	r := httptest.NewRequest(http.MethodGet, "http://upload-api.example:8080/deployments/dep-000001/logs?follow=true", nil)
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	r.Header.Set("Sec-WebSocket-Version", "13")
+	r.Header.Set("Origin", "http://evil.example")
+	rec := httptest.NewRecorder()
+	s.serveLogsWebSocket(rec, r, "dep-000001", 0)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want 403", rec.Code)
+	}
+}
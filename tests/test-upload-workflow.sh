@@ -2,6 +2,17 @@
 set -euo pipefail
 
 API_URL="${API_URL:-http://localhost:8080}"
+
+if ! command -v jq >/dev/null 2>&1; then
+  echo "[test-upload-workflow] jq is required"
+  exit 1
+fi
+
+AUTH_HEADER=()
+if [[ -n "${UPLOAD_API_TOKEN:-}" ]]; then
+  AUTH_HEADER=(-H "Authorization: Bearer ${UPLOAD_API_TOKEN}")
+fi
+
 TMP_DIR="$(mktemp -d)"
 BUNDLE_PATH="${TMP_DIR}/sample-bundle.tar.gz"
 
@@ -14,6 +25,12 @@ mkdir -p "${TMP_DIR}/app"
 cat > "${TMP_DIR}/app/README.md" <<'DOC'
 # sample app
 DOC
+# upload-api rejects bundles it cannot build: ship a Dockerfile.
+cat > "${TMP_DIR}/app/Dockerfile" <<'DOC'
+FROM busybox:1.36
+COPY README.md /README.md
+CMD ["httpd", "-f", "-p", "8080"]
+DOC
 
 tar -czf "${BUNDLE_PATH}" -C "${TMP_DIR}/app" .
 
@@ -22,12 +39,13 @@ curl -sf "${API_URL}/healthz" >/dev/null
 
 echo "[test-upload-workflow] Uploading bundle"
 DEPLOY_RESPONSE="$(curl -sf -X POST "${API_URL}/deploy" \
+  ${AUTH_HEADER[@]+"${AUTH_HEADER[@]}"} \
   -F "bundle=@${BUNDLE_PATH}" \
   -F "service=sample-uploaded-app" \
   -F "namespace=default")"
 
 echo "${DEPLOY_RESPONSE}"
-DEPLOY_ID="$(echo "${DEPLOY_RESPONSE}" | sed -n 's/.*"id":"\([^"]*\)".*/\1/p')"
+DEPLOY_ID="$(echo "${DEPLOY_RESPONSE}" | jq -r '.id // empty')"
 if [[ -z "${DEPLOY_ID}" ]]; then
   echo "[test-upload-workflow] failed to parse deployment id"
   exit 1
@@ -36,9 +54,9 @@ fi
 echo "[test-upload-workflow] Polling status for ${DEPLOY_ID}"
 for _ in $(seq 1 10); do
   STATUS_RESPONSE="$(curl -sf "${API_URL}/status/${DEPLOY_ID}")"
-  STATUS="$(echo "${STATUS_RESPONSE}" | sed -n 's/.*"status":"\([^"]*\)".*/\1/p')"
+  STATUS="$(echo "${STATUS_RESPONSE}" | jq -r '.status // empty')"
   echo "status=${STATUS}"
-  if [[ "${STATUS}" == "READY" || "${STATUS}" == "FAILED" ]]; then
+  if [[ "${STATUS}" =~ ^(READY|FAILED|CANCELLED|TIMED_OUT)$ ]]; then
     echo "${STATUS_RESPONSE}"
     exit 0
   fi